@@ -0,0 +1,417 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditUserCreate = "user.create"
+	AuditUserUpdate = "user.update"
+	AuditUserExport = "user.export"
+	AuditUserErase  = "user.erase"
+	// AuditEmailUnsubscribe targets the hash of the address
+	AuditEmailUnsubscribe = "email.unsubscribe"
+)
+
+// Audit outcomes
+const (
+	OutcomeCompleted = "completed"
+	OutcomeFailed    = "failed"
+)
+
+// AuditConfig holds the audit log settings
+type AuditConfig struct {
+	// File is the JSONL audit log. When empty, audit events are written to
+	// the service log instead and cannot be queried.
+	File string `json:"file,omitempty"`
+	// MaxSizeBytes rotates the file once the next event would exceed it
+	MaxSizeBytes int64 `json:"maxSizeBytes"`
+	// MaxFiles is how many rotated files are kept besides the active one
+	MaxFiles int `json:"maxFiles"`
+}
+
+// Validate checks the audit settings
+func (a AuditConfig) Validate() error {
+	if a.MaxSizeBytes <= 0 {
+		return errors.New("audit.maxSizeBytes must be positive")
+	}
+	if a.MaxFiles < 0 {
+		return errors.New("audit.maxFiles must not be negative")
+	}
+	return nil
+}
+
+// FieldChange is one changed UserInfo field. Every field describes the
+// person, and the append-only log cannot forget it after an erasure, so
+// only the field name is recorded. Before and After remain for entries
+// written by earlier versions, whose hashes cover them.
+type FieldChange struct {
+	Field    string      `json:"field"`
+	Before   interface{} `json:"before,omitempty"`
+	After    interface{} `json:"after,omitempty"`
+	Redacted bool        `json:"redacted,omitempty"`
+}
+
+// AuditEvent is one entry in the audit log. Each entry carries the hash of
+// the one before it, so removing or editing an entry breaks the chain.
+type AuditEvent struct {
+	Seq       int64         `json:"seq"`
+	Time      time.Time     `json:"time"`
+	Actor     string        `json:"actor"`
+	Action    string        `json:"action"`
+	Target    string        `json:"target"`
+	RequestID string        `json:"requestId,omitempty"`
+	Outcome   string        `json:"outcome"`
+	Changes   []FieldChange `json:"changes,omitempty"`
+	PrevHash  string        `json:"prevHash"`
+	Hash      string        `json:"hash"`
+}
+
+// chainHash returns the hash of the event, covering every field but Hash
+func (e AuditEvent) chainHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// diffUsers lists the fields that differ between before and after, without
+// their values
+func diffUsers(before, after UserInfo) []FieldChange {
+	rawBefore, rawAfter := reflect.ValueOf(before), reflect.ValueOf(after)
+	t := rawBefore.Type()
+
+	var changes []FieldChange
+	for i := 0; i < t.NumField(); i++ {
+		if rawBefore.Field(i).Interface() == rawAfter.Field(i).Interface() {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		changes = append(changes, FieldChange{Field: name, Redacted: true})
+	}
+	return changes
+}
+
+// auditLog appends hash-chained events to a rotating JSONL file
+type auditLog struct {
+	mu       sync.Mutex
+	cfg      AuditConfig
+	file     *os.File
+	size     int64
+	seq      int64
+	lastHash string
+}
+
+// auditTrail receives the audit events of every handler
+var auditTrail = &auditLog{cfg: DefaultConfig().Audit}
+
+// openAuditLog opens the audit file and resumes the hash chain from its
+// last event
+func openAuditLog(cfg AuditConfig) (*auditLog, error) {
+	a := &auditLog{cfg: cfg}
+	if cfg.File == "" {
+		return a, nil
+	}
+
+	last, err := a.lastEvent()
+	if err != nil {
+		return nil, err
+	}
+	a.seq, a.lastHash = last.Seq, last.Hash
+
+	if err := a.openFile(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// openFile opens the active file for appending
+func (a *auditLog) openFile() error {
+	f, err := os.OpenFile(a.cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// path returns the name of the nth rotated file; 0 is the active file
+func (a *auditLog) path(n int) string {
+	if n == 0 {
+		return a.cfg.File
+	}
+	return a.cfg.File + "." + strconv.Itoa(n)
+}
+
+// files returns the existing audit files, oldest first
+func (a *auditLog) files() []string {
+	var files []string
+	for n := a.cfg.MaxFiles; n >= 0; n-- {
+		if _, err := os.Stat(a.path(n)); err == nil {
+			files = append(files, a.path(n))
+		}
+	}
+	return files
+}
+
+// readAuditFile parses the events in one audit file
+func readAuditFile(path string) ([]AuditEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: malformed audit event after seq %d", path, lastSeq(events))
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// lastSeq returns the sequence number of the last event, or 0
+func lastSeq(events []AuditEvent) int64 {
+	if len(events) == 0 {
+		return 0
+	}
+	return events[len(events)-1].Seq
+}
+
+// lastEvent returns the newest event on disk
+func (a *auditLog) lastEvent() (AuditEvent, error) {
+	files := a.files()
+	for i := len(files) - 1; i >= 0; i-- {
+		events, err := readAuditFile(files[i])
+		if err != nil {
+			return AuditEvent{}, err
+		}
+		if len(events) > 0 {
+			return events[len(events)-1], nil
+		}
+	}
+	return AuditEvent{}, nil
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, and
+// starts a new active file
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.cfg.MaxFiles == 0 {
+		if err := os.Remove(a.cfg.File); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return a.openFile()
+	}
+	for n := a.cfg.MaxFiles; n > 0; n-- {
+		if err := os.Rename(a.path(n-1), a.path(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.openFile()
+}
+
+// Record appends e to the log, filling in its sequence number and hashes
+func (a *auditLog) Record(e AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e.Seq, e.PrevHash = a.seq+1, a.lastHash
+	e.Hash = e.chainHash()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if a.file == nil {
+		log.Printf("Audit: %s", line)
+	} else {
+		if a.size > 0 && a.size+int64(len(line))+1 > a.cfg.MaxSizeBytes {
+			if err := a.rotate(); err != nil {
+				return fmt.Errorf("rotating audit log: %w", err)
+			}
+		}
+		n, err := a.file.Write(append(line, '\n'))
+		a.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	a.seq, a.lastHash = e.Seq, e.Hash
+	return nil
+}
+
+// Close closes the active file
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// readAll returns every retained event, oldest first
+func (a *auditLog) readAll() ([]AuditEvent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var events []AuditEvent
+	for _, path := range a.files() {
+		fileEvents, err := readAuditFile(path)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, fileEvents...)
+	}
+	return events, nil
+}
+
+// verifyAuditChain checks that every event hashes correctly and links to
+// the one before it. The first retained event may link to a rotated-out
+// file. It returns the sequence number of the first broken event, or 0.
+func verifyAuditChain(events []AuditEvent) int64 {
+	for i, e := range events {
+		if e.Hash != e.chainHash() {
+			return e.Seq
+		}
+		if i > 0 && (e.PrevHash != events[i-1].Hash || e.Seq != events[i-1].Seq+1) {
+			return e.Seq
+		}
+	}
+	return 0
+}
+
+// audit records an action taken by the caller of r. Failures are logged
+// and counted since the action itself has already happened.
+func audit(r *http.Request, action, target, outcome string, changes []FieldChange) {
+	err := auditTrail.Record(AuditEvent{
+		Time:      time.Now().UTC(),
+		Actor:     principalFrom(r.Context()).ID,
+		Action:    action,
+		Target:    target,
+		RequestID: requestIDFrom(r.Context()),
+		Outcome:   outcome,
+		Changes:   changes,
+	})
+	if err != nil {
+		metrics.Add("audit_write_errors", 1)
+		log.Printf("Failed to write audit event %s %s: %v", action, target, err)
+	}
+}
+
+// AuditQueryResponse is returned by the audit query endpoint
+type AuditQueryResponse struct {
+	Events []AuditEvent `json:"events"`
+	// ChainValid reports whether the whole retained log verified, not only
+	// the events returned
+	ChainValid bool  `json:"chainValid"`
+	BrokenAt   int64 `json:"brokenAt,omitempty"`
+}
+
+// auditQuery returns audit events filtered by actor, action, target and
+// time range, newest last
+func auditQuery(w http.ResponseWriter, r *http.Request) {
+	if auditTrail.cfg.File == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, "audit log file is not configured")
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+	var since, until time.Time
+	for name, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+		if s := q.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, name+" must be an RFC 3339 timestamp")
+				return
+			}
+			*dst = t
+		}
+	}
+
+	events, err := auditTrail.readAll()
+	if err != nil {
+		log.Printf("Failed to read audit log: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read audit log")
+		return
+	}
+
+	response := AuditQueryResponse{Events: []AuditEvent{}}
+	response.BrokenAt = verifyAuditChain(events)
+	response.ChainValid = response.BrokenAt == 0
+	for _, e := range events {
+		switch {
+		case q.Get("actor") != "" && e.Actor != q.Get("actor"):
+		case q.Get("action") != "" && e.Action != q.Get("action"):
+		case q.Get("target") != "" && e.Target != q.Get("target"):
+		case !since.IsZero() && e.Time.Before(since):
+		case !until.IsZero() && !e.Time.Before(until):
+		default:
+			response.Events = append(response.Events, e)
+		}
+	}
+	if len(response.Events) > limit {
+		response.Events = response.Events[len(response.Events)-limit:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAuditLog swaps in an audit log writing to a temporary file
+func useAuditLog(t *testing.T, cfg AuditConfig) *auditLog {
+	t.Helper()
+	if cfg.File == "" {
+		cfg.File = filepath.Join(t.TempDir(), "audit.jsonl")
+	}
+	a, err := openAuditLog(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	previous := auditTrail
+	auditTrail = a
+	t.Cleanup(func() {
+		a.Close()
+		auditTrail = previous
+	})
+	return a
+}
+
+// recordEvents appends n events for target
+func recordEvents(t *testing.T, a *auditLog, target string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := a.Record(AuditEvent{Time: time.Now().UTC(), Actor: "tester", Action: AuditUserCreate, Target: target, Outcome: OutcomeCompleted}); err != nil {
+			t.Fatalf("Failed to record event: %v", err)
+		}
+	}
+}
+
+// TestAuditLogChainAndRotation tests hash chaining across rotated files and resuming after a restart
+func TestAuditLogChainAndRotation(t *testing.T) {
+	cfg := AuditConfig{File: filepath.Join(t.TempDir(), "audit.jsonl"), MaxSizeBytes: 600, MaxFiles: 10}
+	a := useAuditLog(t, cfg)
+	recordEvents(t, a, "u1", 6)
+	a.Close()
+
+	if _, err := os.Stat(cfg.File + ".1"); err != nil {
+		t.Fatalf("Expected the log to have rotated: %v", err)
+	}
+
+	reopened := useAuditLog(t, cfg)
+	recordEvents(t, reopened, "u2", 2)
+
+	events, err := reopened.readAll()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(events) != 8 || events[7].Seq != 8 {
+		t.Fatalf("Expected 8 sequential events, got %d", len(events))
+	}
+	if broken := verifyAuditChain(events); broken != 0 {
+		t.Errorf("Expected an intact chain, broken at %d", broken)
+	}
+	if events[6].PrevHash != events[5].Hash {
+		t.Error("Expected the chain to resume after reopening")
+	}
+}
+
+// TestAuditLogRotationDropsOldest tests that only MaxFiles rotated files are kept
+func TestAuditLogRotationDropsOldest(t *testing.T) {
+	cfg := AuditConfig{File: filepath.Join(t.TempDir(), "audit.jsonl"), MaxSizeBytes: 300, MaxFiles: 2}
+	a := useAuditLog(t, cfg)
+	recordEvents(t, a, "u1", 10)
+
+	if _, err := os.Stat(cfg.File + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected no third rotated file, got %v", err)
+	}
+	events, _ := a.readAll()
+	if len(events) == 0 || events[0].Seq == 1 {
+		t.Fatalf("Expected the oldest events to be dropped, got %d events", len(events))
+	}
+	if broken := verifyAuditChain(events); broken != 0 {
+		t.Errorf("Expected the retained chain to verify, broken at %d", broken)
+	}
+}
+
+// TestVerifyAuditChainDetectsTampering tests that edited and removed events break the chain
+func TestVerifyAuditChainDetectsTampering(t *testing.T) {
+	a := useAuditLog(t, AuditConfig{MaxSizeBytes: 1 << 20})
+	recordEvents(t, a, "u1", 4)
+	events, _ := a.readAll()
+
+	edited := append([]AuditEvent(nil), events...)
+	edited[1].Actor = "someone-else"
+	if broken := verifyAuditChain(edited); broken != 2 {
+		t.Errorf("Expected edit to be detected at seq 2, got %d", broken)
+	}
+
+	removed := append(append([]AuditEvent(nil), events[:1]...), events[2:]...)
+	if broken := verifyAuditChain(removed); broken != 3 {
+		t.Errorf("Expected removal to be detected at seq 3, got %d", broken)
+	}
+}
+
+// TestDiffUsers tests that field diffs name the changed fields without
+// their values
+func TestDiffUsers(t *testing.T) {
+	changes := diffUsers(
+		UserInfo{Name: "John", Age: 30, Email: "john@example.com"},
+		UserInfo{Name: "John", Age: 31, Location: "NYC", Email: "john@example.com"},
+	)
+	expected := []FieldChange{{Field: "age", Redacted: true}, {Field: "location", Redacted: true}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+}
+
+// TestCreateUserInfoIsAudited tests that user creation is recorded with actor and request ID
+func TestCreateUserInfoIsAudited(t *testing.T) {
+	useStore(t)
+	a := useAuditLog(t, AuditConfig{MaxSizeBytes: 1 << 20})
+
+	req := httptest.NewRequest("POST", "/greeter/user-info", strings.NewReader(`{"name": "John", "email": "john@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(RequestIDHeader, "req-123")
+	w := httptest.NewRecorder()
+	chain(http.HandlerFunc(userInfoHandler), requestID, authenticate).ServeHTTP(w, req)
+
+	events, _ := a.readAll()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 audit event, got %d", len(events))
+	}
+	e := events[0]
+	if e.Action != AuditUserCreate || e.Actor != AnonymousPrincipal || e.RequestID != "req-123" || e.Target == "" {
+		t.Errorf("Unexpected audit event %+v", e)
+	}
+	data, _ := json.Marshal(e)
+	if strings.Contains(string(data), "john@example.com") {
+		t.Errorf("Expected personal data to be masked in the audit log, got %s", data)
+	}
+}
+
+// TestErasureLeavesNoPersonalData tests that the audit log read back after
+// a user's creation and erasure holds none of their data
+func TestErasureLeavesNoPersonalData(t *testing.T) {
+	useScopedKeys(t)
+	useStore(t)
+	a := useAuditLog(t, AuditConfig{MaxSizeBytes: 1 << 20})
+	id := createTestUser(t, UserInfo{Name: "Johnathan", Age: 42, Location: "Lisbon", Email: "johnathan@example.com"})
+	if w := serveUsers("DELETE", "/greeter/user-info/"+id, "dpo-key", nil, "If-Match", "*"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	events, err := a.readAll()
+	if err != nil || len(events) != 2 || events[1].Action != AuditUserErase {
+		t.Fatalf("Expected the create and erase events, got %+v, %v", events, err)
+	}
+	for _, e := range events {
+		for _, change := range e.Changes {
+			if change.Before != nil || change.After != nil || !change.Redacted {
+				t.Errorf("Expected %s to record only the field name, got %+v", e.Action, change)
+			}
+		}
+		data, _ := json.Marshal(e)
+		for _, value := range []string{"Johnathan", "Lisbon", "johnathan@", "L***", "j***"} {
+			if strings.Contains(string(data), value) {
+				t.Errorf("Expected no trace of %q in %s", value, data)
+			}
+		}
+	}
+}
+
+// TestAuditQuery tests filtering and authorisation of the audit query endpoint
+func TestAuditQuery(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"auth": {"apiKeys": [
+		{"principal": "compliance", "sha256": "`+sha256Hex("audit-key")+`", "scopes": ["audit:read"]}
+	]}}`))
+	a := useAuditLog(t, AuditConfig{MaxSizeBytes: 1 << 20})
+	recordEvents(t, a, "u1", 3)
+	recordEvents(t, a, "u2", 2)
+
+	testCases := []struct {
+		name           string
+		query          string
+		apiKey         string
+		expectedStatus int
+		expectedCount  int
+	}{
+		{"Without scope", "", "", http.StatusForbidden, 0},
+		{"All events", "", "audit-key", http.StatusOK, 5},
+		{"By target", "target=u2", "audit-key", http.StatusOK, 2},
+		{"By actor", "actor=nobody", "audit-key", http.StatusOK, 0},
+		{"Limited", "limit=2", "audit-key", http.StatusOK, 2},
+		{"Future since", "since=2999-01-01T00:00:00Z", "audit-key", http.StatusOK, 0},
+		{"Bad time", "until=yesterday", "audit-key", http.StatusBadRequest, 0},
+		{"Bad limit", "limit=0", "audit-key", http.StatusBadRequest, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/greeter/audit?"+tc.query, nil)
+			if tc.apiKey != "" {
+				req.Header.Set("X-API-Key", tc.apiKey)
+			}
+			w := httptest.NewRecorder()
+			authenticate(requireScope(ScopeAuditRead, auditQuery)).ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			var response AuditQueryResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+			if len(response.Events) != tc.expectedCount {
+				t.Errorf("Expected %d events, got %d", tc.expectedCount, len(response.Events))
+			}
+			if !response.ChainValid {
+				t.Error("Expected the chain to be valid")
+			}
+		})
+	}
+}
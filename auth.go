@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scopes granted to callers through AuthConfig
+const (
+	// ScopePIIRead allows reading unmasked personal data
+	ScopePIIRead = "pii:read"
+	// ScopePIIErase allows erasing a user's personal data
+	ScopePIIErase = "pii:erase"
+	// ScopeAuditRead allows querying the audit log
+	ScopeAuditRead = "audit:read"
+	// ScopeStatsRead allows reading greeting statistics
+	ScopeStatsRead = "stats:read"
+	// ScopeWebhooksManage allows registering webhooks and replaying deliveries
+	ScopeWebhooksManage = "webhooks:manage"
+	// ScopeSchedulesManage allows creating and changing greeting schedules
+	ScopeSchedulesManage = "schedules:manage"
+)
+
+// AnonymousPrincipal is the ID of callers without credentials
+const AnonymousPrincipal = "anonymous"
+
+// APIKeyConfig describes one API key. Only the SHA-256 of the key is kept
+// in configuration.
+type APIKeyConfig struct {
+	Principal string   `json:"principal"`
+	SHA256    string   `json:"sha256"`
+	Scopes    []string `json:"scopes,omitempty"`
+}
+
+// AuthConfig maps caller credentials to principals and scopes
+type AuthConfig struct {
+	APIKeys []APIKeyConfig `json:"apiKeys,omitempty"`
+	// ClientScopes grants scopes to mutual TLS client certificate subjects
+	ClientScopes map[string][]string `json:"clientScopes,omitempty"`
+}
+
+// Validate checks the API key entries
+func (a AuthConfig) Validate() error {
+	for i, key := range a.APIKeys {
+		if key.Principal == "" {
+			return fmt.Errorf("auth.apiKeys[%d].principal is required", i)
+		}
+		if decoded, err := hex.DecodeString(key.SHA256); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("auth.apiKeys[%d].sha256 must be a hex-encoded SHA-256 digest", i)
+		}
+	}
+	return nil
+}
+
+// Principal identifies the caller of a request
+type Principal struct {
+	ID     string
+	Scopes []string
+}
+
+// HasScope reports whether the principal was granted scope
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// principalKey is the context key for the request principal
+type principalKey struct{}
+
+// principalFrom returns the principal attached by authenticate, or the
+// anonymous principal
+func principalFrom(ctx context.Context) Principal {
+	if p, ok := ctx.Value(principalKey{}).(Principal); ok {
+		return p
+	}
+	return Principal{ID: AnonymousPrincipal}
+}
+
+// requireScope rejects requests whose principal lacks scope
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !principalFrom(r.Context()).HasScope(scope) {
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("the %s scope is required", scope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// apiKeyFrom extracts an API key from the X-API-Key header or a bearer token
+func apiKeyFrom(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// resolvePrincipal identifies the caller from an API key or a client
+// certificate. ok is false when an API key was presented but not recognised.
+func (a AuthConfig) resolvePrincipal(r *http.Request) (Principal, bool) {
+	if key := apiKeyFrom(r); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		digest := hex.EncodeToString(sum[:])
+		for _, k := range a.APIKeys {
+			if strings.EqualFold(k.SHA256, digest) {
+				return Principal{ID: k.Principal, Scopes: k.Scopes}, true
+			}
+		}
+		return Principal{}, false
+	}
+	if subject := clientSubject(r); subject != "" {
+		return Principal{ID: subject, Scopes: a.ClientScopes[subject]}, true
+	}
+	return Principal{ID: AnonymousPrincipal}, true
+}
+
+// authenticate attaches the caller's principal to the request context.
+// Requests without credentials proceed as anonymous; unknown API keys are
+// rejected.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := activeConfig.Get().Auth.resolvePrincipal(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="greeter"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
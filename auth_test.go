@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// sha256Hex returns the hex digest stored in config for an API key
+func sha256Hex(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestAuthenticate tests principal resolution from API keys and client certificates
+func TestAuthenticate(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"auth": {
+		"apiKeys": [{"principal": "admin-ui", "sha256": "`+sha256Hex("secret")+`", "scopes": ["pii:read"]}],
+		"clientScopes": {"CN=billing": ["pii:read"]}
+	}, "tls": {"enabled": true, "certFile": "a", "keyFile": "b", "clientCAFile": "c", "clientAuth": "verify-if-given"}}`))
+	billing := []*x509.Certificate{{Subject: pkix.Name{CommonName: "billing"}}}
+
+	testCases := []struct {
+		name           string
+		setup          func(r *http.Request)
+		expectedStatus int
+		expectedID     string
+		expectedScope  bool
+	}{
+		{"Anonymous", func(r *http.Request) {}, http.StatusOK, AnonymousPrincipal, false},
+		{"API key header", func(r *http.Request) { r.Header.Set("X-API-Key", "secret") }, http.StatusOK, "admin-ui", true},
+		{"Bearer token", func(r *http.Request) { r.Header.Set("Authorization", "bearer secret") }, http.StatusOK, "admin-ui", true},
+		{"Unknown key", func(r *http.Request) { r.Header.Set("X-API-Key", "guess") }, http.StatusUnauthorized, "", false},
+		{"Client certificate", func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{PeerCertificates: billing, VerifiedChains: [][]*x509.Certificate{billing}}
+		}, http.StatusOK, "CN=billing", true},
+		{"Unverified client certificate", func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{PeerCertificates: billing}
+		}, http.StatusOK, AnonymousPrincipal, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got Principal
+			handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = principalFrom(r.Context())
+			}))
+
+			req := httptest.NewRequest("GET", "/greeter/greet", nil)
+			tc.setup(req)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			if got.ID != tc.expectedID {
+				t.Errorf("Expected principal %q, got %q", tc.expectedID, got.ID)
+			}
+			if got.HasScope(ScopePIIRead) != tc.expectedScope {
+				t.Errorf("Expected pii:read=%v, got %v", tc.expectedScope, got.Scopes)
+			}
+		})
+	}
+}
+
+// TestAuthConfigValidation tests rejection of malformed API key entries
+func TestAuthConfigValidation(t *testing.T) {
+	valid := AuthConfig{APIKeys: []APIKeyConfig{{Principal: "ui", SHA256: sha256Hex("k")}}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+
+	invalid := []AuthConfig{
+		{APIKeys: []APIKeyConfig{{SHA256: sha256Hex("k")}}},
+		{APIKeys: []APIKeyConfig{{Principal: "ui", SHA256: "secret"}}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for %+v", cfg)
+		}
+	}
+}
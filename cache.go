@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStatusHeader tells whether a response came from the response cache
+const CacheStatusHeader = "X-Cache"
+
+// ResponseCacheConfig controls the in-process cache of greet and farewell
+// responses and the caching headers sent with them
+type ResponseCacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxEntries and MaxBytes bound the cache; the least recently used
+	// responses are evicted first
+	MaxEntries int   `json:"maxEntries"`
+	MaxBytes   int64 `json:"maxBytes"`
+	// TTL is how long a rendered response is reused
+	TTL Duration `json:"ttl"`
+	// MaxAge is the Cache-Control max-age for clients and CDNs. 0 makes
+	// them revalidate every time, so each greeting still reaches the
+	// service and its statistics.
+	MaxAge Duration `json:"maxAge"`
+}
+
+// Validate checks the response cache settings
+func (c ResponseCacheConfig) Validate() error {
+	if c.MaxEntries <= 0 || c.MaxBytes <= 0 || c.TTL <= 0 {
+		return errors.New("cache.maxEntries, cache.maxBytes and cache.ttl must be positive")
+	}
+	if c.MaxAge < 0 {
+		return errors.New("cache.maxAge must not be negative")
+	}
+	return nil
+}
+
+// cachedResponse is a rendered message
+type cachedResponse struct {
+	key     string
+	format  string
+	etag    string
+	body    []byte
+	expires time.Time
+}
+
+// size approximates the memory held by the entry
+func (e *cachedResponse) size() int64 {
+	return int64(len(e.key) + len(e.body) + len(e.etag) + 64)
+}
+
+// responseCache is an LRU cache of rendered responses. Entries belong to
+// one config version; the first access under a new version, such as after
+// a template change, drops them all.
+type responseCache struct {
+	mu      sync.Mutex
+	version string
+	entries map[string]*list.Element
+	// lru holds *cachedResponse, most recently used first
+	lru   *list.List
+	bytes int64
+	now   func() time.Time
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: map[string]*list.Element{}, lru: list.New(), now: time.Now}
+}
+
+// greetingCache caches the greet and farewell responses
+var greetingCache = newResponseCache()
+
+// get returns the unexpired response for key rendered under version
+func (c *responseCache) get(key, version string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.useVersion(version)
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cachedResponse)
+	if !c.now().Before(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry, true
+}
+
+// put stores a response rendered under version and evicts the least
+// recently used ones beyond the bounds of cfg
+func (c *responseCache) put(version string, entry *cachedResponse, cfg ResponseCacheConfig) {
+	if entry.size() > cfg.MaxBytes {
+		return
+	}
+	entry.expires = c.now().Add(time.Duration(cfg.TTL))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.useVersion(version)
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+	for c.lru.Len() > cfg.MaxEntries || c.bytes > cfg.MaxBytes {
+		c.remove(c.lru.Back())
+		metrics.Add("response_cache_evictions", 1)
+	}
+}
+
+// useVersion drops every entry when version differs from theirs; c.mu
+// must be held
+func (c *responseCache) useVersion(version string) {
+	if version == c.version {
+		return
+	}
+	if c.lru.Len() > 0 {
+		metrics.Add("response_cache_invalidations", 1)
+	}
+	c.version = version
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.bytes = 0
+}
+
+// removeName drops the responses rendered for name
+func (c *responseCache) removeName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if parts := strings.SplitN(key, "\x00", 4); len(parts) == 4 && strings.EqualFold(parts[3], name) {
+			c.remove(el)
+		}
+	}
+}
+
+// remove drops one entry; c.mu must be held
+func (c *responseCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
+
+// bodyETag returns a strong entity tag for a response body
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// cacheControl returns the Cache-Control value for a max-age
+func cacheControl(maxAge Duration) string {
+	if maxAge <= 0 {
+		return "public, no-cache"
+	}
+	return "public, max-age=" + strconv.FormatInt(int64(time.Duration(maxAge)/time.Second), 10)
+}
+
+// writeCachedMessage writes the message key for name like writeMessage,
+// reusing the rendered response when it can. The response carries an
+// ETag and Cache-Control so clients and CDNs can cache it as well; it
+// varies only with the Accept and Accept-Language headers and the URL.
+func writeCachedMessage(w http.ResponseWriter, r *http.Request, key, name string) {
+	snap := activeConfig.Snapshot()
+	cfg := snap.Config.Cache
+	format := negotiateFormat(r)
+	locale := snap.Messages.Locale(r)
+	cacheKey := strings.Join([]string{key, locale, format, name}, "\x00")
+
+	var entry *cachedResponse
+	hit := false
+	if cfg.Enabled {
+		entry, hit = greetingCache.get(cacheKey, snap.Version)
+	}
+	if hit {
+		metrics.Add("response_cache_hits", 1)
+	} else {
+		body, err := renderBody(format, snap.Messages.Render(locale, key, name))
+		if err != nil {
+			http.Error(w, "Failed to render response", http.StatusInternalServerError)
+			return
+		}
+		entry = &cachedResponse{key: cacheKey, format: format, etag: bodyETag(body), body: body}
+		if cfg.Enabled {
+			metrics.Add("response_cache_misses", 1)
+			greetingCache.put(snap.Version, entry, cfg)
+		}
+	}
+
+	setRenderHeaders(w, entry.format)
+	header := w.Header()
+	header.Set("ETag", entry.etag)
+	header.Set("Cache-Control", cacheControl(cfg.MaxAge))
+	if cfg.Enabled {
+		header.Set(CacheStatusHeader, map[bool]string{true: "HIT", false: "MISS"}[hit])
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagListMatches(inm, entry.etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = w.Write(entry.body)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useResponseCache swaps in an empty response cache
+func useResponseCache(t *testing.T) *responseCache {
+	t.Helper()
+	c := newResponseCache()
+	previous := greetingCache
+	greetingCache = c
+	t.Cleanup(func() { greetingCache = previous })
+	return c
+}
+
+// TestResponseCache tests LRU eviction by entries and bytes, expiry and
+// invalidation by config version
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache()
+	clock := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return clock }
+	cfg := ResponseCacheConfig{Enabled: true, MaxEntries: 2, MaxBytes: 1 << 20, TTL: Duration(time.Minute)}
+	entry := func(key string, size int) *cachedResponse {
+		return &cachedResponse{key: key, body: make([]byte, size)}
+	}
+	cached := func(keys ...string) string {
+		var found []string
+		for _, key := range keys {
+			if _, ok := c.get(key, "v1"); ok {
+				found = append(found, key)
+			}
+		}
+		return strings.Join(found, ",")
+	}
+
+	testCases := []struct {
+		name     string
+		action   func()
+		expected string
+	}{
+		{"Stored", func() { c.put("v1", entry("a", 1), cfg); c.put("v1", entry("b", 1), cfg) }, "a,b"},
+		{"Least recently used evicted", func() { c.get("a", "v1"); c.put("v1", entry("c", 1), cfg) }, "a,c"},
+		{"Evicted by size", func() {
+			big := cfg
+			big.MaxBytes = entry("d", 500).size() + entry("e", 400).size()
+			c.put("v1", entry("d", 500), big)
+			c.put("v1", entry("e", 500), big)
+		}, "e"},
+		{"Too large to cache", func() { c.put("v1", entry("f", 2<<20), cfg) }, "e"},
+		{"Expired", func() { c.put("v1", entry("g", 1), cfg); clock = clock.Add(time.Minute) }, ""},
+		{"New config version", func() {
+			c.put("v1", entry("h", 1), cfg)
+			c.get("h", "v2")
+		}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.action()
+			if got := cached("a", "b", "c", "d", "e", "f", "g", "h"); got != tc.expected {
+				t.Errorf("Expected %q cached, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestGreetCaching tests the cache status, validators and Vary handling of
+// cached greetings and that template changes invalidate them
+func TestGreetCaching(t *testing.T) {
+	dir := t.TempDir()
+	writeLocale(t, dir, "fr", `{"greet": "Bonjour, {{.Name}} !"}`)
+	path := writeConfig(t, `{"messages": {"dir": "`+filepath.ToSlash(dir)+`"}, "cache": {"maxAge": "1m"}}`)
+	store := useConfig(t, path)
+	useResponseCache(t)
+	useStore(t)
+
+	request := func(target string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		greet(w, req)
+		return w
+	}
+	first := request("/greeter/greet?name=John")
+	etag := first.Header().Get("ETag")
+
+	testCases := []struct {
+		name           string
+		target         string
+		headers        []string
+		expectedStatus int
+		expectedCache  string
+		expectedBody   string
+	}{
+		{"Repeated", "/greeter/greet?name=John", nil, http.StatusOK, "HIT", "Hello, John!"},
+		{"Other name", "/greeter/greet?name=Jane", nil, http.StatusOK, "MISS", "Hello, Jane!"},
+		{"Other format", "/greeter/greet?name=John", []string{"Accept", "application/json"}, http.StatusOK, "MISS", `{"message":"Hello, John!"}`},
+		{"Other language", "/greeter/greet?name=John", []string{"Accept-Language", "fr"}, http.StatusOK, "MISS", "Bonjour, John !"},
+		{"Same locale by query", "/greeter/greet?name=John&lang=fr", nil, http.StatusOK, "HIT", "Bonjour, John !"},
+		{"Revalidated", "/greeter/greet?name=John", []string{"If-None-Match", etag}, http.StatusNotModified, "HIT", ""},
+		{"Stale validator", "/greeter/greet?name=John", []string{"If-None-Match", `"other"`}, http.StatusOK, "HIT", "Hello, John!"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := request(tc.target, tc.headers...)
+			if w.Code != tc.expectedStatus || w.Header().Get(CacheStatusHeader) != tc.expectedCache ||
+				strings.TrimSpace(w.Body.String()) != tc.expectedBody {
+				t.Errorf("Expected %d %s %q, got %d %s %q", tc.expectedStatus, tc.expectedCache, tc.expectedBody,
+					w.Code, w.Header().Get(CacheStatusHeader), w.Body.String())
+			}
+			if w.Header().Get("ETag") == "" || w.Header().Get("Cache-Control") != "public, max-age=60" ||
+				strings.Join(w.Header().Values("Vary"), ", ") != "Accept, Accept-Language" {
+				t.Errorf("Unexpected caching headers %v", w.Header())
+			}
+		})
+	}
+
+	t.Run("Template change", func(t *testing.T) {
+		writeLocale(t, dir, "fr", `{"greet": "Salut, {{.Name}} !"}`)
+		if err := store.Reload(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		w := request("/greeter/greet?name=John", "Accept-Language", "fr")
+		if w.Header().Get(CacheStatusHeader) != "MISS" || strings.TrimSpace(w.Body.String()) != "Salut, John !" {
+			t.Errorf("Expected a fresh greeting, got %s %q", w.Header().Get(CacheStatusHeader), w.Body.String())
+		}
+		if w := request("/greeter/greet?name=John"); w.Header().Get("ETag") != etag {
+			t.Errorf("Expected the unchanged greeting to keep its ETag %s, got %s", etag, w.Header().Get("ETag"))
+		}
+	})
+
+	t.Run("Greetings still recorded", func(t *testing.T) {
+		stats, err := dataStore.GreetingStats(context.Background(), StatsQuery{Until: time.Now().Add(time.Minute), Top: 1})
+		if err != nil || len(stats.TopNames) != 1 || stats.TopNames[0].NameHash != nameHash("John") || stats.TopNames[0].Count < 7 {
+			t.Errorf("Expected every greeting to be recorded, got %+v, %v", stats.TopNames, err)
+		}
+	})
+}
@@ -0,0 +1,395 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings the service can compress responses with
+const (
+	EncodingBrotli  = "br"
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// supportedEncodings is the order of preference among codings the client
+// accepts equally
+var supportedEncodings = []string{EncodingBrotli, EncodingGzip, EncodingDeflate}
+
+// CompressionConfig controls the compression of response bodies
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// MinSize is the smallest body compressed; below it the encoding costs
+	// more than it saves. Flushed (streamed) responses are compressed
+	// whatever their size.
+	MinSize int `json:"minSize"`
+	// ContentTypes lists the media types compressed; "text/*" covers every
+	// text type
+	ContentTypes []string `json:"contentTypes"`
+	// Level is the gzip and deflate level, from 1 (fastest) to 9 (smallest)
+	Level int `json:"level"`
+	// BrotliQuality is the brotli quality, from 0 (fastest) to 11 (smallest)
+	BrotliQuality int `json:"brotliQuality"`
+}
+
+// Validate checks the compression settings
+func (c CompressionConfig) Validate() error {
+	if c.MinSize < 0 {
+		return errors.New("compression.minSize must not be negative")
+	}
+	if c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression {
+		return fmt.Errorf("compression.level must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
+	}
+	if c.BrotliQuality < brotli.BestSpeed || c.BrotliQuality > brotli.BestCompression {
+		return fmt.Errorf("compression.brotliQuality must be between %d and %d", brotli.BestSpeed, brotli.BestCompression)
+	}
+	for _, contentType := range c.ContentTypes {
+		if major, minor, ok := strings.Cut(contentType, "/"); !ok || major == "" || minor == "" {
+			return fmt.Errorf("compression.contentTypes entry %q must be a media type", contentType)
+		}
+	}
+	return nil
+}
+
+// compressible reports whether a Content-Type is in the allowlist
+func (c CompressionConfig) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range c.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// level returns the configured level for a coding
+func (c CompressionConfig) level(coding string) int {
+	if coding == EncodingBrotli {
+		return c.BrotliQuality
+	}
+	return c.Level
+}
+
+// negotiateEncoding picks the content coding for an Accept-Encoding
+// header, or "" to send the body as it is
+func negotiateEncoding(header string) string {
+	weights := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		weights[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range supportedEncodings {
+		q, ok := weights[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// encoder is the interface shared by the gzip, zlib and brotli writers
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+type encoderKey struct {
+	coding string
+	level  int
+}
+
+// encoderPools holds a *sync.Pool of encoders per coding and level, so
+// responses reuse the large compression buffers instead of allocating them
+var encoderPools sync.Map
+
+// getEncoder returns a pooled encoder writing to w
+func getEncoder(coding string, level int, w io.Writer) encoder {
+	key := encoderKey{coding: coding, level: level}
+	pool, ok := encoderPools.Load(key)
+	if !ok {
+		pool, _ = encoderPools.LoadOrStore(key, &sync.Pool{New: func() interface{} { return newEncoder(coding, level) }})
+	}
+	enc := pool.(*sync.Pool).Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+// putEncoder returns a closed encoder to its pool
+func putEncoder(coding string, level int, enc encoder) {
+	enc.Reset(io.Discard)
+	if pool, ok := encoderPools.Load(encoderKey{coding: coding, level: level}); ok {
+		pool.(*sync.Pool).Put(enc)
+	}
+}
+
+// newEncoder creates an encoder; level has been validated. HTTP's
+// "deflate" is the zlib format, not raw deflate.
+func newEncoder(coding string, level int) encoder {
+	switch coding {
+	case EncodingBrotli:
+		return brotli.NewWriterLevel(io.Discard, level)
+	case EncodingDeflate:
+		enc, _ := zlib.NewWriterLevel(io.Discard, level)
+		return enc
+	default:
+		enc, _ := gzip.NewWriterLevel(io.Discard, level)
+		return enc
+	}
+}
+
+// codedETag returns a strong entity tag with the suffix of a content
+// coding, "v3-m" becoming "v3-m-gzip"
+func codedETag(etag, coding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+}
+
+// stripETagCoding removes the suffix codedETag adds, so a validator the
+// client got with a compressed response matches the handler's own
+func stripETagCoding(tag string) string {
+	for _, coding := range supportedEncodings {
+		if suffix := "-" + coding + `"`; strings.HasSuffix(tag, suffix) {
+			return strings.TrimSuffix(tag, suffix) + `"`
+		}
+	}
+	return tag
+}
+
+// compressWriter holds back the start of the body until it knows whether
+// the response is worth compressing: MinSize bytes have been written, the
+// handler flushed or the handler returned. HEAD responses go through the
+// same decision so their headers match GET, but the body is discarded.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg         CompressionConfig
+	coding      string
+	head        bool
+	ifNoneMatch string
+	status      int
+	buf         []byte
+	decided     bool
+	compressed  bool
+	enc         encoder
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	if code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	if !cw.eligible() {
+		_ = cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		switch {
+		case cw.enc != nil:
+			return cw.enc.Write(b)
+		case cw.compressed:
+			return len(b), nil
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.cfg.MinSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what has been written so far, compressing it when the
+// response allows it, so streamed NDJSON and event streams keep flowing
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		_ = cw.start(true)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// eligible reports whether the status and headers allow compression. A
+// missing Content-Type is sniffed from the body later.
+func (cw *compressWriter) eligible() bool {
+	header := cw.Header()
+	if cw.status == http.StatusNoContent || cw.status == http.StatusNotModified || header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if n, err := strconv.Atoi(header.Get("Content-Length")); err == nil && n < cw.cfg.MinSize {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	return contentType == "" || cw.cfg.compressible(contentType)
+}
+
+// start sends the headers, switching to the negotiated coding when
+// compress is set and the response is eligible, followed by the held back
+// bytes
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	etag := header.Get("ETag")
+	strong := strings.HasPrefix(etag, `"`)
+	if compress && cw.eligible() {
+		cw.compressed = true
+		header.Set("Content-Encoding", cw.coding)
+		header.Del("Content-Length")
+		// The compressed bytes differ from the identity ones, so they get a
+		// strong validator of their own
+		if strong {
+			header.Set("ETag", codedETag(etag, cw.coding))
+		}
+		if !cw.head {
+			cw.enc = getEncoder(cw.coding, cw.cfg.level(cw.coding), cw.ResponseWriter)
+		}
+		metrics.Add("responses_compressed", 1)
+	}
+	// A 304 repeats the validator of the copy the client holds, which was
+	// compressed if it sent the coded tag
+	if cw.status == http.StatusNotModified && strong && listsETag(cw.ifNoneMatch, codedETag(etag, cw.coding)) {
+		header.Set("ETag", codedETag(etag, cw.coding))
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 || cw.compressed && cw.head {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// finish completes the response once the handler returned: a body still
+// held back was too small to compress and goes out as it is. A HEAD
+// response without a body is compressed when its Content-Length says the
+// GET would be.
+func (cw *compressWriter) finish() error {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		compress := cw.head && len(cw.buf) == 0 && cw.Header().Get("Content-Length") != ""
+		if err := cw.start(compress); err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	putEncoder(cw.coding, cw.cfg.level(cw.coding), cw.enc)
+	cw.enc = nil
+	return err
+}
+
+// compress compresses response bodies with the coding the client prefers
+// among brotli, gzip and deflate. A handler that panics, like an export
+// aborted halfway, leaves the stream unterminated so the client sees the
+// truncation instead of a well-formed partial body.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := activeConfig.Get().Compression
+		if !cfg.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		coding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if coding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, cfg: cfg, coding: coding, head: r.Method == http.MethodHead,
+			ifNoneMatch: r.Header.Get("If-None-Match")}
+		next.ServeHTTP(cw, r)
+		if err := cw.finish(); err != nil {
+			log.Printf("Failed to compress response: %v", err)
+		}
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decompress decodes a body sent with a content coding
+func decompress(t *testing.T, coding string, body io.Reader) string {
+	t.Helper()
+	var reader io.Reader
+	var err error
+	switch coding {
+	case EncodingGzip:
+		reader, err = gzip.NewReader(body)
+	case EncodingDeflate:
+		reader, err = zlib.NewReader(body)
+	case EncodingBrotli:
+		reader = brotli.NewReader(body)
+	default:
+		reader = body
+	}
+	if err != nil {
+		t.Fatalf("Failed to open %s body: %v", coding, err)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decode %s body: %v", coding, err)
+	}
+	return string(decoded)
+}
+
+// TestNegotiateEncoding tests Accept-Encoding weights, wildcards and the
+// preference among equally weighted codings
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{"None", "", ""},
+		{"Gzip", "gzip", EncodingGzip},
+		{"Preferred on a tie", "gzip, deflate, br", EncodingBrotli},
+		{"Weighted", "br;q=0.5, gzip;q=0.8, deflate", EncodingDeflate},
+		{"Wildcard", "*", EncodingBrotli},
+		{"Wildcard with exclusion", "*, br;q=0", EncodingGzip},
+		{"Identity only", "identity", ""},
+		{"Refused", "gzip;q=0", ""},
+		{"Legacy alias", "x-gzip", EncodingGzip},
+		{"Case and spacing", " GZIP ; Q=0.5 ", EncodingGzip},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := negotiateEncoding(tc.header); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestCompress tests which responses are compressed and that their bodies
+// decode back to the original
+func TestCompress(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"compression": {"minSize": 64}}`))
+	large := strings.Repeat(`{"message":"Hello, John!"}`, 10)
+
+	testCases := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		contentType    string
+		status         int
+		body           string
+		expected       string
+	}{
+		{"Gzip", http.MethodGet, "gzip", "application/json", http.StatusOK, large, EncodingGzip},
+		{"Deflate", http.MethodGet, "deflate", "application/json", http.StatusOK, large, EncodingDeflate},
+		{"Brotli", http.MethodGet, "br, gzip", "application/json", http.StatusOK, large, EncodingBrotli},
+		{"Text wildcard", http.MethodGet, "gzip", "text/csv; charset=utf-8", http.StatusOK, large, EncodingGzip},
+		{"Sniffed type", http.MethodGet, "gzip", "", http.StatusOK, large, EncodingGzip},
+		{"Error status", http.MethodGet, "gzip", "application/json", http.StatusBadRequest, large, EncodingGzip},
+		{"Below minimum size", http.MethodGet, "gzip", "application/json", http.StatusOK, `{"message":"Hello"}`, ""},
+		{"Type not allowed", http.MethodGet, "gzip", "image/png", http.StatusOK, large, ""},
+		{"Not accepted", http.MethodGet, "", "application/json", http.StatusOK, large, ""},
+		{"Head", http.MethodHead, "gzip", "application/json", http.StatusOK, large, EncodingGzip},
+		{"Head below minimum size", http.MethodHead, "gzip", "application/json", http.StatusOK, `{"message":"Hello"}`, ""},
+		{"No content", http.MethodGet, "gzip", "", http.StatusNoContent, "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.contentType != "" {
+					w.Header().Set("Content-Type", tc.contentType)
+				}
+				w.WriteHeader(tc.status)
+				// Written in pieces to exercise the held back prefix
+				for i := 0; i < len(tc.body); i += 50 {
+					end := i + 50
+					if end > len(tc.body) {
+						end = len(tc.body)
+					}
+					_, _ = io.WriteString(w, tc.body[i:end])
+				}
+			})
+			req := httptest.NewRequest(tc.method, "/greeter/bulk-greet", nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+
+			compress(handler).ServeHTTP(w, req)
+
+			if w.Code != tc.status || w.Header().Get("Content-Encoding") != tc.expected {
+				t.Fatalf("Expected %d with encoding %q, got %d with %q", tc.status, tc.expected, w.Code, w.Header().Get("Content-Encoding"))
+			}
+			if tc.method == http.MethodHead && tc.expected != "" {
+				if w.Body.Len() != 0 {
+					t.Errorf("Expected no body, got %d bytes", w.Body.Len())
+				}
+			} else if got := decompress(t, tc.expected, w.Body); got != tc.body {
+				t.Errorf("Expected body %q, got %q", tc.body, got)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Expected Vary Accept-Encoding, got %q", got)
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		useConfig(t, writeConfig(t, `{"compression": {"enabled": false}}`))
+		req := httptest.NewRequest(http.MethodGet, "/greeter/bulk-greet", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, large)
+		})).ServeHTTP(w, req)
+
+		if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "" || w.Body.String() != large {
+			t.Errorf("Expected an untouched response, got %v", w.Header())
+		}
+	})
+}
+
+// TestCompressValidators tests that compression gives strong ETags a
+// coding suffix, repeats it on 304 and leaves pre-encoded responses alone
+func TestCompressValidators(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"compression": {"minSize": 0}}`))
+
+	testCases := []struct {
+		name             string
+		etag             string
+		contentEncoding  string
+		status           int
+		ifNoneMatch      string
+		expectedETag     string
+		expectedEncoding string
+	}{
+		{"Strong", `"abc"`, "", http.StatusOK, "", `"abc-gzip"`, EncodingGzip},
+		{"Weak", `W/"abc"`, "", http.StatusOK, "", `W/"abc"`, EncodingGzip},
+		{"Already encoded", `"abc"`, EncodingBrotli, http.StatusOK, "", `"abc"`, EncodingBrotli},
+		{"Not modified, compressed copy", `"abc"`, "", http.StatusNotModified, `"abc-gzip"`, `"abc-gzip"`, ""},
+		{"Not modified, identity copy", `"abc"`, "", http.StatusNotModified, `"abc"`, `"abc"`, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/greeter/greet", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			req.Header.Set("If-None-Match", tc.ifNoneMatch)
+			w := httptest.NewRecorder()
+
+			compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("ETag", tc.etag)
+				if tc.contentEncoding != "" {
+					w.Header().Set("Content-Encoding", tc.contentEncoding)
+				}
+				w.WriteHeader(tc.status)
+				if tc.status == http.StatusOK {
+					_, _ = io.WriteString(w, "Hello, John!")
+				}
+			})).ServeHTTP(w, req)
+
+			if w.Header().Get("ETag") != tc.expectedETag || w.Header().Get("Content-Encoding") != tc.expectedEncoding {
+				t.Errorf("Expected ETag %s with %s, got %s with %s", tc.expectedETag, tc.expectedEncoding,
+					w.Header().Get("ETag"), w.Header().Get("Content-Encoding"))
+			}
+		})
+	}
+}
+
+// TestCompressStreaming tests that flushed NDJSON lines reach the client
+// before the response ends and that an aborted stream is left truncated
+func TestCompressStreaming(t *testing.T) {
+	useConfig(t, writeConfig(t, `{}`))
+	next := make(chan bool)
+	server := httptest.NewServer(compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", NDJSONType)
+		_, _ = io.WriteString(w, `{"name":"John"}`+"\n")
+		w.(http.Flusher).Flush()
+		if !<-next {
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = io.WriteString(w, `{"name":"Jane"}`+"\n")
+	})))
+	t.Cleanup(server.Close)
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, complete := range []bool{true, false} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if resp.Header.Get("Content-Encoding") != EncodingGzip {
+			t.Fatalf("Expected a gzip stream, got %q", resp.Header.Get("Content-Encoding"))
+		}
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to open gzip stream: %v", err)
+		}
+		lines := bufio.NewReader(reader)
+		if line, err := lines.ReadString('\n'); err != nil || line != `{"name":"John"}`+"\n" {
+			t.Fatalf("Expected the first line before the response ended, got %q, %v", line, err)
+		}
+
+		next <- complete
+		rest, err := io.ReadAll(lines)
+		if complete && (err != nil || string(rest) != `{"name":"Jane"}`+"\n") {
+			t.Errorf("Expected the second line, got %q, %v", rest, err)
+		}
+		if !complete && err == nil {
+			t.Errorf("Expected the aborted stream to fail to decode, got %q", rest)
+		}
+		resp.Body.Close()
+	}
+}
+
+// TestCompressHead tests that HEAD gets the Content-Encoding and ETag of
+// the GET for the same resource
+func TestCompressHead(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"compression": {"minSize": 64}}`))
+	large := strings.Repeat("Hello, John! ", 20)
+
+	testCases := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected string
+	}{
+		{"Body written", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1-m"`)
+			_, _ = io.WriteString(w, large)
+		}, EncodingGzip},
+		{"Content-Length only", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Header().Set("ETag", `"v1-m"`)
+			if r.Method != http.MethodHead {
+				_, _ = io.WriteString(w, large)
+			}
+		}, EncodingGzip},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string]http.Header{}
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				req := httptest.NewRequest(method, "/greeter/greet", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				w := httptest.NewRecorder()
+				compress(tc.handler).ServeHTTP(w, req)
+				headers[method] = w.Header()
+			}
+			get, head := headers[http.MethodGet], headers[http.MethodHead]
+			if get.Get("Content-Encoding") != tc.expected || head.Get("Content-Encoding") != tc.expected {
+				t.Errorf("Expected %s for GET and HEAD, got %q and %q", tc.expected, get.Get("Content-Encoding"), head.Get("Content-Encoding"))
+			}
+			if get.Get("ETag") != `"v1-m-gzip"` || head.Get("ETag") != get.Get("ETag") {
+				t.Errorf("Expected the same coded ETag, got %s and %s", get.Get("ETag"), head.Get("ETag"))
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordETag returns the strong entity tag of a stored user, "v3-f" for
+// the full view and "v3-m" for the masked one. The views are different
+// representations, so a cache must not serve one for the other; both
+// change with every update because the version does.
+func recordETag(rec UserRecord, full bool) string {
+	view := "m"
+	if full {
+		view = "f"
+	}
+	return `"v` + strconv.FormatInt(rec.Version, 10) + "-" + view + `"`
+}
+
+// viewETag returns the entity tag of the view of rec shown to the caller
+func viewETag(r *http.Request, rec UserRecord) string {
+	return recordETag(rec, principalFrom(r.Context()).HasScope(ScopePIIRead))
+}
+
+// setRecordHeaders sets the validators of the caller's view of a stored
+// user on the response
+func setRecordHeaders(w http.ResponseWriter, r *http.Request, rec UserRecord) {
+	w.Header().Set("ETag", viewETag(r, rec))
+	w.Header().Set("Last-Modified", rec.UpdatedAt.UTC().Format(http.TimeFormat))
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match header
+// value lists etag. Weak tags only match when weak is true. Tags carrying
+// the coding suffix of a compressed response match the uncompressed tag.
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if stripETagCoding(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// listsETag reports whether an If-None-Match header value lists exactly
+// etag, compared weakly
+func listsETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers a conditional GET with 304 when the client's copy of
+// rec is current, following the precedence of RFC 9110: If-None-Match is
+// used when present, If-Modified-Since otherwise
+func notModified(w http.ResponseWriter, r *http.Request, rec UserRecord) bool {
+	fresh := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		fresh = etagListMatches(inm, viewETag(r, rec), true)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil {
+			fresh = !rec.UpdatedAt.Truncate(time.Second).After(t)
+		}
+	}
+	if !fresh {
+		return false
+	}
+	setRecordHeaders(w, r, rec)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// requireIfMatch checks that a change to rec names its current version in
+// If-Match. Requests without the header get 428 so clients cannot
+// overwrite changes they have not seen; stale versions get 412. Only the
+// full view's tag is accepted unless acceptMasked is set: writing back a
+// masked copy would store the masked values over the real ones.
+func requireIfMatch(w http.ResponseWriter, r *http.Request, rec UserRecord, acceptMasked bool) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		writeJSONError(w, http.StatusPreconditionRequired, "If-Match header with the user's ETag is required")
+		return false
+	}
+	if etagListMatches(ifMatch, recordETag(rec, true), false) {
+		return true
+	}
+	masked := etagListMatches(ifMatch, recordETag(rec, false), false)
+	if masked && acceptMasked {
+		return true
+	}
+	w.Header().Set("ETag", viewETag(r, rec))
+	if masked {
+		writeJSONError(w, http.StatusPreconditionFailed, "If-Match must name the full record's ETag; a masked copy cannot be written back")
+		return false
+	}
+	writeJSONError(w, http.StatusPreconditionFailed, "user was modified since it was read")
+	return false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestETagMatching tests strong and weak comparison of entity tag lists
+func TestETagMatching(t *testing.T) {
+	testCases := []struct {
+		header   string
+		weak     bool
+		expected bool
+	}{
+		{`"v1"`, false, true},
+		{`"v2", "v1"`, false, true},
+		{`"v2"`, false, false},
+		{`W/"v1"`, false, false},
+		{`W/"v1"`, true, true},
+		{`"v1-gzip"`, false, true},
+		{`W/"v1-br"`, true, true},
+		{`"v2-gzip"`, false, false},
+		{`*`, false, true},
+	}
+	for _, tc := range testCases {
+		if got := etagListMatches(tc.header, `"v1"`, tc.weak); got != tc.expected {
+			t.Errorf("etagListMatches(%s, weak=%v): expected %v, got %v", tc.header, tc.weak, tc.expected, got)
+		}
+	}
+}
+
+// TestConditionalGet tests 304 responses for If-None-Match and If-Modified-Since
+func TestConditionalGet(t *testing.T) {
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John"})
+
+	w := serveUsers("GET", "/greeter/user-info/"+id, "", nil)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag != `"v1-m"` || lastModified == "" {
+		t.Fatalf("Expected ETag and Last-Modified, got %q and %q", etag, lastModified)
+	}
+
+	testCases := []struct {
+		name           string
+		headers        []string
+		expectedStatus int
+	}{
+		{"Matching ETag", []string{"If-None-Match", etag}, http.StatusNotModified},
+		{"Weak ETag", []string{"If-None-Match", "W/" + etag}, http.StatusNotModified},
+		{"Stale ETag", []string{"If-None-Match", `"v0-m"`}, http.StatusOK},
+		{"Other view", []string{"If-None-Match", `"v1-f"`}, http.StatusOK},
+		{"Not modified since", []string{"If-Modified-Since", lastModified}, http.StatusNotModified},
+		{"Modified since", []string{"If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, http.StatusOK},
+		{"ETag wins over date", []string{"If-None-Match", `"v0-m"`, "If-Modified-Since", lastModified}, http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveUsers("GET", "/greeter/user-info/"+id, "", nil, tc.headers...)
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if tc.expectedStatus == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != etag) {
+				t.Errorf("Expected an empty 304 with the ETag, got %q and %q", w.Body.String(), w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+// TestReplaceUserRequiresIfMatch tests 428 and 412 handling of PUT
+func TestReplaceUserRequiresIfMatch(t *testing.T) {
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John", Location: "NYC"})
+	payload := []byte(`{"name": "John", "location": "LA"}`)
+
+	if w := serveUsers("PUT", "/greeter/user-info/"+id, "", payload); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected status %d without If-Match, got %d", http.StatusPreconditionRequired, w.Code)
+	}
+
+	w := serveUsers("PUT", "/greeter/user-info/"+id, "", payload, "If-Match", `"v1-f"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"v2-m"` {
+		t.Fatalf("Expected status %d with ETag v2, got %d and %q", http.StatusOK, w.Code, w.Header().Get("ETag"))
+	}
+	var rec UserRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil || rec.Version != 2 {
+		t.Errorf("Expected the updated record at version 2, got %s", w.Body.String())
+	}
+
+	// A second admin still holding version 1 must not clobber the change
+	w = serveUsers("PUT", "/greeter/user-info/"+id, "", []byte(`{"name": "John"}`), "If-Match", `"v1-f"`)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != `"v2-m"` {
+		t.Errorf("Expected status %d with the current ETag, got %d and %q", http.StatusPreconditionFailed, w.Code, w.Header().Get("ETag"))
+	}
+
+	if w := serveUsers("PUT", "/greeter/user-info/"+id, "", []byte(`{"age": 3}`), "If-Match", `"v2-f"`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d for a missing name, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+}
+
+// TestRecordETagViews tests that the masked and full views of a user have
+// their own ETags and that writes only accept the full one
+func TestRecordETagViews(t *testing.T) {
+	useScopedKeys(t)
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John", Email: "john@example.com"})
+
+	testCases := []struct {
+		name           string
+		apiKey         string
+		ifNoneMatch    string
+		expectedStatus int
+		expectedETag   string
+	}{
+		{"Masked", "support-key", "", http.StatusOK, `"v1-m"`},
+		{"Full", "dpo-key", "", http.StatusOK, `"v1-f"`},
+		{"Masked copy for full view", "dpo-key", `"v1-m"`, http.StatusOK, `"v1-f"`},
+		{"Full copy for masked view", "support-key", `"v1-f"`, http.StatusOK, `"v1-m"`},
+		{"Current full copy", "dpo-key", `"v1-f"`, http.StatusNotModified, `"v1-f"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveUsers("GET", "/greeter/user-info/"+id, tc.apiKey, nil, "If-None-Match", tc.ifNoneMatch)
+			if w.Code != tc.expectedStatus || w.Header().Get("ETag") != tc.expectedETag {
+				t.Errorf("Expected status %d with ETag %s, got %d with %s", tc.expectedStatus, tc.expectedETag, w.Code, w.Header().Get("ETag"))
+			}
+		})
+	}
+
+	for i, tc := range []struct {
+		etag           string
+		expectedStatus int
+	}{
+		{`"v1-m"`, http.StatusPreconditionFailed},
+		{`"v1-f"`, http.StatusOK},
+		{`"v2-m"`, http.StatusPreconditionFailed},
+		{`"v2-f"`, http.StatusOK},
+	} {
+		payload := []byte(`{"name": "John", "age": ` + strconv.Itoa(30+i) + `}`)
+		if w := serveUsers("PUT", "/greeter/user-info/"+id, "support-key", payload, "If-Match", tc.etag); w.Code != tc.expectedStatus {
+			t.Errorf("Expected status %d with If-Match %s, got %d", tc.expectedStatus, tc.etag, w.Code)
+		}
+	}
+}
+
+// TestMaskedRoundTrip tests that a masked user read back and replaced
+// unchanged does not overwrite the real personal data
+func TestMaskedRoundTrip(t *testing.T) {
+	useScopedKeys(t)
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John", Location: "NYC", Email: "john@example.com"})
+
+	for _, method := range []string{"PUT", "PATCH"} {
+		t.Run(method, func(t *testing.T) {
+			get := serveUsers("GET", "/greeter/user-info/"+id, "support-key", nil)
+			var masked UserRecord
+			if err := json.Unmarshal(get.Body.Bytes(), &masked); err != nil || masked.User.Email != "j***@example.com" {
+				t.Fatalf("Expected a masked user, got %s", get.Body.String())
+			}
+			payload, _ := json.Marshal(masked.User)
+			contentType := "application/json"
+			if method == "PATCH" {
+				contentType = MergePatchType
+			}
+			w := serveUsers(method, "/greeter/user-info/"+id, "support-key", payload, "Content-Type", contentType, "If-Match", get.Header().Get("ETag"))
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+			}
+
+			rec, err := dataStore.GetUser(context.Background(), id)
+			if err != nil || rec.User.Email != "john@example.com" || rec.User.Location != "NYC" || rec.Version != 1 {
+				t.Errorf("Expected the stored user to be unchanged, got %+v, %v", rec.User, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,641 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigEnvVar names the environment variable holding the config file path
+const ConfigEnvVar = "GREETER_CONFIG"
+
+// Config holds the service configuration
+type Config struct {
+	Server    ServerConfig    `json:"server"`
+	TLS       TLSConfig       `json:"tls"`
+	Lifecycle LifecycleConfig `json:"lifecycle"`
+	Messages  MessagesConfig  `json:"messages"`
+	Reload    ReloadConfig    `json:"reload"`
+	CORS      CORSConfig      `json:"cors"`
+	Limits    LimitsConfig    `json:"limits"`
+
+	SecurityHeaders SecurityHeadersConfig `json:"securityHeaders"`
+
+	Auth AuthConfig `json:"auth"`
+	PII  PIIConfig  `json:"pii"`
+
+	Storage StorageConfig `json:"storage"`
+	Audit   AuditConfig   `json:"audit"`
+
+	Idempotency IdempotencyConfig `json:"idempotency"`
+	Webhooks    WebhookConfig     `json:"webhooks"`
+	Events      EventsConfig      `json:"events"`
+	Scheduler   SchedulerConfig   `json:"scheduler"`
+	Email       EmailConfig       `json:"email"`
+
+	Cache       ResponseCacheConfig `json:"cache"`
+	Compression CompressionConfig   `json:"compression"`
+}
+
+// ServerConfig holds HTTP listener settings
+type ServerConfig struct {
+	Port int `json:"port"`
+
+	ReadTimeout       Duration `json:"readTimeout"`
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	MaxHeaderBytes    int      `json:"maxHeaderBytes"`
+
+	// MaxConnections caps concurrently open connections; 0 means unlimited
+	MaxConnections int `json:"maxConnections"`
+	// DisableKeepAlives closes every connection after a single request
+	DisableKeepAlives bool `json:"disableKeepAlives"`
+	// TCPKeepAlive is the TCP keep-alive probe period; 0 uses the Go default
+	TCPKeepAlive Duration `json:"tcpKeepAlive"`
+
+	// H2C enables HTTP/2 over cleartext connections for internal traffic
+	H2C                  bool   `json:"h2c"`
+	MaxConcurrentStreams uint32 `json:"maxConcurrentStreams"`
+
+	// AltSvc is sent as the Alt-Svc header to advertise an HTTP/3 endpoint,
+	// such as a QUIC-capable proxy in front of the service
+	AltSvc string `json:"altSvc,omitempty"`
+}
+
+// TLSConfig holds TLS and mutual TLS settings
+type TLSConfig struct {
+	Enabled  bool   `json:"enabled"`
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+
+	// ClientCAFile is a PEM bundle used to verify client certificates
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	// ClientAuth is one of none, request, require, verify-if-given or require-and-verify
+	ClientAuth string `json:"clientAuth,omitempty"`
+
+	MinVersion   string   `json:"minVersion,omitempty"`
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+
+	// ReloadInterval controls how often certificate files are checked for changes
+	ReloadInterval Duration `json:"reloadInterval,omitempty"`
+}
+
+// LifecycleConfig holds shutdown behaviour
+type LifecycleConfig struct {
+	// PreStopDelay is how long the service keeps serving after reporting
+	// not ready, giving load balancers time to stop routing to it
+	PreStopDelay Duration `json:"preStopDelay"`
+	// DrainTimeout bounds how long in-flight requests may take to finish
+	DrainTimeout Duration `json:"drainTimeout"`
+	// HookTimeout bounds the shutdown hooks that flush state
+	HookTimeout Duration `json:"hookTimeout"`
+}
+
+// MessagesConfig locates the greeting templates
+type MessagesConfig struct {
+	// Dir holds one <locale>.json file of message templates per locale
+	Dir           string `json:"dir,omitempty"`
+	DefaultLocale string `json:"defaultLocale,omitempty"`
+}
+
+// ReloadConfig controls hot reloading of the config and locale files
+type ReloadConfig struct {
+	// WatchInterval is how often files are checked for changes; 0 disables
+	// watching and leaves SIGHUP as the only trigger
+	WatchInterval Duration `json:"watchInterval"`
+}
+
+// Duration is a time.Duration that reads and writes JSON strings such as "10s"
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON accepts a duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	*d = Duration(n)
+	return nil
+}
+
+// DefaultConfig returns the configuration used when no config file is given
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:                 9090,
+			ReadTimeout:          Duration(30 * time.Second),
+			ReadHeaderTimeout:    Duration(10 * time.Second),
+			WriteTimeout:         Duration(60 * time.Second),
+			IdleTimeout:          Duration(120 * time.Second),
+			MaxHeaderBytes:       1 << 20,
+			MaxConcurrentStreams: 250,
+		},
+		TLS: TLSConfig{
+			ClientAuth:     "none",
+			MinVersion:     "1.2",
+			ReloadInterval: Duration(30 * time.Second),
+		},
+		Lifecycle: LifecycleConfig{
+			DrainTimeout: Duration(10 * time.Second),
+			HookTimeout:  Duration(5 * time.Second),
+		},
+		Messages: MessagesConfig{
+			DefaultLocale: DefaultLocale,
+		},
+		Reload: ReloadConfig{
+			WatchInterval: Duration(10 * time.Second),
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowedHeaders: []string{"Content-Type", "Accept", "Accept-Language", "If-Match", "If-None-Match", IdempotencyKeyHeader},
+			ExposedHeaders: []string{"Link", "X-Total-Count", RequestIDHeader, "ETag", "Last-Modified", "Location", IdempotentReplayedHeader},
+			MaxAge:         Duration(10 * time.Minute),
+		},
+		Limits: LimitsConfig{
+			MaxBodyBytes: 1 << 20,
+			RouteBodyBytes: map[string]int64{
+				"/greeter/user-info":        16 << 10,
+				"/greeter/user-info/import": 8 << 20,
+			},
+			MaxJSONDepth: 32,
+		},
+		SecurityHeaders: SecurityHeadersConfig{
+			Headers: map[string]string{
+				"X-Content-Type-Options": "nosniff",
+				"X-Frame-Options":        "DENY",
+				"Referrer-Policy":        "no-referrer",
+			},
+			HSTS: "max-age=31536000; includeSubDomains",
+			Routes: map[string]map[string]string{
+				"/greeter/user-info": {"Cache-Control": "no-store"},
+			},
+			RemoveHeaders: []string{"Server", "X-Powered-By"},
+		},
+		Storage: StorageConfig{
+			Driver:          DriverMemory,
+			HistoryLimit:    10000,
+			MaxOpenConns:    10,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: Duration(30 * time.Minute),
+		},
+		Audit: AuditConfig{
+			MaxSizeBytes: 10 << 20,
+			MaxFiles:     5,
+		},
+		Idempotency: IdempotencyConfig{
+			TTL:     Duration(24 * time.Hour),
+			MaxKeys: 10000,
+		},
+		Webhooks: WebhookConfig{
+			Workers:         4,
+			QueueSize:       1000,
+			Timeout:         Duration(10 * time.Second),
+			MaxAttempts:     6,
+			InitialBackoff:  Duration(time.Second),
+			MaxBackoff:      Duration(5 * time.Minute),
+			MaxDeliveryLogs: 1000,
+		},
+		Events: EventsConfig{
+			Publisher:    PublisherNone,
+			Source:       "/greeter",
+			Topic:        "greeter.events",
+			PollInterval: Duration(time.Second),
+			BatchSize:    100,
+			Timeout:      Duration(10 * time.Second),
+		},
+		Scheduler: SchedulerConfig{
+			Enabled:      true,
+			PollInterval: Duration(30 * time.Second),
+			MisfireGrace: Duration(time.Minute),
+			MaxCatchUp:   100,
+		},
+		Cache: ResponseCacheConfig{
+			Enabled:    true,
+			MaxEntries: 10000,
+			MaxBytes:   16 << 20,
+			TTL:        Duration(10 * time.Minute),
+		},
+		Compression: CompressionConfig{
+			Enabled:       true,
+			MinSize:       1024,
+			ContentTypes:  []string{"application/json", NDJSONType, "text/*"},
+			Level:         5,
+			BrotliQuality: 4,
+		},
+		Email: EmailConfig{
+			Port:           587,
+			TLS:            EmailTLSStartTLS,
+			Workers:        2,
+			QueueSize:      1000,
+			Timeout:        Duration(30 * time.Second),
+			MaxAttempts:    5,
+			InitialBackoff: Duration(30 * time.Second),
+			MaxBackoff:     Duration(30 * time.Minute),
+			MaxPerMinute:   60,
+		},
+	}
+}
+
+// LoadConfig reads a JSON config file on top of the defaults.
+// An empty path returns the defaults.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading config: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration for inconsistent settings
+func (c Config) Validate() error {
+	if err := c.Server.Validate(); err != nil {
+		return err
+	}
+	if err := c.Lifecycle.Validate(); err != nil {
+		return err
+	}
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+	if err := c.Limits.Validate(); err != nil {
+		return err
+	}
+	if err := c.SecurityHeaders.Validate(); err != nil {
+		return err
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return err
+	}
+	if err := c.PII.Validate(); err != nil {
+		return err
+	}
+	if err := c.Storage.Validate(); err != nil {
+		return err
+	}
+	if err := c.Audit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Idempotency.Validate(); err != nil {
+		return err
+	}
+	if err := c.Webhooks.Validate(); err != nil {
+		return err
+	}
+	if err := c.Events.Validate(); err != nil {
+		return err
+	}
+	if err := c.Scheduler.Validate(); err != nil {
+		return err
+	}
+	if err := c.Email.Validate(); err != nil {
+		return err
+	}
+	if err := c.Cache.Validate(); err != nil {
+		return err
+	}
+	if err := c.Compression.Validate(); err != nil {
+		return err
+	}
+	if c.Reload.WatchInterval < 0 {
+		return errors.New("reload.watchInterval must not be negative")
+	}
+	if c.Server.H2C && c.TLS.Enabled {
+		return errors.New("server.h2c cannot be combined with TLS, which negotiates HTTP/2 itself")
+	}
+	if len(c.Auth.ClientScopes) > 0 && !c.TLS.verifiesClients() {
+		return errors.New("auth.clientScopes requires tls.clientAuth verify-if-given or require-and-verify")
+	}
+	return c.TLS.Validate()
+}
+
+// Validate checks the listener settings
+func (s ServerConfig) Validate() error {
+	if s.Port <= 0 || s.Port > 65535 {
+		return fmt.Errorf("server.port %d is out of range", s.Port)
+	}
+	timeouts := map[string]Duration{
+		"readTimeout":       s.ReadTimeout,
+		"readHeaderTimeout": s.ReadHeaderTimeout,
+		"writeTimeout":      s.WriteTimeout,
+		"idleTimeout":       s.IdleTimeout,
+		"tcpKeepAlive":      s.TCPKeepAlive,
+	}
+	for name, d := range timeouts {
+		if d < 0 {
+			return fmt.Errorf("server.%s must not be negative", name)
+		}
+	}
+	if s.ReadHeaderTimeout == 0 {
+		return errors.New("server.readHeaderTimeout is required to protect against slow clients")
+	}
+	if s.MaxHeaderBytes < 0 {
+		return errors.New("server.maxHeaderBytes must not be negative")
+	}
+	if s.MaxConnections < 0 {
+		return errors.New("server.maxConnections must not be negative")
+	}
+	if strings.ContainsAny(s.AltSvc, "\r\n") {
+		return errors.New("server.altSvc must be a single header value")
+	}
+	return nil
+}
+
+// Validate checks the TLS settings
+func (t TLSConfig) Validate() error {
+	if !t.Enabled {
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return errors.New("tls.certFile and tls.keyFile are required when TLS is enabled")
+	}
+	if _, err := parseTLSVersion(t.MinVersion); err != nil {
+		return err
+	}
+	if _, err := parseCipherSuites(t.CipherSuites); err != nil {
+		return err
+	}
+	clientAuth, err := parseClientAuth(t.ClientAuth)
+	if err != nil {
+		return err
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && t.ClientCAFile == "" {
+		return fmt.Errorf("tls.clientCAFile is required for clientAuth %q", t.ClientAuth)
+	}
+	if t.ReloadInterval < 0 {
+		return errors.New("tls.reloadInterval must not be negative")
+	}
+	return nil
+}
+
+// verifiesClients reports whether client certificates are checked against
+// the client CAs, which granting scopes by subject relies on
+func (t TLSConfig) verifiesClients() bool {
+	clientAuth, err := parseClientAuth(t.ClientAuth)
+	return t.Enabled && err == nil && clientAuth >= tls.VerifyClientCertIfGiven
+}
+
+// Validate checks the shutdown settings
+func (l LifecycleConfig) Validate() error {
+	if l.PreStopDelay < 0 {
+		return errors.New("lifecycle.preStopDelay must not be negative")
+	}
+	if l.DrainTimeout <= 0 {
+		return errors.New("lifecycle.drainTimeout must be positive")
+	}
+	if l.HookTimeout <= 0 {
+		return errors.New("lifecycle.hookTimeout must be positive")
+	}
+	return nil
+}
+
+// snapshot is an immutable view of the active configuration together
+// with the message templates loaded alongside it
+type snapshot struct {
+	Config   Config
+	Messages *messageCatalog
+	// Version identifies the config and locale file contents
+	Version  string
+	LoadedAt time.Time
+}
+
+// loadSnapshot reads and validates the config file and the locale files
+// it points to
+func loadSnapshot(path string) (*snapshot, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := newMessageCatalog(cfg.Messages.Dir, cfg.Messages.DefaultLocale)
+	if err != nil {
+		return nil, fmt.Errorf("loading messages: %w", err)
+	}
+
+	files := []string{}
+	if path != "" {
+		files = append(files, path)
+	}
+	locales, err := localeFiles(cfg.Messages.Dir)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, locales...)
+
+	version := "default"
+	if len(files) > 0 {
+		hash := sha256.New()
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(hash, "%s\x00%d\x00", filepath.Base(file), len(data))
+			hash.Write(data)
+		}
+		version = hex.EncodeToString(hash.Sum(nil))[:12]
+	}
+
+	return &snapshot{Config: cfg, Messages: messages, Version: version, LoadedAt: time.Now()}, nil
+}
+
+// configStore holds the active snapshot and swaps it on reload
+type configStore struct {
+	path    string
+	current atomic.Pointer[snapshot]
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+}
+
+// activeConfig is the store request handlers read settings from.
+// main replaces it with one backed by the config file.
+var activeConfig = mustDefaultConfigStore()
+
+// mustDefaultConfigStore returns a store holding the built-in defaults
+func mustDefaultConfigStore() *configStore {
+	store, err := newConfigStore("")
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// newConfigStore loads the configuration at path
+func newConfigStore(path string) (*configStore, error) {
+	snap, err := loadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &configStore{path: path}
+	s.current.Store(snap)
+	s.modTimes = s.watchedModTimes()
+	return s, nil
+}
+
+// Get returns the active configuration
+func (s *configStore) Get() Config {
+	return s.current.Load().Config
+}
+
+// Snapshot returns the active configuration and messages
+func (s *configStore) Snapshot() *snapshot {
+	return s.current.Load()
+}
+
+// Reload re-reads the config and locale files. The active snapshot is only
+// replaced when the new one loads and validates; new requests see the new
+// snapshot while requests already running keep the one they started with.
+func (s *configStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, err := loadSnapshot(s.path)
+	if err != nil {
+		return err
+	}
+	// The email cipher and name hash key are built once at startup, so a
+	// reload cannot apply new keys
+	if !reflect.DeepEqual(s.current.Load().Config.PII, snap.Config.PII) {
+		return errors.New("pii keys changed; restart the server to apply them")
+	}
+	previous := s.current.Swap(snap)
+	s.modTimes = s.watchedModTimes()
+
+	if restartOnly(previous.Config, snap.Config) {
+		log.Println("Server, TLS, storage, audit, webhook pool, event, scheduler or email settings changed; they take effect after a restart")
+	}
+	log.Printf("Configuration version %s active (was %s)", snap.Version, previous.Version)
+	return nil
+}
+
+// restartOnly reports whether settings that cannot be swapped at runtime changed
+func restartOnly(previous, next Config) bool {
+	return !reflect.DeepEqual(previous.Server, next.Server) ||
+		!reflect.DeepEqual(previous.TLS, next.TLS) ||
+		!reflect.DeepEqual(previous.Storage, next.Storage) ||
+		!reflect.DeepEqual(previous.Audit, next.Audit) ||
+		previous.Webhooks.Workers != next.Webhooks.Workers ||
+		previous.Webhooks.QueueSize != next.Webhooks.QueueSize ||
+		!reflect.DeepEqual(previous.Events, next.Events) ||
+		!reflect.DeepEqual(previous.Scheduler, next.Scheduler) ||
+		!reflect.DeepEqual(previous.Email, next.Email)
+}
+
+// watchedModTimes records the modification time of the config file, the
+// locale files and the locale directory itself so additions are noticed
+func (s *configStore) watchedModTimes() map[string]time.Time {
+	paths := []string{}
+	if s.path != "" {
+		paths = append(paths, s.path)
+	}
+	if dir := s.current.Load().Config.Messages.Dir; dir != "" {
+		paths = append(paths, dir)
+		if files, err := localeFiles(dir); err == nil {
+			paths = append(paths, files...)
+		}
+	}
+
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed reports whether any watched file was modified, added or removed
+func (s *configStore) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !reflect.DeepEqual(s.modTimes, s.watchedModTimes())
+}
+
+// watch reloads whenever the watched files change, until ctx is cancelled
+func (s *configStore) watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				log.Printf("Reload failed, keeping configuration version %s: %v", s.Snapshot().Version, err)
+				// Remember the broken files so the failure is logged once
+				s.mu.Lock()
+				s.modTimes = s.watchedModTimes()
+				s.mu.Unlock()
+			}
+		}
+	}
+}
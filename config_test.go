@@ -0,0 +1,245 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file into a temporary directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+// TestLoadConfigDefaults tests that an empty path yields the defaults
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.Server.Port != 9090 {
+		t.Errorf("Expected default port 9090, got %d", cfg.Server.Port)
+	}
+	if cfg.TLS.Enabled {
+		t.Error("Expected TLS to be disabled by default")
+	}
+}
+
+// TestLoadConfigFromFile tests that file values override the defaults
+func TestLoadConfigFromFile(t *testing.T) {
+	path := writeConfig(t, `{
+		"server": {"port": 8443},
+		"tls": {"enabled": true, "certFile": "server.crt", "keyFile": "server.key", "minVersion": "1.3", "reloadInterval": "5s"}
+	}`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.Server.Port != 8443 {
+		t.Errorf("Expected port 8443, got %d", cfg.Server.Port)
+	}
+	if cfg.TLS.MinVersion != "1.3" {
+		t.Errorf("Expected minVersion 1.3, got %q", cfg.TLS.MinVersion)
+	}
+	if time.Duration(cfg.TLS.ReloadInterval) != 5*time.Second {
+		t.Errorf("Expected reloadInterval 5s, got %v", time.Duration(cfg.TLS.ReloadInterval))
+	}
+	if cfg.TLS.ClientAuth != "none" {
+		t.Errorf("Expected default clientAuth to be kept, got %q", cfg.TLS.ClientAuth)
+	}
+}
+
+// TestLoadConfigInvalid tests that invalid configuration is rejected
+func TestLoadConfigInvalid(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		errText string
+	}{
+		{"Unknown field", `{"server": {"prot": 80}}`, "unknown field"},
+		{"Bad port", `{"server": {"port": 70000}}`, "out of range"},
+		{"Bad duration", `{"tls": {"reloadInterval": "soon"}}`, "invalid duration"},
+		{"Missing key", `{"tls": {"enabled": true, "certFile": "a.crt"}}`, "keyFile"},
+		{"Old TLS version", `{"tls": {"enabled": true, "certFile": "a", "keyFile": "b", "minVersion": "1.0"}}`, "no longer supported"},
+		{"Unknown cipher", `{"tls": {"enabled": true, "certFile": "a", "keyFile": "b", "cipherSuites": ["TLS_RSA_WITH_RC4_128_SHA"]}}`, "cipher suite"},
+		{"Verify without CA", `{"tls": {"enabled": true, "certFile": "a", "keyFile": "b", "clientAuth": "require-and-verify"}}`, "clientCAFile"},
+		{"Negative timeout", `{"server": {"writeTimeout": "-1s"}}`, "writeTimeout"},
+		{"Missing header timeout", `{"server": {"readHeaderTimeout": "0s"}}`, "readHeaderTimeout"},
+		{"Negative connection limit", `{"server": {"maxConnections": -1}}`, "maxConnections"},
+		{"Multi-line Alt-Svc", `{"server": {"altSvc": "h3=\":443\"\r\nX-Injected: 1"}}`, "altSvc"},
+		{"Short name hash key", `{"pii": {"nameHashKey": "short"}}`, "nameHashKey"},
+		{"Two name hash keys", `{"pii": {"nameHashKey": "a-long-enough-secret", "nameHashKeyFile": "names.key"}}`, "mutually exclusive"},
+		{"HTTP publisher without URL", `{"events": {"publisher": "http"}}`, "events.url"},
+		{"Zero event timeout", `{"events": {"timeout": "0s"}}`, "events.timeout"},
+		{"H2C with TLS", `{"server": {"h2c": true}, "tls": {"enabled": true, "certFile": "a", "keyFile": "b"}}`, "h2c"},
+		{"Negative pre-stop delay", `{"lifecycle": {"preStopDelay": "-5s"}}`, "preStopDelay"},
+		{"Zero drain timeout", `{"lifecycle": {"drainTimeout": "0s"}}`, "drainTimeout"},
+		{"Zero body limit", `{"limits": {"maxBodyBytes": 0}}`, "maxBodyBytes"},
+		{"Relative route limit", `{"limits": {"routeBodyBytes": {"greeter/greet": 10}}}`, "routeBodyBytes"},
+		{"Unknown storage driver", `{"storage": {"driver": "mongodb"}}`, "storage.driver"},
+		{"SQLite without DSN", `{"storage": {"driver": "sqlite"}}`, "storage.dsn"},
+		{"Zero audit file size", `{"audit": {"maxSizeBytes": 0}}`, "audit.maxSizeBytes"},
+		{"Zero idempotency TTL", `{"idempotency": {"ttl": "0s"}}`, "idempotency.ttl"},
+		{"Unknown event publisher", `{"events": {"publisher": "kafka"}}`, "events.publisher"},
+		{"Zero scheduler catch-up", `{"scheduler": {"maxCatchUp": 0}}`, "scheduler.maxCatchUp"},
+		{"Email without host", `{"email": {"enabled": true, "from": "greeter@example.com"}}`, "email.host"},
+		{"Welcome without email", `{"email": {"welcome": true}}`, "email.welcome"},
+		{"Empty response cache", `{"cache": {"maxEntries": 0}}`, "cache.maxEntries"},
+		{"Compression level out of range", `{"compression": {"level": 10}}`, "compression.level"},
+		{"Compression content type", `{"compression": {"contentTypes": ["json"]}}`, "compression.contentTypes"},
+		{"Client scopes without verification", `{"auth": {"clientScopes": {"CN=billing": ["pii:read"]}}, "tls": {"enabled": true, "certFile": "a", "keyFile": "b", "clientAuth": "request"}}`, "auth.clientScopes"},
+		{"Unknown client auth", `{"tls": {"enabled": true, "certFile": "a", "keyFile": "b", "clientAuth": "maybe"}}`, "clientAuth"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tc.content))
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+			if !strings.Contains(err.Error(), tc.errText) {
+				t.Errorf("Expected error to contain %q, got %v", tc.errText, err)
+			}
+		})
+	}
+}
+
+// TestConfigStoreReload tests that a failed reload keeps the active configuration
+func TestConfigStoreReload(t *testing.T) {
+	path := writeConfig(t, `{"lifecycle": {"preStopDelay": "1s"}}`)
+	store, err := newConfigStore(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"lifecycle": {"preStopDelay": "2s"}}`), 0o600); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Expected reload to succeed, got %v", err)
+	}
+	if got := time.Duration(store.Get().Lifecycle.PreStopDelay); got != 2*time.Second {
+		t.Errorf("Expected preStopDelay 2s after reload, got %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"lifecycle": {"preStopDelay": "-1s"}}`), 0o600); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Error("Expected reload of invalid config to fail")
+	}
+	if got := time.Duration(store.Get().Lifecycle.PreStopDelay); got != 2*time.Second {
+		t.Errorf("Expected previous preStopDelay to be kept, got %v", got)
+	}
+}
+
+// TestConfigStoreReloadRejectsPIIKeys tests that a reload changing the PII keys fails and keeps the active configuration
+func TestConfigStoreReloadRejectsPIIKeys(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+	}{
+		{"Encryption key", `{"lifecycle": {"preStopDelay": "2s"}, "pii": {"encryptionKey": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}`},
+		{"Encryption key file", `{"lifecycle": {"preStopDelay": "2s"}, "pii": {"encryptionKeyFile": "/run/secrets/email-key"}}`},
+		{"Name hash key", `{"lifecycle": {"preStopDelay": "2s"}, "pii": {"nameHashKey": "0123456789abcdef"}}`},
+		{"Name hash key file", `{"lifecycle": {"preStopDelay": "2s"}, "pii": {"nameHashKeyFile": "/run/secrets/name-key"}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, `{"lifecycle": {"preStopDelay": "1s"}}`)
+			store, err := newConfigStore(path)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatalf("Failed to update config: %v", err)
+			}
+			err = store.Reload()
+			if err == nil || !strings.Contains(err.Error(), "restart") {
+				t.Errorf("Expected reload to fail asking for a restart, got %v", err)
+			}
+			if got := time.Duration(store.Get().Lifecycle.PreStopDelay); got != time.Second {
+				t.Errorf("Expected previous preStopDelay to be kept, got %v", got)
+			}
+		})
+	}
+}
+
+// TestConfigStoreReloadsLocales tests that locale changes produce a new version and failures keep the old one
+func TestConfigStoreReloadsLocales(t *testing.T) {
+	dir := t.TempDir()
+	writeLocale(t, dir, "fr", `{"greet": "Bonjour, {{.Name}} !"}`)
+	store, err := newConfigStore(writeConfig(t, `{"messages": {"dir": "`+filepath.ToSlash(dir)+`"}}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	firstVersion := store.Snapshot().Version
+	if firstVersion == "" || firstVersion == "default" {
+		t.Errorf("Expected a content version, got %q", firstVersion)
+	}
+
+	writeLocale(t, dir, "fr", `{"greet": "Salut, {{.Name}} !"}`)
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Expected reload to succeed, got %v", err)
+	}
+	secondVersion := store.Snapshot().Version
+	if secondVersion == firstVersion {
+		t.Error("Expected version to change with the locale file")
+	}
+	if got := store.Snapshot().Messages.Render("fr", MsgGreet, "Alice"); got != "Salut, Alice !" {
+		t.Errorf("Expected reloaded template, got %q", got)
+	}
+
+	writeLocale(t, dir, "fr", `{"greet": "Salut, {{.Name"}`)
+	if err := store.Reload(); err == nil {
+		t.Error("Expected reload with a broken template to fail")
+	}
+	if store.Snapshot().Version != secondVersion {
+		t.Error("Expected failed reload to keep the previous version")
+	}
+	if got := store.Snapshot().Messages.Render("fr", MsgGreet, "Alice"); got != "Salut, Alice !" {
+		t.Errorf("Expected previous template to stay active, got %q", got)
+	}
+}
+
+// TestConfigStoreChanged tests detection of modified and added watched files
+func TestConfigStoreChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, `{"messages": {"dir": "`+filepath.ToSlash(dir)+`"}}`)
+	store, err := newConfigStore(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if store.changed() {
+		t.Error("Expected no change right after loading")
+	}
+
+	writeLocale(t, dir, "de", `{"greet": "Hallo, {{.Name}}!"}`)
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(dir, future, future)
+	if !store.changed() {
+		t.Error("Expected a new locale file to be detected")
+	}
+
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Expected reload to succeed, got %v", err)
+	}
+	if store.changed() {
+		t.Error("Expected no change after reload")
+	}
+
+	_ = os.Chtimes(path, future.Add(time.Minute), future.Add(time.Minute))
+	if !store.changed() {
+		t.Error("Expected a modified config file to be detected")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// corsTestHandler marks responses that reached the wrapped handler
+var corsTestHandler = cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Handled", "true")
+	w.WriteHeader(http.StatusOK)
+}))
+
+// TestCORSSimpleRequests tests CORS headers on non-preflight requests for each origin policy
+func TestCORSSimpleRequests(t *testing.T) {
+	testCases := []struct {
+		name          string
+		config        string
+		origin        string
+		expectedAllow string
+		expectedCreds string
+	}{
+		{"Disabled", `{}`, "https://app.example.com", "", ""},
+		{"No origin header", `{"cors": {"allowedOrigins": ["https://app.example.com"]}}`, "", "", ""},
+		{"Exact match", `{"cors": {"allowedOrigins": ["https://app.example.com"]}}`, "https://app.example.com", "https://app.example.com", ""},
+		{"Exact match ignores case", `{"cors": {"allowedOrigins": ["https://App.Example.com"]}}`, "https://app.example.com", "https://app.example.com", ""},
+		{"Origin not allowed", `{"cors": {"allowedOrigins": ["https://app.example.com"]}}`, "https://evil.example.org", "", ""},
+		{"Any origin", `{"cors": {"allowedOrigins": ["*"]}}`, "https://anything.test", "*", ""},
+		{"Subdomain wildcard", `{"cors": {"allowedOrigins": ["https://*.example.com"]}}`, "https://web.app.example.com", "https://web.app.example.com", ""},
+		{"Wildcard excludes apex", `{"cors": {"allowedOrigins": ["https://*.example.com"]}}`, "https://example.com", "", ""},
+		{"Wildcard checks scheme", `{"cors": {"allowedOrigins": ["https://*.example.com"]}}`, "http://app.example.com", "", ""},
+		{"Wildcard rejects path tricks", `{"cors": {"allowedOrigins": ["https://*.example.com"]}}`, "https://evil.test/x.example.com", "", ""},
+		{"Credentials", `{"cors": {"allowedOrigins": ["https://app.example.com"], "allowCredentials": true}}`, "https://app.example.com", "https://app.example.com", "true"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useConfig(t, writeConfig(t, tc.config))
+
+			req := httptest.NewRequest("GET", "/greeter/greet", nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			w := httptest.NewRecorder()
+
+			corsTestHandler.ServeHTTP(w, req)
+
+			if w.Header().Get("X-Handled") != "true" {
+				t.Error("Expected simple request to reach the handler")
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.expectedAllow {
+				t.Errorf("Expected Access-Control-Allow-Origin %q, got %q", tc.expectedAllow, got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tc.expectedCreds {
+				t.Errorf("Expected Access-Control-Allow-Credentials %q, got %q", tc.expectedCreds, got)
+			}
+		})
+	}
+}
+
+// TestCORSPreflight tests that preflight requests are answered without reaching the handlers
+func TestCORSPreflight(t *testing.T) {
+	config := `{"cors": {
+		"allowedOrigins": ["https://app.example.com"],
+		"allowedMethods": ["GET", "POST"],
+		"allowedHeaders": ["Content-Type"],
+		"maxAge": "1h"
+	}}`
+
+	testCases := []struct {
+		name           string
+		origin         string
+		method         string
+		headers        string
+		expectedStatus int
+	}{
+		{"Allowed", "https://app.example.com", "POST", "content-type", http.StatusNoContent},
+		{"Method not allowed", "https://app.example.com", "DELETE", "", http.StatusForbidden},
+		{"Header not allowed", "https://app.example.com", "POST", "Content-Type, X-Secret", http.StatusForbidden},
+		{"Origin not allowed", "https://evil.example.org", "GET", "", http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useConfig(t, writeConfig(t, config))
+
+			req := httptest.NewRequest("OPTIONS", "/greeter/user-info", nil)
+			req.Header.Set("Origin", tc.origin)
+			req.Header.Set("Access-Control-Request-Method", tc.method)
+			if tc.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tc.headers)
+			}
+			w := httptest.NewRecorder()
+
+			corsTestHandler.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if w.Header().Get("X-Handled") != "" {
+				t.Error("Expected preflight to be short-circuited")
+			}
+			if tc.expectedStatus != http.StatusNoContent {
+				return
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+				t.Errorf("Expected allowed methods 'GET, POST', got %q", got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+				t.Errorf("Expected allowed headers 'Content-Type', got %q", got)
+			}
+			if got := w.Header().Get("Access-Control-Max-Age"); got != "3600" {
+				t.Errorf("Expected max age 3600, got %q", got)
+			}
+			if vary := strings.Join(w.Header().Values("Vary"), ","); !strings.Contains(vary, "Origin") {
+				t.Errorf("Expected Vary to include Origin, got %q", vary)
+			}
+		})
+	}
+}
+
+// TestCORSPlainOptionsPassesThrough tests that OPTIONS without a preflight header reaches the handler
+func TestCORSPlainOptionsPassesThrough(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"cors": {"allowedOrigins": ["*"]}}`))
+
+	req := httptest.NewRequest("OPTIONS", "/greeter/greet", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+
+	corsTestHandler.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Handled") != "true" {
+		t.Error("Expected plain OPTIONS request to reach the handler")
+	}
+}
+
+// TestCORSExposedHeaders tests that exposed headers are listed on actual responses
+func TestCORSExposedHeaders(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"cors": {"allowedOrigins": ["*"], "exposedHeaders": ["X-Request-Id"]}}`))
+
+	req := httptest.NewRequest("GET", "/greeter/greet", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+
+	corsTestHandler.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != "X-Request-Id" {
+		t.Errorf("Expected exposed headers 'X-Request-Id', got %q", got)
+	}
+}
+
+// TestCORSConfigValidation tests rejection of unsafe or malformed policies
+func TestCORSConfigValidation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  CORSConfig
+		wantErr bool
+	}{
+		{"Valid", CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.com"}}, false},
+		{"Any origin", CORSConfig{AllowedOrigins: []string{"*"}}, false},
+		{"Any origin with credentials", CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, true},
+		{"Missing scheme", CORSConfig{AllowedOrigins: []string{"app.example.com"}}, true},
+		{"Path in origin", CORSConfig{AllowedOrigins: []string{"https://app.example.com/"}}, true},
+		{"Inner wildcard", CORSConfig{AllowedOrigins: []string{"https://app.*.com"}}, true},
+		{"Negative max age", CORSConfig{MaxAge: -1}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Expected error=%v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
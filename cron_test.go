@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseCron tests accepted and rejected cron expressions
+func TestParseCron(t *testing.T) {
+	testCases := []struct {
+		name          string
+		expr          string
+		expectedError string
+	}{
+		{"Every minute", "* * * * *", ""},
+		{"Lists, ranges and steps", "0,30 9-17/2 1-15 */3 *", ""},
+		{"Names", "0 8 * JAN-MAR mon-fri", ""},
+		{"Sunday as 7", "0 8 * * 7", ""},
+		{"Macro", "@yearly", ""},
+		{"Too few fields", "0 8 * *", "5 fields"},
+		{"Minute out of range", "60 * * * *", "minute field"},
+		{"Day of month zero", "0 0 0 * *", "day of month field"},
+		{"Reversed range", "0 17-9 * * *", "hour field"},
+		{"Zero step", "*/0 * * * *", "step"},
+		{"Unknown name", "0 0 * FOO *", "month field"},
+		{"Unknown macro", "@fortnightly", "5 fields"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseCron(tc.expr)
+			switch {
+			case tc.expectedError == "" && err != nil:
+				t.Errorf("Expected no error, got %v", err)
+			case tc.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedError)):
+				t.Errorf("Expected an error containing %q, got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+// TestCronNext tests next run computation, including time zones and
+// daylight saving changes
+func TestCronNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatalf("Failed to load time zone: %v", err)
+	}
+	at := func(loc *time.Location, value string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+		if err != nil {
+			t.Fatalf("Bad test time %q: %v", value, err)
+		}
+		return parsed
+	}
+
+	testCases := []struct {
+		name     string
+		expr     string
+		after    time.Time
+		expected time.Time
+	}{
+		{"Next minute", "* * * * *", at(time.UTC, "2024-01-01 10:00").Add(30 * time.Second), at(time.UTC, "2024-01-01 10:01")},
+		{"Later today", "0 8 * * *", at(paris, "2024-01-01 07:59"), at(paris, "2024-01-01 08:00")},
+		{"Tomorrow", "0 8 * * *", at(paris, "2024-01-01 08:00"), at(paris, "2024-01-02 08:00")},
+		{"Weekday", "0 8 * * MON-FRI", at(paris, "2024-01-05 09:00"), at(paris, "2024-01-08 08:00")},
+		{"Yearly birthday", "0 9 14 3 *", at(paris, "2024-03-14 09:00"), at(paris, "2025-03-14 09:00")},
+		{"Leap day", "0 0 29 2 *", at(time.UTC, "2024-03-01 00:00"), at(time.UTC, "2028-02-29 00:00")},
+		{"Day of month or week", "0 0 13 * FRI", at(time.UTC, "2024-01-06 00:00"), at(time.UTC, "2024-01-12 00:00")},
+		{"Step", "*/20 * * * *", at(time.UTC, "2024-01-01 10:41"), at(time.UTC, "2024-01-01 11:00")},
+		{"Wall clock across spring forward", "0 8 * * *", at(paris, "2024-03-30 08:00"), at(paris, "2024-03-31 08:00")},
+		{"Skipped by spring forward", "30 2 * * *", at(paris, "2024-03-30 03:00"), at(paris, "2024-04-01 02:30")},
+		{"Repeated by fall back", "30 2 * * *", time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC).In(paris), at(paris, "2024-10-28 02:30")},
+		{"Hourly through fall back", "0 * * * *", time.Date(2024, 10, 27, 0, 0, 0, 0, time.UTC).In(paris), time.Date(2024, 10, 27, 2, 0, 0, 0, time.UTC).In(paris)},
+		{"Never", "0 0 30 2 *", at(time.UTC, "2024-01-01 00:00"), time.Time{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseCron(tc.expr)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := c.Next(tc.after); !got.Equal(tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
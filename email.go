@@ -0,0 +1,699 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email transport security
+const (
+	// EmailTLSStartTLS upgrades the connection and refuses servers that
+	// cannot
+	EmailTLSStartTLS = "starttls"
+	// EmailTLSImplicit connects over TLS, usually to port 465
+	EmailTLSImplicit = "tls"
+	// EmailTLSNone sends in clear text, for local relays and test servers
+	EmailTLSNone = "none"
+)
+
+// Suppression reasons
+const (
+	SuppressionUnsubscribed = "unsubscribed"
+	// SuppressionBounced marks an address the relay permanently rejected
+	SuppressionBounced = "bounced"
+)
+
+var (
+	errEmailDisabled   = errors.New("email delivery is not configured")
+	errNoEmail         = errors.New("the user has no email address")
+	errEmailSuppressed = errors.New("the address unsubscribed or bounced")
+	errEmailQueueFull  = errors.New("email queue is full")
+	errMailerClosed    = errors.New("email delivery is shutting down")
+	// errRecipientRejected wraps permanent rejections of the recipient,
+	// which suppress the address
+	errRecipientRejected = errors.New("recipient rejected")
+	errBadUnsubscribe    = errors.New("invalid unsubscribe token")
+)
+
+// EmailConfig controls email delivery over SMTP
+type EmailConfig struct {
+	// Enabled turns email delivery on; Host, From and the unsubscribe
+	// settings are required with it
+	Enabled bool   `json:"enabled"`
+	Host    string `json:"host,omitempty"`
+	Port    int    `json:"port"`
+	// TLS is starttls, tls or none
+	TLS string `json:"tls"`
+	// Username and Password are sent with PLAIN auth, which is only used
+	// over TLS or to localhost
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// PasswordFile is read at startup in place of Password
+	PasswordFile string `json:"passwordFile,omitempty"`
+	// From is the sender, such as "Greeter <greeter@example.com>"
+	From string `json:"from,omitempty"`
+	// UnsubscribeURL is the public address of /greeter/email/unsubscribe,
+	// linked from every email
+	UnsubscribeURL string `json:"unsubscribeURL,omitempty"`
+	// UnsubscribeSecret signs unsubscribe links; changing it invalidates
+	// the links already sent
+	UnsubscribeSecret string `json:"unsubscribeSecret,omitempty"`
+	// Welcome emails the welcome message to new users with an address
+	Welcome bool `json:"welcome"`
+
+	// Workers and QueueSize size the sending pool
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+	// Timeout bounds each SMTP session
+	Timeout Duration `json:"timeout"`
+	// MaxAttempts is the number of attempts before a message is dropped.
+	// Permanent rejections are not retried.
+	MaxAttempts int `json:"maxAttempts"`
+	// InitialBackoff doubles after each failed attempt up to MaxBackoff
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	// MaxPerMinute spaces messages out so bursts such as imports do not
+	// get the sender throttled or flagged by the relay
+	MaxPerMinute int `json:"maxPerMinute"`
+}
+
+// Validate checks the email settings
+func (c EmailConfig) Validate() error {
+	positive := map[string]int64{
+		"workers":        int64(c.Workers),
+		"queueSize":      int64(c.QueueSize),
+		"timeout":        int64(c.Timeout),
+		"maxAttempts":    int64(c.MaxAttempts),
+		"initialBackoff": int64(c.InitialBackoff),
+		"maxPerMinute":   int64(c.MaxPerMinute),
+	}
+	for name, v := range positive {
+		if v <= 0 {
+			return fmt.Errorf("email.%s must be positive", name)
+		}
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		return errors.New("email.maxBackoff must not be less than email.initialBackoff")
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("email.port %d is out of range", c.Port)
+	}
+	switch c.TLS {
+	case EmailTLSStartTLS, EmailTLSImplicit, EmailTLSNone:
+	default:
+		return fmt.Errorf("email.tls must be %s, %s or %s", EmailTLSStartTLS, EmailTLSImplicit, EmailTLSNone)
+	}
+	if c.Password != "" && c.PasswordFile != "" {
+		return errors.New("email.password and email.passwordFile are mutually exclusive")
+	}
+
+	if !c.Enabled {
+		if c.Welcome {
+			return errors.New("email.welcome requires email.enabled")
+		}
+		return nil
+	}
+	if c.Host == "" {
+		return errors.New("email.host is required when email is enabled")
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("email.from %q is not a valid address", c.From)
+	}
+	if u, err := url.Parse(c.UnsubscribeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("email.unsubscribeURL must be an absolute http or https URL")
+	}
+	if len(c.UnsubscribeSecret) < 16 {
+		return errors.New("email.unsubscribeSecret must be at least 16 characters")
+	}
+	return nil
+}
+
+// password returns Password or the contents of PasswordFile
+func (c EmailConfig) password() (string, error) {
+	if c.PasswordFile == "" {
+		return c.Password, nil
+	}
+	data, err := os.ReadFile(c.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("reading email password: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// EmailSuppression keeps an address from being emailed. The address is
+// kept only as a hash, so suppressions survive erasure of the user.
+type EmailSuppression struct {
+	AddressHash string    `json:"addressHash"`
+	Reason      string    `json:"reason"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// emailAddressHash returns the hash suppressions are recorded under
+func emailAddressHash(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(address))))
+	return hex.EncodeToString(sum[:])
+}
+
+// unsubscribeToken returns the token of the unsubscribe link for an
+// address: its hash and an HMAC of the hash, so links name no address and
+// cannot be forged
+func unsubscribeToken(secret, addressHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(addressHash))
+	return addressHash + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyUnsubscribeToken returns the address hash of a valid token
+func verifyUnsubscribeToken(secret, token string) (string, error) {
+	hash, _, ok := strings.Cut(token, ".")
+	if !ok || secret == "" || !hmac.Equal([]byte(token), []byte(unsubscribeToken(secret, hash))) {
+		return "", errBadUnsubscribe
+	}
+	return hash, nil
+}
+
+// emailContent is what buildEmail renders
+type emailContent struct {
+	From, To    *mail.Address
+	Greeting    string
+	Locale      string
+	Unsubscribe string
+	MessageID   string
+	Date        time.Time
+}
+
+// emailFooter explains why the email was sent; the HTML part links it
+const emailFooter = "You are receiving this because you have an account with Greeter."
+
+var emailHTML = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+<head><meta charset="utf-8"><title>{{.Greeting}}</title></head>
+<body>
+<p>{{.Greeting}}</p>
+<p style="font-size:small;color:#666">{{.Footer}} <a href="{{.Unsubscribe}}">Unsubscribe</a></p>
+</body>
+</html>
+`))
+
+// headerText drops line breaks, which would end a header early
+func headerText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// buildEmail renders a greeting as a multipart/alternative message with
+// plain text and HTML parts and one-click unsubscribe headers (RFC 8058)
+func buildEmail(c emailContent) ([]byte, error) {
+	var html bytes.Buffer
+	err := emailHTML.Execute(&html, map[string]string{
+		"Locale": c.Locale, "Greeting": c.Greeting, "Footer": emailFooter, "Unsubscribe": c.Unsubscribe,
+	})
+	if err != nil {
+		return nil, err
+	}
+	plain := c.Greeting + "\r\n\r\n-- \r\n" + emailFooter + "\r\nUnsubscribe: " + c.Unsubscribe + "\r\n"
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, text string }{
+		{"text/plain; charset=utf-8", plain},
+		{"text/html; charset=utf-8", html.String()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.text)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	from, to := *c.From, *c.To
+	from.Name, to.Name = headerText(from.Name), headerText(to.Name)
+	var msg bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", headerText(c.Greeting))},
+		{"Date", c.Date.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + c.MessageID + ">"},
+		{"MIME-Version", "1.0"},
+		{"List-Unsubscribe", "<" + c.Unsubscribe + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+		{"Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": parts.Boundary()})},
+	} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// sendThrottle spaces sends evenly at a maximum rate
+type sendThrottle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// reserve books the next free slot and returns how long to wait for it
+func (t *sendThrottle) reserve(now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	return wait
+}
+
+// emailMessage is a queued email
+type emailMessage struct {
+	ID          string
+	To          string
+	AddressHash string
+	data        []byte
+	attempts    int
+	// cancelled is set under mailer.mu when the recipient is erased
+	cancelled bool
+}
+
+// mailer sends emails from a pool of workers, no faster than the
+// configured rate. Transient failures are retried with backoff; a
+// permanent rejection of the recipient suppresses the address so it is
+// not mailed again.
+type mailer struct {
+	mu     sync.Mutex
+	timers map[*emailMessage]*time.Timer
+	// pending holds the messages queued or waiting for a retry
+	pending map[*emailMessage]bool
+	closed  bool
+
+	cfg      EmailConfig
+	password string
+	queue    chan *emailMessage
+	throttle *sendThrottle
+	start    sync.Once
+	wg       sync.WaitGroup
+}
+
+// newMailer returns a mailer; workers start with the first email
+func newMailer(cfg EmailConfig, password string) *mailer {
+	return &mailer{
+		timers:   map[*emailMessage]*time.Timer{},
+		pending:  map[*emailMessage]bool{},
+		cfg:      cfg,
+		password: password,
+		queue:    make(chan *emailMessage, cfg.QueueSize),
+		throttle: &sendThrottle{interval: time.Minute / time.Duration(cfg.MaxPerMinute)},
+	}
+}
+
+// emails is the mailer used by the handlers and the scheduler
+var emails = newMailer(DefaultConfig().Email, "")
+
+// Enabled reports whether email delivery is configured
+func (m *mailer) Enabled() bool {
+	return m.cfg.Enabled
+}
+
+// Send queues an email with greeting to user. Users without an address
+// and suppressed addresses are skipped with an error.
+func (m *mailer) Send(ctx context.Context, user UserInfo, greeting, locale string) error {
+	if !m.cfg.Enabled {
+		return errEmailDisabled
+	}
+	if user.Email == "" {
+		return errNoEmail
+	}
+	to, err := mail.ParseAddress(user.Email)
+	if err != nil {
+		return fmt.Errorf("invalid email address: %w", err)
+	}
+	to.Name = user.Name
+	hash := emailAddressHash(to.Address)
+	if _, err := dataStore.GetSuppression(ctx, hash); err == nil {
+		metrics.Add("emails_suppressed", 1)
+		return errEmailSuppressed
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	from, err := mail.ParseAddress(m.cfg.From)
+	if err != nil {
+		return err
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	link, err := url.Parse(m.cfg.UnsubscribeURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", unsubscribeToken(m.cfg.UnsubscribeSecret, hash))
+	link.RawQuery = query.Encode()
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	data, err := buildEmail(emailContent{
+		From:        from,
+		To:          to,
+		Greeting:    greeting,
+		Locale:      locale,
+		Unsubscribe: link.String(),
+		MessageID:   id + "@" + domain,
+		Date:        time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return m.enqueue(&emailMessage{ID: id, To: to.Address, AddressHash: hash, data: data})
+}
+
+// enqueue hands a message to the workers
+func (m *mailer) enqueue(msg *emailMessage) error {
+	m.start.Do(func() {
+		for i := 0; i < m.cfg.Workers; i++ {
+			m.wg.Add(1)
+			go m.work()
+		}
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.timers, msg)
+	if m.closed {
+		return errMailerClosed
+	}
+	if msg.cancelled {
+		return nil
+	}
+	select {
+	case m.queue <- msg:
+		m.pending[msg] = true
+		return nil
+	default:
+		delete(m.pending, msg)
+		metrics.Add("email_failures", 1)
+		return errEmailQueueFull
+	}
+}
+
+// Forget cancels the queued messages and retries for an address hash and
+// returns how many there were; a message being sent still completes
+func (m *mailer) Forget(addressHash string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for msg := range m.pending {
+		if msg.AddressHash != addressHash {
+			continue
+		}
+		msg.cancelled = true
+		if timer, ok := m.timers[msg]; ok {
+			timer.Stop()
+			delete(m.timers, msg)
+		}
+		delete(m.pending, msg)
+		n++
+	}
+	return n
+}
+
+// work sends queued messages at the throttled rate until the queue is
+// closed
+func (m *mailer) work() {
+	defer m.wg.Done()
+	for msg := range m.queue {
+		m.mu.Lock()
+		cancelled := msg.cancelled
+		m.mu.Unlock()
+		if cancelled {
+			continue
+		}
+		time.Sleep(m.throttle.reserve(time.Now()))
+		m.attempt(msg)
+	}
+}
+
+// attempt makes one delivery attempt and schedules a retry, suppresses a
+// rejected address or drops the message. Nothing is kept of a message
+// whose recipient was erased while it was being sent.
+func (m *mailer) attempt(msg *emailMessage) {
+	msg.attempts++
+	err := m.deliver(msg)
+	retry := err != nil && !errors.Is(err, errRecipientRejected) && !permanentSMTPError(err) && msg.attempts < m.cfg.MaxAttempts
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg.cancelled {
+		return
+	}
+	if !retry {
+		delete(m.pending, msg)
+	}
+	switch {
+	case err == nil:
+		metrics.Add("emails_sent", 1)
+	case errors.Is(err, errRecipientRejected):
+		metrics.Add("email_bounces", 1)
+		log.Printf("Email %s bounced, suppressing the address: %v", msg.ID, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.cfg.Timeout))
+		defer cancel()
+		suppression := EmailSuppression{AddressHash: msg.AddressHash, Reason: SuppressionBounced, CreatedAt: time.Now().UTC()}
+		if err := dataStore.SuppressEmail(ctx, suppression); err != nil {
+			log.Printf("Failed to suppress the address of email %s: %v", msg.ID, err)
+		}
+	case !retry:
+		metrics.Add("email_failures", 1)
+		log.Printf("Email %s dropped after %d attempts: %v", msg.ID, msg.attempts, err)
+	default:
+		delay := backoff(msg.attempts, time.Duration(m.cfg.InitialBackoff), time.Duration(m.cfg.MaxBackoff))
+		if !m.closed {
+			m.timers[msg] = time.AfterFunc(delay, func() {
+				if err := m.enqueue(msg); err != nil {
+					log.Printf("Email %s dropped: %v", msg.ID, err)
+				}
+			})
+		}
+	}
+}
+
+// permanentSMTPError reports a 5xx reply, which retrying will not change
+func permanentSMTPError(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
+
+// deliver sends one message in its own SMTP session
+func (m *mailer) deliver(msg *emailMessage) error {
+	timeout := time.Duration(m.cfg.Timeout)
+	address := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	dialer := &net.Dialer{Timeout: timeout}
+	tlsConfig := &tls.Config{ServerName: m.cfg.Host, MinVersion: tls.VersionTLS12}
+
+	var conn net.Conn
+	var err error
+	if m.cfg.TLS == EmailTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if m.cfg.TLS == EmailTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server does not offer STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.cfg.Username, m.password, m.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	from, err := mail.ParseAddress(m.cfg.From)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		if permanentSMTPError(err) {
+			return fmt.Errorf("%w: %v", errRecipientRejected, err)
+		}
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// The message was accepted, so a failed goodbye does not matter
+	_ = client.Quit()
+	return nil
+}
+
+// Close stops sending. Messages in progress finish unless ctx expires
+// first; queued messages and scheduled retries are dropped.
+func (m *mailer) Close(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	for msg, timer := range m.timers {
+		timer.Stop()
+		delete(m.timers, msg)
+	}
+	close(m.queue)
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendWelcomeEmail emails the welcome message to a new user in the locale
+// of r when welcome emails are on
+func sendWelcomeEmail(r *http.Request, rec UserRecord) {
+	if !emails.cfg.Welcome || rec.User.Email == "" {
+		return
+	}
+	catalog := activeConfig.Snapshot().Messages
+	locale := catalog.Locale(r)
+	err := emails.Send(r.Context(), rec.User, catalog.Render(locale, MsgWelcome, rec.User.Name), locale)
+	if err != nil {
+		log.Printf("Welcome email for user %s not sent: %v", rec.ID, err)
+	}
+}
+
+// unsubscribePage confirms before unsubscribing, so mail scanners that
+// follow links in emails do not unsubscribe anyone
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+{{if .Done}}<p>You have been unsubscribed and will not receive further emails.</p>
+{{else}}<form method="post" action="?token={{.Token}}"><p>Stop receiving greetings by email?</p><button type="submit">Unsubscribe</button></form>
+{{end}}</body>
+</html>
+`))
+
+// unsubscribeHandler serves the links in emails. GET shows a confirmation
+// form; POST, which mail clients also send for one-click unsubscribes,
+// suppresses the address.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	token := r.URL.Query().Get("token")
+	hash, err := verifyUnsubscribeToken(emails.cfg.UnsubscribeSecret, token)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	done := r.Method == http.MethodPost
+	if done {
+		suppression := EmailSuppression{AddressHash: hash, Reason: SuppressionUnsubscribed, CreatedAt: time.Now().UTC()}
+		if err := dataStore.SuppressEmail(r.Context(), suppression); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		metrics.Add("email_unsubscribes", 1)
+		audit(r, AuditEmailUnsubscribe, hash, OutcomeCompleted, nil)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := unsubscribePage.Execute(w, map[string]interface{}{"Done": done, "Token": token}); err != nil {
+		log.Printf("Rendering the unsubscribe page failed: %v", err)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testUnsubscribeSecret = "test-unsubscribe-secret"
+
+// receivedEmail is a message accepted by the SMTP stand-in
+type receivedEmail struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// smtpStandIn is a local SMTP server that accepts everything except the
+// recipients given scripted replies
+type smtpStandIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	// replies holds the RCPT replies for an address in order, repeating
+	// the last
+	replies  map[string][]string
+	rcpts    map[string]int
+	received []receivedEmail
+}
+
+// newSMTPStandIn starts a stand-in on a local port
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &smtpStandIn{listener: listener, replies: map[string][]string{}, rcpts: map[string]int{}}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.session(conn)
+		}
+	}()
+	return s
+}
+
+// reply scripts the RCPT replies for an address
+func (s *smtpStandIn) reply(address string, replies ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies[address] = replies
+}
+
+// rcptReply returns the next scripted reply for an address
+func (s *smtpStandIn) rcptReply(address string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.rcpts[address]
+	s.rcpts[address]++
+	replies := s.replies[address]
+	switch {
+	case len(replies) == 0:
+		return "250 OK"
+	case n < len(replies):
+		return replies[n]
+	default:
+		return replies[len(replies)-1]
+	}
+}
+
+// attempts returns how often an address was given as a recipient
+func (s *smtpStandIn) attempts(address string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rcpts[address]
+}
+
+// messages returns the accepted messages
+func (s *smtpStandIn) messages() []receivedEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedEmail{}, s.received...)
+}
+
+func (s *smtpStandIn) session(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	address := func(arg string) string {
+		_, rest, _ := strings.Cut(arg, "<")
+		addr, _, _ := strings.Cut(rest, ">")
+		return addr
+	}
+
+	_ = tp.PrintfLine("220 greeter-test ESMTP")
+	var msg receivedEmail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 greeter-test")
+		case "MAIL":
+			msg = receivedEmail{from: address(arg)}
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			rcpt := address(arg)
+			reply := s.rcptReply(rcpt)
+			if strings.HasPrefix(reply, "250") {
+				msg.to = append(msg.to, rcpt)
+			}
+			_ = tp.PrintfLine("%s", reply)
+		case "DATA":
+			_ = tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			if msg.data, err = tp.ReadDotBytes(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received = append(s.received, msg)
+			s.mu.Unlock()
+			_ = tp.PrintfLine("250 Queued")
+		case "RSET", "NOOP":
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 Bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// useMailer swaps in a mailer sending to the stand-in with fast retries
+func useMailer(t *testing.T, server *smtpStandIn, welcome bool) *mailer {
+	t.Helper()
+	cfg := DefaultConfig().Email
+	cfg.Enabled, cfg.Welcome = true, welcome
+	cfg.Host, cfg.Port, cfg.TLS = "127.0.0.1", server.listener.Addr().(*net.TCPAddr).Port, EmailTLSNone
+	cfg.From = "Greeter <greeter@example.com>"
+	cfg.UnsubscribeURL = "https://greeter.example.com/greeter/email/unsubscribe"
+	cfg.UnsubscribeSecret = testUnsubscribeSecret
+	cfg.Timeout = Duration(2 * time.Second)
+	cfg.MaxAttempts = 3
+	cfg.InitialBackoff, cfg.MaxBackoff = Duration(time.Millisecond), Duration(5*time.Millisecond)
+	cfg.MaxPerMinute = 60000
+	m := newMailer(cfg, "")
+	previous := emails
+	emails = m
+	t.Cleanup(func() {
+		_ = m.Close(context.Background())
+		emails = previous
+	})
+	return m
+}
+
+// emailParts reads a received message and the decoded text of its parts
+func emailParts(t *testing.T, data []byte) (*mail.Message, map[string]string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("Failed to parse the email: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Expected multipart/alternative, got %q", msg.Header.Get("Content-Type"))
+	}
+	parts := map[string]string{}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read a part: %v", err)
+		}
+		text, _ := io.ReadAll(part)
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(text)
+	}
+	return msg, parts
+}
+
+// TestBuildEmail tests the headers and the plain and HTML parts of emails
+func TestBuildEmail(t *testing.T) {
+	data, err := buildEmail(emailContent{
+		From:        &mail.Address{Name: "Greeter", Address: "greeter@example.com"},
+		To:          &mail.Address{Name: "Zoë <b>", Address: "zoe@example.com"},
+		Greeting:    "Welcome, Zoë <b>!\r\nBcc: evil@example.com",
+		Locale:      "fr",
+		Unsubscribe: "https://greeter.example.com/greeter/email/unsubscribe?token=abc",
+		MessageID:   "1@example.com",
+		Date:        time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	msg, parts := emailParts(t, data)
+
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	to, err := mail.ParseAddress(msg.Header.Get("To"))
+	if err != nil {
+		t.Fatalf("Failed to parse the recipient: %v", err)
+	}
+	testCases := []struct {
+		name     string
+		expected string
+		got      string
+	}{
+		{"Subject on one line", "Welcome, Zoë <b>!  Bcc: evil@example.com", subject},
+		{"Recipient", "zoe@example.com", to.Address},
+		{"Recipient name", "Zoë <b>", to.Name},
+		{"No injected header", "", msg.Header.Get("Bcc")},
+		{"Unsubscribe header", "<https://greeter.example.com/greeter/email/unsubscribe?token=abc>", msg.Header.Get("List-Unsubscribe")},
+		{"One-click unsubscribe", "List-Unsubscribe=One-Click", msg.Header.Get("List-Unsubscribe-Post")},
+		{"Message ID", "<1@example.com>", msg.Header.Get("Message-ID")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, tc.got)
+			}
+		})
+	}
+
+	t.Run("Parts", func(t *testing.T) {
+		plain, html := parts["text/plain"], parts["text/html"]
+		if !strings.HasPrefix(plain, "Welcome, Zoë <b>!") || !strings.Contains(plain, "Unsubscribe: https://greeter.example.com/") {
+			t.Errorf("Unexpected plain part %q", plain)
+		}
+		if !strings.Contains(html, "Welcome, Zoë &lt;b&gt;!") || strings.Contains(html, "<b>") ||
+			!strings.Contains(html, `lang="fr"`) || !strings.Contains(html, `href="https://greeter.example.com/greeter/email/unsubscribe?token=abc"`) {
+			t.Errorf("Unexpected HTML part %q", html)
+		}
+	})
+}
+
+// TestUnsubscribeToken tests that tokens verify only unchanged and with
+// the secret that signed them
+func TestUnsubscribeToken(t *testing.T) {
+	hash := emailAddressHash("John@Example.com ")
+	token := unsubscribeToken(testUnsubscribeSecret, hash)
+	other := unsubscribeToken(testUnsubscribeSecret, emailAddressHash("jane@example.com"))
+	_, otherMAC, _ := strings.Cut(other, ".")
+
+	testCases := []struct {
+		name        string
+		secret      string
+		token       string
+		expectValid bool
+	}{
+		{"Valid", testUnsubscribeSecret, token, true},
+		{"Other secret", "another-secret-value", token, false},
+		{"Swapped signature", testUnsubscribeSecret, hash + "." + otherMAC, false},
+		{"No signature", testUnsubscribeSecret, hash, false},
+		{"Empty", testUnsubscribeSecret, "", false},
+		{"No secret", "", token, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := verifyUnsubscribeToken(tc.secret, tc.token)
+			if tc.expectValid && (err != nil || got != emailAddressHash("john@example.com")) {
+				t.Errorf("Expected the address hash, got %q, %v", got, err)
+			}
+			if !tc.expectValid && !errors.Is(err, errBadUnsubscribe) {
+				t.Errorf("Expected errBadUnsubscribe, got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// TestSendThrottle tests that sends are spaced evenly
+func TestSendThrottle(t *testing.T) {
+	throttle := &sendThrottle{interval: time.Second}
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name         string
+		at           time.Time
+		expectedWait time.Duration
+	}{
+		{"First send", start, 0},
+		{"Burst", start, time.Second},
+		{"Burst continues", start.Add(500 * time.Millisecond), 1500 * time.Millisecond},
+		{"After a pause", start.Add(time.Minute), 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if wait := throttle.reserve(tc.at); wait != tc.expectedWait {
+				t.Errorf("Expected a wait of %v, got %v", tc.expectedWait, wait)
+			}
+		})
+	}
+}
+
+// TestWelcomeEmail tests that new users with an address get the welcome
+// greeting by email
+func TestWelcomeEmail(t *testing.T) {
+	useStore(t)
+	server := newSMTPStandIn(t)
+	useMailer(t, server, true)
+
+	createTestUser(t, UserInfo{Name: "Nobody"})
+	createTestUser(t, UserInfo{Name: "John", Email: "john@example.com"})
+	waitFor(t, "the welcome email", func() bool { return len(server.messages()) == 1 })
+
+	received := server.messages()[0]
+	if received.from != "greeter@example.com" || len(received.to) != 1 || received.to[0] != "john@example.com" {
+		t.Errorf("Unexpected envelope %s -> %v", received.from, received.to)
+	}
+	msg, parts := emailParts(t, received.data)
+	if subject := msg.Header.Get("Subject"); subject != "Welcome to Greeter, John!" {
+		t.Errorf("Expected the welcome subject, got %q", subject)
+	}
+	if !strings.HasPrefix(parts["text/plain"], "Welcome to Greeter, John!") || !strings.Contains(parts["text/html"], "Welcome to Greeter, John!") {
+		t.Errorf("Expected the welcome greeting in both parts, got %v", parts)
+	}
+}
+
+// TestEmailRetries tests retries of transient failures and suppression of
+// rejected recipients
+func TestEmailRetries(t *testing.T) {
+	store := useStore(t)
+	server := newSMTPStandIn(t)
+	m := useMailer(t, server, false)
+	server.reply("busy@example.com", "451 4.3.0 Try again later", "250 OK")
+	server.reply("down@example.com", "421 4.3.2 Service not available")
+	server.reply("gone@example.com", "550 5.1.1 No such user")
+
+	testCases := []struct {
+		address          string
+		expectedAttempts int
+		expectDelivered  bool
+		expectSuppressed bool
+	}{
+		{"busy@example.com", 2, true, false},
+		{"down@example.com", 3, false, false},
+		{"gone@example.com", 1, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.address, func(t *testing.T) {
+			if err := m.Send(context.Background(), UserInfo{Name: "John", Email: tc.address}, "Hello, John!", "en"); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			waitFor(t, "the attempts", func() bool { return server.attempts(tc.address) == tc.expectedAttempts })
+			time.Sleep(20 * time.Millisecond)
+			if n := server.attempts(tc.address); n != tc.expectedAttempts {
+				t.Errorf("Expected %d attempts, got %d", tc.expectedAttempts, n)
+			}
+
+			delivered := false
+			for _, msg := range server.messages() {
+				delivered = delivered || msg.to[0] == tc.address
+			}
+			if delivered != tc.expectDelivered {
+				t.Errorf("Expected delivered %v, got %v", tc.expectDelivered, delivered)
+			}
+			_, err := store.GetSuppression(context.Background(), emailAddressHash(tc.address))
+			if suppressed := err == nil; suppressed != tc.expectSuppressed {
+				t.Errorf("Expected suppressed %v, got %v", tc.expectSuppressed, suppressed)
+			}
+		})
+	}
+
+	err := m.Send(context.Background(), UserInfo{Name: "John", Email: "gone@example.com"}, "Hello, John!", "en")
+	if !errors.Is(err, errEmailSuppressed) {
+		t.Errorf("Expected errEmailSuppressed for the bounced address, got %v", err)
+	}
+}
+
+// TestUnsubscribe tests the confirmation page and the unsubscribe itself
+func TestUnsubscribe(t *testing.T) {
+	store := useStore(t)
+	m := useMailer(t, newSMTPStandIn(t), false)
+	hash := emailAddressHash("john@example.com")
+	target := "/greeter/email/unsubscribe?token=" + unsubscribeToken(testUnsubscribeSecret, hash)
+
+	testCases := []struct {
+		name             string
+		method           string
+		target           string
+		expectedStatus   int
+		expectedBody     string
+		expectSuppressed bool
+	}{
+		{"Confirmation page", http.MethodGet, target, http.StatusOK, `<form method="post"`, false},
+		{"Forged token", http.MethodPost, "/greeter/email/unsubscribe?token=" + hash + ".forged", http.StatusBadRequest, "invalid unsubscribe token", false},
+		{"Wrong method", http.MethodDelete, target, http.StatusMethodNotAllowed, "not allowed", false},
+		{"One-click unsubscribe", http.MethodPost, target, http.StatusOK, "You have been unsubscribed", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader("List-Unsubscribe=One-Click"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			unsubscribeHandler(w, req)
+			if w.Code != tc.expectedStatus || !strings.Contains(w.Body.String(), tc.expectedBody) {
+				t.Errorf("Expected %d with %q, got %d: %s", tc.expectedStatus, tc.expectedBody, w.Code, w.Body.String())
+			}
+			_, err := store.GetSuppression(context.Background(), hash)
+			if suppressed := err == nil; suppressed != tc.expectSuppressed {
+				t.Errorf("Expected suppressed %v, got %v", tc.expectSuppressed, suppressed)
+			}
+		})
+	}
+
+	err := m.Send(context.Background(), UserInfo{Name: "John", Email: "John@example.com"}, "Hello, John!", "en")
+	if !errors.Is(err, errEmailSuppressed) {
+		t.Errorf("Expected errEmailSuppressed after unsubscribing, got %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event publishers
+const (
+	// PublisherNone discards relayed events
+	PublisherNone = "none"
+	// PublisherLog writes each event as a line of CloudEvents JSON to
+	// standard output, for a log shipper to forward to a broker
+	PublisherLog = "log"
+	// PublisherHTTP posts each event to events.url in CloudEvents
+	// structured mode, for sinks such as a Knative broker or an HTTP
+	// bridge to Kafka
+	PublisherHTTP = "http"
+)
+
+// CloudEventsContentType is the media type of structured-mode CloudEvents
+const CloudEventsContentType = "application/cloudevents+json; charset=utf-8"
+
+// CloudEventsSpecVersion is the CloudEvents version of published envelopes
+const CloudEventsSpecVersion = "1.0"
+
+// maxRelayBackoff caps the wait between relay passes while publishing fails
+const maxRelayBackoff = time.Minute
+
+// EventsConfig controls publishing of outbox events to a message broker
+type EventsConfig struct {
+	Publisher string `json:"publisher"`
+	// Source is the CloudEvents source of every event
+	Source string `json:"source"`
+	// Topic is the broker topic events are published to
+	Topic string `json:"topic"`
+	// PollInterval is how often the outbox is checked for events committed
+	// by other instances or left over from failed passes
+	PollInterval Duration `json:"pollInterval"`
+	// BatchSize caps the events read from the outbox per pass
+	BatchSize int `json:"batchSize"`
+	// URL receives the events of the http publisher
+	URL string `json:"url,omitempty"`
+	// Timeout bounds each request of the http publisher
+	Timeout Duration `json:"timeout"`
+}
+
+// Validate checks the event publishing settings
+func (c EventsConfig) Validate() error {
+	switch {
+	case c.Publisher != PublisherNone && c.Publisher != PublisherLog && c.Publisher != PublisherHTTP:
+		return fmt.Errorf("events.publisher %q is not supported", c.Publisher)
+	case c.Publisher == PublisherHTTP && !absoluteHTTPURL(c.URL):
+		return errors.New("events.url must be an absolute http or https URL for the http publisher")
+	case c.Timeout <= 0:
+		return errors.New("events.timeout must be positive")
+	case c.Source == "":
+		return errors.New("events.source is required")
+	case c.Topic == "":
+		return errors.New("events.topic is required")
+	case c.PollInterval <= 0:
+		return errors.New("events.pollInterval must be positive")
+	case c.BatchSize <= 0:
+		return errors.New("events.batchSize must be positive")
+	}
+	return nil
+}
+
+// absoluteHTTPURL reports whether raw is an absolute http or https URL
+func absoluteHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// OutboxEvent is an event committed in the same transaction as the change
+// it describes, waiting to be published
+type OutboxEvent struct {
+	ID   string
+	Type string
+	// Subject is the ID of the record the event is about
+	Subject string
+	Time    time.Time
+	Data    json.RawMessage
+}
+
+// userCreatedEvent returns the outbox event for a new user. Published
+// events outlive erasure requests, so it only holds the masked record.
+func userCreatedEvent(rec UserRecord) (OutboxEvent, error) {
+	id, err := newID()
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	masked := rec
+	masked.User = maskPII(rec.User)
+	data, err := json.Marshal(masked)
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	return OutboxEvent{ID: id, Type: EventUserCreated, Subject: rec.ID, Time: rec.CreatedAt, Data: data}, nil
+}
+
+// CloudEvent is a CloudEvents 1.0 envelope in structured JSON mode
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// newCloudEvent wraps an outbox event. The ID is kept so consumers can
+// drop the duplicates at-least-once delivery may produce.
+func newCloudEvent(source string, e OutboxEvent) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              e.ID,
+		Source:          source,
+		Type:            e.Type,
+		Subject:         e.Subject,
+		Time:            e.Time.UTC(),
+		DataContentType: "application/json",
+		Data:            e.Data,
+	}
+}
+
+// EventPublisher sends events to a message broker such as Kafka or NATS
+type EventPublisher interface {
+	// Publish returns once the broker has accepted the event
+	Publish(ctx context.Context, topic string, event CloudEvent) error
+	Close() error
+}
+
+// openPublisher returns the publisher selected by cfg
+func openPublisher(cfg EventsConfig) (EventPublisher, error) {
+	switch cfg.Publisher {
+	case PublisherNone:
+		return discardPublisher{}, nil
+	case PublisherLog:
+		return newLogPublisher(os.Stdout), nil
+	case PublisherHTTP:
+		return newHTTPPublisher(cfg.URL, time.Duration(cfg.Timeout)), nil
+	default:
+		return nil, fmt.Errorf("unknown event publisher %q", cfg.Publisher)
+	}
+}
+
+// discardPublisher accepts and drops every event
+type discardPublisher struct{}
+
+func (discardPublisher) Publish(context.Context, string, CloudEvent) error { return nil }
+
+func (discardPublisher) Close() error { return nil }
+
+// logPublisher writes events as JSON lines
+type logPublisher struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newLogPublisher(w io.Writer) *logPublisher {
+	return &logPublisher{enc: json.NewEncoder(w)}
+}
+
+func (p *logPublisher) Publish(ctx context.Context, topic string, event CloudEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enc.Encode(event)
+}
+
+func (p *logPublisher) Close() error { return nil }
+
+// httpPublisher posts events to a CloudEvents HTTP sink. The sink accepts
+// an event by answering with a 2xx status. The URL picks the destination,
+// so the topic is not sent.
+type httpPublisher struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+func newHTTPPublisher(target string, timeout time.Duration) *httpPublisher {
+	return &httpPublisher{url: target, timeout: timeout, client: &http.Client{}}
+}
+
+func (p *httpPublisher) Publish(ctx context.Context, topic string, event CloudEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", CloudEventsContentType)
+	req.Header.Set("User-Agent", "greeter-events/"+AppVersion)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sink answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *httpPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// outboxRelay moves events from the outbox to the publisher. An event is
+// removed from the outbox only after the broker accepted it, so a crash or
+// failed removal publishes it again: delivery is at least once. Events are
+// published in the order they were written and a failure holds back the
+// events after it.
+type outboxRelay struct {
+	store     OutboxStore
+	publisher EventPublisher
+	cfg       EventsConfig
+
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func newOutboxRelay(store OutboxStore, publisher EventPublisher, cfg EventsConfig) *outboxRelay {
+	return &outboxRelay{
+		store:     store,
+		publisher: publisher,
+		cfg:       cfg,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// eventRelay is the relay of the data store's outbox
+var eventRelay = newOutboxRelay(dataStore, discardPublisher{}, DefaultConfig().Events)
+
+// Start runs the relay in the background until Close
+func (r *outboxRelay) Start() {
+	r.startOnce.Do(func() { go r.run() })
+}
+
+// Notify wakes the relay after events were committed, so they go out
+// without waiting for the next poll
+func (r *outboxRelay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run relays events until stopped, backing off while publishing fails
+func (r *outboxRelay) run() {
+	defer close(r.done)
+	failures := 0
+	for {
+		n, err := r.relay(context.Background())
+		wait := time.Duration(r.cfg.PollInterval)
+		switch {
+		case err != nil:
+			failures++
+			wait = backoff(failures, wait, maxRelayBackoff)
+			log.Printf("Event relay failed, retrying in %v: %v", wait.Round(time.Millisecond), err)
+		case n == r.cfg.BatchSize:
+			// More may be waiting
+			failures, wait = 0, 0
+		default:
+			failures = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-r.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// relay publishes one batch of pending events, returning how many were
+// published
+func (r *outboxRelay) relay(ctx context.Context) (int, error) {
+	events, err := r.store.PendingEvents(ctx, r.cfg.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("reading the outbox: %w", err)
+	}
+
+	published := make([]string, 0, len(events))
+	var publishErr error
+	for _, e := range events {
+		if err := r.publisher.Publish(ctx, r.cfg.Topic, newCloudEvent(r.cfg.Source, e)); err != nil {
+			metrics.Add("events_publish_failures", 1)
+			publishErr = fmt.Errorf("publishing event %s: %w", e.ID, err)
+			break
+		}
+		published = append(published, e.ID)
+	}
+	if len(published) > 0 {
+		metrics.Add("events_published", int64(len(published)))
+		if err := r.store.DeleteEvents(ctx, published); err != nil {
+			return 0, fmt.Errorf("removing published events: %w", err)
+		}
+	}
+	return len(published), publishErr
+}
+
+// Close stops the relay, publishes what is left in the outbox while ctx
+// allows and closes the publisher
+func (r *outboxRelay) Close(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	r.startOnce.Do(func() { close(r.done) })
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var err error
+	for err == nil && ctx.Err() == nil {
+		var n int
+		if n, err = r.relay(ctx); n < r.cfg.BatchSize {
+			break
+		}
+	}
+	if closeErr := r.publisher.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryBroker is an in-process broker. Subscribers receive
+// events published after they subscribed; Publish waits for each of them
+// to take the event.
+type memoryBroker struct {
+	mu          sync.Mutex
+	topics      map[string][]CloudEvent
+	subscribers map[string][]chan CloudEvent
+	closed      bool
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{topics: map[string][]CloudEvent{}, subscribers: map[string][]chan CloudEvent{}}
+}
+
+// Subscribe returns a channel of the events published to topic, closed
+// when the broker is
+func (b *memoryBroker) Subscribe(topic string, buffer int) <-chan CloudEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan CloudEvent, buffer)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subscribers[topic] = append(b.subscribers[topic], ch)
+	return ch
+}
+
+// Events returns every event published to topic, oldest first
+func (b *memoryBroker) Events(topic string) []CloudEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]CloudEvent(nil), b.topics[topic]...)
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, topic string, event CloudEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("broker is closed")
+	}
+	for _, ch := range b.subscribers[topic] {
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	b.topics[topic] = append(b.topics[topic], event)
+	return nil
+}
+
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		for _, subs := range b.subscribers {
+			for _, ch := range subs {
+				close(ch)
+			}
+		}
+	}
+	return nil
+}
+
+// testEventsConfig relays small batches and polls rarely, so tests see
+// what Notify and explicit passes do
+func testEventsConfig() EventsConfig {
+	cfg := DefaultConfig().Events
+	cfg.BatchSize = 2
+	cfg.PollInterval = Duration(time.Hour)
+	return cfg
+}
+
+// flakyPublisher forwards to a broker, failing once it has accepted limit
+// events until limit is raised
+type flakyPublisher struct {
+	*memoryBroker
+	mu    sync.Mutex
+	limit int
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, topic string, event CloudEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.Events(topic)) >= p.limit {
+		return errors.New("broker unavailable")
+	}
+	return p.memoryBroker.Publish(ctx, topic, event)
+}
+
+// createStoreUsers creates users directly in the store
+func createStoreUsers(t *testing.T, store Store, names ...string) []UserRecord {
+	t.Helper()
+	users := make([]UserInfo, len(names))
+	for i, name := range names {
+		users[i] = UserInfo{Name: name, Email: name + "@example.com"}
+	}
+	recs, err := store.CreateUsers(context.Background(), users)
+	if err != nil {
+		t.Fatalf("Failed to create users: %v", err)
+	}
+	return recs
+}
+
+// TestOutboxRelay tests that relay passes publish CloudEvents in order and
+// hold back events after a failure
+func TestOutboxRelay(t *testing.T) {
+	store := newMemoryStore(DefaultConfig().Storage)
+	publisher := &flakyPublisher{memoryBroker: newMemoryBroker(), limit: 1}
+	relay := newOutboxRelay(store, publisher, testEventsConfig())
+	recs := createStoreUsers(t, store, "john", "jane", "jim")
+	topic := relay.cfg.Topic
+
+	testCases := []struct {
+		name              string
+		limit             int
+		expectedRelayed   int
+		expectError       bool
+		expectedPublished int
+	}{
+		{"Broker fails after one event", 1, 1, true, 1},
+		{"Broker still down", 1, 0, true, 1},
+		{"Broker back", 10, 2, false, 3},
+		{"Nothing left", 10, 0, false, 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			publisher.mu.Lock()
+			publisher.limit = tc.limit
+			publisher.mu.Unlock()
+
+			n, err := relay.relay(context.Background())
+			if n != tc.expectedRelayed || (err != nil) != tc.expectError {
+				t.Errorf("Expected %d relayed and error %v, got %d, %v", tc.expectedRelayed, tc.expectError, n, err)
+			}
+			if published := publisher.Events(topic); len(published) != tc.expectedPublished {
+				t.Errorf("Expected %d published, got %d", tc.expectedPublished, len(published))
+			}
+		})
+	}
+
+	published := publisher.Events(topic)
+	for i, event := range published {
+		if event.Subject != recs[i].ID {
+			t.Errorf("Expected event %d to be about %s, got %s", i, recs[i].ID, event.Subject)
+		}
+		if event.SpecVersion != "1.0" || event.Type != EventUserCreated || event.Source != "/greeter" ||
+			event.ID == "" || event.DataContentType != "application/json" || !event.Time.Equal(recs[i].CreatedAt) {
+			t.Errorf("Unexpected envelope %+v", event)
+		}
+	}
+	var data UserRecord
+	if err := json.Unmarshal(published[0].Data, &data); err != nil || data.ID != recs[0].ID || data.User.Email != "j***@example.com" {
+		t.Errorf("Expected the masked record, got %s", published[0].Data)
+	}
+	if pending, _ := store.PendingEvents(context.Background(), 10); len(pending) != 0 {
+		t.Errorf("Expected an empty outbox, got %d events", len(pending))
+	}
+}
+
+// TestOutboxRelayBackground tests that creating a user through the API
+// wakes the running relay
+func TestOutboxRelayBackground(t *testing.T) {
+	store := useStore(t)
+	broker := newMemoryBroker()
+	relay := newOutboxRelay(store, broker, testEventsConfig())
+	events := broker.Subscribe(relay.cfg.Topic, 1)
+	previous := eventRelay
+	eventRelay = relay
+	t.Cleanup(func() { eventRelay = previous })
+	relay.Start()
+	defer relay.Close(context.Background())
+
+	id := createTestUser(t, UserInfo{Name: "John"})
+	select {
+	case event := <-events:
+		if event.Subject != id {
+			t.Errorf("Expected an event about %s, got %+v", id, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the event")
+	}
+}
+
+// TestOutboxRelayClose tests that closing publishes what is left in the
+// outbox and closes the publisher
+func TestOutboxRelayClose(t *testing.T) {
+	store := newMemoryStore(DefaultConfig().Storage)
+	broker := newMemoryBroker()
+	relay := newOutboxRelay(store, broker, testEventsConfig())
+	createStoreUsers(t, store, "john", "jane", "jim")
+
+	if err := relay.Close(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if published := broker.Events(relay.cfg.Topic); len(published) != 3 {
+		t.Errorf("Expected 3 events published on close, got %d", len(published))
+	}
+	if err := broker.Publish(context.Background(), relay.cfg.Topic, CloudEvent{}); err == nil {
+		t.Error("Expected the broker to be closed")
+	}
+}
+
+// TestLogPublisher tests that events are written as JSON lines
+func TestLogPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	publisher := newLogPublisher(&buf)
+	event := newCloudEvent("/greeter", OutboxEvent{ID: "1", Type: EventUserCreated, Subject: "u1", Time: time.Now(), Data: json.RawMessage(`{"id":"u1"}`)})
+	for i := 0; i < 2; i++ {
+		if err := publisher.Publish(context.Background(), "greeter.events", event); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	var decoded map[string]interface{}
+	if len(lines) != 2 || json.Unmarshal(lines[0], &decoded) != nil {
+		t.Fatalf("Expected 2 JSON lines, got %q", buf.String())
+	}
+	if decoded["specversion"] != "1.0" || decoded["subject"] != "u1" || decoded["data"].(map[string]interface{})["id"] != "u1" {
+		t.Errorf("Unexpected event %s", lines[0])
+	}
+}
+
+// TestHTTPPublisher tests that events are posted to the sink in CloudEvents
+// structured mode and that a refused event is kept in the outbox
+func TestHTTPPublisher(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusAccepted
+	var received []*http.Request
+	var bodies [][]byte
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received, bodies = append(received, r), append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer sink.Close()
+
+	cfg := testEventsConfig()
+	cfg.Publisher, cfg.URL = PublisherHTTP, sink.URL
+	publisher, err := openPublisher(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store := newMemoryStore(DefaultConfig().Storage)
+	relay := newOutboxRelay(store, publisher, cfg)
+	recs := createStoreUsers(t, store, "john")
+
+	testCases := []struct {
+		name            string
+		status          int
+		expectError     bool
+		expectedPending int
+	}{
+		{"Sink refuses", http.StatusServiceUnavailable, true, 1},
+		{"Sink accepts", http.StatusAccepted, false, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			status = tc.status
+			mu.Unlock()
+			if _, err := relay.relay(context.Background()); (err != nil) != tc.expectError {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+			if pending, _ := store.PendingEvents(context.Background(), 10); len(pending) != tc.expectedPending {
+				t.Errorf("Expected %d pending events, got %d", tc.expectedPending, len(pending))
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(received))
+	}
+	if received[1].Method != http.MethodPost || received[1].Header.Get("Content-Type") != CloudEventsContentType {
+		t.Errorf("Expected a CloudEvents POST, got %s with %q", received[1].Method, received[1].Header.Get("Content-Type"))
+	}
+	var event CloudEvent
+	if err := json.Unmarshal(bodies[1], &event); err != nil || event.SpecVersion != "1.0" || event.Type != EventUserCreated || event.Subject != recs[0].ID {
+		t.Errorf("Expected the user.created event, got %s", bodies[1])
+	}
+	if err := relay.Close(context.Background()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+// TestHTTPPublisherTimeout tests that a slow sink fails the event
+func TestHTTPPublisherTimeout(t *testing.T) {
+	release := make(chan struct{})
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer sink.Close()
+	defer close(release)
+
+	publisher := newHTTPPublisher(sink.URL, 50*time.Millisecond)
+	event := newCloudEvent("/greeter", OutboxEvent{ID: "1", Type: EventUserCreated, Time: time.Now(), Data: json.RawMessage(`{}`)})
+	if err := publisher.Publish(context.Background(), "greeter.events", event); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
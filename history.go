@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Greeting types recorded in the history
+const (
+	GreetingGreet     = "greet"
+	GreetingFarewell  = "farewell"
+	GreetingTimeGreet = "time-greet"
+	GreetingBulkGreet = "bulk-greet"
+	GreetingScheduled = "scheduled"
+)
+
+// Stats window defaults and limits
+const (
+	DefaultStatsWindow = 7 * 24 * time.Hour
+	MaxStatsWindow     = 366 * 24 * time.Hour
+	DefaultTopNames    = 10
+	MaxTopNames        = 100
+)
+
+// recordGreeting adds a greeting for name to the history and notifies
+// webhook subscribers; an empty name is a greeting to the default name.
+// Failures are logged and never fail the greeting itself.
+func recordGreeting(r *http.Request, kind, name string) {
+	event := GreetingEvent{
+		Type:   kind,
+		Locale: activeConfig.Snapshot().Messages.Locale(r),
+		Client: principalFrom(r.Context()).ID,
+		Time:   time.Now().UTC(),
+	}
+	if name != "" {
+		event.NameHash = nameHash(name)
+	}
+	recordGreetingEvent(r.Context(), event)
+}
+
+// recordGreetingEvent stores event and notifies webhook subscribers with
+// the public name hash, logging failures
+func recordGreetingEvent(ctx context.Context, event GreetingEvent) {
+	if err := dataStore.RecordGreeting(ctx, event); err != nil {
+		log.Printf("Failed to record %s greeting: %v", event.Type, err)
+	}
+	published := event
+	published.NameHash = publicNameHash(event.NameHash)
+	webhooks.Publish(EventGreetingIssued, webhookSubject{UserID: event.UserID}, published, published)
+}
+
+// parseWindow reads a window such as 24h, 7d or 30d
+func parseWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseStatsQuery reads the stats window and ranking size. The window ends
+// at until, or now, and covers either the window parameter or everything
+// since the since parameter.
+func parseStatsQuery(values url.Values, now time.Time) (StatsQuery, error) {
+	q := StatsQuery{Until: now.UTC(), Top: DefaultTopNames}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := values.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*dst = t.UTC()
+		}
+	}
+
+	if s := values.Get("window"); s != "" {
+		if !q.Since.IsZero() {
+			return q, fmt.Errorf("window cannot be combined with since")
+		}
+		window, err := parseWindow(s)
+		if err != nil || window <= 0 {
+			return q, fmt.Errorf("window must be a positive duration such as 24h or 7d")
+		}
+		q.Since = q.Until.Add(-window)
+	} else if q.Since.IsZero() {
+		q.Since = q.Until.Add(-DefaultStatsWindow)
+	}
+	if !q.Since.Before(q.Until) {
+		return q, fmt.Errorf("since must be before until")
+	}
+	if q.Until.Sub(q.Since) > MaxStatsWindow {
+		return q, fmt.Errorf("the window must not exceed %d days", MaxStatsWindow/(24*time.Hour))
+	}
+
+	if s := values.Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxTopNames {
+			return q, fmt.Errorf("top must be between 1 and %d", MaxTopNames)
+		}
+		q.Top = n
+	}
+	return q, nil
+}
+
+// greetingStats reports greeting counts by type, locale, client and hour of
+// day, and the public hashes of the most greeted names, over a time window
+func greetingStats(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStatsQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stats, err := dataStore.GreetingStats(r.Context(), q)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	for i := range stats.TopNames {
+		stats.TopNames[i].NameHash = publicNameHash(stats.TopNames[i].NameHash)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
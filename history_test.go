@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestRecordGreetings tests that every greeting endpoint records its
+// greetings with the caller as the client
+func TestRecordGreetings(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"auth": {"apiKeys": [
+		{"principal": "mobile-app", "sha256": "`+sha256Hex("mobile-key")+`"}
+	]}}`))
+
+	testCases := []struct {
+		name          string
+		handler       http.HandlerFunc
+		target        string
+		expectedType  string
+		expectedNames []string
+	}{
+		{"Greet", greet, "/greeter/greet?name=John", GreetingGreet, []string{"John"}},
+		{"Greet without a name", greet, "/greeter/greet", GreetingGreet, []string{""}},
+		{"Farewell", farewell, "/greeter/farewell?name=John", GreetingFarewell, []string{"John"}},
+		{"Time greet", timeBasedGreet, "/greeter/time-greet?name=John", GreetingTimeGreet, []string{"John"}},
+		{"Bulk greet", bulkGreet, "/greeter/bulk-greet?names=John,,Jane", GreetingBulkGreet, []string{"John", "Jane"}},
+		{"Bulk greet without names", bulkGreet, "/greeter/bulk-greet?names=,", GreetingBulkGreet, []string{""}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := useStore(t)
+			req := httptest.NewRequest("GET", tc.target, nil)
+			req.Header.Set("X-API-Key", "mobile-key")
+			authenticate(tc.handler).ServeHTTP(httptest.NewRecorder(), req)
+
+			store.mu.RLock()
+			events := append([]GreetingEvent(nil), store.greetings...)
+			store.mu.RUnlock()
+			if len(events) != len(tc.expectedNames) {
+				t.Fatalf("Expected %d events, got %d", len(tc.expectedNames), len(events))
+			}
+			for i, e := range events {
+				expectedHash := ""
+				if tc.expectedNames[i] != "" {
+					expectedHash = nameHash(tc.expectedNames[i])
+				}
+				if e.Type != tc.expectedType || e.NameHash != expectedHash || e.Client != "mobile-app" || e.Locale == "" {
+					t.Errorf("Unexpected event %+v", e)
+				}
+			}
+		})
+	}
+}
+
+// TestParseStatsQuery tests the stats window parameters
+func TestParseStatsQuery(t *testing.T) {
+	now := time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		query         string
+		expectedSince time.Time
+		expectedUntil time.Time
+		expectedError bool
+	}{
+		{"", now.Add(-7 * 24 * time.Hour), now, false},
+		{"window=24h", now.Add(-24 * time.Hour), now, false},
+		{"window=30d", now.Add(-30 * 24 * time.Hour), now, false},
+		{"since=2026-03-01T00:00:00Z&until=2026-03-02T00:00:00Z", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), false},
+		{"until=2026-03-02T00:00:00Z&window=1d", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), false},
+		{"window=0d", time.Time{}, time.Time{}, true},
+		{"window=week", time.Time{}, time.Time{}, true},
+		{"window=400d", time.Time{}, time.Time{}, true},
+		{"window=1d&since=2026-03-01T00:00:00Z", time.Time{}, time.Time{}, true},
+		{"since=2026-03-10T00:00:00Z", time.Time{}, time.Time{}, true},
+		{"since=yesterday", time.Time{}, time.Time{}, true},
+		{"top=0", time.Time{}, time.Time{}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(tc.query)
+			q, err := parseStatsQuery(values, now)
+			if tc.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got %+v", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !q.Since.Equal(tc.expectedSince) || !q.Until.Equal(tc.expectedUntil) {
+				t.Errorf("Expected %v to %v, got %v to %v", tc.expectedSince, tc.expectedUntil, q.Since, q.Until)
+			}
+		})
+	}
+}
+
+// TestGreetingStatsEndpoint tests the stats response and its authorisation
+func TestGreetingStatsEndpoint(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"auth": {"apiKeys": [
+		{"principal": "product", "sha256": "`+sha256Hex("stats-key")+`", "scopes": ["stats:read"]},
+		{"principal": "support", "sha256": "`+sha256Hex("support-key")+`"}
+	]}}`))
+	store := useStore(t)
+	for _, name := range []string{"John", "John", "Jane"} {
+		_ = store.RecordGreeting(context.Background(), GreetingEvent{Type: GreetingGreet, NameHash: nameHash(name), Locale: "en", Client: "web", Time: time.Now().UTC()})
+	}
+
+	testCases := []struct {
+		name           string
+		apiKey         string
+		query          string
+		expectedStatus int
+	}{
+		{"With scope", "stats-key", "?window=1d&top=1", http.StatusOK},
+		{"Without scope", "support-key", "", http.StatusForbidden},
+		{"Invalid window", "stats-key", "?window=soon", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/greeter/stats"+tc.query, nil)
+			req.Header.Set("X-API-Key", tc.apiKey)
+			w := httptest.NewRecorder()
+			authenticate(requireScope(ScopeStatsRead, greetingStats)).ServeHTTP(w, req)
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var stats GreetingStats
+			if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+				t.Fatalf("Expected stats, got %s", w.Body.String())
+			}
+			if stats.Total != 3 || stats.ByType[GreetingGreet] != 3 {
+				t.Errorf("Expected 3 greetings, got %+v", stats)
+			}
+			if len(stats.TopNames) != 1 || stats.TopNames[0].NameHash != publicNameHash(nameHash("John")) || stats.TopNames[0].Count != 2 {
+				t.Errorf("Expected John as the top name, got %+v", stats.TopNames)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Idempotency headers
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLength caps the length of an Idempotency-Key
+const maxIdempotencyKeyLength = 255
+
+var (
+	errKeyInFlight = errors.New("idempotency key in flight")
+	errKeyReused   = errors.New("idempotency key reused")
+)
+
+// IdempotencyConfig controls how responses to requests carrying an
+// Idempotency-Key are kept for replay
+type IdempotencyConfig struct {
+	// TTL is how long a response is replayed for retries
+	TTL Duration `json:"ttl"`
+	// MaxKeys caps the stored responses; the oldest are evicted first
+	MaxKeys int `json:"maxKeys"`
+}
+
+// Validate checks the idempotency settings
+func (c IdempotencyConfig) Validate() error {
+	if c.TTL <= 0 {
+		return errors.New("idempotency.ttl must be positive")
+	}
+	if c.MaxKeys <= 0 {
+		return errors.New("idempotency.maxKeys must be positive")
+	}
+	return nil
+}
+
+// storedResponse is a response kept for replay
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyEntry tracks one key; response is nil while the first request
+// is still being handled
+type idempotencyEntry struct {
+	fingerprint string
+	response    *storedResponse
+	expires     time.Time
+}
+
+// idempotencyCache holds the responses for recently used keys
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	now     func() time.Time
+}
+
+// newIdempotencyCache returns an empty cache
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{entries: map[string]*idempotencyEntry{}, now: time.Now}
+}
+
+// idempotencyKeys is the cache used by the idempotency middleware
+var idempotencyKeys = newIdempotencyCache()
+
+// reserve claims key for a request with the given fingerprint. It returns
+// the stored response when the request was already handled, errKeyInFlight
+// while the first request is still running and errKeyReused when the key was
+// used for a different request. A nil response and error mean the caller
+// must handle the request and then call complete or release.
+func (c *idempotencyCache) reserve(key, fingerprint string, maxKeys int) (*storedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if entry, ok := c.entries[key]; ok && (entry.response == nil || now.Before(entry.expires)) {
+		switch {
+		case entry.fingerprint != fingerprint:
+			return nil, errKeyReused
+		case entry.response == nil:
+			return nil, errKeyInFlight
+		default:
+			return entry.response, nil
+		}
+	}
+
+	if len(c.entries) >= maxKeys {
+		c.evict(now, maxKeys)
+	}
+	c.entries[key] = &idempotencyEntry{fingerprint: fingerprint}
+	return nil, nil
+}
+
+// evict drops expired entries and then, if the cache is still full, the
+// completed entries closest to expiry. In-flight entries are never evicted.
+func (c *idempotencyCache) evict(now time.Time, maxKeys int) {
+	for key, entry := range c.entries {
+		if entry.response != nil && !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for len(c.entries) >= maxKeys {
+		oldest := ""
+		for key, entry := range c.entries {
+			if entry.response != nil && (oldest == "" || entry.expires.Before(c.entries[oldest].expires)) {
+				oldest = key
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+// complete stores the response for a reserved key
+func (c *idempotencyCache) complete(key string, response *storedResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.response, entry.expires = response, c.now().Add(ttl)
+	}
+}
+
+// forget drops the stored responses that mention id, such as the record of
+// an erased user returned when it was created
+func (c *idempotencyCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if entry.response != nil && bytes.Contains(entry.response.body, []byte(id)) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// release forgets a reserved key so the request can be retried
+func (c *idempotencyCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && entry.response == nil {
+		delete(c.entries, key)
+	}
+}
+
+// responseRecorder copies a response while passing it through
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+		rec.header = rec.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// response returns the recorded response
+func (rec *responseRecorder) response() *storedResponse {
+	if rec.status == 0 {
+		return &storedResponse{status: http.StatusOK, header: rec.Header().Clone()}
+	}
+	return &storedResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()}
+}
+
+// validIdempotencyKey reports whether key is printable ASCII of a sane length
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFingerprint identifies a request by its method, target and body
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyScope returns the cache key of an Idempotency-Key. Keys are
+// scoped to the principal. Anonymous callers cannot be told apart, so
+// their keys are also scoped to the method and path; the fingerprint check
+// then only replays a response to a retry with the same body.
+func idempotencyScope(r *http.Request, principal Principal, key string) string {
+	if principal.ID == AnonymousPrincipal {
+		return AnonymousPrincipal + "\x00" + r.Method + "\x00" + r.URL.Path + "\x00" + key
+	}
+	return principal.ID + "\x00" + key
+}
+
+// replay writes a stored response. The request ID stays that of the retry.
+func replay(w http.ResponseWriter, response *storedResponse) {
+	header := w.Header()
+	for name, values := range response.header {
+		if name != RequestIDHeader {
+			header[name] = values
+		}
+	}
+	header.Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(response.status)
+	_, _ = w.Write(response.body)
+}
+
+// idempotency makes requests other than GET, HEAD and OPTIONS safe to retry
+// when they carry an Idempotency-Key. The first response for a key and
+// principal is stored and replayed for retries with the same method, target
+// and body. Reusing a key for a different request gets a 422, and a retry
+// arriving while the first request is still running gets a 409. Server
+// errors are not stored, so the request can be retried.
+func idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		principal := principalFrom(r.Context())
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s must be at most %d printable ASCII characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := readBody(r)
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		cfg := activeConfig.Get().Idempotency
+		scoped := idempotencyScope(r, principal, key)
+		response, err := idempotencyKeys.reserve(scoped, requestFingerprint(r, body), cfg.MaxKeys)
+		switch {
+		case errors.Is(err, errKeyReused):
+			writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("%s was already used for a different request", IdempotencyKeyHeader))
+			return
+		case errors.Is(err, errKeyInFlight):
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("a request with this %s is still in progress", IdempotencyKeyHeader))
+			return
+		case response != nil:
+			metrics.Add("idempotent_replays", 1)
+			replay(w, response)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		stored := false
+		// Release the key if the handler panics or fails so a retry runs again
+		defer func() {
+			if !stored {
+				idempotencyKeys.release(scoped)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		if response := rec.response(); response.status < http.StatusInternalServerError {
+			idempotencyKeys.complete(scoped, response, time.Duration(cfg.TTL))
+			stored = true
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useIdempotencyCache swaps in an empty idempotency cache for a test
+func useIdempotencyCache(t *testing.T) *idempotencyCache {
+	t.Helper()
+	cache := newIdempotencyCache()
+	previous := idempotencyKeys
+	idempotencyKeys = cache
+	t.Cleanup(func() { idempotencyKeys = previous })
+	return cache
+}
+
+// countingHandler counts calls and answers with the given status
+func countingHandler(calls *int32, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		w.Header().Set("X-Call", strconv.Itoa(int(n)))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("created"))
+	})
+}
+
+// sendIdempotent sends a request through authentication and the idempotency
+// middleware
+func sendIdempotent(h http.Handler, method, target, key, apiKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	w := httptest.NewRecorder()
+	chain(h, authenticate, idempotency).ServeHTTP(w, req)
+	return w
+}
+
+// TestIdempotencyReplay tests replays, key reuse and the requests the
+// middleware leaves alone
+func TestIdempotencyReplay(t *testing.T) {
+	testCases := []struct {
+		name            string
+		first           []string
+		second          []string
+		status          int
+		expectedStatus  int
+		expectedCalls   int32
+		expectedReplays bool
+	}{
+		{"Retry is replayed", []string{"POST", "/a", "k1", "support-key", "{}"}, []string{"POST", "/a", "k1", "support-key", "{}"}, http.StatusCreated, http.StatusCreated, 1, true},
+		{"Different body", []string{"POST", "/a", "k1", "support-key", "{}"}, []string{"POST", "/a", "k1", "support-key", `{"a": 1}`}, http.StatusCreated, http.StatusUnprocessableEntity, 1, false},
+		{"Different path", []string{"POST", "/a", "k1", "support-key", "{}"}, []string{"POST", "/b", "k1", "support-key", "{}"}, http.StatusCreated, http.StatusUnprocessableEntity, 1, false},
+		{"Different key", []string{"POST", "/a", "k1", "support-key", "{}"}, []string{"POST", "/a", "k2", "support-key", "{}"}, http.StatusCreated, http.StatusCreated, 2, false},
+		{"Different principal", []string{"POST", "/a", "k1", "dpo-key", "{}"}, []string{"POST", "/a", "k1", "support-key", "{}"}, http.StatusCreated, http.StatusCreated, 2, false},
+		{"Client errors are replayed", []string{"POST", "/a", "k1", "support-key", "{}"}, []string{"POST", "/a", "k1", "support-key", "{}"}, http.StatusBadRequest, http.StatusBadRequest, 1, true},
+		{"Server errors are not stored", []string{"POST", "/a", "k1", "support-key", "{}"}, []string{"POST", "/a", "k1", "support-key", "{}"}, http.StatusInternalServerError, http.StatusInternalServerError, 2, false},
+		{"Without a key", []string{"POST", "/a", "", "support-key", "{}"}, []string{"POST", "/a", "", "support-key", "{}"}, http.StatusCreated, http.StatusCreated, 2, false},
+		{"Anonymous retry is replayed", []string{"POST", "/a", "k1", "", "{}"}, []string{"POST", "/a", "k1", "", "{}"}, http.StatusCreated, http.StatusCreated, 1, true},
+		{"Anonymous different body", []string{"POST", "/a", "k1", "", "{}"}, []string{"POST", "/a", "k1", "", `{"a": 1}`}, http.StatusCreated, http.StatusUnprocessableEntity, 1, false},
+		{"Anonymous different path", []string{"POST", "/a", "k1", "", "{}"}, []string{"POST", "/b", "k1", "", "{}"}, http.StatusCreated, http.StatusCreated, 2, false},
+		{"Anonymous and authenticated", []string{"POST", "/a", "k1", "", "{}"}, []string{"POST", "/a", "k1", "support-key", "{}"}, http.StatusCreated, http.StatusCreated, 2, false},
+		{"GET is ignored", []string{"GET", "/a", "k1", "support-key", ""}, []string{"GET", "/a", "k1", "support-key", ""}, http.StatusOK, http.StatusOK, 2, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useScopedKeys(t)
+			useIdempotencyCache(t)
+			var calls int32
+			h := countingHandler(&calls, tc.status)
+
+			first := sendIdempotent(h, tc.first[0], tc.first[1], tc.first[2], tc.first[3], tc.first[4])
+			second := sendIdempotent(h, tc.second[0], tc.second[1], tc.second[2], tc.second[3], tc.second[4])
+			if second.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, second.Code)
+			}
+			if calls != tc.expectedCalls {
+				t.Errorf("Expected %d handler calls, got %d", tc.expectedCalls, calls)
+			}
+			replayed := second.Header().Get(IdempotentReplayedHeader) == "true"
+			if replayed != tc.expectedReplays {
+				t.Errorf("Expected replayed %v, got %v", tc.expectedReplays, replayed)
+			}
+			if replayed && (second.Header().Get("X-Call") != first.Header().Get("X-Call") || second.Body.String() != first.Body.String()) {
+				t.Errorf("Expected the first response to be replayed, got %q and %q", second.Header().Get("X-Call"), second.Body.String())
+			}
+		})
+	}
+}
+
+// TestIdempotencyInFlight tests that a retry arriving while the first
+// request runs gets a 409 instead of running twice
+func TestIdempotencyInFlight(t *testing.T) {
+	useScopedKeys(t)
+	useIdempotencyCache(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- sendIdempotent(h, "POST", "/a", "k1", "support-key", "{}") }()
+	<-started
+
+	w := sendIdempotent(h, "POST", "/a", "k1", "support-key", "{}")
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status %d with Retry-After, got %d", http.StatusConflict, w.Code)
+	}
+	close(release)
+	if first := <-done; first.Code != http.StatusCreated {
+		t.Errorf("Expected the first request to complete, got %d", first.Code)
+	}
+	if w := sendIdempotent(h, "POST", "/a", "k1", "support-key", "{}"); w.Code != http.StatusCreated || w.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("Expected a replay after completion, got %d", w.Code)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 handler call, got %d", calls)
+	}
+}
+
+// TestIdempotencyExpiry tests the TTL and eviction of stored responses
+func TestIdempotencyExpiry(t *testing.T) {
+	cache := newIdempotencyCache()
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	response := &storedResponse{status: http.StatusCreated}
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := cache.reserve(key, "f", 2); err != nil {
+			t.Fatalf("Expected %s to be reserved, got %v", key, err)
+		}
+		cache.complete(key, response, time.Hour)
+		now = now.Add(time.Minute)
+	}
+
+	// A third key evicts the oldest entry
+	if _, err := cache.reserve("c", "f", 2); err != nil {
+		t.Fatalf("Expected c to be reserved, got %v", err)
+	}
+	if got, _ := cache.reserve("a", "other", 3); got != nil {
+		t.Error("Expected a to have been evicted")
+	}
+	if got, _ := cache.reserve("b", "f", 3); got != response {
+		t.Error("Expected b to be replayed")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if got, err := cache.reserve("b", "other", 3); got != nil || err != nil {
+		t.Errorf("Expected b to be reusable after its TTL, got %v and %v", got, err)
+	}
+}
+
+// TestIdempotentUserCreate tests that a retried create stores one user,
+// for authenticated and anonymous callers
+func TestIdempotentUserCreate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		apiKey string
+	}{
+		{"Authenticated", "support-key"},
+		{"Anonymous", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useScopedKeys(t)
+			useStore(t)
+			useIdempotencyCache(t)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/greeter/user-info", userInfoHandler)
+			h := chain(mux, authenticate, limitBody, idempotency)
+
+			var ids []string
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("POST", "/greeter/user-info", bytes.NewReader([]byte(`{"name": "John"}`)))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set(IdempotencyKeyHeader, "create-john")
+				if tc.apiKey != "" {
+					req.Header.Set("X-API-Key", tc.apiKey)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					t.Fatalf("Expected status %d, got %d", http.StatusCreated, w.Code)
+				}
+				ids = append(ids, w.Header().Get("Location"))
+			}
+
+			page, err := dataStore.ListUsers(context.Background(), UserQuery{Sort: SortCreatedAt, Limit: 10})
+			if err != nil || page.Total != 1 {
+				t.Errorf("Expected 1 stored user, got %d (%v)", page.Total, err)
+			}
+			if ids[0] != ids[1] {
+				t.Errorf("Expected the retry to return the same user, got %s and %s", ids[0], ids[1])
+			}
+		})
+	}
+}
+
+// TestIdempotencyKeyValidation tests rejection of malformed keys
+func TestIdempotencyKeyValidation(t *testing.T) {
+	useScopedKeys(t)
+	useIdempotencyCache(t)
+	var calls int32
+	long := string(bytes.Repeat([]byte("k"), maxIdempotencyKeyLength+1))
+	if w := sendIdempotent(countingHandler(&calls, http.StatusCreated), "POST", "/a", long, "support-key", "{}"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a long key, got %d", http.StatusBadRequest, w.Code)
+	}
+	if calls != 0 {
+		t.Errorf("Expected no handler calls, got %d", calls)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shutdownHook flushes or closes a component during shutdown
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// lifecycle coordinates readiness, request draining, shutdown hooks and
+// configuration reloads for the server
+type lifecycle struct {
+	ready    atomic.Bool
+	inflight atomic.Int64
+	cutOff   atomic.Int64
+
+	// baseCtx is the parent of every request context; cancelling it tells
+	// long-running handlers such as bulk greetings to stop
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+
+	mu            sync.Mutex
+	shutdownHooks []shutdownHook
+	reloadHooks   []func() error
+}
+
+// newLifecycle returns a lifecycle that reports ready
+func newLifecycle() *lifecycle {
+	l := &lifecycle{}
+	l.baseCtx, l.cancelBase = context.WithCancel(context.Background())
+	l.ready.Store(true)
+	return l
+}
+
+// publishMetrics exposes the request counters through the metrics map
+func (l *lifecycle) publishMetrics() {
+	metrics.Set("inflight_requests", expvar.Func(func() interface{} { return l.inflight.Load() }))
+	metrics.Set("requests_cut_off", expvar.Func(func() interface{} { return l.cutOff.Load() }))
+	metrics.Set("ready", expvar.Func(func() interface{} { return l.ready.Load() }))
+}
+
+// OnShutdown registers a hook run after requests have drained, in
+// registration order
+func (l *lifecycle) OnShutdown(name string, fn func(context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shutdownHooks = append(l.shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// OnReload registers a hook run when SIGHUP is received
+func (l *lifecycle) OnReload(fn func() error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reloadHooks = append(l.reloadHooks, fn)
+}
+
+// attach makes every request context on server derive from the lifecycle
+func (l *lifecycle) attach(server *http.Server) {
+	server.BaseContext = func(net.Listener) context.Context { return l.baseCtx }
+}
+
+// trackRequests counts in-flight requests
+func (l *lifecycle) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.inflight.Add(1)
+		defer l.inflight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readiness reports whether the service should receive traffic
+func (l *lifecycle) readiness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status := "ready"
+	if !l.ready.Load() {
+		status = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	response := map[string]interface{}{
+		"status":   status,
+		"inflight": l.inflight.Load(),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// run blocks until a termination signal arrives, reloading on SIGHUP, and
+// then shuts the server down
+func (l *lifecycle) run(server *http.Server, signals <-chan os.Signal, cfg func() LifecycleConfig) {
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			l.reload()
+			continue
+		}
+		log.Printf("Received %v", sig)
+		l.shutdown(server, signals, cfg())
+		return
+	}
+}
+
+// reload runs the reload hooks, logging failures
+func (l *lifecycle) reload() {
+	l.mu.Lock()
+	hooks := append([]func() error(nil), l.reloadHooks...)
+	l.mu.Unlock()
+
+	log.Println("Reloading configuration...")
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			log.Printf("Reload failed: %v", err)
+			return
+		}
+	}
+	log.Println("Reload complete.")
+}
+
+// shutdown stops accepting traffic, drains in-flight requests and runs the
+// shutdown hooks. A second SIGTERM or SIGINT skips the pre-stop delay; a
+// SIGHUP is ignored so a reload does not cut the delay short.
+func (l *lifecycle) shutdown(server *http.Server, signals <-chan os.Signal, cfg LifecycleConfig) {
+	l.ready.Store(false)
+	if delay := time.Duration(cfg.PreStopDelay); delay > 0 {
+		log.Printf("Marked not ready, waiting %v before draining...", delay)
+		timer := time.NewTimer(delay)
+	waiting:
+		for {
+			select {
+			case <-timer.C:
+				break waiting
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					log.Printf("Received %v while shutting down, ignoring it", sig)
+					continue
+				}
+				timer.Stop()
+				log.Printf("Received %v, skipping pre-stop delay", sig)
+				break waiting
+			}
+		}
+	}
+
+	log.Printf("Shutting down the server, %d requests in flight...", l.inflight.Load())
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- server.Shutdown(drainCtx) }()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var err error
+draining:
+	for {
+		select {
+		case err = <-done:
+			break draining
+		case <-ticker.C:
+			log.Printf("Draining, %d requests in flight...", l.inflight.Load())
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		remaining := l.inflight.Load()
+		l.cutOff.Add(remaining)
+		log.Printf("Drain timeout reached, cancelling %d in-flight requests", remaining)
+		l.cancelBase()
+		if err := server.Close(); err != nil {
+			log.Printf("HTTP close error: %v", err)
+		}
+	} else if err != nil {
+		log.Printf("HTTP shutdown error: %v", err)
+	}
+	l.cancelBase()
+
+	l.runShutdownHooks(time.Duration(cfg.HookTimeout))
+	log.Println("Shutdown complete.")
+}
+
+// runShutdownHooks runs each hook with a shared timeout, logging failures
+func (l *lifecycle) runShutdownHooks(timeout time.Duration) {
+	l.mu.Lock()
+	hooks := append([]shutdownHook(nil), l.shutdownHooks...)
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, hook := range hooks {
+		if err := hook.fn(ctx); err != nil {
+			log.Printf("Shutdown hook %s failed: %v", hook.name, err)
+		}
+	}
+}
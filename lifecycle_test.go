@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testLifecycleConfig keeps shutdown tests fast
+var testLifecycleConfig = LifecycleConfig{
+	DrainTimeout: Duration(500 * time.Millisecond),
+	HookTimeout:  Duration(time.Second),
+}
+
+// startLifecycleServer serves handler behind the lifecycle request tracking
+func startLifecycleServer(t *testing.T, lc *lifecycle, handler http.Handler) (*http.Server, string) {
+	t.Helper()
+	server, err := newHTTPServer(DefaultConfig().Server, nil, lc.trackRequests(handler))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	lc.attach(server)
+
+	ln, err := listen(context.Background(), ServerConfig{})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return server, "http://" + ln.Addr().String()
+}
+
+// TestReadinessHandler tests that readiness flips to 503 once draining starts
+func TestReadinessHandler(t *testing.T) {
+	lc := newLifecycle()
+
+	w := httptest.NewRecorder()
+	lc.readiness(w, httptest.NewRequest("GET", "/greeter/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+
+	lc.ready.Store(false)
+	w = httptest.NewRecorder()
+	lc.readiness(w, httptest.NewRequest("GET", "/greeter/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", w.Code)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal readiness response: %v", err)
+	}
+	if response["status"] != "draining" {
+		t.Errorf("Expected status 'draining', got %v", response["status"])
+	}
+}
+
+// TestTrackRequests tests the in-flight request counter
+func TestTrackRequests(t *testing.T) {
+	lc := newLifecycle()
+	var during int64
+	handler := lc.trackRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		during = lc.inflight.Load()
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if during != 1 {
+		t.Errorf("Expected 1 request in flight during handling, got %d", during)
+	}
+	if lc.inflight.Load() != 0 {
+		t.Errorf("Expected 0 requests in flight afterwards, got %d", lc.inflight.Load())
+	}
+}
+
+// TestShutdownDrainsInFlightRequests tests that a request finishing within the drain timeout completes
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	lc := newLifecycle()
+	started := make(chan struct{})
+	server, url := startLifecycleServer(t, lc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = io.WriteString(w, "done")
+	}))
+
+	var flushed atomic.Bool
+	lc.OnShutdown("flush", func(context.Context) error {
+		flushed.Store(true)
+		return nil
+	})
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		result <- string(body)
+	}()
+
+	<-started
+	lc.shutdown(server, make(chan os.Signal), testLifecycleConfig)
+
+	if body := <-result; body != "done" {
+		t.Errorf("Expected in-flight request to complete, got %q", body)
+	}
+	if lc.ready.Load() {
+		t.Error("Expected lifecycle to report not ready")
+	}
+	if !flushed.Load() {
+		t.Error("Expected shutdown hook to run")
+	}
+	if lc.cutOff.Load() != 0 {
+		t.Errorf("Expected no requests cut off, got %d", lc.cutOff.Load())
+	}
+}
+
+// TestShutdownCancelsLongRequests tests that requests outliving the drain timeout see their context cancelled
+func TestShutdownCancelsLongRequests(t *testing.T) {
+	lc := newLifecycle()
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	server, url := startLifecycleServer(t, lc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		cancelled <- r.Context().Err()
+	}))
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+	lc.shutdown(server, make(chan os.Signal), testLifecycleConfig)
+
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected long request to be cancelled")
+	}
+	if lc.cutOff.Load() != 1 {
+		t.Errorf("Expected 1 request cut off, got %d", lc.cutOff.Load())
+	}
+}
+
+// TestRunReloadsOnSIGHUP tests that SIGHUP triggers reload hooks without stopping the server
+func TestRunReloadsOnSIGHUP(t *testing.T) {
+	lc := newLifecycle()
+	server, _ := startLifecycleServer(t, lc, http.NotFoundHandler())
+
+	reloads := make(chan struct{}, 1)
+	lc.OnReload(func() error {
+		reloads <- struct{}{}
+		return nil
+	})
+
+	signals := make(chan os.Signal, 2)
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGTERM
+	lc.run(server, signals, func() LifecycleConfig { return testLifecycleConfig })
+
+	select {
+	case <-reloads:
+	default:
+		t.Error("Expected reload hook to run on SIGHUP")
+	}
+	if lc.ready.Load() {
+		t.Error("Expected SIGTERM to shut the server down after the reload")
+	}
+}
+
+// TestPreStopDelaySignals tests that only a second SIGTERM or SIGINT skips
+// the pre-stop delay
+func TestPreStopDelaySignals(t *testing.T) {
+	delay := 300 * time.Millisecond
+	testCases := []struct {
+		name         string
+		signal       os.Signal
+		expectedSkip bool
+	}{
+		{"SIGTERM skips", syscall.SIGTERM, true},
+		{"SIGINT skips", syscall.SIGINT, true},
+		{"SIGHUP is ignored", syscall.SIGHUP, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lc := newLifecycle()
+			server, _ := startLifecycleServer(t, lc, http.NotFoundHandler())
+			reloads := 0
+			lc.OnReload(func() error {
+				reloads++
+				return nil
+			})
+
+			cfg := testLifecycleConfig
+			cfg.PreStopDelay = Duration(delay)
+			signals := make(chan os.Signal, 1)
+			signals <- tc.signal
+			start := time.Now()
+			lc.shutdown(server, signals, cfg)
+
+			if skipped := time.Since(start) < delay; skipped != tc.expectedSkip {
+				t.Errorf("Expected skipped=%v, took %v", tc.expectedSkip, time.Since(start))
+			}
+			if reloads != 0 {
+				t.Errorf("Expected no reload while shutting down, got %d", reloads)
+			}
+		})
+	}
+}
+
+// TestBulkGreetHandlerCancelled tests that bulk greeting stops when the request context is cancelled
+func TestBulkGreetHandlerCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := httptest.NewRequest("GET", "/greeter/bulk-greet?names=Alice,Bob", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	bulkGreet(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", w.Code)
+	}
+}
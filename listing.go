@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Listing page sizes
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// UserList is one page of the user listing
+type UserList struct {
+	Items      []interface{} `json:"items"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// listFields are the field names accepted by the fields parameter
+var listFields = map[string]bool{
+	"name": true, "age": true, "location": true, "email": true,
+	"createdAt": true, "updatedAt": true, "version": true,
+}
+
+// encodeCursor returns the opaque form of c used in query strings
+func encodeCursor(c *UserCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor produced by encodeCursor
+func decodeCursor(s string) (*UserCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c UserCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	return &c, nil
+}
+
+// parseUserQuery reads the listing filters, sort and page from the query string
+func parseUserQuery(values url.Values) (UserQuery, error) {
+	q := UserQuery{
+		Name:        sanitizeName(values.Get("name")),
+		Location:    values.Get("location"),
+		EmailDomain: values.Get("emailDomain"),
+		Sort:        SortCreatedAt,
+		Limit:       DefaultPageSize,
+	}
+
+	for param, dst := range map[string]*int{"minAge": &q.MinAge, "maxAge": &q.MaxAge} {
+		if s := values.Get(param); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("%s must be a non-negative integer", param)
+			}
+			*dst = n
+		}
+	}
+	if q.MaxAge > 0 && q.MinAge > q.MaxAge {
+		return q, fmt.Errorf("minAge must not exceed maxAge")
+	}
+
+	if s := values.Get("sort"); s != "" {
+		q.Descending = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		if q.Sort != SortName && q.Sort != SortAge && q.Sort != SortCreatedAt {
+			return q, fmt.Errorf("sort must be one of name, age or createdAt, optionally prefixed with -")
+		}
+	}
+
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+		}
+		q.Limit = n
+	}
+
+	if s := values.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+		if c.Sort != q.Sort || c.Descending != q.Descending {
+			return q, fmt.Errorf("cursor belongs to a different sort order")
+		}
+		q.After = c
+	}
+	return q, nil
+}
+
+// parseFields reads the fields parameter; nil selects every field
+func parseFields(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	for i, f := range fields {
+		fields[i] = strings.TrimSpace(f)
+		if !listFields[fields[i]] {
+			return nil, fmt.Errorf("unknown field %q", fields[i])
+		}
+	}
+	return fields, nil
+}
+
+// selectFields returns rec with only the given fields besides its ID
+func selectFields(rec UserRecord, fields []string) interface{} {
+	if fields == nil {
+		return rec
+	}
+	item := map[string]interface{}{"id": rec.ID}
+	user := map[string]interface{}{}
+	for _, f := range fields {
+		switch f {
+		case "name":
+			user["name"] = rec.User.Name
+		case "age":
+			user["age"] = rec.User.Age
+		case "location":
+			user["location"] = rec.User.Location
+		case "email":
+			user["email"] = rec.User.Email
+		case "createdAt":
+			item["createdAt"] = rec.CreatedAt
+		case "updatedAt":
+			item["updatedAt"] = rec.UpdatedAt
+		case "version":
+			item["version"] = rec.Version
+		}
+	}
+	if len(user) > 0 {
+		item["user"] = user
+	}
+	return item
+}
+
+// pageLink returns the URL of the listing with cursor replaced
+func pageLink(r *http.Request, cursor string) string {
+	values := r.URL.Query()
+	values.Del("cursor")
+	if cursor != "" {
+		values.Set("cursor", cursor)
+	}
+	return (&url.URL{Path: r.URL.Path, RawQuery: values.Encode()}).String()
+}
+
+// listUsers returns a page of stored users, masked for callers without pii:read
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	q, err := parseUserQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := parseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	principal := principalFrom(r.Context())
+	// Filtering on a masked field would reveal it one guess at a time
+	if q.Location != "" && !principal.HasScope(ScopePIIRead) {
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("filtering on location requires the %s scope", ScopePIIRead))
+		return
+	}
+
+	page, err := dataStore.ListUsers(r.Context(), q)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	list := UserList{Items: make([]interface{}, 0, len(page.Records)), Total: page.Total}
+	for _, rec := range page.Records {
+		rec.User = viewForPrincipal(rec.User, principal)
+		list.Items = append(list.Items, selectFields(rec, fields))
+	}
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageLink(r, ""))}
+	if page.Next != nil {
+		list.NextCursor = encodeCursor(page.Next)
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageLink(r, list.NextCursor)))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// listResponse decodes a listing with field selection applied
+type listResponse struct {
+	Items      []map[string]interface{} `json:"items"`
+	Total      int                      `json:"total"`
+	NextCursor string                   `json:"nextCursor"`
+}
+
+// TestListUsersPagination tests following Link headers through every page
+func TestListUsersPagination(t *testing.T) {
+	useStore(t)
+	for _, name := range []string{"Alice", "Bob", "Carol", "Dave", "Erin"} {
+		if _, err := dataStore.CreateUser(context.Background(), UserInfo{Name: name}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	var names []string
+	target := "/greeter/user-info?sort=-name&limit=2&fields=name"
+	for pages := 1; target != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("Expected pagination to end")
+		}
+		w := httptest.NewRecorder()
+		listUsers(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Total-Count"); got != "5" {
+			t.Errorf("Expected X-Total-Count 5, got %q", got)
+		}
+
+		var list listResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed to unmarshal list: %v", err)
+		}
+		for _, item := range list.Items {
+			if _, ok := item["createdAt"]; ok {
+				t.Errorf("Expected unselected fields to be left out, got %v", item)
+			}
+			names = append(names, item["user"].(map[string]interface{})["name"].(string))
+		}
+
+		link := w.Header().Get("Link")
+		if !strings.Contains(link, `rel="first"`) {
+			t.Errorf("Expected a first link, got %q", link)
+		}
+		target = ""
+		if list.NextCursor != "" {
+			next := "</greeter/user-info?cursor=" + url.QueryEscape(list.NextCursor)
+			if !strings.Contains(link, next) || !strings.Contains(link, `rel="next"`) {
+				t.Errorf("Expected a next link with the cursor, got %q", link)
+			}
+			target = "/greeter/user-info?sort=-name&limit=2&fields=name&cursor=" + url.QueryEscape(list.NextCursor)
+		}
+	}
+
+	if got := strings.Join(names, ","); got != "Erin,Dave,Carol,Bob,Alice" {
+		t.Errorf("Expected every user once in order, got %s", got)
+	}
+}
+
+// TestListUsersInvalidQuery tests rejection of malformed listing parameters
+func TestListUsersInvalidQuery(t *testing.T) {
+	useStore(t)
+	nameCursor := encodeCursor(&UserCursor{Sort: SortName, ID: "abc"})
+
+	testCases := []struct {
+		name           string
+		query          string
+		expectedStatus int
+	}{
+		{"Unknown sort", "sort=email", http.StatusBadRequest},
+		{"Limit too large", "limit=1000", http.StatusBadRequest},
+		{"Age range reversed", "minAge=40&maxAge=20", http.StatusBadRequest},
+		{"Garbage cursor", "cursor=%21%21", http.StatusBadRequest},
+		{"Cursor for another sort", "sort=age&cursor=" + nameCursor, http.StatusBadRequest},
+		{"Matching cursor", "sort=name&cursor=" + nameCursor, http.StatusOK},
+		{"Unknown field", "fields=name,password", http.StatusBadRequest},
+		{"Location without scope", "location=NYC", http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			authenticate(http.HandlerFunc(listUsers)).ServeHTTP(w, httptest.NewRequest("GET", "/greeter/user-info?"+tc.query, nil))
+			if w.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,7 +28,6 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -43,18 +43,96 @@ const (
 type UserInfo struct {
 	Name     string `json:"name"`
 	Age      int    `json:"age,omitempty"`
-	Location string `json:"location,omitempty"`
-	Email    string `json:"email,omitempty"`
+	Location string `json:"location,omitempty" pii:"location"`
+	Email    string `json:"email,omitempty" pii:"email"`
 }
 
 // HealthResponse represents health check response
 type HealthResponse struct {
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
-	Version   string    `json:"version"`
+	Status        string    `json:"status"`
+	Timestamp     time.Time `json:"timestamp"`
+	Version       string    `json:"version"`
+	ConfigVersion string    `json:"configVersion"`
+	ConfigLoaded  time.Time `json:"configLoadedAt"`
 }
 
 func main() {
+	log.SetOutput(redactingWriter{w: os.Stderr})
+
+	config, err := newConfigStore(os.Getenv(ConfigEnvVar))
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	activeConfig = config
+	cfg := config.Get()
+	log.Printf("Configuration version %s loaded", config.Snapshot().Version)
+
+	emailCipher, err = newFieldCipher(cfg.PII)
+	if err != nil {
+		log.Fatalf("PII encryption setup error: %v", err)
+	}
+	if emailCipher != nil {
+		log.Println("Encryption at rest enabled for stored email addresses")
+	}
+	key, err := loadNameHashKey(cfg.PII)
+	if err != nil {
+		log.Fatalf("PII name hash setup error: %v", err)
+	}
+	if key != nil {
+		nameHashKey = key
+	} else {
+		log.Println("No pii.nameHashKey configured, name hashes in statistics and events change on restart")
+	}
+
+	dataStore, err = openStore(cfg.Storage)
+	if err != nil {
+		log.Fatalf("Storage setup error: %v", err)
+	}
+	log.Printf("Using %s storage", cfg.Storage.Driver)
+
+	auditTrail, err = openAuditLog(cfg.Audit)
+	if err != nil {
+		log.Fatalf("Audit log setup error: %v", err)
+	}
+	if cfg.Audit.File == "" {
+		log.Println("No audit.file configured; audit events go to the service log")
+	}
+
+	webhooks = newWebhookDispatcher(cfg.Webhooks)
+
+	publisher, err := openPublisher(cfg.Events)
+	if err != nil {
+		log.Fatalf("Event publisher setup error: %v", err)
+	}
+	eventRelay = newOutboxRelay(dataStore, publisher, cfg.Events)
+	eventRelay.Start()
+
+	schedules = newGreetingScheduler(cfg.Scheduler)
+	if cfg.Scheduler.Enabled {
+		schedules.Start()
+	} else {
+		log.Println("Scheduler disabled; schedules are stored but not run on this instance")
+	}
+
+	password, err := cfg.Email.password()
+	if err != nil {
+		log.Fatalf("Email setup error: %v", err)
+	}
+	emails = newMailer(cfg.Email, password)
+	if cfg.Email.Enabled {
+		log.Printf("Email delivery through %s:%d", cfg.Email.Host, cfg.Email.Port)
+	}
+
+	lc := newLifecycle()
+	lc.publishMetrics()
+	lc.OnReload(config.Reload)
+	lc.OnShutdown("webhooks", webhooks.Close)
+	lc.OnShutdown("scheduler", schedules.Close)
+	lc.OnShutdown("email", emails.Close)
+	lc.OnShutdown("event relay", eventRelay.Close)
+	lc.OnShutdown("storage", func(context.Context) error { return dataStore.Close() })
+	lc.OnShutdown("audit log", func(context.Context) error { return auditTrail.Close() })
+
 	serverMux := http.NewServeMux()
 
 	// Existing endpoint
@@ -65,62 +143,103 @@ func main() {
 	serverMux.HandleFunc("/greeter/health", healthCheck)
 	serverMux.HandleFunc("/greeter/time-greet", timeBasedGreet)
 	serverMux.HandleFunc("/greeter/user-info", userInfoHandler)
+	serverMux.HandleFunc("/greeter/user-info/", userRecordHandler)
+	serverMux.HandleFunc("/greeter/user-info/import", importUsers)
+	serverMux.HandleFunc("/greeter/user-info/export", exportUsers)
 	serverMux.HandleFunc("/greeter/bulk-greet", bulkGreet)
+	serverMux.HandleFunc("/greeter/email/unsubscribe", unsubscribeHandler)
+
+	// Operational endpoints
+	serverMux.HandleFunc("/greeter/ready", lc.readiness)
+	serverMux.HandleFunc("/greeter/metrics", metricsHandler)
+	serverMux.HandleFunc("/greeter/audit", requireScope(ScopeAuditRead, auditQuery))
+	serverMux.HandleFunc("/greeter/stats", requireScope(ScopeStatsRead, greetingStats))
+	serverMux.HandleFunc("/greeter/webhooks", requireScope(ScopeWebhooksManage, webhooksHandler))
+	serverMux.HandleFunc("/greeter/webhooks/", requireScope(ScopeWebhooksManage, webhookHandler))
+	serverMux.HandleFunc("/greeter/schedules", requireScope(ScopeSchedulesManage, schedulesHandler))
+	serverMux.HandleFunc("/greeter/schedules/", requireScope(ScopeSchedulesManage, scheduleHandler))
+
+	serverPort := cfg.Server.Port
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled {
+		reloader, err := newTLSReloader(cfg.TLS)
+		if err != nil {
+			log.Fatalf("TLS setup error: %v", err)
+		}
+		tlsConfig = reloader.serverConfig()
+		go reloader.watch(watchCtx)
+	}
+
+	server, err := newHTTPServer(cfg.Server, tlsConfig, chain(serverMux, requestID, logRequests, lc.trackRequests, securityHeaders, compress, cors, authenticate, limitBody, idempotency))
+	if err != nil {
+		log.Fatalf("HTTP server setup error: %v", err)
+	}
+	lc.attach(server)
 
-	serverPort := 9090
-	server := http.Server{
-		Addr:              fmt.Sprintf(":%d", serverPort),
-		Handler:           serverMux,
-		ReadHeaderTimeout: 10 * time.Second,
+	go config.watch(watchCtx, time.Duration(cfg.Reload.WatchInterval))
+
+	listener, err := listen(watchCtx, cfg.Server)
+	if err != nil {
+		log.Fatalf("HTTP listen error: %v", err)
 	}
+
 	go func() {
-		log.Printf("Starting HTTP Greeter on port %d\n", serverPort)
-		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		switch {
+		case server.TLSConfig != nil:
+			log.Printf("Starting HTTPS Greeter on port %d\n", serverPort)
+			err = server.ServeTLS(listener, "", "")
+		case cfg.Server.H2C:
+			log.Printf("Starting HTTP Greeter (h2c enabled) on port %d\n", serverPort)
+			err = server.Serve(listener)
+		default:
+			log.Printf("Starting HTTP Greeter on port %d\n", serverPort)
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("HTTP ListenAndServe error: %v", err)
 		}
 		log.Println("HTTP server stopped serving new requests.")
 	}()
 
-	stopCh := make(chan os.Signal, 1)
-	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
-	<-stopCh // Wait for shutdown signal
-
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	log.Println("Shutting down the server...")
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Printf("HTTP shutdown error: %v", err)
-		return
-	}
-	log.Println("Shutdown complete.")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	lc.run(server, signals, func() LifecycleConfig { return config.Get().Lifecycle })
 }
 
 func greet(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get("name")
+	name := sanitizeName(r.URL.Query().Get("name"))
+	recordGreeting(r, GreetingGreet, name)
 	if name == "" {
 		name = DefaultName
 	}
-	fmt.Fprintf(w, "Hello, %s!\n", name)
+	writeCachedMessage(w, r, MsgGreet, name)
 }
 
 // farewell handles goodbye messages
 func farewell(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get("name")
+	name := sanitizeName(r.URL.Query().Get("name"))
+	recordGreeting(r, GreetingFarewell, name)
 	if name == "" {
 		name = DefaultName
 	}
-	fmt.Fprintf(w, "Goodbye, %s! Have a great day!\n", name)
+	writeCachedMessage(w, r, MsgFarewell, name)
 }
 
 // healthCheck provides service health status
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	snap := activeConfig.Snapshot()
 	health := HealthResponse{
-		Status:    "healthy",
-		Timestamp: time.Now(),
-		Version:   AppVersion,
+		Status:        "healthy",
+		Timestamp:     time.Now(),
+		Version:       AppVersion,
+		ConfigVersion: snap.Version,
+		ConfigLoaded:  snap.LoadedAt,
 	}
 
 	if err := json.NewEncoder(w).Encode(health); err != nil {
@@ -130,31 +249,32 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 
 // timeBasedGreet provides time-appropriate greetings
 func timeBasedGreet(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get("name")
+	name := sanitizeName(r.URL.Query().Get("name"))
+	recordGreeting(r, GreetingTimeGreet, name)
 	if name == "" {
 		name = DefaultName
 	}
 
-	hour := time.Now().Hour()
-	var greeting string
+	writeMessage(w, r, renderMessage(r, greetingForHour(time.Now().Hour()), name))
+}
 
+// greetingForHour returns the message key appropriate for the hour of day
+func greetingForHour(hour int) string {
 	switch {
 	case hour < 12:
-		greeting = "Good morning"
+		return MsgMorning
 	case hour < 17:
-		greeting = "Good afternoon"
+		return MsgAfternoon
 	default:
-		greeting = "Good evening"
+		return MsgEvening
 	}
-
-	fmt.Fprintf(w, "%s, %s!\n", greeting, name)
 }
 
-// userInfoHandler handles user information (GET and POST)
+// userInfoHandler lists (GET) and creates (POST) users
 func userInfoHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		getUserInfo(w, r)
+		listUsers(w, r)
 	case http.MethodPost:
 		createUserInfo(w, r)
 	default:
@@ -163,70 +283,154 @@ func userInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// getUserInfo returns user information from query parameters
-func getUserInfo(w http.ResponseWriter, r *http.Request) {
+// createUserInfo creates user information from JSON payload
+func createUserInfo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	name := r.URL.Query().Get("name")
-	if name == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		if err := json.NewEncoder(w).Encode(map[string]string{"error": "name parameter is required"}); err != nil {
-			http.Error(w, "Failed to encode error response", http.StatusInternalServerError)
-		}
+	var user UserInfo
+	if err := decodeJSONBody(r, &user); err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
-	user := UserInfo{Name: name}
+	// Create has always answered an invalid user with 400; the 422 of
+	// validateUser is kept for PUT and PATCH
+	if err := validateUser(&user); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if ageStr := r.URL.Query().Get("age"); ageStr != "" {
-		if age, err := strconv.Atoi(ageStr); err == nil && age > 0 {
-			user.Age = age
-		}
+	rec, err := dataStore.CreateUser(r.Context(), user)
+	if err != nil {
+		writeStoreError(w, err)
+		return
 	}
 
-	if location := r.URL.Query().Get("location"); location != "" {
-		user.Location = location
+	audit(r, AuditUserCreate, rec.ID, OutcomeCompleted, diffUsers(UserInfo{}, user))
+	publishUserCreated(r, rec)
+
+	w.Header().Set("Location", "/greeter/user-info/"+rec.ID)
+	setRecordHeaders(w, r, rec)
+	w.WriteHeader(http.StatusCreated)
+	response := map[string]interface{}{
+		"message": fmt.Sprintf("User %s created successfully", user.Name),
+		"id":      rec.ID,
+		"user":    viewForPrincipal(user, principalFrom(r.Context())),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
+}
 
-	if email := r.URL.Query().Get("email"); email != "" {
-		user.Email = email
+// userRecordHandler handles stored users under /greeter/user-info/{id}
+func userRecordHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, ok := parseUserPath(r.URL.Path)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
 	}
 
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	switch {
+	case action == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		getUserRecord(w, r, id)
+	case action == "" && r.Method == http.MethodPut:
+		replaceUser(w, r, id)
+	case action == "" && r.Method == http.MethodPatch:
+		patchUser(w, r, id)
+	case action == "" && r.Method == http.MethodDelete:
+		requireScope(ScopePIIErase, func(w http.ResponseWriter, r *http.Request) { eraseUser(w, r, id) })(w, r)
+	case action == "export" && r.Method == http.MethodGet:
+		requireScope(ScopePIIRead, func(w http.ResponseWriter, r *http.Request) { exportUser(w, r, id) })(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method %s not allowed\n", r.Method)
 	}
 }
 
-// createUserInfo creates user information from JSON payload
-func createUserInfo(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// parseUserPath splits /greeter/user-info/{id}[/{action}] into its parts
+func parseUserPath(path string) (id, action string, ok bool) {
+	rest := strings.TrimPrefix(path, "/greeter/user-info/")
+	id, action, _ = strings.Cut(rest, "/")
+	if !validID(id) || strings.Contains(action, "/") {
+		return "", "", false
+	}
+	return id, action, true
+}
 
-	var user UserInfo
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		if encErr := json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON payload"}); encErr != nil {
-			http.Error(w, "Failed to encode error response", http.StatusInternalServerError)
+// validID reports whether id is a safe record or request ID
+func validID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
 		}
+	}
+	return true
+}
+
+// getUserRecord returns a stored user, masked for callers without pii:read
+func getUserRecord(w http.ResponseWriter, r *http.Request, id string) {
+	rec, err := dataStore.GetUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if notModified(w, r, rec) {
 		return
 	}
+	writeUserRecord(w, r, http.StatusOK, rec)
+}
 
-	if user.Name == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		if err := json.NewEncoder(w).Encode(map[string]string{"error": "name field is required"}); err != nil {
-			http.Error(w, "Failed to encode error response", http.StatusInternalServerError)
-		}
+// writeUserRecord writes rec with its validators, masked for callers
+// without pii:read
+func writeUserRecord(w http.ResponseWriter, r *http.Request, status int, rec UserRecord) {
+	rec.User = viewForPrincipal(rec.User, principalFrom(r.Context()))
+
+	setRecordHeaders(w, r, rec)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(rec); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// replaceUser replaces a stored user with the JSON payload. The request
+// must carry the user's current ETag in If-Match.
+func replaceUser(w http.ResponseWriter, r *http.Request, id string) {
+	current, err := dataStore.GetUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !requireIfMatch(w, r, current, false) {
 		return
 	}
 
-	// Simulate user creation success
-	w.WriteHeader(http.StatusCreated)
-	response := map[string]interface{}{
-		"message": fmt.Sprintf("User %s created successfully", user.Name),
-		"user":    user,
+	var user UserInfo
+	if err := decodeJSONBody(r, &user); err != nil {
+		writeRequestError(w, err)
+		return
 	}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	if err := validateUser(&user); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	saveUser(w, r, current, user)
+}
+
+// saveUser stores user over current unless another request updated it in
+// the meantime, and audits the change
+func saveUser(w http.ResponseWriter, r *http.Request, current UserRecord, user UserInfo) {
+	rec, err := dataStore.UpdateUser(r.Context(), current.ID, user, current.Version)
+	if err != nil {
+		writeStoreError(w, err)
+		return
 	}
+	audit(r, AuditUserUpdate, rec.ID, OutcomeCompleted, diffUsers(current.User, rec.User))
+	writeUserRecord(w, r, http.StatusOK, rec)
 }
 
 // bulkGreet handles multiple names at once
@@ -246,14 +450,25 @@ func bulkGreet(w http.ResponseWriter, r *http.Request) {
 	greetings := make([]string, 0, len(names))
 
 	for _, name := range names {
-		name = strings.TrimSpace(name)
+		// Stop early when the client goes away or the server is draining
+		if err := r.Context().Err(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			if encErr := json.NewEncoder(w).Encode(map[string]string{"error": "request cancelled"}); encErr != nil {
+				http.Error(w, "Failed to encode error response", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		name = strings.TrimSpace(sanitizeName(name))
 		if name != "" {
-			greetings = append(greetings, fmt.Sprintf("Hello, %s!", name))
+			recordGreeting(r, GreetingBulkGreet, name)
+			greetings = append(greetings, renderMessage(r, MsgGreet, name))
 		}
 	}
 
 	if len(greetings) == 0 {
-		greetings = append(greetings, fmt.Sprintf("Hello, %s!", DefaultName))
+		recordGreeting(r, GreetingBulkGreet, "")
+		greetings = append(greetings, renderMessage(r, MsgGreet, DefaultName))
 	}
 
 	response := map[string][]string{
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -264,6 +265,27 @@ func TestHealthCheckHandler(t *testing.T) {
 	}
 }
 
+// TestHealthCheckReportsConfigVersion tests that the health endpoint reports the active config version
+func TestHealthCheckReportsConfigVersion(t *testing.T) {
+	store := useConfig(t, writeConfig(t, `{"server": {"port": 9091}}`))
+
+	req := httptest.NewRequest("GET", "/greeter/health", nil)
+	w := httptest.NewRecorder()
+
+	healthCheck(w, req)
+
+	var health HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("Failed to unmarshal health response: %v", err)
+	}
+	if health.ConfigVersion != store.Snapshot().Version {
+		t.Errorf("Expected config version %q, got %q", store.Snapshot().Version, health.ConfigVersion)
+	}
+	if health.ConfigLoaded.IsZero() {
+		t.Error("Expected config load time to be set")
+	}
+}
+
 // TestTimeBasedGreetHandler tests the time-based greeting function
 func TestTimeBasedGreetHandler(t *testing.T) {
 	testCases := []struct {
@@ -312,19 +334,25 @@ func TestTimeBasedGreetHandler(t *testing.T) {
 
 // TestUserInfoHandlerGET tests the GET method of user info endpoint
 func TestUserInfoHandlerGET(t *testing.T) {
+	useStore(t)
+	for _, user := range []UserInfo{{Name: "John", Age: 25}, {Name: "Jane", Age: 31}} {
+		if _, err := dataStore.CreateUser(context.Background(), user); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
 	testCases := []struct {
 		name           string
 		query          string
 		expectedStatus int
-		expectedName   string
-		expectedAge    int
+		expectedNames  []string
 	}{
-		{"Basic user", "name=John", http.StatusOK, "John", 0},
-		{"User with age", "name=John&age=25", http.StatusOK, "John", 25},
-		{"User with all fields", "name=John&age=25&location=NYC&email=john@example.com", http.StatusOK, "John", 25},
-		{"Missing name", "", http.StatusBadRequest, "", 0},
-		{"Invalid age", "name=John&age=invalid", http.StatusOK, "John", 0},
-		{"Negative age", "name=John&age=-5", http.StatusOK, "John", 0},
+		{"All users", "", http.StatusOK, []string{"John", "Jane"}},
+		{"By name", "name=john", http.StatusOK, []string{"John"}},
+		{"By age", "minAge=30", http.StatusOK, []string{"Jane"}},
+		{"No match", "name=Nobody", http.StatusOK, []string{}},
+		{"Invalid age", "minAge=invalid", http.StatusBadRequest, nil},
+		{"Negative age", "maxAge=-5", http.StatusBadRequest, nil},
 	}
 
 	for _, tc := range testCases {
@@ -347,16 +375,23 @@ func TestUserInfoHandlerGET(t *testing.T) {
 			}
 
 			if tc.expectedStatus == http.StatusOK {
-				var user UserInfo
-				if err := json.Unmarshal(body, &user); err != nil {
-					t.Errorf("Failed to unmarshal user response: %v", err)
+				var list struct {
+					Items []UserRecord `json:"items"`
+					Total int          `json:"total"`
+				}
+				if err := json.Unmarshal(body, &list); err != nil {
+					t.Errorf("Failed to unmarshal user list: %v", err)
 				}
 
-				if user.Name != tc.expectedName {
-					t.Errorf("Expected name %q, got %q", tc.expectedName, user.Name)
+				names := []string{}
+				for _, rec := range list.Items {
+					names = append(names, rec.User.Name)
+				}
+				if strings.Join(names, ",") != strings.Join(tc.expectedNames, ",") {
+					t.Errorf("Expected users %v, got %v", tc.expectedNames, names)
 				}
-				if user.Age != tc.expectedAge {
-					t.Errorf("Expected age %d, got %d", tc.expectedAge, user.Age)
+				if list.Total != len(tc.expectedNames) {
+					t.Errorf("Expected total %d, got %d", len(tc.expectedNames), list.Total)
 				}
 			}
 		})
@@ -374,6 +409,7 @@ func TestUserInfoHandlerPOST(t *testing.T) {
 		{"Valid user", UserInfo{Name: "John", Age: 25, Location: "NYC"}, http.StatusCreated, false},
 		{"Minimal user", UserInfo{Name: "Jane"}, http.StatusCreated, false},
 		{"Missing name", UserInfo{Age: 25}, http.StatusBadRequest, true},
+		{"Negative age", UserInfo{Name: "John", Age: -1}, http.StatusBadRequest, true},
 	}
 
 	for _, tc := range testCases {
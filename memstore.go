@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. Data is lost on restart.
+type memoryStore struct {
+	mu           sync.RWMutex
+	users        map[string]UserRecord
+	greetings    []GreetingEvent
+	outbox       []OutboxEvent
+	schedules    map[string]Schedule
+	suppressions map[string]EmailSuppression
+	historyLimit int
+}
+
+func newMemoryStore(cfg StorageConfig) *memoryStore {
+	return &memoryStore{
+		users:        make(map[string]UserRecord),
+		schedules:    make(map[string]Schedule),
+		suppressions: make(map[string]EmailSuppression),
+		historyLimit: cfg.HistoryLimit,
+	}
+}
+
+func (m *memoryStore) CreateUser(ctx context.Context, user UserInfo) (UserRecord, error) {
+	recs, err := m.CreateUsers(ctx, []UserInfo{user})
+	if err != nil {
+		return UserRecord{}, err
+	}
+	return recs[0], nil
+}
+
+func (m *memoryStore) CreateUsers(ctx context.Context, users []UserInfo) ([]UserRecord, error) {
+	recs := make([]UserRecord, len(users))
+	stored := make([]UserRecord, len(users))
+	events := make([]OutboxEvent, len(users))
+	for i, user := range users {
+		rec, sealed, err := newUserRecord(user)
+		if err != nil {
+			return nil, err
+		}
+		if events[i], err = userCreatedEvent(rec); err != nil {
+			return nil, err
+		}
+		recs[i], stored[i] = rec, rec
+		stored[i].User = sealed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range stored {
+		m.users[rec.ID] = rec
+	}
+	m.outbox = append(m.outbox, events...)
+	return recs, nil
+}
+
+func (m *memoryStore) GetUser(ctx context.Context, id string) (UserRecord, error) {
+	m.mu.RLock()
+	rec, ok := m.users[id]
+	m.mu.RUnlock()
+	if !ok {
+		return UserRecord{}, ErrNotFound
+	}
+	user, err := openUser(rec.User)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	rec.User = user
+	return rec, nil
+}
+
+func (m *memoryStore) UpdateUser(ctx context.Context, id string, user UserInfo, expectedVersion int64) (UserRecord, error) {
+	sealed, err := sealUser(user)
+	if err != nil {
+		return UserRecord{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.users[id]
+	if !ok {
+		return UserRecord{}, ErrNotFound
+	}
+	if expectedVersion != 0 && rec.Version != expectedVersion {
+		return UserRecord{}, ErrVersionConflict
+	}
+	rec.User, rec.UpdatedAt, rec.Version = sealed, time.Now().UTC(), rec.Version+1
+	m.users[id] = rec
+
+	rec.User = user
+	return rec, nil
+}
+
+func (m *memoryStore) DeleteUser(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, id)
+	return nil
+}
+
+func (m *memoryStore) ListUsers(ctx context.Context, q UserQuery) (UserPage, error) {
+	m.mu.RLock()
+	stored := make([]UserRecord, 0, len(m.users))
+	for _, rec := range m.users {
+		stored = append(stored, rec)
+	}
+	m.mu.RUnlock()
+
+	var matched []UserRecord
+	for _, rec := range stored {
+		user, err := openUser(rec.User)
+		if err != nil {
+			return UserPage{}, err
+		}
+		if rec.User = user; q.matches(user) {
+			matched = append(matched, rec)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return q.less(matched[i], matched[j]) })
+
+	page := UserPage{Total: len(matched)}
+	if q.After != nil {
+		after := q.After.record()
+		matched = matched[sort.Search(len(matched), func(i int) bool { return q.less(after, matched[i]) }):]
+	}
+	if len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+		page.Next = q.cursorAfter(matched[len(matched)-1])
+	}
+	page.Records = matched
+	return page, nil
+}
+
+func (m *memoryStore) RecordGreeting(ctx context.Context, event GreetingEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.greetings = append(m.greetings, event)
+	if m.historyLimit > 0 && len(m.greetings) > m.historyLimit {
+		m.greetings = m.greetings[len(m.greetings)-m.historyLimit:]
+	}
+	return nil
+}
+
+func (m *memoryStore) GreetingsFor(ctx context.Context, userID string) ([]GreetingEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var events []GreetingEvent
+	for _, e := range m.greetings {
+		if userID != "" && e.UserID == userID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *memoryStore) DeleteGreetings(ctx context.Context, userID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.greetings[:0]
+	for _, e := range m.greetings {
+		if userID == "" || e.UserID != userID {
+			kept = append(kept, e)
+		}
+	}
+	deleted := len(m.greetings) - len(kept)
+	m.greetings = kept
+	return deleted, nil
+}
+
+func (m *memoryStore) GreetingStats(ctx context.Context, q StatsQuery) (GreetingStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := newGreetingStats(q)
+	names := map[string]int{}
+	for _, e := range m.greetings {
+		if e.Time.Before(q.Since) || !e.Time.Before(q.Until) {
+			continue
+		}
+		stats.Total++
+		stats.ByType[e.Type]++
+		stats.ByLocale[e.Locale]++
+		stats.ByClient[e.Client]++
+		stats.ByHour[e.Time.UTC().Hour()]++
+		if e.NameHash != "" {
+			names[e.NameHash]++
+		}
+	}
+	stats.TopNames = rankNames(names, q.Top)
+	return stats, nil
+}
+
+func (m *memoryStore) PendingEvents(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.outbox) < limit {
+		limit = len(m.outbox)
+	}
+	return append([]OutboxEvent(nil), m.outbox[:limit]...), nil
+}
+
+func (m *memoryStore) DeleteEvents(ctx context.Context, ids []string) error {
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.outbox[:0]
+	for _, e := range m.outbox {
+		if !remove[e.ID] {
+			kept = append(kept, e)
+		}
+	}
+	m.outbox = kept
+	return nil
+}
+
+func (m *memoryStore) DeleteSubjectEvents(ctx context.Context, subject string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.outbox[:0]
+	for _, e := range m.outbox {
+		if e.Subject != subject {
+			kept = append(kept, e)
+		}
+	}
+	n := len(m.outbox) - len(kept)
+	m.outbox = kept
+	return n, nil
+}
+
+func (m *memoryStore) SaveSchedule(ctx context.Context, s Schedule, expectedVersion int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.schedules[s.ID]
+	switch {
+	case !ok && expectedVersion != 0:
+		return ErrNotFound
+	case ok && current.Version != expectedVersion:
+		return ErrVersionConflict
+	}
+	m.schedules[s.ID] = s
+	return nil
+}
+
+func (m *memoryStore) GetSchedule(ctx context.Context, id string) (Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.schedules[id]
+	if !ok {
+		return Schedule{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *memoryStore) ListSchedules(ctx context.Context) ([]Schedule, error) {
+	m.mu.RLock()
+	schedules := make([]Schedule, 0, len(m.schedules))
+	for _, s := range m.schedules {
+		schedules = append(schedules, s)
+	}
+	m.mu.RUnlock()
+	sort.Slice(schedules, func(i, j int) bool {
+		if !schedules[i].CreatedAt.Equal(schedules[j].CreatedAt) {
+			return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+		}
+		return schedules[i].ID < schedules[j].ID
+	})
+	return schedules, nil
+}
+
+func (m *memoryStore) DeleteSchedule(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schedules[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.schedules, id)
+	return nil
+}
+
+func (m *memoryStore) DeleteUserSchedules(ctx context.Context, userID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, s := range m.schedules {
+		if s.UserID == userID {
+			delete(m.schedules, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) SuppressEmail(ctx context.Context, s EmailSuppression) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.suppressions[s.AddressHash]; !ok {
+		m.suppressions[s.AddressHash] = s
+	}
+	return nil
+}
+
+func (m *memoryStore) GetSuppression(ctx context.Context, addressHash string) (EmailSuppression, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.suppressions[addressHash]
+	if !ok {
+		return EmailSuppression{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *memoryStore) DeleteSuppression(ctx context.Context, addressHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.suppressions[addressHash]; !ok {
+		return ErrNotFound
+	}
+	delete(m.suppressions, addressHash)
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Message keys used by the greeting handlers
+const (
+	MsgGreet     = "greet"
+	MsgFarewell  = "farewell"
+	MsgMorning   = "morning"
+	MsgAfternoon = "afternoon"
+	MsgEvening   = "evening"
+	// MsgWelcome is emailed to new users when welcome emails are on
+	MsgWelcome = "welcome"
+)
+
+// DefaultLocale is the locale of the built-in messages
+const DefaultLocale = "en"
+
+// builtinMessages are the English templates compiled into the binary.
+// Locale files may override any of them.
+var builtinMessages = map[string]string{
+	MsgGreet:     "Hello, {{.Name}}!",
+	MsgFarewell:  "Goodbye, {{.Name}}! Have a great day!",
+	MsgMorning:   "Good morning, {{.Name}}!",
+	MsgAfternoon: "Good afternoon, {{.Name}}!",
+	MsgEvening:   "Good evening, {{.Name}}!",
+	MsgWelcome:   "Welcome to Greeter, {{.Name}}!",
+}
+
+// localePattern matches locale file names such as en, fr or pt-br
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// messageData is passed to every message template
+type messageData struct {
+	Name string
+}
+
+// messageCatalog holds the greeting templates for every known locale
+type messageCatalog struct {
+	defaultLocale string
+	locales       map[string]map[string]*template.Template
+}
+
+// newMessageCatalog loads <locale>.json files from dir on top of the
+// built-in messages. An empty dir yields only the built-in messages.
+func newMessageCatalog(dir, defaultLocale string) (*messageCatalog, error) {
+	if defaultLocale == "" {
+		defaultLocale = DefaultLocale
+	}
+	catalog := &messageCatalog{
+		defaultLocale: strings.ToLower(defaultLocale),
+		locales:       make(map[string]map[string]*template.Template),
+	}
+	if err := catalog.add(DefaultLocale, builtinMessages); err != nil {
+		return nil, err
+	}
+
+	files, err := localeFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading locale file: %w", err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("parsing locale file %s: %w", file, err)
+		}
+		locale := strings.TrimSuffix(filepath.Base(file), ".json")
+		if err := catalog.add(locale, messages); err != nil {
+			return nil, fmt.Errorf("locale file %s: %w", file, err)
+		}
+	}
+
+	if _, ok := catalog.locales[catalog.defaultLocale]; !ok {
+		return nil, fmt.Errorf("no messages for default locale %q", defaultLocale)
+	}
+	return catalog, nil
+}
+
+// localeFiles lists the locale files in dir in a stable order
+func localeFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// add parses and test-renders the templates of one locale
+func (c *messageCatalog) add(locale string, messages map[string]string) error {
+	locale = strings.ToLower(locale)
+	if !localePattern.MatchString(locale) {
+		return fmt.Errorf("invalid locale name %q", locale)
+	}
+
+	templates := c.locales[locale]
+	if templates == nil {
+		templates = make(map[string]*template.Template)
+		c.locales[locale] = templates
+	}
+	for key, text := range messages {
+		if _, known := builtinMessages[key]; !known {
+			return fmt.Errorf("unknown message key %q", key)
+		}
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("message %q: %w", key, err)
+		}
+		if err := tmpl.Execute(&bytes.Buffer{}, messageData{Name: DefaultName}); err != nil {
+			return fmt.Errorf("message %q: %w", key, err)
+		}
+		templates[key] = tmpl
+	}
+	return nil
+}
+
+// Render formats the message key for locale, falling back to the default
+// locale and then to the built-in English text
+func (c *messageCatalog) Render(locale, key, name string) string {
+	data := messageData{Name: name}
+	for _, candidate := range []string{locale, c.defaultLocale, DefaultLocale} {
+		tmpl, ok := c.locales[candidate][key]
+		if !ok {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			log.Printf("Rendering message %q for locale %q failed: %v", key, candidate, err)
+			continue
+		}
+		return buf.String()
+	}
+	return name
+}
+
+// Match picks the best supported locale from an Accept-Language header
+func (c *messageCatalog) Match(acceptLanguage string) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag != "" && q > 0 {
+			tags = append(tags, weighted{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	for _, t := range tags {
+		for tag := t.tag; tag != ""; {
+			if _, ok := c.locales[tag]; ok {
+				return tag
+			}
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return c.defaultLocale
+}
+
+// Locale returns the locale for r: the lang query parameter when
+// supported, otherwise the best Accept-Language match
+func (c *messageCatalog) Locale(r *http.Request) string {
+	if lang := strings.ToLower(r.URL.Query().Get("lang")); lang != "" {
+		if _, ok := c.locales[lang]; ok {
+			return lang
+		}
+	}
+	return c.Match(r.Header.Get("Accept-Language"))
+}
+
+// renderMessage formats the message key in the locale of r
+func renderMessage(r *http.Request, key, name string) string {
+	catalog := activeConfig.Snapshot().Messages
+	return catalog.Render(catalog.Locale(r), key, name)
+}
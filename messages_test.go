@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLocale writes a locale file into dir
+func writeLocale(t *testing.T, dir, locale, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, locale+".json"), []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write locale file: %v", err)
+	}
+}
+
+// useConfig makes handlers read from a store loaded from path for the rest of the test
+func useConfig(t *testing.T, path string) *configStore {
+	t.Helper()
+	store, err := newConfigStore(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	previous := activeConfig
+	activeConfig = store
+	t.Cleanup(func() { activeConfig = previous })
+	return store
+}
+
+// TestMessageCatalogBuiltin tests that the built-in messages match the original responses
+func TestMessageCatalogBuiltin(t *testing.T) {
+	catalog, err := newMessageCatalog("", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	testCases := map[string]string{
+		MsgGreet:     "Hello, Alice!",
+		MsgFarewell:  "Goodbye, Alice! Have a great day!",
+		MsgMorning:   "Good morning, Alice!",
+		MsgAfternoon: "Good afternoon, Alice!",
+		MsgEvening:   "Good evening, Alice!",
+	}
+	for key, expected := range testCases {
+		if got := catalog.Render("en", key, "Alice"); got != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, key, got)
+		}
+	}
+}
+
+// TestMessageCatalogLocaleFiles tests loading locale overrides and falling back for missing keys
+func TestMessageCatalogLocaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeLocale(t, dir, "fr", `{"greet": "Bonjour, {{.Name}} !"}`)
+	writeLocale(t, dir, "pt-br", `{"greet": "Olá, {{.Name}}!"}`)
+
+	catalog, err := newMessageCatalog(dir, "en")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if got := catalog.Render("fr", MsgGreet, "Alice"); got != "Bonjour, Alice !" {
+		t.Errorf("Expected French greeting, got %q", got)
+	}
+	if got := catalog.Render("fr", MsgFarewell, "Alice"); got != "Goodbye, Alice! Have a great day!" {
+		t.Errorf("Expected fallback to English farewell, got %q", got)
+	}
+	if got := catalog.Render("de", MsgGreet, "Alice"); got != "Hello, Alice!" {
+		t.Errorf("Expected unknown locale to use the default, got %q", got)
+	}
+}
+
+// TestMessageCatalogInvalid tests that broken locale files are rejected
+func TestMessageCatalogInvalid(t *testing.T) {
+	testCases := []struct {
+		name    string
+		locale  string
+		content string
+		errText string
+	}{
+		{"Bad JSON", "fr", `{"greet": `, "parsing locale file"},
+		{"Bad template", "fr", `{"greet": "Bonjour, {{.Name"}`, "message \"greet\""},
+		{"Unknown field", "fr", `{"greet": "Bonjour, {{.Nom}}"}`, "message \"greet\""},
+		{"Unknown key", "fr", `{"salute": "Salut"}`, "unknown message key"},
+		{"Bad locale name", "French", `{"greet": "Bonjour"}`, "invalid locale name"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeLocale(t, dir, tc.locale, tc.content)
+
+			_, err := newMessageCatalog(dir, "en")
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+			if !strings.Contains(err.Error(), tc.errText) {
+				t.Errorf("Expected error to contain %q, got %v", tc.errText, err)
+			}
+		})
+	}
+}
+
+// TestMessageCatalogMatch tests Accept-Language negotiation
+func TestMessageCatalogMatch(t *testing.T) {
+	dir := t.TempDir()
+	writeLocale(t, dir, "fr", `{"greet": "Bonjour, {{.Name}} !"}`)
+	writeLocale(t, dir, "pt-br", `{"greet": "Olá, {{.Name}}!"}`)
+	catalog, err := newMessageCatalog(dir, "en")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	testCases := []struct {
+		header   string
+		expected string
+	}{
+		{"", "en"},
+		{"fr", "fr"},
+		{"fr-CA", "fr"},
+		{"PT-BR", "pt-br"},
+		{"de, fr;q=0.5", "fr"},
+		{"fr;q=0.2, pt-BR;q=0.9", "pt-br"},
+		{"fr;q=0", "en"},
+		{"de, it", "en"},
+	}
+	for _, tc := range testCases {
+		if got := catalog.Match(tc.header); got != tc.expected {
+			t.Errorf("Match(%q): expected %q, got %q", tc.header, tc.expected, got)
+		}
+	}
+}
+
+// TestGreetHandlerLocalized tests that greet uses the locale requested by the client
+func TestGreetHandlerLocalized(t *testing.T) {
+	dir := t.TempDir()
+	writeLocale(t, dir, "fr", `{"greet": "Bonjour, {{.Name}} !"}`)
+	useConfig(t, writeConfig(t, `{"messages": {"dir": "`+filepath.ToSlash(dir)+`"}}`))
+
+	testCases := []struct {
+		name     string
+		url      string
+		header   string
+		expected string
+	}{
+		{"Accept-Language", "/greeter/greet?name=Alice", "fr-FR,fr;q=0.9", "Bonjour, Alice !\n"},
+		{"Query override", "/greeter/greet?name=Alice&lang=en", "fr", "Hello, Alice!\n"},
+		{"Unsupported lang", "/greeter/greet?name=Alice&lang=xx", "", "Hello, Alice!\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.url, nil)
+			if tc.header != "" {
+				req.Header.Set("Accept-Language", tc.header)
+			}
+			w := httptest.NewRecorder()
+
+			greet(w, req)
+
+			body, _ := io.ReadAll(w.Result().Body)
+			if string(body) != tc.expected {
+				t.Errorf("Expected body %q, got %q", tc.expected, string(body))
+			}
+		})
+	}
+}
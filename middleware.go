@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// middleware wraps an http.Handler with additional behaviour
+type middleware func(http.Handler) http.Handler
+
+// chain applies middlewares so that the first one listed runs first
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush forwards to the underlying writer when it supports flushing
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequests writes one access log line per request. The query string is
+// left out because it carries user-supplied names.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if subject := clientSubject(r); subject != "" {
+			log.Printf("%s %s %d %s client=%q", r.Method, r.URL.Path, rec.status, time.Since(start), subject)
+			return
+		}
+		log.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+// RequestIDHeader carries the request ID in requests and responses
+const RequestIDHeader = "X-Request-Id"
+
+// requestIDKey is the context key for the request ID
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID attached by requestID, if any
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID tags each request with an ID, reusing the caller's
+// X-Request-Id when it is well formed, and echoes it in the response
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validID(id) {
+			generated, err := newID()
+			if err != nil {
+				http.Error(w, "Failed to generate request ID", http.StatusInternalServerError)
+				return
+			}
+			id = generated
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// routeMatch returns the entry of routes whose path is the longest prefix
+// of path. A route covers itself and everything below it.
+func routeMatch[T any](routes map[string]T, path string) (T, bool) {
+	var match T
+	matched, found := "", false
+	for route, value := range routes {
+		if len(route) <= len(matched) && found {
+			continue
+		}
+		if path == route || strings.HasPrefix(path, strings.TrimSuffix(route, "/")+"/") {
+			match, matched, found = value, route, true
+		}
+	}
+	return match, found
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRequestID tests that request IDs are reused when well formed and generated otherwise
+func TestRequestID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		incoming string
+		reused   bool
+	}{
+		{"Generated", "", false},
+		{"Reused", "abc-123", true},
+		{"Rejected", "bad id\r\n", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var seen string
+			handler := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestIDFrom(r.Context())
+			}))
+			req := httptest.NewRequest("GET", "/greeter/greet", nil)
+			if tc.incoming != "" {
+				req.Header.Set(RequestIDHeader, tc.incoming)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if seen == "" || w.Header().Get(RequestIDHeader) != seen {
+				t.Errorf("Expected the request ID %q to be echoed, got %q", seen, w.Header().Get(RequestIDHeader))
+			}
+			if (seen == tc.incoming) != tc.reused {
+				t.Errorf("Expected reused=%v, got ID %q", tc.reused, seen)
+			}
+		})
+	}
+}
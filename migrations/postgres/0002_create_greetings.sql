@@ -0,0 +1,9 @@
+CREATE TABLE greetings (
+    id         BIGSERIAL PRIMARY KEY,
+    type       TEXT NOT NULL,
+    name_hash  TEXT NOT NULL,
+    locale     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX greetings_name_hash ON greetings (name_hash);
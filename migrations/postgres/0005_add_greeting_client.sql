@@ -0,0 +1,3 @@
+ALTER TABLE greetings ADD COLUMN client TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX greetings_created_at ON greetings (created_at);
@@ -0,0 +1,17 @@
+CREATE TABLE schedules (
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    message     TEXT NOT NULL,
+    locale      TEXT NOT NULL DEFAULT '',
+    cron        TEXT NOT NULL DEFAULT '',
+    run_at      TIMESTAMPTZ,
+    timezone    TEXT NOT NULL,
+    delivery    TEXT NOT NULL,
+    missed_runs TEXT NOT NULL,
+    next_run    TIMESTAMPTZ,
+    last_run    TIMESTAMPTZ,
+    last_error  TEXT NOT NULL DEFAULT '',
+    created_by  TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE schedules ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,9 @@
+CREATE TABLE greetings (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    type       TEXT NOT NULL,
+    name_hash  TEXT NOT NULL,
+    locale     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX greetings_name_hash ON greetings (name_hash);
@@ -0,0 +1,11 @@
+ALTER TABLE users ADD COLUMN email_domain TEXT NOT NULL DEFAULT '';
+
+-- Encrypted emails cannot be backfilled here; they get a domain on their next update
+UPDATE users SET email_domain = LOWER(SUBSTR(email, INSTR(email, '@') + 1))
+WHERE email LIKE '%@%' AND email NOT LIKE 'enc:%';
+
+CREATE INDEX users_email_domain ON users (email_domain);
+CREATE INDEX users_location ON users (location);
+CREATE INDEX users_age ON users (age, id);
+CREATE INDEX users_created_at ON users (created_at, id);
+CREATE INDEX users_name ON users (name, id);
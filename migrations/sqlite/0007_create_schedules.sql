@@ -0,0 +1,17 @@
+CREATE TABLE schedules (
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    message     TEXT NOT NULL,
+    locale      TEXT NOT NULL DEFAULT '',
+    cron        TEXT NOT NULL DEFAULT '',
+    run_at      TIMESTAMP,
+    timezone    TEXT NOT NULL,
+    delivery    TEXT NOT NULL,
+    missed_runs TEXT NOT NULL,
+    next_run    TIMESTAMP,
+    last_run    TIMESTAMP,
+    last_error  TEXT NOT NULL DEFAULT '',
+    created_by  TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMP NOT NULL,
+    updated_at  TIMESTAMP NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE email_suppressions (
+    address_hash TEXT PRIMARY KEY,
+    reason       TEXT NOT NULL,
+    created_at   TIMESTAMP NOT NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE greetings ADD COLUMN user_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX greetings_user_id ON greetings (user_id);
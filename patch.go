@@ -0,0 +1,402 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch media types accepted by PATCH /greeter/user-info/{id}
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// userDocument returns user as a generic JSON object. Every field is
+// present, empty or not, so JSON Patch paths such as /location always
+// resolve and removing a field clears it.
+func userDocument(user UserInfo) map[string]interface{} {
+	v := reflect.ValueOf(user)
+	fields := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		fields[name] = v.Field(i).Interface()
+	}
+
+	// Round trip so values have the types json.Unmarshal produces
+	data, _ := json.Marshal(fields)
+	doc := map[string]interface{}{}
+	_ = json.Unmarshal(data, &doc)
+	return doc
+}
+
+// piiDocumentFields returns the JSON names of the UserInfo fields tagged as
+// personal data
+func piiDocumentFields() map[string]bool {
+	t := reflect.TypeOf(UserInfo{})
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("pii") != "" {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// userFromDocument decodes a patched document, rejecting anything that is
+// not a valid UserInfo
+func userFromDocument(doc interface{}) (UserInfo, error) {
+	var user UserInfo
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return user, &requestError{status: http.StatusUnprocessableEntity, message: "patched user must be a JSON object"}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return user, err
+	}
+	if err := decodeJSON(data, &user, activeConfig.Get().Limits.MaxJSONDepth); err != nil {
+		return user, &requestError{status: http.StatusUnprocessableEntity, message: "patched user is invalid: " + err.Error()}
+	}
+	return user, nil
+}
+
+// validateUser normalises the name and checks the fields of a user about
+// to be stored
+func validateUser(user *UserInfo) error {
+	user.Name = sanitizeName(user.Name)
+	if user.Name == "" {
+		return &requestError{status: http.StatusUnprocessableEntity, message: "name field is required"}
+	}
+	if user.Age < 0 {
+		return &requestError{status: http.StatusUnprocessableEntity, message: "age must not be negative"}
+	}
+	return nil
+}
+
+// applyMergePatch applies an RFC 7396 merge patch: object members replace
+// those of target and null members remove them
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+			continue
+		}
+		targetObj[name] = applyMergePatch(targetObj[name], value)
+	}
+	return targetObj
+}
+
+// patchOperation is one RFC 6902 JSON Patch operation
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// patchConflict reports an operation that does not apply to the document
+func patchConflict(i int, format string, args ...interface{}) error {
+	return &requestError{status: http.StatusConflict, message: fmt.Sprintf("operation %d: ", i) + fmt.Sprintf(format, args...)}
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token; end allows one past the last
+// element, as add does
+func arrayIndex(token string, length int, end bool) (int, bool) {
+	if token == "-" && end {
+		return length, true
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, false
+	}
+	if i > length || (i == length && !end) {
+		return 0, false
+	}
+	return i, true
+}
+
+// getAt returns the value at tokens
+func getAt(node interface{}, tokens []string) (interface{}, bool) {
+	for _, token := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, false
+			}
+			node = child
+		case []interface{}:
+			i, ok := arrayIndex(token, len(n), false)
+			if !ok {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// setAt adds or, when replace is set, replaces the value at tokens and
+// returns the updated node
+func setAt(node interface{}, tokens []string, value interface{}, replace bool) (interface{}, bool) {
+	if len(tokens) == 0 {
+		return value, true
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[token]
+		if last {
+			if replace && !exists {
+				return nil, false
+			}
+			n[token] = value
+			return n, true
+		}
+		if !exists {
+			return nil, false
+		}
+		updated, ok := setAt(child, tokens[1:], value, replace)
+		n[token] = updated
+		return n, ok
+	case []interface{}:
+		i, ok := arrayIndex(token, len(n), last && !replace)
+		if !ok {
+			return nil, false
+		}
+		if !last {
+			updated, ok := setAt(n[i], tokens[1:], value, replace)
+			n[i] = updated
+			return n, ok
+		}
+		if replace {
+			n[i] = value
+			return n, true
+		}
+		n = append(n, nil)
+		copy(n[i+1:], n[i:])
+		n[i] = value
+		return n, true
+	default:
+		return nil, false
+	}
+}
+
+// removeAt removes the value at tokens, returning the updated node and the
+// removed value
+func removeAt(node interface{}, tokens []string) (interface{}, interface{}, bool) {
+	if len(tokens) == 0 {
+		return nil, nil, false
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[token]
+		if !exists {
+			return nil, nil, false
+		}
+		if last {
+			delete(n, token)
+			return n, child, true
+		}
+		updated, removed, ok := removeAt(child, tokens[1:])
+		n[token] = updated
+		return n, removed, ok
+	case []interface{}:
+		i, ok := arrayIndex(token, len(n), false)
+		if !ok {
+			return nil, nil, false
+		}
+		if last {
+			removed := n[i]
+			return append(n[:i], n[i+1:]...), removed, true
+		}
+		updated, removed, ok := removeAt(n[i], tokens[1:])
+		n[i] = updated
+		return n, removed, ok
+	default:
+		return nil, nil, false
+	}
+}
+
+// readsField reports whether tokens point at or below one of fields
+func readsField(tokens []string, fields map[string]bool) bool {
+	return len(tokens) == 0 || fields[tokens[0]]
+}
+
+// applyJSONPatch applies RFC 6902 operations in order. Callers that may not
+// read personal data cannot test or copy it, which would reveal it.
+func applyJSONPatch(doc interface{}, ops []patchOperation, canReadPII bool) (interface{}, error) {
+	piiFields := piiDocumentFields()
+	for i, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("operation %d: %v", i, err)}
+		}
+
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("operation %d: %s requires a value", i, op.Op)}
+			}
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("operation %d: invalid value", i)}
+			}
+		}
+
+		var from []string
+		if op.Op == "move" || op.Op == "copy" {
+			if from, err = parsePointer(op.From); err != nil {
+				return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("operation %d: %v", i, err)}
+			}
+		}
+		if !canReadPII && ((op.Op == "test" && readsField(path, piiFields)) || (op.Op == "copy" || op.Op == "move") && readsField(from, piiFields)) {
+			return nil, &requestError{status: http.StatusForbidden, message: fmt.Sprintf("operation %d: reading personal data requires the %s scope", i, ScopePIIRead)}
+		}
+
+		var ok bool
+		switch op.Op {
+		case "add":
+			doc, ok = setAt(doc, path, value, false)
+		case "replace":
+			doc, ok = setAt(doc, path, value, true)
+		case "remove":
+			doc, _, ok = removeAt(doc, path)
+		case "move":
+			var moved interface{}
+			if doc, moved, ok = removeAt(doc, from); ok {
+				doc, ok = setAt(doc, path, moved, false)
+			}
+		case "copy":
+			var copied interface{}
+			if copied, ok = getAt(doc, from); ok {
+				doc, ok = setAt(doc, path, deepCopy(copied), false)
+			}
+		case "test":
+			var current interface{}
+			if current, ok = getAt(doc, path); ok && !reflect.DeepEqual(current, value) {
+				return nil, patchConflict(i, "test failed for %s", op.Path)
+			}
+		default:
+			return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("operation %d: unknown op %q", i, op.Op)}
+		}
+		if !ok {
+			return nil, patchConflict(i, "path %s does not exist", op.Path)
+		}
+	}
+	return doc, nil
+}
+
+// deepCopy copies a decoded JSON value so copies do not share containers
+func deepCopy(v interface{}) interface{} {
+	data, _ := json.Marshal(v)
+	var copied interface{}
+	_ = json.Unmarshal(data, &copied)
+	return copied
+}
+
+// patchUser applies a merge patch or JSON Patch to a stored user. The
+// result is validated as a whole before it is stored, and the request must
+// carry the user's current ETag in If-Match.
+func patchUser(w http.ResponseWriter, r *http.Request, id string) {
+	current, err := dataStore.GetUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !requireIfMatch(w, r, current, false) {
+		return
+	}
+
+	if err := requireContentType(r, MergePatchType, JSONPatchType); err != nil {
+		w.Header().Set("Accept-Patch", MergePatchType+", "+JSONPatchType)
+		writeRequestError(w, err)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	data, err := readBody(r)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	var patched interface{}
+	if mediaType == MergePatchType {
+		var patch interface{}
+		if err := decodeJSON(data, &patch, activeConfig.Get().Limits.MaxJSONDepth); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		patched = applyMergePatch(userDocument(current.User), patch)
+	} else {
+		var ops []patchOperation
+		if err := decodeJSON(data, &ops, activeConfig.Get().Limits.MaxJSONDepth); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		canReadPII := principalFrom(r.Context()).HasScope(ScopePIIRead)
+		if patched, err = applyJSONPatch(userDocument(current.User), ops, canReadPII); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+	}
+
+	user, err := userFromDocument(patched)
+	if err == nil {
+		err = validateUser(&user)
+	}
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	saveUser(w, r, current, user)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// TestPatchUser tests merge patches and JSON Patch documents applied to a
+// stored user
+func TestPatchUser(t *testing.T) {
+	testCases := []struct {
+		name           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expected       UserInfo
+	}{
+		{"Merge patch one field", MergePatchType, `{"age": 31}`, http.StatusOK, UserInfo{Name: "John", Age: 31, Location: "NYC"}},
+		{"Merge patch clears location with null", MergePatchType, `{"location": null}`, http.StatusOK, UserInfo{Name: "John", Age: 30}},
+		{"Merge patch clears location with empty string", MergePatchType, `{"location": ""}`, http.StatusOK, UserInfo{Name: "John", Age: 30}},
+		{"Merge patch removing the name", MergePatchType, `{"name": null}`, http.StatusUnprocessableEntity, UserInfo{}},
+		{"Merge patch unknown field", MergePatchType, `{"nickname": "Jo"}`, http.StatusUnprocessableEntity, UserInfo{}},
+		{"Merge patch wrong type", MergePatchType, `{"age": "old"}`, http.StatusUnprocessableEntity, UserInfo{}},
+		{"Merge patch replacing the document", MergePatchType, `[1]`, http.StatusUnprocessableEntity, UserInfo{}},
+		{"JSON Patch replace", JSONPatchType, `[{"op": "replace", "path": "/location", "value": "LA"}]`, http.StatusOK, UserInfo{Name: "John", Age: 30, Location: "LA"}},
+		{"JSON Patch remove clears location", JSONPatchType, `[{"op": "remove", "path": "/location"}]`, http.StatusOK, UserInfo{Name: "John", Age: 30}},
+		{"JSON Patch test then replace", JSONPatchType, `[{"op": "test", "path": "/age", "value": 30}, {"op": "replace", "path": "/age", "value": 40}]`, http.StatusOK, UserInfo{Name: "John", Age: 40, Location: "NYC"}},
+		{"JSON Patch copy", JSONPatchType, `[{"op": "copy", "from": "/name", "path": "/location"}]`, http.StatusOK, UserInfo{Name: "John", Age: 30, Location: "John"}},
+		{"JSON Patch failed test", JSONPatchType, `[{"op": "test", "path": "/age", "value": 29}, {"op": "replace", "path": "/age", "value": 40}]`, http.StatusConflict, UserInfo{}},
+		{"JSON Patch missing path", JSONPatchType, `[{"op": "replace", "path": "/nickname", "value": "Jo"}]`, http.StatusConflict, UserInfo{}},
+		{"JSON Patch add unknown field", JSONPatchType, `[{"op": "add", "path": "/nickname", "value": "Jo"}]`, http.StatusUnprocessableEntity, UserInfo{}},
+		{"JSON Patch negative age", JSONPatchType, `[{"op": "replace", "path": "/age", "value": -1}]`, http.StatusUnprocessableEntity, UserInfo{}},
+		{"JSON Patch unknown op", JSONPatchType, `[{"op": "swap", "path": "/age"}]`, http.StatusBadRequest, UserInfo{}},
+		{"JSON Patch missing value", JSONPatchType, `[{"op": "add", "path": "/age"}]`, http.StatusBadRequest, UserInfo{}},
+		{"JSON Patch bad pointer", JSONPatchType, `[{"op": "remove", "path": "age"}]`, http.StatusBadRequest, UserInfo{}},
+		{"Plain JSON", "application/json", `{"age": 31}`, http.StatusUnsupportedMediaType, UserInfo{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useStore(t)
+			id := createTestUser(t, UserInfo{Name: "John", Age: 30, Location: "NYC"})
+
+			w := serveUsers("PATCH", "/greeter/user-info/"+id, "", []byte(tc.body), "Content-Type", tc.contentType, "If-Match", `"v1-f"`)
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+
+			rec, err := dataStore.GetUser(context.Background(), id)
+			if err != nil {
+				t.Fatalf("Expected the user to exist, got %v", err)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				if rec.Version != 1 {
+					t.Errorf("Expected the user to be unchanged, got version %d", rec.Version)
+				}
+				return
+			}
+			if rec.User != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, rec.User)
+			}
+			if w.Header().Get("ETag") != `"v2-m"` {
+				t.Errorf("Expected ETag \"v2-m\", got %q", w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+// TestPatchUserUnsupportedMediaType tests that a 415 advertises the patch
+// formats
+func TestPatchUserUnsupportedMediaType(t *testing.T) {
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John"})
+
+	w := serveUsers("PATCH", "/greeter/user-info/"+id, "", []byte(`{"age": 31}`), "If-Match", `"v1-f"`)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+	if accept := w.Header().Get("Accept-Patch"); accept != MergePatchType+", "+JSONPatchType {
+		t.Errorf("Expected Accept-Patch to list both formats, got %q", accept)
+	}
+}
+
+// TestPatchUserPreconditions tests 428 and 412 handling of PATCH
+func TestPatchUserPreconditions(t *testing.T) {
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John"})
+	body := []byte(`{"age": 31}`)
+
+	if w := serveUsers("PATCH", "/greeter/user-info/"+id, "", body, "Content-Type", MergePatchType); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected status %d without If-Match, got %d", http.StatusPreconditionRequired, w.Code)
+	}
+	if w := serveUsers("PATCH", "/greeter/user-info/"+id, "", body, "Content-Type", MergePatchType, "If-Match", `"v0-f"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d for a stale ETag, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	if w := serveUsers("PATCH", "/greeter/user-info/missing", "", body, "Content-Type", MergePatchType, "If-Match", `"v1-f"`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing user, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// TestPatchUserPIIReads tests that JSON Patch cannot reveal personal data to
+// callers without the pii:read scope
+func TestPatchUserPIIReads(t *testing.T) {
+	useScopedKeys(t)
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John", Location: "NYC", Email: "john@example.com"})
+
+	testCases := []struct {
+		name           string
+		apiKey         string
+		body           string
+		expectedStatus int
+	}{
+		{"Test on PII without scope", "support-key", `[{"op": "test", "path": "/location", "value": "NYC"}]`, http.StatusForbidden},
+		{"Copy PII without scope", "support-key", `[{"op": "copy", "from": "/email", "path": "/name"}]`, http.StatusForbidden},
+		{"Test whole document without scope", "support-key", `[{"op": "test", "path": "", "value": {}}]`, http.StatusForbidden},
+		{"Replace PII without scope", "support-key", `[{"op": "replace", "path": "/location", "value": "LA"}]`, http.StatusOK},
+		{"Test on PII with scope", "dpo-key", `[{"op": "test", "path": "/location", "value": "LA"}]`, http.StatusOK},
+	}
+
+	version := 1
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			etag := `"v` + strconv.Itoa(version) + `-f"`
+			w := serveUsers("PATCH", "/greeter/user-info/"+id, tc.apiKey, []byte(tc.body), "Content-Type", JSONPatchType, "If-Match", etag)
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK {
+				version++
+			}
+		})
+	}
+}
+
+// TestJSONPointer tests escaping in JSON Pointer paths
+func TestJSONPointer(t *testing.T) {
+	doc := map[string]interface{}{"a/b": map[string]interface{}{"m~n": []interface{}{"x", "y"}}}
+	tokens, err := parsePointer("/a~1b/m~0n/1")
+	if err != nil {
+		t.Fatalf("Expected a valid pointer, got %v", err)
+	}
+	if value, ok := getAt(doc, tokens); !ok || value != "y" {
+		t.Errorf("Expected \"y\", got %v (found %v)", value, ok)
+	}
+	if _, ok := getAt(doc, []string{"a/b", "m~n", "01"}); ok {
+		t.Error("Expected an index with a leading zero to be rejected")
+	}
+}
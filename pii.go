@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// PII classes used in `pii` struct tags
+const (
+	PIIEmail    = "email"
+	PIILocation = "location"
+)
+
+// RedactedValue replaces personal data in logs and error messages
+const RedactedValue = "[REDACTED]"
+
+// encryptedPrefix marks values sealed by fieldCipher
+const encryptedPrefix = "enc:v1:"
+
+// PIIConfig holds personal data protection settings
+type PIIConfig struct {
+	// EncryptionKey is a base64-encoded 32-byte AES key used to encrypt
+	// stored email addresses. EncryptionKeyFile reads it from a file instead.
+	EncryptionKey     string `json:"encryptionKey,omitempty"`
+	EncryptionKeyFile string `json:"encryptionKeyFile,omitempty"`
+
+	// NameHashKey is the secret keying the name hashes shown in statistics
+	// and events. NameHashKeyFile reads it from a file instead.
+	NameHashKey     string `json:"nameHashKey,omitempty"`
+	NameHashKeyFile string `json:"nameHashKeyFile,omitempty"`
+}
+
+// minNameHashKeyLength is the shortest name hash key accepted
+const minNameHashKeyLength = 16
+
+// Validate checks that at most one source is configured for each key
+func (p PIIConfig) Validate() error {
+	if p.EncryptionKey != "" && p.EncryptionKeyFile != "" {
+		return errors.New("pii.encryptionKey and pii.encryptionKeyFile are mutually exclusive")
+	}
+	if p.NameHashKey != "" && p.NameHashKeyFile != "" {
+		return errors.New("pii.nameHashKey and pii.nameHashKeyFile are mutually exclusive")
+	}
+	if p.NameHashKey != "" && len(p.NameHashKey) < minNameHashKeyLength {
+		return fmt.Errorf("pii.nameHashKey must be at least %d bytes", minNameHashKeyLength)
+	}
+	return nil
+}
+
+// piiFields returns the settable string fields of the struct v points to,
+// keyed by their PII class
+func piiFields(v reflect.Value) map[string][]reflect.Value {
+	fields := make(map[string][]reflect.Value)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		class := t.Field(i).Tag.Get("pii")
+		if class == "" || t.Field(i).Type.Kind() != reflect.String {
+			continue
+		}
+		fields[class] = append(fields[class], v.Field(i))
+	}
+	return fields
+}
+
+// redactPII returns a copy of the struct v with every PII field that is
+// set replaced by RedactedValue
+func redactPII[T any](v T) T {
+	rv := reflect.ValueOf(&v).Elem()
+	for _, fields := range piiFields(rv) {
+		for _, field := range fields {
+			if field.String() != "" {
+				field.SetString(RedactedValue)
+			}
+		}
+	}
+	return v
+}
+
+// maskPII returns a copy of the struct v with PII fields partially hidden
+// according to their class
+func maskPII[T any](v T) T {
+	rv := reflect.ValueOf(&v).Elem()
+	for class, fields := range piiFields(rv) {
+		for _, field := range fields {
+			if field.String() == "" {
+				continue
+			}
+			if class == PIIEmail {
+				field.SetString(maskEmail(field.String()))
+			} else {
+				field.SetString(maskText(field.String()))
+			}
+		}
+	}
+	return v
+}
+
+// maskEmail keeps the first character of the local part and the domain,
+// turning john@example.com into j***@example.com
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return maskText(email)
+	}
+	first, _ := utf8.DecodeRuneInString(local)
+	return string(first) + "***@" + domain
+}
+
+// maskText keeps only the first character
+func maskText(s string) string {
+	first, _ := utf8.DecodeRuneInString(s)
+	return string(first) + "***"
+}
+
+// viewForPrincipal returns the user as the principal may see it
+func viewForPrincipal(user UserInfo, principal Principal) UserInfo {
+	if principal.HasScope(ScopePIIRead) {
+		return user
+	}
+	return maskPII(user)
+}
+
+// emailPattern finds email addresses in free text
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// redactingWriter masks email addresses in everything written to it. It is
+// installed as the log output so personal data never reaches the logs in
+// clear text, whatever the call site.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write(emailPattern.ReplaceAllFunc(p, func(m []byte) []byte {
+		return []byte(maskEmail(string(m)))
+	})); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// fieldCipher encrypts individual fields with AES-256-GCM
+type fieldCipher struct {
+	aead cipher.AEAD
+}
+
+// newFieldCipher loads the key from cfg. It returns nil when encryption
+// is not configured.
+func newFieldCipher(cfg PIIConfig) (*fieldCipher, error) {
+	encoded := cfg.EncryptionKey
+	if cfg.EncryptionKeyFile != "" {
+		data, err := os.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading encryption key: %w", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("encryption key must be base64-encoded")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fieldCipher{aead: aead}, nil
+}
+
+// Encrypt seals plaintext. Empty values and a nil cipher pass through.
+func (c *fieldCipher) Encrypt(plaintext string) (string, error) {
+	if c == nil || plaintext == "" {
+		return plaintext, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt. Values without the encrypted
+// prefix are returned unchanged so existing plaintext data stays readable.
+func (c *fieldCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("encrypted value found but no encryption key is configured")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt value")
+	}
+	return string(plaintext), nil
+}
+
+// emailCipher encrypts stored email addresses when a key is configured
+var emailCipher *fieldCipher
+
+// loadNameHashKey reads the name hash key from cfg. It returns nil when
+// no key is configured.
+func loadNameHashKey(cfg PIIConfig) ([]byte, error) {
+	key := cfg.NameHashKey
+	if cfg.NameHashKeyFile != "" {
+		data, err := os.ReadFile(cfg.NameHashKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading name hash key: %w", err)
+		}
+		key = strings.TrimSpace(string(data))
+		if len(key) < minNameHashKeyLength {
+			return nil, fmt.Errorf("name hash key must be at least %d bytes", minNameHashKeyLength)
+		}
+	}
+	if key == "" {
+		return nil, nil
+	}
+	return []byte(key), nil
+}
+
+// randomNameHashKey returns a key for the lifetime of the process, used
+// when none is configured
+func randomNameHashKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// nameHashKey keys the name hashes shown outside the service
+var nameHashKey = randomNameHashKey()
+
+// publicNameHash keys a stored name hash before it leaves the service, so
+// names cannot be recovered from statistics or events by hashing a
+// dictionary of common names. Stored hashes stay unkeyed so history can
+// still be found for export and erasure.
+func publicNameHash(hash string) string {
+	if hash == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, nameHashKey)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// plainUserInfo has the fields of UserInfo without its methods
+type plainUserInfo UserInfo
+
+// String formats the user with personal data redacted so UserInfo values
+// are safe to log with %v
+func (u UserInfo) String() string {
+	return fmt.Sprintf("%+v", plainUserInfo(redactPII(u)))
+}
+
+// GoString redacts personal data for %#v as well
+func (u UserInfo) GoString() string {
+	return fmt.Sprintf("%#v", plainUserInfo(redactPII(u)))
+}
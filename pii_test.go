@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEncryptionKey is a fixed 32-byte key for cipher tests
+var testEncryptionKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+// TestMaskEmail tests the masked view of email addresses
+func TestMaskEmail(t *testing.T) {
+	testCases := map[string]string{
+		"john@example.com": "j***@example.com",
+		"j@example.com":    "j***@example.com",
+		"émile@example.fr": "é***@example.fr",
+		"not-an-email":     "n***",
+		"@example.com":     "@***",
+	}
+	for input, expected := range testCases {
+		if got := maskEmail(input); got != expected {
+			t.Errorf("maskEmail(%q): expected %q, got %q", input, expected, got)
+		}
+	}
+}
+
+// TestUserInfoFormattingRedactsPII tests that printing a UserInfo never reveals email or location
+func TestUserInfoFormattingRedactsPII(t *testing.T) {
+	user := UserInfo{Name: "John", Age: 30, Location: "NYC", Email: "john@example.com"}
+
+	for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+		out := fmt.Sprintf(format, user)
+		if strings.Contains(out, "john@example.com") || strings.Contains(out, "NYC") {
+			t.Errorf("Format %s leaked personal data: %s", format, out)
+		}
+		if !strings.Contains(out, "John") || !strings.Contains(out, RedactedValue) {
+			t.Errorf("Format %s should keep the name and mark redactions: %s", format, out)
+		}
+	}
+
+	if user.Email != "john@example.com" {
+		t.Error("Expected redaction to leave the original value untouched")
+	}
+}
+
+// TestMaskPII tests the masked view used for callers without the PII scope
+func TestMaskPII(t *testing.T) {
+	user := UserInfo{Name: "John", Age: 30, Location: "New York", Email: "john@example.com"}
+
+	masked := viewForPrincipal(user, Principal{ID: AnonymousPrincipal})
+	if masked.Email != "j***@example.com" || masked.Location != "N***" {
+		t.Errorf("Unexpected masked view %+v", plainUserInfo(masked))
+	}
+	if masked.Name != "John" || masked.Age != 30 {
+		t.Error("Expected unclassified fields to be kept")
+	}
+
+	full := viewForPrincipal(user, Principal{ID: "admin", Scopes: []string{ScopePIIRead}})
+	if full != user {
+		t.Error("Expected callers with pii:read to see the full record")
+	}
+}
+
+// TestRedactingWriter tests that email addresses are masked in log output
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(redactingWriter{w: &buf}, "", 0)
+
+	logger.Printf("created user with email %s and %s", "john.doe+tag@example.com", "x@sub.example.org")
+
+	out := buf.String()
+	if strings.Contains(out, "john.doe+tag@example.com") || strings.Contains(out, "x@sub.example.org") {
+		t.Errorf("Expected emails to be masked, got %q", out)
+	}
+	if !strings.Contains(out, "j***@example.com") || !strings.Contains(out, "x***@sub.example.org") {
+		t.Errorf("Expected masked emails in output, got %q", out)
+	}
+}
+
+// TestFieldCipher tests encryption round trips and failure cases
+func TestFieldCipher(t *testing.T) {
+	c, err := newFieldCipher(PIIConfig{EncryptionKey: testEncryptionKey})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	sealed, err := c.Encrypt("john@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(sealed, encryptedPrefix) || strings.Contains(sealed, "john") {
+		t.Errorf("Expected an opaque encrypted value, got %q", sealed)
+	}
+	again, _ := c.Encrypt("john@example.com")
+	if again == sealed {
+		t.Error("Expected a fresh nonce for every encryption")
+	}
+
+	opened, err := c.Decrypt(sealed)
+	if err != nil || opened != "john@example.com" {
+		t.Errorf("Expected round trip, got %q, %v", opened, err)
+	}
+
+	if plain, err := c.Decrypt("legacy@example.com"); err != nil || plain != "legacy@example.com" {
+		t.Errorf("Expected plaintext values to pass through, got %q, %v", plain, err)
+	}
+
+	tampered := sealed[:len(sealed)-4] + "AAAA"
+	if _, err := c.Decrypt(tampered); err == nil {
+		t.Error("Expected tampered value to fail")
+	}
+
+	var disabled *fieldCipher
+	if _, err := disabled.Decrypt(sealed); err == nil {
+		t.Error("Expected decrypting without a key to fail")
+	}
+}
+
+// TestNewFieldCipherKeySources tests key loading from config and files
+func TestNewFieldCipherKeySources(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "email.key")
+	if err := os.WriteFile(keyFile, []byte(testEncryptionKey+"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		cfg       PIIConfig
+		expectNil bool
+		wantErr   bool
+	}{
+		{"Disabled", PIIConfig{}, true, false},
+		{"Inline key", PIIConfig{EncryptionKey: testEncryptionKey}, false, false},
+		{"Key file", PIIConfig{EncryptionKeyFile: keyFile}, false, false},
+		{"Missing file", PIIConfig{EncryptionKeyFile: keyFile + ".missing"}, true, true},
+		{"Short key", PIIConfig{EncryptionKey: base64.StdEncoding.EncodeToString([]byte("short"))}, true, true},
+		{"Not base64", PIIConfig{EncryptionKey: "not base64!"}, true, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := newFieldCipher(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error=%v, got %v", tc.wantErr, err)
+			}
+			if (c == nil) != tc.expectNil {
+				t.Errorf("Expected nil cipher=%v, got %v", tc.expectNil, c)
+			}
+		})
+	}
+}
+
+// TestLoadNameHashKey tests name hash key loading from config and files
+func TestLoadNameHashKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "names.key")
+	if err := os.WriteFile(keyFile, []byte("a-long-enough-secret\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	shortFile := filepath.Join(t.TempDir(), "short.key")
+	if err := os.WriteFile(shortFile, []byte("short\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         PIIConfig
+		expectedKey string
+		wantErr     bool
+	}{
+		{"Not configured", PIIConfig{}, "", false},
+		{"Inline key", PIIConfig{NameHashKey: "a-long-enough-secret"}, "a-long-enough-secret", false},
+		{"Key file", PIIConfig{NameHashKeyFile: keyFile}, "a-long-enough-secret", false},
+		{"Missing file", PIIConfig{NameHashKeyFile: keyFile + ".missing"}, "", true},
+		{"Short key file", PIIConfig{NameHashKeyFile: shortFile}, "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := loadNameHashKey(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error=%v, got %v", tc.wantErr, err)
+			}
+			if string(key) != tc.expectedKey {
+				t.Errorf("Expected key %q, got %q", tc.expectedKey, key)
+			}
+		})
+	}
+}
+
+// TestPublicNameHash tests that shown name hashes depend on the key and
+// cannot be matched against a plain hash of the name
+func TestPublicNameHash(t *testing.T) {
+	previous := nameHashKey
+	t.Cleanup(func() { nameHashKey = previous })
+
+	nameHashKey = []byte("a-long-enough-secret")
+	john := publicNameHash(nameHash("John"))
+	if john == nameHash("John") || len(john) != 64 {
+		t.Errorf("Expected a keyed hash, got %q", john)
+	}
+	if again := publicNameHash(nameHash("john")); again != john {
+		t.Errorf("Expected the same hash for the same name, got %q and %q", john, again)
+	}
+	if empty := publicNameHash(""); empty != "" {
+		t.Errorf("Expected no hash for the default name, got %q", empty)
+	}
+
+	nameHashKey = []byte("another-long-secret")
+	if other := publicNameHash(nameHash("John")); other == john {
+		t.Error("Expected a different key to give a different hash")
+	}
+}
+
+// TestListUsersMasksPIIByScope tests masked and full views of listed users
+func TestListUsersMasksPIIByScope(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"auth": {"apiKeys": [
+		{"principal": "admin-ui", "sha256": "`+sha256Hex("admin-key")+`", "scopes": ["pii:read"]}
+	]}}`))
+	useStore(t)
+	if _, err := dataStore.CreateUser(context.Background(), UserInfo{Name: "John", Location: "NYC", Email: "john@example.com"}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		apiKey        string
+		expectedEmail string
+		expectedLoc   string
+	}{
+		{"Anonymous", "", "j***@example.com", "N***"},
+		{"With pii:read", "admin-key", "john@example.com", "NYC"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/greeter/user-info", nil)
+			if tc.apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.apiKey)
+			}
+			w := httptest.NewRecorder()
+
+			authenticate(http.HandlerFunc(userInfoHandler)).ServeHTTP(w, req)
+
+			var list struct {
+				Items []UserRecord `json:"items"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Items) != 1 {
+				t.Fatalf("Expected one listed user, got %s", w.Body.String())
+			}
+			user := list.Items[0].User
+			if user.Email != tc.expectedEmail || user.Location != tc.expectedLoc {
+				t.Errorf("Expected email %q and location %q, got %q and %q", tc.expectedEmail, tc.expectedLoc, user.Email, user.Location)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+
+	// PostgreSQL driver
+	_ "github.com/lib/pq"
+)
+
+// postgresDialect stores data in PostgreSQL. The DSN is a connection URL
+// such as postgres://greeter:secret@db:5432/greeter?sslmode=verify-full
+var postgresDialect = sqlDialect{
+	name:        DriverPostgres,
+	driver:      "postgres",
+	placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	hourExpr:    "CAST(EXTRACT(HOUR FROM created_at AT TIME ZONE 'UTC') AS INTEGER)",
+	// Held until the migration transaction ends
+	migrationLock: "SELECT pg_advisory_xact_lock(7234001)",
+}
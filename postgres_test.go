@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// PostgresTestDSNEnvVar points the storage tests at a PostgreSQL server,
+// e.g. one started with make test-postgres
+const PostgresTestDSNEnvVar = "GREETER_TEST_POSTGRES_DSN"
+
+// openTestPostgres opens a Postgres store in a fresh schema, skipping the
+// test when no server is configured
+func openTestPostgres(t *testing.T) Store {
+	t.Helper()
+	dsn := os.Getenv(PostgresTestDSNEnvVar)
+	if dsn == "" {
+		t.Skipf("%s is not set", PostgresTestDSNEnvVar)
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	defer admin.Close()
+
+	id, _ := newID()
+	schema := "greeter_test_" + id
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if db, err := sql.Open("postgres", dsn); err == nil {
+			_, _ = db.Exec("DROP SCHEMA " + schema + " CASCADE")
+			db.Close()
+		}
+	})
+
+	cfg := DefaultConfig().Storage
+	cfg.Driver = DriverPostgres
+	cfg.DSN = withSearchPath(dsn, schema)
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open Postgres store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// withSearchPath adds a search_path run-time parameter to a URL or
+// key/value DSN
+func withSearchPath(dsn, schema string) string {
+	if !strings.Contains(dsn, "://") {
+		return fmt.Sprintf("%s search_path=%s", dsn, schema)
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&search_path=" + schema
+	}
+	return dsn + "?search_path=" + schema
+}
+
+// TestPostgresMigrationsAreIdempotent tests reopening an already migrated database
+func TestPostgresMigrationsAreIdempotent(t *testing.T) {
+	store := openTestPostgres(t).(*sqlStore)
+
+	if err := store.migrate(context.Background()); err != nil {
+		t.Fatalf("Expected re-running migrations to be a no-op, got %v", err)
+	}
+	migrations, _ := store.migrations()
+	var count int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count); err != nil || count != len(migrations) {
+		t.Errorf("Expected %d recorded migrations, got %d, %v", len(migrations), count, err)
+	}
+}
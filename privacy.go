@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"time"
+)
+
+// SubjectExport is the archive returned for a data subject access request
+type SubjectExport struct {
+	ExportedAt time.Time       `json:"exportedAt"`
+	Record     UserRecord      `json:"record"`
+	Greetings  []GreetingEvent `json:"greetings"`
+}
+
+// What an erasure deliberately keeps, as listed in ErasureReport.Kept
+const (
+	KeptNameGreetings = "greetings asked for by name alone, which are not tied to the user"
+	KeptSuppression   = "the suppression of the user's email address, stored as a hash"
+)
+
+// ErasureReport summarises what an erasure request removed
+type ErasureReport struct {
+	ID          string `json:"id"`
+	UserDeleted bool   `json:"userDeleted"`
+	// GreetingsDeleted counts the greetings recorded for the user's ID
+	GreetingsDeleted int `json:"greetingsDeleted"`
+	SchedulesDeleted int `json:"schedulesDeleted"`
+	// EventsDeleted counts the outbox events not yet published
+	EventsDeleted            int `json:"eventsDeleted"`
+	WebhookDeliveriesDeleted int `json:"webhookDeliveriesDeleted"`
+	EmailsCancelled          int `json:"emailsCancelled"`
+	// Kept lists what was left in place on purpose
+	Kept []string `json:"kept"`
+}
+
+// auditSubjectRequest records who asked for a subject's data to be exported
+// or erased, and the outcome
+func auditSubjectRequest(r *http.Request, action, id, outcome string, changes []FieldChange) {
+	metrics.Add("subject_requests", 1)
+	audit(r, action, id, outcome, changes)
+}
+
+// exportUser returns everything held about a user as a JSON archive
+func exportUser(w http.ResponseWriter, r *http.Request, id string) {
+	rec, err := dataStore.GetUser(r.Context(), id)
+	if err != nil {
+		auditSubjectRequest(r, AuditUserExport, id, OutcomeFailed, nil)
+		writeStoreError(w, err)
+		return
+	}
+
+	greetings, err := dataStore.GreetingsFor(r.Context(), rec.ID)
+	if err != nil {
+		auditSubjectRequest(r, AuditUserExport, id, OutcomeFailed, nil)
+		writeStoreError(w, err)
+		return
+	}
+	if greetings == nil {
+		greetings = []GreetingEvent{}
+	}
+
+	auditSubjectRequest(r, AuditUserExport, id, OutcomeCompleted, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.json"`, id))
+	archive := SubjectExport{ExportedAt: time.Now().UTC(), Record: rec, Greetings: greetings}
+	if err := json.NewEncoder(w).Encode(archive); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// eraseUser deletes a user and everything derived from them. The user
+// record is removed last so a failed request can be retried while it still
+// identifies the rest.
+func eraseUser(w http.ResponseWriter, r *http.Request, id string) {
+	rec, err := dataStore.GetUser(r.Context(), id)
+	if err != nil {
+		auditSubjectRequest(r, AuditUserErase, id, OutcomeFailed, nil)
+		writeStoreError(w, err)
+		return
+	}
+
+	if !requireIfMatch(w, r, rec, true) {
+		auditSubjectRequest(r, AuditUserErase, id, OutcomeFailed, nil)
+		return
+	}
+
+	report := ErasureReport{ID: id}
+	if err := eraseTraces(r.Context(), rec, &report); err != nil {
+		auditSubjectRequest(r, AuditUserErase, id, OutcomeFailed, nil)
+		writeStoreError(w, err)
+		return
+	}
+	if err := dataStore.DeleteUser(r.Context(), id); err != nil && !errors.Is(err, ErrNotFound) {
+		auditSubjectRequest(r, AuditUserErase, id, OutcomeFailed, nil)
+		writeStoreError(w, err)
+		return
+	}
+	report.UserDeleted = true
+
+	auditSubjectRequest(r, AuditUserErase, id, OutcomeCompleted, diffUsers(rec.User, UserInfo{}))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// eraseTraces removes what was derived from a user: the greetings recorded
+// for their ID, schedules, unpublished events, webhook deliveries, queued
+// emails and cached responses. Greetings asked for by name alone are kept,
+// since other users may share the name. The suppression of their address
+// is kept too, so a user created again with it is still not mailed; it
+// holds only the address hash.
+func eraseTraces(ctx context.Context, rec UserRecord, report *ErasureReport) error {
+	report.Kept = []string{KeptNameGreetings}
+	var err error
+	if report.GreetingsDeleted, err = dataStore.DeleteGreetings(ctx, rec.ID); err != nil {
+		return err
+	}
+	if report.SchedulesDeleted, err = schedules.DeleteForUser(ctx, rec.ID); err != nil {
+		return err
+	}
+	if report.EventsDeleted, err = dataStore.DeleteSubjectEvents(ctx, rec.ID); err != nil {
+		return err
+	}
+	report.WebhookDeliveriesDeleted = webhooks.Forget(webhookSubject{UserID: rec.ID})
+	if rec.User.Email != "" {
+		address := rec.User.Email
+		if parsed, err := mail.ParseAddress(address); err == nil {
+			address = parsed.Address
+		}
+		addressHash := emailAddressHash(address)
+		report.EmailsCancelled = emails.Forget(addressHash)
+		_, err := dataStore.GetSuppression(ctx, addressHash)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			report.Kept = append(report.Kept, KeptSuppression)
+		}
+	}
+	greetingCache.removeName(sanitizeName(rec.User.Name))
+	idempotencyKeys.forget(rec.ID)
+	return nil
+}
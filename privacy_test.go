@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useScopedKeys configures an API key per scope used by the privacy endpoints
+func useScopedKeys(t *testing.T) {
+	t.Helper()
+	useConfig(t, writeConfig(t, `{"auth": {"apiKeys": [
+		{"principal": "dpo", "sha256": "`+sha256Hex("dpo-key")+`", "scopes": ["pii:read", "pii:erase"]},
+		{"principal": "support", "sha256": "`+sha256Hex("support-key")+`"}
+	]}}`))
+}
+
+// serveUsers runs a request through authentication and the user routes.
+// headers are name/value pairs.
+func serveUsers(method, target, apiKey string, body []byte, headers ...string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/greeter/user-info", userInfoHandler)
+	mux.HandleFunc("/greeter/user-info/", userRecordHandler)
+	mux.HandleFunc("/greeter/user-info/import", importUsers)
+	mux.HandleFunc("/greeter/user-info/export", exportUsers)
+
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	authenticate(mux).ServeHTTP(w, req)
+	return w
+}
+
+// createTestUser creates a user through the API and returns its ID
+func createTestUser(t *testing.T, user UserInfo) string {
+	t.Helper()
+	payload, _ := json.Marshal(user)
+	w := serveUsers("POST", "/greeter/user-info", "", payload)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.ID == "" {
+		t.Fatalf("Expected an ID in the response, got %s", w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != "/greeter/user-info/"+response.ID {
+		t.Errorf("Expected Location header for the new user, got %q", location)
+	}
+	return response.ID
+}
+
+// recordUserGreeting records a scheduled greeting for a stored user
+func recordUserGreeting(id, name string) {
+	recordGreetingEvent(context.Background(), GreetingEvent{Type: GreetingScheduled, UserID: id, NameHash: nameHash(name), Time: time.Now().UTC()})
+}
+
+// TestSubjectExport tests the export archive and its authorisation
+func TestSubjectExport(t *testing.T) {
+	useScopedKeys(t)
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John", Age: 30, Email: "john@example.com"})
+	namesake := createTestUser(t, UserInfo{Name: "John"})
+	recordUserGreeting(id, "John")
+	recordUserGreeting(namesake, "John")
+	greet(httptest.NewRecorder(), httptest.NewRequest("GET", "/greeter/greet?name=John", nil))
+	farewell(httptest.NewRecorder(), httptest.NewRequest("GET", "/greeter/farewell?name=Jane", nil))
+
+	testCases := []struct {
+		name           string
+		target         string
+		apiKey         string
+		expectedStatus int
+	}{
+		{"Without scope", "/greeter/user-info/" + id + "/export", "support-key", http.StatusForbidden},
+		{"Anonymous", "/greeter/user-info/" + id + "/export", "", http.StatusForbidden},
+		{"Unknown user", "/greeter/user-info/missing/export", "dpo-key", http.StatusNotFound},
+		{"Unknown action", "/greeter/user-info/" + id + "/archive", "dpo-key", http.StatusMethodNotAllowed},
+		{"With scope", "/greeter/user-info/" + id + "/export", "dpo-key", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveUsers("GET", tc.target, tc.apiKey, nil)
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			if !strings.Contains(w.Header().Get("Content-Disposition"), "user-"+id+".json") {
+				t.Errorf("Expected an attachment filename, got %q", w.Header().Get("Content-Disposition"))
+			}
+			var archive SubjectExport
+			if err := json.Unmarshal(w.Body.Bytes(), &archive); err != nil {
+				t.Fatalf("Failed to unmarshal export: %v", err)
+			}
+			if archive.Record.User.Email != "john@example.com" {
+				t.Errorf("Expected the unmasked email in the export, got %q", archive.Record.User.Email)
+			}
+			if len(archive.Greetings) != 1 || archive.Greetings[0].Type != GreetingScheduled || archive.Greetings[0].UserID != id {
+				t.Errorf("Expected only the greeting recorded for the user, got %+v", archive.Greetings)
+			}
+		})
+	}
+}
+
+// TestSubjectErasure tests that erasure removes the user and their greeting
+// history, and keeps other users' history and the email suppression
+func TestSubjectErasure(t *testing.T) {
+	useScopedKeys(t)
+	store := useStore(t)
+	cache := useResponseCache(t)
+	_, _ = useScheduler(t, time.Now())
+	// Without workers, webhook deliveries and emails stay queued
+	hooks := newWebhookDispatcher(WebhookConfig{QueueSize: 10})
+	previousHooks := webhooks
+	webhooks = hooks
+	t.Cleanup(func() { webhooks = previousHooks })
+	if _, err := hooks.Subscribe(WebhookSubscription{URL: "https://hooks.example.com", Events: []string{"*"}}); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	mailCfg := DefaultConfig().Email
+	mailCfg.Enabled, mailCfg.Welcome, mailCfg.Workers = true, true, 0
+	mailCfg.From = "Greeter <greeter@example.com>"
+	mailCfg.UnsubscribeURL = "https://greeter.example.com/greeter/email/unsubscribe"
+	mailCfg.UnsubscribeSecret = testUnsubscribeSecret
+	mailer := newMailer(mailCfg, "")
+	previousEmails := emails
+	emails = mailer
+	t.Cleanup(func() { emails = previousEmails })
+
+	id := createTestUser(t, UserInfo{Name: "John", Email: "john@example.com"})
+	namesake := createTestUser(t, UserInfo{Name: "John"})
+	recordUserGreeting(id, "John")
+	recordUserGreeting(namesake, "John")
+	greet(httptest.NewRecorder(), httptest.NewRequest("GET", "/greeter/greet?name=John", nil))
+	greet(httptest.NewRecorder(), httptest.NewRequest("GET", "/greeter/greet?name=Jane", nil))
+	for _, sch := range []Schedule{{ID: "john", UserID: id}, {ID: "jane", UserID: "other"}} {
+		if err := store.SaveSchedule(context.Background(), sch, 0); err != nil {
+			t.Fatalf("Failed to save schedule: %v", err)
+		}
+	}
+	addressHash := emailAddressHash("john@example.com")
+	if err := store.SuppressEmail(context.Background(), EmailSuppression{AddressHash: addressHash, Reason: SuppressionUnsubscribed}); err != nil {
+		t.Fatalf("Failed to suppress email: %v", err)
+	}
+
+	if w := serveUsers("DELETE", "/greeter/user-info/"+id, "support-key", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d without pii:erase, got %d", http.StatusForbidden, w.Code)
+	}
+
+	if w := serveUsers("DELETE", "/greeter/user-info/"+id, "dpo-key", nil); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("Expected status %d without If-Match, got %d", http.StatusPreconditionRequired, w.Code)
+	}
+
+	w := serveUsers("DELETE", "/greeter/user-info/"+id, "dpo-key", nil, "If-Match", `"v1-f"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var report ErasureReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to unmarshal report: %v", err)
+	}
+	expected := ErasureReport{ID: id, UserDeleted: true, GreetingsDeleted: 1, SchedulesDeleted: 1, EventsDeleted: 1,
+		WebhookDeliveriesDeleted: 2, EmailsCancelled: 1, Kept: []string{KeptNameGreetings, KeptSuppression}}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Expected erasure report %+v, got %+v", expected, report)
+	}
+
+	if _, err := store.GetUser(context.Background(), id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected user to be gone, got %v", err)
+	}
+	if events, _ := store.GreetingsFor(context.Background(), namesake); len(events) != 1 {
+		t.Errorf("Expected the history of another John to be kept, got %d events", len(events))
+	}
+	if stats, _ := store.GreetingStats(context.Background(), StatsQuery{Until: time.Now().Add(time.Minute), Top: 1}); stats.ByType[GreetingGreet] != 2 {
+		t.Errorf("Expected greetings asked for by name to be kept, got %v", stats.ByType)
+	}
+	if list, _ := store.ListSchedules(context.Background()); len(list) != 1 || list[0].ID != "jane" {
+		t.Errorf("Expected only the other user's schedule to be kept, got %+v", list)
+	}
+	if events, _ := store.PendingEvents(context.Background(), 10); len(events) != 1 || events[0].Subject != namesake {
+		t.Errorf("Expected only the other John's outbox event, got %+v", events)
+	}
+	if _, err := store.GetSuppression(context.Background(), addressHash); err != nil {
+		t.Errorf("Expected the suppression to be kept, got %v", err)
+	}
+	if deliveries := hooks.Deliveries("", ""); len(deliveries) != 4 {
+		t.Errorf("Expected the deliveries about the other John and the greetings by name to be kept, got %+v", deliveries)
+	}
+	if n := mailer.Forget(addressHash); n != 0 {
+		t.Errorf("Expected no queued emails, got %d", n)
+	}
+	for key := range cache.entries {
+		if strings.HasSuffix(key, "\x00John") {
+			t.Errorf("Expected the cached greeting for John to be gone, got %q", key)
+		}
+	}
+	if len(cache.entries) != 1 {
+		t.Errorf("Expected the cached greeting for Jane to be kept, got %d entries", len(cache.entries))
+	}
+	if w := serveUsers("DELETE", "/greeter/user-info/"+id, "dpo-key", nil, "If-Match", "*"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a repeated erasure, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// TestGetUserRecord tests reading a stored user with masking
+func TestGetUserRecord(t *testing.T) {
+	useScopedKeys(t)
+	useStore(t)
+	id := createTestUser(t, UserInfo{Name: "John", Email: "john@example.com"})
+
+	w := serveUsers("GET", "/greeter/user-info/"+id, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var rec UserRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+		t.Fatalf("Failed to unmarshal record: %v", err)
+	}
+	if rec.ID != id || rec.User.Email != "j***@example.com" {
+		t.Errorf("Expected masked record %s, got %+v", id, rec)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Output formats supported by writeMessage
+const (
+	FormatText = "text/plain"
+	FormatHTML = "text/html"
+	FormatJSON = "application/json"
+)
+
+// ContentSecurityPolicy is sent with every rendered message. The service
+// never serves scripts, styles or frames of its own.
+const ContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+// htmlMessage renders a message as an escaped HTML fragment
+var htmlMessage = template.Must(template.New("message").Parse(`<p class="greeting">{{.}}</p>` + "\n"))
+
+// MessageResponse is the JSON form of a rendered message
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+// isBidiControl reports whether r is a Unicode bidirectional embedding,
+// override or isolate control, which can make text display differently
+// from how it is stored
+func isBidiControl(r rune) bool {
+	switch {
+	case r >= '\u202A' && r <= '\u202E': // LRE, RLE, PDF, LRO, RLO
+		return true
+	case r >= '\u2066' && r <= '\u2069': // LRI, RLI, FSI, PDI
+		return true
+	case r == '\u200E' || r == '\u200F' || r == '\u061C': // LRM, RLM, ALM
+		return true
+	}
+	return false
+}
+
+// sanitizeName prepares a user-supplied name for display: it is normalised
+// to NFC, and control and bidi override characters are removed
+func sanitizeName(name string) string {
+	name = norm.NFC.String(name)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || isBidiControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, name)
+}
+
+// negotiateFormat picks the output format from the Accept header,
+// defaulting to plain text
+func negotiateFormat(r *http.Request) string {
+	best, bestQ := FormatText, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				q = parsed
+			}
+		}
+
+		var format string
+		switch mediaType {
+		case FormatText, "text/*", "*/*":
+			format = FormatText
+		case FormatHTML:
+			format = FormatHTML
+		case FormatJSON:
+			format = FormatJSON
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// setRenderHeaders sets the headers common to every rendered message
+func setRenderHeaders(w http.ResponseWriter, contentType string) {
+	header := w.Header()
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", ContentSecurityPolicy)
+	header.Add("Vary", "Accept")
+	header.Add("Vary", "Accept-Language")
+}
+
+// writeMessage writes a greeting in the format negotiated for r, escaping
+// it for that format
+func writeMessage(w http.ResponseWriter, r *http.Request, message string) {
+	format := negotiateFormat(r)
+	body, err := renderBody(format, message)
+	if err != nil {
+		http.Error(w, "Failed to render response", http.StatusInternalServerError)
+		return
+	}
+	setRenderHeaders(w, format)
+	_, _ = w.Write(body)
+}
+
+// renderBody formats a message as a response body in one of the output
+// formats
+func renderBody(format, message string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case FormatHTML:
+		err = htmlMessage.Execute(&buf, message)
+	case FormatJSON:
+		err = json.NewEncoder(&buf).Encode(MessageResponse{Message: message})
+	default:
+		_, err = fmt.Fprintln(&buf, message)
+	}
+	return buf.Bytes(), err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestSanitizeName tests normalisation and removal of unsafe characters
+func TestSanitizeName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"Plain", "Alice", "Alice"},
+		{"NFC composition", "Jose\u0301", "Jos\u00e9"},
+		{"Already composed", "Jos\u00e9", "Jos\u00e9"},
+		{"Right-to-left override", "Alice\u202egnp.exe", "Alicegnp.exe"},
+		{"Isolates", "\u2066Bob\u2069", "Bob"},
+		{"Control characters", "Al\x00ice\r\n\x1b[31m", "Alice[31m"},
+		{"Invalid UTF-8", "Al\xffice", "Alice"},
+		{"Markup kept for escaping later", "<script>", "<script>"},
+		{"Unicode letters", "用户", "用户"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sanitizeName(tc.input); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestNegotiateFormat tests output format selection from the Accept header
+func TestNegotiateFormat(t *testing.T) {
+	testCases := []struct {
+		accept   string
+		expected string
+	}{
+		{"", FormatText},
+		{"*/*", FormatText},
+		{"text/plain", FormatText},
+		{"application/json", FormatJSON},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", FormatHTML},
+		{"text/html;q=0.5, application/json", FormatJSON},
+		{"application/xml", FormatText},
+		{"application/json;q=0", FormatText},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/greeter/greet", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		if got := negotiateFormat(req); got != tc.expected {
+			t.Errorf("Accept %q: expected %q, got %q", tc.accept, tc.expected, got)
+		}
+	}
+}
+
+// TestGreetHandlerEscapesPerFormat tests that markup in names is escaped for each output format
+func TestGreetHandlerEscapesPerFormat(t *testing.T) {
+	name := `<script>alert("x")</script>`
+
+	testCases := []struct {
+		name        string
+		accept      string
+		contentType string
+		check       func(t *testing.T, body string)
+	}{
+		{"HTML", "text/html", "text/html; charset=utf-8", func(t *testing.T, body string) {
+			if strings.Contains(body, "<script>") {
+				t.Errorf("Expected markup to be escaped, got %q", body)
+			}
+			if !strings.Contains(body, "&lt;script&gt;") {
+				t.Errorf("Expected escaped script tag, got %q", body)
+			}
+		}},
+		{"JSON", "application/json", "application/json; charset=utf-8", func(t *testing.T, body string) {
+			if strings.Contains(body, "<script>") {
+				t.Errorf("Expected markup to be escaped, got %q", body)
+			}
+			var response MessageResponse
+			if err := json.Unmarshal([]byte(body), &response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+			if response.Message != "Hello, "+name+"!" {
+				t.Errorf("Expected message to round-trip, got %q", response.Message)
+			}
+		}},
+		{"Text", "text/plain", "text/plain; charset=utf-8", func(t *testing.T, body string) {
+			if body != "Hello, "+name+"!\n" {
+				t.Errorf("Expected literal text, got %q", body)
+			}
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/greeter/greet?name="+url.QueryEscape(name), nil)
+			req.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+
+			greet(w, req)
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+
+			if got := resp.Header.Get("Content-Type"); got != tc.contentType {
+				t.Errorf("Expected Content-Type %q, got %q", tc.contentType, got)
+			}
+			if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("Expected X-Content-Type-Options nosniff, got %q", got)
+			}
+			if got := resp.Header.Get("Content-Security-Policy"); got != ContentSecurityPolicy {
+				t.Errorf("Expected Content-Security-Policy %q, got %q", ContentSecurityPolicy, got)
+			}
+			tc.check(t, string(body))
+		})
+	}
+}
+
+// TestFarewellHandlerStripsControlCharacters tests that text output cannot inject extra lines
+func TestFarewellHandlerStripsControlCharacters(t *testing.T) {
+	req := httptest.NewRequest("GET", "/greeter/farewell?name="+url.QueryEscape("Eve\r\nX-Injected: yes"), nil)
+	w := httptest.NewRecorder()
+
+	farewell(w, req)
+
+	body, _ := io.ReadAll(w.Result().Body)
+	expected := "Goodbye, EveX-Injected: yes! Have a great day!\n"
+	if string(body) != expected {
+		t.Errorf("Expected body %q, got %q", expected, string(body))
+	}
+}
+
+// TestGreetHandlerOnlyUnsafeCharacters tests that a name made only of stripped characters falls back to the default
+func TestGreetHandlerOnlyUnsafeCharacters(t *testing.T) {
+	req := httptest.NewRequest("GET", "/greeter/greet?name="+url.QueryEscape("\u202e\x00"), nil)
+	w := httptest.NewRecorder()
+
+	greet(w, req)
+
+	body, _ := io.ReadAll(w.Result().Body)
+	if string(body) != "Hello, Stranger!\n" {
+		t.Errorf("Expected default name, got %q", string(body))
+	}
+}
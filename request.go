@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// LimitsConfig bounds the size and shape of request bodies
+type LimitsConfig struct {
+	// MaxBodyBytes applies to routes without their own limit
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// RouteBodyBytes overrides the limit for a path and everything below it
+	RouteBodyBytes map[string]int64 `json:"routeBodyBytes,omitempty"`
+	// MaxJSONDepth caps nesting of JSON objects and arrays
+	MaxJSONDepth int `json:"maxJSONDepth"`
+}
+
+// Validate checks the request limits
+func (l LimitsConfig) Validate() error {
+	if l.MaxBodyBytes <= 0 {
+		return errors.New("limits.maxBodyBytes must be positive")
+	}
+	for route, limit := range l.RouteBodyBytes {
+		if !strings.HasPrefix(route, "/") || limit <= 0 {
+			return fmt.Errorf("limits.routeBodyBytes[%q] must be a path with a positive limit", route)
+		}
+	}
+	if l.MaxJSONDepth <= 0 {
+		return errors.New("limits.maxJSONDepth must be positive")
+	}
+	return nil
+}
+
+// bodyLimit returns the body size limit for path, using the longest
+// matching route prefix
+func (l LimitsConfig) bodyLimit(path string) int64 {
+	if limit, ok := routeMatch(l.RouteBodyBytes, path); ok {
+		return limit
+	}
+	return l.MaxBodyBytes
+}
+
+// limitBody caps every request body at the limit configured for its route
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := activeConfig.Get().Limits.bodyLimit(r.URL.Path)
+		if r.ContentLength > limit {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must not exceed %d bytes", limit))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSONError writes a JSON error response with the given status
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": message}); err != nil {
+		http.Error(w, "Failed to encode error response", http.StatusInternalServerError)
+	}
+}
+
+// requestError is a client error carrying the HTTP status to report
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// writeJSON writes v as a JSON response with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// writeRequestError reports err to the client, using its status when it
+// is a requestError and 400 otherwise
+func writeRequestError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		writeJSONError(w, reqErr.status, reqErr.message)
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, err.Error())
+}
+
+// writeStoreError reports a storage error, hiding internal details
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		writeJSONError(w, http.StatusPreconditionFailed, "user was modified since it was read")
+		return
+	}
+	log.Printf("Storage error: %v", err)
+	writeJSONError(w, http.StatusInternalServerError, "storage error")
+}
+
+// requireContentType checks that the request body has one of the given
+// media types
+func requireContentType(r *http.Request, mediaTypes ...string) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil {
+		for _, allowed := range mediaTypes {
+			if mediaType == allowed {
+				return nil
+			}
+		}
+	}
+	return &requestError{
+		status:  http.StatusUnsupportedMediaType,
+		message: fmt.Sprintf("Content-Type must be %s", strings.Join(mediaTypes, " or ")),
+	}
+}
+
+// readBody reads the whole request body, translating an exceeded
+// MaxBytesReader limit into a 413 error
+func readBody(r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, &requestError{
+				status:  http.StatusRequestEntityTooLarge,
+				message: fmt.Sprintf("request body must not exceed %d bytes", tooLarge.Limit),
+			}
+		}
+		return nil, &requestError{status: http.StatusBadRequest, message: "failed to read request body"}
+	}
+	return data, nil
+}
+
+// decodeJSONBody strictly decodes a single JSON value from an
+// application/json request body into dst: unknown fields, trailing data
+// and nesting beyond the configured depth are rejected
+func decodeJSONBody(r *http.Request, dst interface{}) error {
+	if err := requireContentType(r, "application/json"); err != nil {
+		return err
+	}
+	data, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(data, dst, activeConfig.Get().Limits.MaxJSONDepth)
+}
+
+// decodeJSON strictly decodes data into dst
+func decodeJSON(data []byte, dst interface{}, maxDepth int) error {
+	if err := checkJSONDepth(data, maxDepth); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return &requestError{status: http.StatusBadRequest, message: describeJSONError(err)}
+	}
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return &requestError{status: http.StatusBadRequest, message: "request body must contain a single JSON value"}
+	}
+	return nil
+}
+
+// describeJSONError turns a decoding error into a message for the client
+func describeJSONError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "request body must not be empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "request body contains truncated JSON"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("request body contains malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Sprintf("field %q must be of type %s", typeErr.Field, typeErr.Type)
+		}
+		return fmt.Sprintf("request body must be a JSON %s", jsonKind(typeErr.Type.Kind().String()))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "request body contains unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	default:
+		return "Invalid JSON payload"
+	}
+}
+
+// jsonKind names the JSON type corresponding to a Go kind
+func jsonKind(kind string) string {
+	switch kind {
+	case "struct", "map":
+		return "object"
+	case "slice", "array":
+		return "array"
+	default:
+		return kind
+	}
+}
+
+// checkJSONDepth rejects documents nesting objects or arrays deeper than
+// maxDepth. It only tracks brackets outside of strings; syntax errors are
+// left for the decoder to report.
+func checkJSONDepth(data []byte, maxDepth int) error {
+	depth, inString, escaped := 0, false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && b == '\\':
+			escaped = true
+		case b == '"':
+			inString = !inString
+		case inString:
+		case b == '{' || b == '[':
+			depth++
+			if depth > maxDepth {
+				return &requestError{
+					status:  http.StatusBadRequest,
+					message: fmt.Sprintf("request body nests deeper than %d levels", maxDepth),
+				}
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return nil
+}
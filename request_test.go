@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postUserInfo sends body to the user info handler behind the body limit middleware
+func postUserInfo(contentType string, body io.Reader) *http.Response {
+	req := httptest.NewRequest("POST", "/greeter/user-info", body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+
+	limitBody(http.HandlerFunc(userInfoHandler)).ServeHTTP(w, req)
+	return w.Result()
+}
+
+// TestCreateUserInfoStrictDecoding tests rejection of malformed or unexpected payloads
+func TestCreateUserInfoStrictDecoding(t *testing.T) {
+	testCases := []struct {
+		name           string
+		contentType    string
+		body           string
+		expectedStatus int
+		errText        string
+	}{
+		{"Valid", "application/json", `{"name": "John", "age": 30}`, http.StatusCreated, ""},
+		{"Charset parameter", "application/json; charset=utf-8", `{"name": "John"}`, http.StatusCreated, ""},
+		{"Unknown field", "application/json", `{"name": "John", "admin": true}`, http.StatusBadRequest, "unknown field"},
+		{"Trailing garbage", "application/json", `{"name": "John"} garbage`, http.StatusBadRequest, "single JSON value"},
+		{"Two objects", "application/json", `{"name": "John"}{"name": "Jane"}`, http.StatusBadRequest, "single JSON value"},
+		{"Empty body", "application/json", ``, http.StatusBadRequest, "must not be empty"},
+		{"Truncated", "application/json", `{"name": "Jo`, http.StatusBadRequest, "truncated"},
+		{"Malformed", "application/json", `{"name" "John"}`, http.StatusBadRequest, "malformed JSON"},
+		{"Wrong field type", "application/json", `{"name": "John", "age": "old"}`, http.StatusBadRequest, `field "age"`},
+		{"Array instead of object", "application/json", `[{"name": "John"}]`, http.StatusBadRequest, "JSON object"},
+		{"Too deep", "application/json", `{"name": "John", "x": ` + strings.Repeat("[", 40) + strings.Repeat("]", 40) + `}`, http.StatusBadRequest, "nests deeper"},
+		{"Brackets inside strings", "application/json", `{"name": "` + strings.Repeat("[", 40) + `"}`, http.StatusCreated, ""},
+		{"Wrong content type", "text/plain", `{"name": "John"}`, http.StatusUnsupportedMediaType, "Content-Type"},
+		{"Missing content type", "", `{"name": "John"}`, http.StatusUnsupportedMediaType, "Content-Type"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postUserInfo(tc.contentType, strings.NewReader(tc.body))
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%s)", tc.expectedStatus, resp.StatusCode, body)
+			}
+			if tc.errText == "" {
+				return
+			}
+			var response map[string]string
+			if err := json.Unmarshal(body, &response); err != nil {
+				t.Fatalf("Failed to unmarshal error response: %v", err)
+			}
+			if !strings.Contains(response["error"], tc.errText) {
+				t.Errorf("Expected error to contain %q, got %q", tc.errText, response["error"])
+			}
+		})
+	}
+}
+
+// TestCreateUserInfoBodyTooLarge tests 413 responses for declared and streamed oversized bodies
+func TestCreateUserInfoBodyTooLarge(t *testing.T) {
+	limit := activeConfig.Get().Limits.bodyLimit("/greeter/user-info")
+	payload := `{"name": "` + strings.Repeat("A", int(limit)) + `"}`
+
+	t.Run("Declared length", func(t *testing.T) {
+		resp := postUserInfo("application/json", strings.NewReader(payload))
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Unknown length", func(t *testing.T) {
+		// Hide the length so the limit is enforced while reading
+		resp := postUserInfo("application/json", io.MultiReader(strings.NewReader(payload)))
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(string(body), "must not exceed") {
+			t.Errorf("Expected size error message, got %q", string(body))
+		}
+	})
+}
+
+// TestBodyLimitRoutes tests the per-route limit lookup
+func TestBodyLimitRoutes(t *testing.T) {
+	limits := LimitsConfig{
+		MaxBodyBytes: 100,
+		RouteBodyBytes: map[string]int64{
+			"/greeter/user-info":        10,
+			"/greeter/user-info/import": 1000,
+		},
+	}
+
+	testCases := map[string]int64{
+		"/greeter/greet":             100,
+		"/greeter/user-info":         10,
+		"/greeter/user-info/42":      10,
+		"/greeter/user-info/import":  1000,
+		"/greeter/user-infoextended": 100,
+	}
+	for path, expected := range testCases {
+		if got := limits.bodyLimit(path); got != expected {
+			t.Errorf("bodyLimit(%q): expected %d, got %d", path, expected, got)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// Schedules name IANA time zones, which the Alpine image lacks
+	_ "time/tzdata"
+)
+
+// Schedule messages; ScheduleMessageTime picks the morning, afternoon or
+// evening greeting for the local time of each run, as /greeter/time-greet does
+const (
+	ScheduleMessageGreet    = MsgGreet
+	ScheduleMessageFarewell = MsgFarewell
+	ScheduleMessageTime     = "time"
+)
+
+// Schedule deliveries
+const (
+	// ScheduleDeliveryWebhook sends greeting.scheduled events to webhook
+	// subscribers
+	ScheduleDeliveryWebhook = "webhook"
+	// ScheduleDeliveryLog writes the greeting to the service log
+	ScheduleDeliveryLog = "log"
+	// ScheduleDeliveryEmail emails the greeting to the user's address
+	ScheduleDeliveryEmail = "email"
+)
+
+// Missed-run policies, applied to runs that start later than the
+// scheduler's misfire grace, typically after a restart
+const (
+	// MissedRunsSkip drops missed runs
+	MissedRunsSkip = "skip"
+	// MissedRunsOnce delivers one greeting for all missed runs
+	MissedRunsOnce = "once"
+	// MissedRunsAll delivers every missed run, up to the scheduler's
+	// maxCatchUp most recent
+	MissedRunsAll = "all"
+)
+
+// SchedulerConfig controls the greeting scheduler
+type SchedulerConfig struct {
+	// Enabled runs due schedules on this instance. Instances sharing a
+	// database should enable it on one of them only.
+	Enabled bool `json:"enabled"`
+	// PollInterval bounds how long a schedule changed through another
+	// instance waits to be noticed
+	PollInterval Duration `json:"pollInterval"`
+	// MisfireGrace is how late a run may start and still be on time
+	MisfireGrace Duration `json:"misfireGrace"`
+	// MaxCatchUp caps the runs delivered at once under the all policy
+	MaxCatchUp int `json:"maxCatchUp"`
+}
+
+// Validate checks the scheduler settings
+func (c SchedulerConfig) Validate() error {
+	switch {
+	case c.PollInterval <= 0:
+		return errors.New("scheduler.pollInterval must be positive")
+	case c.MisfireGrace <= 0:
+		return errors.New("scheduler.misfireGrace must be positive")
+	case c.MaxCatchUp <= 0:
+		return errors.New("scheduler.maxCatchUp must be positive")
+	}
+	return nil
+}
+
+// Schedule is a greeting delivered to a stored user on a cron schedule or
+// once at a given time
+type Schedule struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	// Message is greet, farewell or time
+	Message string `json:"message"`
+	// Locale of the message; empty uses the default locale
+	Locale string `json:"locale,omitempty"`
+	// Cron is a five-field cron expression; At is a one-off time. Exactly
+	// one of them is set.
+	Cron string     `json:"cron,omitempty"`
+	At   *time.Time `json:"at,omitempty"`
+	// Timezone is the IANA zone cron expressions and the time message are
+	// evaluated in
+	Timezone   string `json:"timezone"`
+	Delivery   string `json:"delivery"`
+	MissedRuns string `json:"missedRuns"`
+	// NextRun is nil once a one-off schedule has run
+	NextRun   *time.Time `json:"nextRun"`
+	LastRun   *time.Time `json:"lastRun,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	// Version increases with every change, so a run never overwrites an
+	// edit made while it was delivering
+	Version int64 `json:"version"`
+
+	clock *scheduleClock
+}
+
+// scheduleClock is the parsed cron expression and time zone of a schedule
+type scheduleClock struct {
+	at   *time.Time
+	cron *cronSchedule
+	loc  *time.Location
+}
+
+// times returns the parsed cron expression and time zone of s, parsing
+// them the first time
+func (s *Schedule) times() (*scheduleClock, error) {
+	if s.clock != nil {
+		return s.clock, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	c := &scheduleClock{at: s.At, loc: loc}
+	if s.At == nil {
+		if c.cron, err = parseCron(s.Cron); err != nil {
+			return nil, err
+		}
+	}
+	s.clock = c
+	return c, nil
+}
+
+// nextAfter returns the first run after t, or nil when there is none
+func (c *scheduleClock) nextAfter(t time.Time) *time.Time {
+	if c.at != nil {
+		if !c.at.After(t) {
+			return nil
+		}
+		at := c.at.UTC()
+		return &at
+	}
+	next := c.cron.Next(t.In(c.loc))
+	if next.IsZero() {
+		return nil
+	}
+	next = next.UTC()
+	return &next
+}
+
+// ScheduledGreeting is the payload of greeting.scheduled events
+type ScheduledGreeting struct {
+	ScheduleID   string    `json:"scheduleId"`
+	UserID       string    `json:"userId"`
+	Message      string    `json:"message"`
+	Locale       string    `json:"locale"`
+	ScheduledFor time.Time `json:"scheduledFor"`
+	DeliveredAt  time.Time `json:"deliveredAt"`
+}
+
+// greetingScheduler delivers due schedules. Deliveries happen outside mu,
+// so they do not hold up the API; schedules are saved with a version check
+// so a run never overwrites an edit made meanwhile.
+type greetingScheduler struct {
+	mu sync.Mutex
+	// running keeps passes from delivering the same run twice
+	running sync.Mutex
+	cfg     SchedulerConfig
+	now     func() time.Time
+
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func newGreetingScheduler(cfg SchedulerConfig) *greetingScheduler {
+	return &greetingScheduler{
+		cfg:  cfg,
+		now:  time.Now,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// schedules is the scheduler used by the handlers
+var schedules = newGreetingScheduler(DefaultConfig().Scheduler)
+
+// Start runs due schedules in the background until Close
+func (s *greetingScheduler) Start() {
+	s.startOnce.Do(func() { go s.run() })
+}
+
+// Close stops the scheduler, waiting for a run in progress
+func (s *greetingScheduler) Close(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.startOnce.Do(func() { close(s.done) })
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Save stores sch with its next run computed from now and wakes the
+// scheduler. It returns ErrVersionConflict when the schedule changed since
+// sch was read.
+func (s *greetingScheduler) Save(ctx context.Context, sch Schedule) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	clock, err := sch.times()
+	if err != nil {
+		return sch, err
+	}
+	sch.NextRun, sch.UpdatedAt = clock.nextAfter(now), now
+	if sch.CreatedAt.IsZero() {
+		sch.CreatedAt = now
+	}
+	expected := sch.Version
+	sch.Version++
+	if err := dataStore.SaveSchedule(ctx, sch, expected); err != nil {
+		return sch, err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return sch, nil
+}
+
+// Delete removes a schedule
+func (s *greetingScheduler) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return dataStore.DeleteSchedule(ctx, id)
+}
+
+// DeleteForUser removes the schedules of a user and returns how many
+// there were
+func (s *greetingScheduler) DeleteForUser(ctx context.Context, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return dataStore.DeleteUserSchedules(ctx, userID)
+}
+
+// run delivers due schedules until stopped, sleeping until the next run
+// or the poll interval, whichever comes first
+func (s *greetingScheduler) run() {
+	defer close(s.done)
+	for {
+		wait := time.Duration(s.cfg.PollInterval)
+		next, err := s.RunDue(context.Background())
+		if err != nil {
+			log.Printf("Scheduler failed: %v", err)
+		} else if next != nil {
+			if until := next.Sub(s.now()); until < wait {
+				wait = until
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// RunDue delivers the schedules whose next run has come and returns the
+// earliest next run left. A schedule that cannot be run, or whose delivery
+// failed, is logged and retried after the poll interval; one changed or
+// deleted while it was delivering keeps the change.
+func (s *greetingScheduler) RunDue(ctx context.Context) (*time.Time, error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+	s.mu.Lock()
+	all, err := dataStore.ListSchedules(ctx)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now().UTC()
+	var earliest *time.Time
+	for _, sch := range all {
+		if sch.NextRun != nil && !sch.NextRun.After(now) {
+			if sch, err = s.process(ctx, sch, now); errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionConflict) {
+				continue
+			} else if err != nil {
+				log.Printf("Schedule %s could not be run: %v", sch.ID, err)
+				continue
+			}
+		}
+		if sch.NextRun != nil && (earliest == nil || sch.NextRun.Before(*earliest)) {
+			earliest = sch.NextRun
+		}
+	}
+	return earliest, nil
+}
+
+// process delivers the due runs of sch its missed-run policy allows and
+// then saves its next run under mu. The next run follows the last due one
+// rather than now, so a run repeated when the clocks go back is not
+// delivered again. A failed delivery stays the next run and its error is
+// returned, so the run is retried under the missed-run policy. Schedules
+// of users that no longer exist are removed and reported as ErrNotFound.
+func (s *greetingScheduler) process(ctx context.Context, sch Schedule, now time.Time) (Schedule, error) {
+	clock, err := sch.times()
+	if err != nil {
+		return sch, err
+	}
+	due := s.dueRuns(sch, clock, now)
+	runs := s.runsFor(sch, due, now)
+	if missed := len(due) - len(runs); missed > 0 {
+		metrics.Add("scheduled_greetings_missed", int64(missed))
+		log.Printf("Schedule %s missed %d run(s) since %s", sch.ID, missed, due[0].Format(time.RFC3339))
+	}
+
+	var failed error
+	for i, at := range runs {
+		err := s.deliver(ctx, sch, clock.loc, at, now)
+		if errors.Is(err, ErrNotFound) {
+			log.Printf("Removing schedule %s: user %s no longer exists", sch.ID, sch.UserID)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if err := dataStore.DeleteSchedule(ctx, sch.ID); err != nil && !errors.Is(err, ErrNotFound) {
+				return sch, err
+			}
+			return sch, ErrNotFound
+		}
+		sch.LastRun, sch.LastError = &now, ""
+		if err != nil {
+			sch.LastError, failed = err.Error(), err
+			sch.NextRun = &runs[i]
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failed == nil {
+		sch.NextRun = clock.nextAfter(due[len(due)-1])
+	}
+	sch.UpdatedAt = now
+	expected := sch.Version
+	sch.Version++
+	err = dataStore.SaveSchedule(ctx, sch, expected)
+	if errors.Is(err, ErrVersionConflict) {
+		log.Printf("Schedule %s changed while it ran, keeping the change", sch.ID)
+	}
+	if err == nil {
+		err = failed
+	}
+	return sch, err
+}
+
+// dueRuns lists the run times of sch up to now, keeping the most recent
+// maxCatchUp
+func (s *greetingScheduler) dueRuns(sch Schedule, clock *scheduleClock, now time.Time) []time.Time {
+	var due []time.Time
+	for next := sch.NextRun; next != nil && !next.After(now); next = clock.nextAfter(*next) {
+		if due = append(due, *next); len(due) > s.cfg.MaxCatchUp {
+			due = due[1:]
+		}
+	}
+	return due
+}
+
+// runsFor picks the due runs to deliver. The latest run is delivered when
+// it is on time; runs later than the misfire grace follow the schedule's
+// missed-run policy.
+func (s *greetingScheduler) runsFor(sch Schedule, due []time.Time, now time.Time) []time.Time {
+	if len(due) == 0 {
+		return nil
+	}
+	latest := due[len(due)-1]
+	switch {
+	case sch.MissedRuns == MissedRunsAll:
+		return due
+	case sch.MissedRuns == MissedRunsOnce || now.Sub(latest) <= time.Duration(s.cfg.MisfireGrace):
+		return due[len(due)-1:]
+	default:
+		return nil
+	}
+}
+
+// deliver renders the greeting of sch for a run at the given time and
+// sends it to the schedule's delivery
+func (s *greetingScheduler) deliver(ctx context.Context, sch Schedule, loc *time.Location, at, now time.Time) error {
+	rec, err := dataStore.GetUser(ctx, sch.UserID)
+	if err != nil {
+		return err
+	}
+
+	key := sch.Message
+	if key == ScheduleMessageTime {
+		key = greetingForHour(at.In(loc).Hour())
+	}
+	catalog := activeConfig.Snapshot().Messages
+	locale := sch.Locale
+	if locale == "" {
+		locale = catalog.defaultLocale
+	}
+	greeting := ScheduledGreeting{
+		ScheduleID:   sch.ID,
+		UserID:       sch.UserID,
+		Message:      catalog.Render(locale, key, rec.User.Name),
+		Locale:       locale,
+		ScheduledFor: at,
+		DeliveredAt:  now,
+	}
+
+	switch sch.Delivery {
+	case ScheduleDeliveryLog:
+		log.Printf("Scheduled greeting %s for user %s: %s", sch.ID, sch.UserID, greeting.Message)
+	case ScheduleDeliveryEmail:
+		if err := emails.Send(ctx, rec.User, greeting.Message, locale); err != nil {
+			return err
+		}
+	default:
+		webhooks.Publish(EventGreetingScheduled, webhookSubject{UserID: sch.UserID}, greeting, greeting)
+	}
+	recordGreetingEvent(ctx, GreetingEvent{
+		Type:     GreetingScheduled,
+		UserID:   sch.UserID,
+		NameHash: nameHash(rec.User.Name),
+		Locale:   locale,
+		Client:   sch.CreatedBy,
+		Time:     now,
+	})
+	metrics.Add("scheduled_greetings", 1)
+	return nil
+}
+
+// scheduleRequest is the body of schedule creation and replacement
+type scheduleRequest struct {
+	UserID     string     `json:"userId"`
+	Message    string     `json:"message"`
+	Locale     string     `json:"locale"`
+	Cron       string     `json:"cron"`
+	At         *time.Time `json:"at"`
+	Timezone   string     `json:"timezone"`
+	Delivery   string     `json:"delivery"`
+	MissedRuns string     `json:"missedRuns"`
+}
+
+// schedule validates req, applies defaults and copies it onto sch
+func (req scheduleRequest) schedule(ctx context.Context, sch Schedule, now time.Time) (Schedule, error) {
+	invalid := func(format string, args ...interface{}) (Schedule, error) {
+		return sch, &requestError{http.StatusUnprocessableEntity, fmt.Sprintf(format, args...)}
+	}
+	defaults := map[*string]string{
+		&req.Message:    ScheduleMessageTime,
+		&req.Timezone:   "UTC",
+		&req.Delivery:   ScheduleDeliveryWebhook,
+		&req.MissedRuns: MissedRunsSkip,
+	}
+	for field, value := range defaults {
+		if *field == "" {
+			*field = value
+		}
+	}
+
+	switch {
+	case req.UserID == "":
+		return invalid("userId is required")
+	case req.Message != ScheduleMessageGreet && req.Message != ScheduleMessageFarewell && req.Message != ScheduleMessageTime:
+		return invalid("message must be %s, %s or %s", ScheduleMessageGreet, ScheduleMessageFarewell, ScheduleMessageTime)
+	case req.Delivery != ScheduleDeliveryWebhook && req.Delivery != ScheduleDeliveryLog && req.Delivery != ScheduleDeliveryEmail:
+		return invalid("delivery must be %s, %s or %s", ScheduleDeliveryWebhook, ScheduleDeliveryLog, ScheduleDeliveryEmail)
+	case req.Delivery == ScheduleDeliveryEmail && !emails.Enabled():
+		return invalid("%v", errEmailDisabled)
+	case req.MissedRuns != MissedRunsSkip && req.MissedRuns != MissedRunsOnce && req.MissedRuns != MissedRunsAll:
+		return invalid("missedRuns must be %s, %s or %s", MissedRunsSkip, MissedRunsOnce, MissedRunsAll)
+	case (req.Cron == "") == (req.At == nil):
+		return invalid("exactly one of cron and at is required")
+	case req.At != nil && !req.At.After(now):
+		return invalid("at must be in the future")
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil || strings.EqualFold(req.Timezone, "local") {
+		return invalid("timezone %q is not an IANA time zone", req.Timezone)
+	}
+	if req.Cron != "" {
+		cron, err := parseCron(req.Cron)
+		if err != nil {
+			return invalid("%v", err)
+		}
+		if cron.Next(now).IsZero() {
+			return invalid("cron expression %q never matches", req.Cron)
+		}
+	}
+	if req.Locale != "" {
+		if _, ok := activeConfig.Snapshot().Messages.locales[strings.ToLower(req.Locale)]; !ok {
+			return invalid("locale %q is not supported", req.Locale)
+		}
+	}
+	rec, err := dataStore.GetUser(ctx, req.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return invalid("userId %q does not match a stored user", req.UserID)
+	} else if err != nil {
+		return sch, err
+	}
+	if req.Delivery == ScheduleDeliveryEmail && rec.User.Email == "" {
+		return invalid("userId %q has no email address", req.UserID)
+	}
+
+	sch.UserID, sch.Message, sch.Locale = req.UserID, req.Message, strings.ToLower(req.Locale)
+	sch.Cron, sch.At, sch.Timezone = req.Cron, req.At, req.Timezone
+	sch.Delivery, sch.MissedRuns = req.Delivery, req.MissedRuns
+	sch.LastError, sch.clock = "", nil
+	return sch, nil
+}
+
+// schedulesHandler lists schedules and creates new ones
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		all, err := dataStore.ListSchedules(r.Context())
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if all == nil {
+			all = []Schedule{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"schedules": all})
+	case http.MethodPost:
+		id, err := newID()
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		saveSchedule(w, r, Schedule{ID: id, CreatedBy: principalFrom(r.Context()).ID}, http.StatusCreated)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// scheduleHandler reads, replaces and deletes /greeter/schedules/{id}
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/greeter/schedules/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPut:
+		sch, err := dataStore.GetSchedule(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, "schedule not found")
+			return
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, sch)
+			return
+		}
+		saveSchedule(w, r, sch, http.StatusOK)
+	case http.MethodDelete:
+		err := schedules.Delete(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, "schedule not found")
+			return
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// saveSchedule applies the request body to sch and stores it. A schedule
+// changed or deleted since it was read, by a run or another request, is
+// reported rather than overwritten.
+func saveSchedule(w http.ResponseWriter, r *http.Request, sch Schedule, status int) {
+	var req scheduleRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	sch, err := req.schedule(r.Context(), sch, time.Now())
+	if err != nil {
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			writeRequestError(w, err)
+			return
+		}
+		writeStoreError(w, err)
+		return
+	}
+	sch, err = schedules.Save(r.Context(), sch)
+	switch {
+	case errors.Is(err, ErrVersionConflict):
+		writeJSONError(w, http.StatusConflict, "schedule was modified concurrently, retry the request")
+		return
+	case errors.Is(err, ErrNotFound):
+		writeJSONError(w, http.StatusNotFound, "schedule not found")
+		return
+	case err != nil:
+		writeStoreError(w, err)
+		return
+	}
+	if status == http.StatusCreated {
+		w.Header().Set("Location", "/greeter/schedules/"+sch.ID)
+	}
+	writeJSON(w, status, sch)
+}
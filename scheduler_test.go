@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useScheduler swaps in a scheduler whose clock the test moves
+func useScheduler(t *testing.T, now time.Time) (*greetingScheduler, *time.Time) {
+	t.Helper()
+	clock := now
+	s := newGreetingScheduler(DefaultConfig().Scheduler)
+	s.now = func() time.Time { return clock }
+	previous := schedules
+	schedules = s
+	t.Cleanup(func() { schedules = previous })
+	return s, &clock
+}
+
+// serveSchedules runs a request through authentication and the schedule
+// routes
+func serveSchedules(method, target, apiKey string, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/greeter/schedules", requireScope(ScopeSchedulesManage, schedulesHandler))
+	mux.HandleFunc("/greeter/schedules/", requireScope(ScopeSchedulesManage, scheduleHandler))
+	req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-API-Key", apiKey)
+	w := httptest.NewRecorder()
+	authenticate(mux).ServeHTTP(w, req)
+	return w
+}
+
+// createSchedule creates a schedule directly through the scheduler
+func createSchedule(t *testing.T, s *greetingScheduler, sch Schedule) Schedule {
+	t.Helper()
+	sch.ID = "s-" + sch.UserID
+	if sch.Timezone == "" {
+		sch.Timezone = "UTC"
+	}
+	if sch.Message == "" {
+		sch.Message = ScheduleMessageTime
+	}
+	saved, err := s.Save(context.Background(), sch)
+	if err != nil {
+		t.Fatalf("Failed to save schedule: %v", err)
+	}
+	return saved
+}
+
+// scheduledGreetings counts the scheduled greetings recorded for a user
+func scheduledGreetings(t *testing.T, userID string) int {
+	t.Helper()
+	events, err := dataStore.GreetingsFor(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("Failed to read greetings: %v", err)
+	}
+	n := 0
+	for _, e := range events {
+		if e.Type == GreetingScheduled {
+			n++
+		}
+	}
+	return n
+}
+
+// TestSchedulerMissedRuns tests the missed-run policies after downtime
+func TestSchedulerMissedRuns(t *testing.T) {
+	created := time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)
+	firstRun := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name              string
+		policy            string
+		now               time.Time
+		expectedDelivered int
+	}{
+		{"On time, skip", MissedRunsSkip, firstRun.Add(10 * time.Second), 1},
+		{"On time, all", MissedRunsAll, firstRun.Add(10 * time.Second), 1},
+		{"Missed three, skip", MissedRunsSkip, firstRun.Add(50 * time.Hour), 0},
+		{"Missed three, once", MissedRunsOnce, firstRun.Add(50 * time.Hour), 1},
+		{"Missed three, all", MissedRunsAll, firstRun.Add(50 * time.Hour), 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useStore(t)
+			s, clock := useScheduler(t, created)
+			id := createTestUser(t, UserInfo{Name: "John"})
+			sch := createSchedule(t, s, Schedule{UserID: id, Cron: "0 8 * * *", Delivery: ScheduleDeliveryLog, MissedRuns: tc.policy})
+			if !sch.NextRun.Equal(firstRun) {
+				t.Fatalf("Expected the first run at %v, got %v", firstRun, sch.NextRun)
+			}
+
+			*clock = tc.now
+			next, err := s.RunDue(context.Background())
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := scheduledGreetings(t, id); got != tc.expectedDelivered {
+				t.Errorf("Expected %d greetings, got %d", tc.expectedDelivered, got)
+			}
+			expectedNext := time.Date(tc.now.Year(), tc.now.Month(), tc.now.Day()+1, 8, 0, 0, 0, time.UTC)
+			if next == nil || !next.Equal(expectedNext) {
+				t.Errorf("Expected the next run at %v, got %v", expectedNext, next)
+			}
+			stored, _ := dataStore.GetSchedule(context.Background(), sch.ID)
+			if (stored.LastRun != nil) != (tc.expectedDelivered > 0) {
+				t.Errorf("Expected lastRun to be set only after a delivery, got %v", stored.LastRun)
+			}
+		})
+	}
+}
+
+// TestSchedulerDelivery tests webhook delivery of the time-of-day message
+// in the schedule's time zone, one-off schedules and removed users
+func TestSchedulerDelivery(t *testing.T) {
+	useWebhooks(t, true)
+	useStore(t)
+	paris, _ := time.LoadLocation("Europe/Paris")
+	runAt := time.Date(2024, 6, 1, 8, 0, 0, 0, paris)
+	s, clock := useScheduler(t, runAt.Add(-time.Hour))
+	rcv := newWebhookReceiver(t, http.StatusOK)
+	registerWebhook(t, "hooks-key", `{"url": "`+rcv.URL+`", "events": ["greeting.scheduled"]}`)
+
+	id := createTestUser(t, UserInfo{Name: "John"})
+	at := runAt.UTC()
+	sch := createSchedule(t, s, Schedule{UserID: id, At: &at, Timezone: "Europe/Paris", Delivery: ScheduleDeliveryWebhook, MissedRuns: MissedRunsSkip})
+
+	*clock = runAt
+	if _, err := s.RunDue(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	waitFor(t, "the scheduled greeting", func() bool { return len(rcv.requests()) == 1 })
+	var event struct {
+		Type string            `json:"type"`
+		Data ScheduledGreeting `json:"data"`
+	}
+	if err := json.Unmarshal(rcv.requests()[0].body, &event); err != nil {
+		t.Fatalf("Expected a JSON event, got %s", rcv.requests()[0].body)
+	}
+	if event.Type != EventGreetingScheduled || event.Data.Message != "Good morning, John!" || event.Data.ScheduleID != sch.ID {
+		t.Errorf("Expected a morning greeting, got %+v", event)
+	}
+
+	t.Run("One-off runs once", func(t *testing.T) {
+		stored, _ := dataStore.GetSchedule(context.Background(), sch.ID)
+		if stored.NextRun != nil || stored.LastRun == nil {
+			t.Errorf("Expected a finished schedule, got %+v", stored)
+		}
+		*clock = runAt.Add(time.Hour)
+		if _, err := s.RunDue(context.Background()); err != nil || scheduledGreetings(t, id) != 1 {
+			t.Errorf("Expected no further greetings, got %d, %v", scheduledGreetings(t, id), err)
+		}
+	})
+
+	t.Run("Removed user", func(t *testing.T) {
+		gone := createSchedule(t, s, Schedule{UserID: "missing", Cron: "* * * * *", Delivery: ScheduleDeliveryLog, MissedRuns: MissedRunsSkip})
+		*clock = gone.NextRun.Add(time.Second)
+		if _, err := s.RunDue(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, err := dataStore.GetSchedule(context.Background(), gone.ID); err != ErrNotFound {
+			t.Errorf("Expected the schedule to be removed, got %v", err)
+		}
+	})
+}
+
+// pausingStore holds the first user lookup until released, so a test can
+// act while a delivery or a request is in progress
+type pausingStore struct {
+	*memoryStore
+	held    atomic.Bool
+	paused  chan struct{}
+	release chan struct{}
+}
+
+// usePausingStore wraps the test's memory store in a pausingStore
+func usePausingStore(t *testing.T, store *memoryStore) *pausingStore {
+	t.Helper()
+	ps := &pausingStore{memoryStore: store, paused: make(chan struct{}), release: make(chan struct{})}
+	dataStore = ps
+	t.Cleanup(func() {
+		select {
+		case <-ps.release:
+		default:
+			close(ps.release)
+		}
+	})
+	return ps
+}
+
+func (p *pausingStore) GetUser(ctx context.Context, id string) (UserRecord, error) {
+	if p.held.CompareAndSwap(false, true) {
+		close(p.paused)
+		<-p.release
+	}
+	return p.memoryStore.GetUser(ctx, id)
+}
+
+// failingStore fails user lookups while fail is set
+type failingStore struct {
+	*memoryStore
+	fail atomic.Bool
+}
+
+func (f *failingStore) GetUser(ctx context.Context, id string) (UserRecord, error) {
+	if f.fail.Load() {
+		return UserRecord{}, errors.New("store unavailable")
+	}
+	return f.memoryStore.GetUser(ctx, id)
+}
+
+// TestSchedulerRetriesFailedRun tests that a run whose delivery failed
+// stays due and is delivered after the poll interval
+func TestSchedulerRetriesFailedRun(t *testing.T) {
+	store := &failingStore{memoryStore: useStore(t)}
+	runAt := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	s, clock := useScheduler(t, runAt.Add(-time.Hour))
+	id := createTestUser(t, UserInfo{Name: "John"})
+	sch := createSchedule(t, s, Schedule{UserID: id, Cron: "0 8 * * *", Delivery: ScheduleDeliveryLog, MissedRuns: MissedRunsSkip})
+	dataStore = store
+
+	store.fail.Store(true)
+	*clock = runAt
+	next, err := s.RunDue(context.Background())
+	if err != nil || next != nil {
+		t.Fatalf("Expected the failed schedule to wait for the poll interval, got %v, %v", next, err)
+	}
+	stored, _ := store.GetSchedule(context.Background(), sch.ID)
+	if stored.NextRun == nil || !stored.NextRun.Equal(runAt) || stored.LastError == "" {
+		t.Errorf("Expected the failed run to stay due with its error, got %+v", stored)
+	}
+
+	store.fail.Store(false)
+	*clock = runAt.Add(time.Duration(DefaultConfig().Scheduler.PollInterval))
+	if _, err := s.RunDue(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := scheduledGreetings(t, id); got != 1 {
+		t.Errorf("Expected the failed run to be delivered on retry, got %d greetings", got)
+	}
+	stored, _ = store.GetSchedule(context.Background(), sch.ID)
+	if stored.NextRun == nil || !stored.NextRun.Equal(runAt.Add(24*time.Hour)) || stored.LastError != "" {
+		t.Errorf("Expected the next day's run after the retry, got %+v", stored)
+	}
+}
+
+// TestSchedulerFallBack tests that a daily run in the hour repeated when
+// the clocks go back is delivered once
+func TestSchedulerFallBack(t *testing.T) {
+	useStore(t)
+	created := time.Date(2024, 10, 27, 0, 15, 0, 0, time.UTC)
+	s, clock := useScheduler(t, created)
+	id := createTestUser(t, UserInfo{Name: "John"})
+	sch := createSchedule(t, s, Schedule{UserID: id, Cron: "30 2 * * *", Timezone: "Europe/Paris", Delivery: ScheduleDeliveryLog, MissedRuns: MissedRunsSkip})
+	firstRun := time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC)
+	if !sch.NextRun.Equal(firstRun) {
+		t.Fatalf("Expected the first run at %v, got %v", firstRun, sch.NextRun)
+	}
+
+	for _, now := range []time.Time{firstRun.Add(10 * time.Second), firstRun.Add(time.Hour + 10*time.Second)} {
+		*clock = now
+		if _, err := s.RunDue(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if got := scheduledGreetings(t, id); got != 1 {
+		t.Errorf("Expected 1 greeting, got %d", got)
+	}
+	expectedNext := time.Date(2024, 10, 28, 1, 30, 0, 0, time.UTC)
+	if stored, _ := dataStore.GetSchedule(context.Background(), sch.ID); stored.NextRun == nil || !stored.NextRun.Equal(expectedNext) {
+		t.Errorf("Expected the next run at %v, got %v", expectedNext, stored.NextRun)
+	}
+}
+
+// TestSchedulerConcurrentEdits tests that deliveries do not block edits
+// and that neither a run nor a request overwrites the other's change
+func TestSchedulerConcurrentEdits(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"auth": {"apiKeys": [
+		{"principal": "planner", "sha256": "`+sha256Hex("planner-key")+`", "scopes": ["schedules:manage"]}
+	]}}`))
+	created := time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)
+	runAt := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	t.Run("Edit during a delivery", func(t *testing.T) {
+		store := useStore(t)
+		s, clock := useScheduler(t, created)
+		id := createTestUser(t, UserInfo{Name: "John"})
+		sch := createSchedule(t, s, Schedule{UserID: id, Cron: "0 8 * * *", Delivery: ScheduleDeliveryLog, MissedRuns: MissedRunsSkip})
+		ps := usePausingStore(t, store)
+		*clock = runAt.Add(10 * time.Second)
+
+		ran := make(chan error, 1)
+		go func() {
+			_, err := s.RunDue(context.Background())
+			ran <- err
+		}()
+		<-ps.paused
+		saved := make(chan error, 1)
+		go func() {
+			sch.Cron, sch.clock = "30 18 * * *", nil
+			_, err := s.Save(context.Background(), sch)
+			saved <- err
+		}()
+		select {
+		case err := <-saved:
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the edit not to wait for the delivery")
+		}
+		close(ps.release)
+		if err := <-ran; err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		stored, _ := dataStore.GetSchedule(context.Background(), sch.ID)
+		if stored.Cron != "30 18 * * *" || stored.NextRun.Hour() != 18 || stored.Version != 2 {
+			t.Errorf("Expected the edit to be kept, got %+v", stored)
+		}
+		if got := scheduledGreetings(t, id); got != 1 {
+			t.Errorf("Expected 1 greeting, got %d", got)
+		}
+	})
+
+	t.Run("Replace during a run", func(t *testing.T) {
+		store := useStore(t)
+		s, clock := useScheduler(t, created)
+		id := createTestUser(t, UserInfo{Name: "John"})
+		sch := createSchedule(t, s, Schedule{UserID: id, Cron: "0 8 * * *", Delivery: ScheduleDeliveryLog, MissedRuns: MissedRunsSkip})
+		ps := usePausingStore(t, store)
+		*clock = runAt.Add(10 * time.Second)
+
+		replaced := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			replaced <- serveSchedules("PUT", "/greeter/schedules/"+sch.ID, "planner-key", `{"userId": "`+id+`", "cron": "30 18 * * *"}`)
+		}()
+		<-ps.paused
+		if _, err := s.RunDue(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		close(ps.release)
+		if w := <-replaced; w.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+		}
+
+		stored, _ := dataStore.GetSchedule(context.Background(), sch.ID)
+		expectedNext := runAt.AddDate(0, 0, 1)
+		if stored.Cron != "0 8 * * *" || stored.NextRun == nil || !stored.NextRun.Equal(expectedNext) || stored.LastRun == nil {
+			t.Errorf("Expected the run to be kept, got %+v", stored)
+		}
+	})
+}
+
+// TestScheduleAPI tests validation and the CRUD endpoints
+func TestScheduleAPI(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"auth": {"apiKeys": [
+		{"principal": "planner", "sha256": "`+sha256Hex("planner-key")+`", "scopes": ["schedules:manage"]},
+		{"principal": "support", "sha256": "`+sha256Hex("support-key")+`"}
+	]}}`))
+	useStore(t)
+	useScheduler(t, time.Now())
+	id := createTestUser(t, UserInfo{Name: "John"})
+	user := `"userId": "` + id + `"`
+
+	testCases := []struct {
+		name           string
+		apiKey         string
+		body           string
+		expectedStatus int
+	}{
+		{"Cron", "planner-key", `{` + user + `, "cron": "0 8 * * *", "timezone": "Asia/Tokyo"}`, http.StatusCreated},
+		{"One-off", "planner-key", `{` + user + `, "at": "2999-01-01T08:00:00Z", "message": "greet", "delivery": "log"}`, http.StatusCreated},
+		{"Without scope", "support-key", `{` + user + `, "cron": "0 8 * * *"}`, http.StatusForbidden},
+		{"Unknown user", "planner-key", `{"userId": "nobody", "cron": "0 8 * * *"}`, http.StatusUnprocessableEntity},
+		{"Neither cron nor at", "planner-key", `{` + user + `}`, http.StatusUnprocessableEntity},
+		{"Both cron and at", "planner-key", `{` + user + `, "cron": "0 8 * * *", "at": "2999-01-01T08:00:00Z"}`, http.StatusUnprocessableEntity},
+		{"Past one-off", "planner-key", `{` + user + `, "at": "2000-01-01T08:00:00Z"}`, http.StatusUnprocessableEntity},
+		{"Bad cron", "planner-key", `{` + user + `, "cron": "0 25 * * *"}`, http.StatusUnprocessableEntity},
+		{"Never matching cron", "planner-key", `{` + user + `, "cron": "0 0 31 2 *"}`, http.StatusUnprocessableEntity},
+		{"Bad time zone", "planner-key", `{` + user + `, "cron": "0 8 * * *", "timezone": "Mars/Olympus"}`, http.StatusUnprocessableEntity},
+		{"Bad message", "planner-key", `{` + user + `, "cron": "0 8 * * *", "message": "shout"}`, http.StatusUnprocessableEntity},
+		{"Bad policy", "planner-key", `{` + user + `, "cron": "0 8 * * *", "missedRuns": "sometimes"}`, http.StatusUnprocessableEntity},
+		{"Unknown locale", "planner-key", `{` + user + `, "cron": "0 8 * * *", "locale": "xx"}`, http.StatusUnprocessableEntity},
+		{"Unknown field", "planner-key", `{` + user + `, "cron": "0 8 * * *", "name": "John"}`, http.StatusBadRequest},
+		{"Email not configured", "planner-key", `{` + user + `, "cron": "0 8 * * *", "delivery": "email"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveSchedules("POST", "/greeter/schedules", tc.apiKey, tc.body)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		w := serveSchedules("POST", "/greeter/schedules", "planner-key", `{`+user+`, "cron": "0 8 * * *", "timezone": "Asia/Tokyo"}`)
+		var sch Schedule
+		if err := json.Unmarshal(w.Body.Bytes(), &sch); err != nil || w.Header().Get("Location") != "/greeter/schedules/"+sch.ID {
+			t.Fatalf("Expected a created schedule, got %d: %s", w.Code, w.Body.String())
+		}
+		tokyo, _ := time.LoadLocation("Asia/Tokyo")
+		if next := sch.NextRun.In(tokyo); next.Hour() != 8 || next.Minute() != 0 || sch.Message != ScheduleMessageTime ||
+			sch.Delivery != ScheduleDeliveryWebhook || sch.MissedRuns != MissedRunsSkip || sch.CreatedBy != "planner" {
+			t.Errorf("Expected defaults and a run at 08:00 in Tokyo, got %+v", sch)
+		}
+
+		w = serveSchedules("PUT", "/greeter/schedules/"+sch.ID, "planner-key", `{`+user+`, "cron": "30 18 * * *", "message": "farewell"}`)
+		var replaced Schedule
+		_ = json.Unmarshal(w.Body.Bytes(), &replaced)
+		if w.Code != http.StatusOK || replaced.NextRun.Hour() != 18 || replaced.Timezone != "UTC" || !replaced.CreatedAt.Equal(sch.CreatedAt) {
+			t.Errorf("Expected the schedule to be replaced, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = serveSchedules("GET", "/greeter/schedules", "planner-key", "")
+		var list struct {
+			Schedules []Schedule `json:"schedules"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Schedules) != 3 {
+			t.Errorf("Expected 3 schedules, got %s", w.Body.String())
+		}
+
+		if w := serveSchedules("DELETE", "/greeter/schedules/"+sch.ID, "planner-key", ""); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+		if w := serveSchedules("GET", "/greeter/schedules/"+sch.ID, "planner-key", ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d after deletion, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SecurityHeadersConfig holds the hardening headers added to responses
+type SecurityHeadersConfig struct {
+	// Headers are set on every response
+	Headers map[string]string `json:"headers"`
+	// HSTS is the Strict-Transport-Security value, sent only over TLS
+	HSTS string `json:"hsts"`
+	// Routes override Headers for a path and everything below it; an empty
+	// value removes the header for that route
+	Routes map[string]map[string]string `json:"routes,omitempty"`
+	// RemoveHeaders are stripped from responses to avoid fingerprinting
+	RemoveHeaders []string `json:"removeHeaders"`
+}
+
+// Validate checks the security header settings
+func (s SecurityHeadersConfig) Validate() error {
+	for route := range s.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("securityHeaders.routes key %q must be a path", route)
+		}
+	}
+	return nil
+}
+
+// headersFor returns the headers to set for a response to r
+func (s SecurityHeadersConfig) headersFor(r *http.Request) map[string]string {
+	headers := make(map[string]string, len(s.Headers)+1)
+	for name, value := range s.Headers {
+		headers[name] = value
+	}
+	if r.TLS != nil && s.HSTS != "" {
+		headers["Strict-Transport-Security"] = s.HSTS
+	}
+	if overrides, ok := routeMatch(s.Routes, r.URL.Path); ok {
+		for name, value := range overrides {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// headerStripper removes fingerprinting headers right before the response
+// headers are sent
+type headerStripper struct {
+	http.ResponseWriter
+	remove      []string
+	wroteHeader bool
+}
+
+func (h *headerStripper) WriteHeader(code int) {
+	if !h.wroteHeader {
+		h.wroteHeader = true
+		for _, name := range h.remove {
+			h.Header().Del(name)
+		}
+	}
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h *headerStripper) Write(b []byte) (int, error) {
+	if !h.wroteHeader {
+		h.WriteHeader(http.StatusOK)
+	}
+	return h.ResponseWriter.Write(b)
+}
+
+// Flush forwards to the underlying writer when it supports flushing
+func (h *headerStripper) Flush() {
+	if !h.wroteHeader {
+		h.WriteHeader(http.StatusOK)
+	}
+	if f, ok := h.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// securityHeaders applies the configured hardening headers. They are set
+// before the handler runs so a handler can still override them.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := activeConfig.Get().SecurityHeaders
+		header := w.Header()
+		for name, value := range cfg.headersFor(r) {
+			if value == "" {
+				header.Del(name)
+				continue
+			}
+			header.Set(name, value)
+		}
+
+		if len(cfg.RemoveHeaders) > 0 {
+			w = &headerStripper{ResponseWriter: w, remove: cfg.RemoveHeaders}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
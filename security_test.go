@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fingerprintHandler sets headers that identify the server software
+var fingerprintHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "greeter/1.0.0")
+	w.Header().Set("X-Powered-By", "Go")
+	w.WriteHeader(http.StatusOK)
+})
+
+// TestSecurityHeadersDefaults tests the default hardening headers on a plain HTTP response
+func TestSecurityHeadersDefaults(t *testing.T) {
+	req := httptest.NewRequest("GET", "/greeter/greet", nil)
+	w := httptest.NewRecorder()
+
+	securityHeaders(fingerprintHandler).ServeHTTP(w, req)
+
+	expected := map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+		"Strict-Transport-Security": "",
+		"Cache-Control":             "",
+		"Server":                    "",
+		"X-Powered-By":              "",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+}
+
+// TestSecurityHeadersHSTSOverTLS tests that HSTS is only sent over TLS
+func TestSecurityHeadersHSTSOverTLS(t *testing.T) {
+	req := httptest.NewRequest("GET", "/greeter/greet", nil)
+	req.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+
+	securityHeaders(fingerprintHandler).ServeHTTP(w, req)
+
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("Expected HSTS header over TLS, got %q", got)
+	}
+}
+
+// TestSecurityHeadersUserInfoCacheControl tests the no-store default on user info responses
+func TestSecurityHeadersUserInfoCacheControl(t *testing.T) {
+	for _, path := range []string{"/greeter/user-info", "/greeter/user-info/42"} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+
+		securityHeaders(fingerprintHandler).ServeHTTP(w, req)
+
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Expected Cache-Control no-store for %s, got %q", path, got)
+		}
+	}
+}
+
+// TestSecurityHeadersRouteOverrides tests per-route configuration, including removing a default header
+func TestSecurityHeadersRouteOverrides(t *testing.T) {
+	useConfig(t, writeConfig(t, `{"securityHeaders": {
+		"headers": {"Permissions-Policy": "geolocation=()"},
+		"routes": {"/greeter/embed": {"X-Frame-Options": "", "Content-Security-Policy": "frame-ancestors https://portal.example.com"}}
+	}}`))
+
+	req := httptest.NewRequest("GET", "/greeter/embed/widget", nil)
+	w := httptest.NewRecorder()
+
+	securityHeaders(fingerprintHandler).ServeHTTP(w, req)
+
+	if got := w.Header().Get("X-Frame-Options"); got != "" {
+		t.Errorf("Expected X-Frame-Options to be removed for the route, got %q", got)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "frame-ancestors https://portal.example.com" {
+		t.Errorf("Expected route CSP, got %q", got)
+	}
+	if got := w.Header().Get("Permissions-Policy"); got != "geolocation=()" {
+		t.Errorf("Expected added global header, got %q", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("Expected defaults to be kept, got %q", got)
+	}
+}
+
+// TestSecurityHeadersHandlerOverride tests that a handler can replace a default header
+func TestSecurityHeadersHandlerOverride(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		_, _ = w.Write([]byte("ok"))
+	})
+	req := httptest.NewRequest("GET", "/greeter/user-info", nil)
+	w := httptest.NewRecorder()
+
+	securityHeaders(handler).ServeHTTP(w, req)
+
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=60" {
+		t.Errorf("Expected handler Cache-Control to win, got %q", got)
+	}
+}
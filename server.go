@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+)
+
+// newHTTPServer builds an http.Server from the listener settings. HTTP/2
+// uses the same stream limit over TLS as over h2c.
+func newHTTPServer(cfg ServerConfig, tlsConfig *tls.Config, handler http.Handler) (*http.Server, error) {
+	h2 := &http2.Server{
+		IdleTimeout:          time.Duration(cfg.IdleTimeout),
+		MaxConcurrentStreams: cfg.MaxConcurrentStreams,
+	}
+	if cfg.AltSvc != "" {
+		handler = advertiseAltSvc(handler, cfg.AltSvc)
+	}
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, h2)
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handler,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}
+	server.SetKeepAlivesEnabled(!cfg.DisableKeepAlives)
+	if tlsConfig != nil {
+		if err := http2.ConfigureServer(server, h2); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// advertiseAltSvc sets the Alt-Svc header on every response, so clients
+// learn about an HTTP/3 endpoint served alongside this one
+func advertiseAltSvc(next http.Handler, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listen opens the TCP listener, applying the TCP keep-alive period and
+// the concurrent connection limit
+func listen(ctx context.Context, cfg ServerConfig) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: time.Duration(cfg.TCPKeepAlive)}
+	if cfg.DisableKeepAlives {
+		lc.KeepAlive = -1
+	}
+
+	ln, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConnections > 0 {
+		ln = netutil.LimitListener(ln, cfg.MaxConnections)
+	}
+	return ln, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// startTestServer serves handler with the given listener settings on a random port
+func startTestServer(t *testing.T, cfg ServerConfig, handler http.Handler) string {
+	t.Helper()
+	cfg.Port = 0
+
+	server, err := newHTTPServer(cfg, nil, handler)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ln, err := listen(context.Background(), ServerConfig{
+		MaxConnections:    cfg.MaxConnections,
+		DisableKeepAlives: cfg.DisableKeepAlives,
+		TCPKeepAlive:      cfg.TCPKeepAlive,
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	return "http://" + ln.Addr().String()
+}
+
+// protoHandler echoes the protocol used by the request
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.WriteString(w, r.Proto)
+})
+
+// TestNewHTTPServerAppliesSettings tests that configured limits reach the http.Server
+func TestNewHTTPServerAppliesSettings(t *testing.T) {
+	cfg := DefaultConfig().Server
+	cfg.WriteTimeout = Duration(5 * time.Second)
+	cfg.MaxHeaderBytes = 4096
+
+	server, err := newHTTPServer(cfg, nil, protoHandler)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if server.ReadTimeout != 30*time.Second {
+		t.Errorf("Expected ReadTimeout 30s, got %v", server.ReadTimeout)
+	}
+	if server.ReadHeaderTimeout != 10*time.Second {
+		t.Errorf("Expected ReadHeaderTimeout 10s, got %v", server.ReadHeaderTimeout)
+	}
+	if server.WriteTimeout != 5*time.Second {
+		t.Errorf("Expected WriteTimeout 5s, got %v", server.WriteTimeout)
+	}
+	if server.IdleTimeout != 120*time.Second {
+		t.Errorf("Expected IdleTimeout 120s, got %v", server.IdleTimeout)
+	}
+	if server.MaxHeaderBytes != 4096 {
+		t.Errorf("Expected MaxHeaderBytes 4096, got %d", server.MaxHeaderBytes)
+	}
+	if server.Addr != ":9090" {
+		t.Errorf("Expected Addr :9090, got %q", server.Addr)
+	}
+}
+
+// TestH2CServer tests that HTTP/2 over cleartext is negotiated when enabled
+func TestH2CServer(t *testing.T) {
+	cfg := DefaultConfig().Server
+	cfg.H2C = true
+	url := startTestServer(t, cfg, protoHandler)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Expected h2c request to succeed, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0, got %q", string(body))
+	}
+}
+
+// TestTLSServerStreamLimit tests that HTTP/2 over TLS announces the
+// configured stream limit, as h2c does
+func TestTLSServerStreamLimit(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", true, nil)
+	certFile, keyFile := writeTestCert(t, dir, "server", newTestCert(t, "localhost", false, ca))
+	tlsConfig, err := buildTLSConfig(TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	cfg := DefaultConfig().Server
+	cfg.MaxConcurrentStreams = 7
+	server, err := newHTTPServer(cfg, tlsConfig, protoHandler)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = server.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"h2"}, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Fatalf("Expected h2 to be negotiated, got %q", proto)
+	}
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatalf("Failed to write preface: %v", err)
+	}
+	frame, err := http2.NewFramer(conn, conn).ReadFrame()
+	if err != nil {
+		t.Fatalf("Failed to read settings: %v", err)
+	}
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("Expected a SETTINGS frame, got %v", frame)
+	}
+	if streams, ok := settings.Value(http2.SettingMaxConcurrentStreams); !ok || streams != 7 {
+		t.Errorf("Expected a limit of 7 streams, got %d", streams)
+	}
+}
+
+// TestServerAltSvc tests that a configured Alt-Svc header is sent on
+// every response
+func TestServerAltSvc(t *testing.T) {
+	cfg := DefaultConfig().Server
+	cfg.AltSvc = `h3=":443"; ma=86400`
+	url := startTestServer(t, cfg, protoHandler)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Expected request to succeed, got %v", err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Get("Alt-Svc"); got != cfg.AltSvc {
+		t.Errorf("Expected Alt-Svc %q, got %q", cfg.AltSvc, got)
+	}
+}
+
+// TestServerWithoutH2C tests that plain HTTP/1.1 is served by default
+func TestServerWithoutH2C(t *testing.T) {
+	url := startTestServer(t, DefaultConfig().Server, protoHandler)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Expected request to succeed, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1, got %q", string(body))
+	}
+}
+
+// TestServerDisableKeepAlives tests that connections are closed after each response
+func TestServerDisableKeepAlives(t *testing.T) {
+	cfg := DefaultConfig().Server
+	cfg.DisableKeepAlives = true
+	url := startTestServer(t, cfg, protoHandler)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Expected request to succeed, got %v", err)
+	}
+	resp.Body.Close()
+
+	if !resp.Close {
+		t.Error("Expected the server to close the connection")
+	}
+}
+
+// TestServerMaxConnections tests that connections beyond the limit wait for a free slot
+func TestServerMaxConnections(t *testing.T) {
+	cfg := DefaultConfig().Server
+	cfg.MaxConnections = 1
+	url := startTestServer(t, cfg, protoHandler)
+
+	// Hold the only slot with an idle keep-alive connection
+	first := &http.Client{Transport: &http.Transport{}}
+	resp, err := first.Get(url)
+	if err != nil {
+		t.Fatalf("Expected first request to succeed, got %v", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	second := &http.Client{Transport: &http.Transport{}, Timeout: 200 * time.Millisecond}
+	if resp, err := second.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("Expected second connection to be held back by the limit")
+	}
+
+	first.CloseIdleConnections()
+	time.Sleep(50 * time.Millisecond)
+
+	second.Timeout = 2 * time.Second
+	resp, err = second.Get(url)
+	if err != nil {
+		t.Fatalf("Expected request to succeed once a slot was freed, got %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	// Pure Go SQLite driver, so builds need no cgo
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDialect stores data in a local SQLite file. The DSN is a file name
+// or URI such as file:/data/greeter.db
+var sqliteDialect = sqlDialect{
+	name:        DriverSQLite,
+	driver:      "sqlite",
+	placeholder: func(int) string { return "?" },
+	dsn:         sqliteDSN,
+	timeValue:   sqliteTime,
+	hourExpr:    "CAST(strftime('%H', created_at) AS INTEGER)",
+}
+
+// sqliteTimeFormat has a fixed width so stored times sort as text
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000000Z"
+
+// sqliteTime formats t so that comparing and ordering TIMESTAMP columns
+// follows time order; the driver's default drops trailing zeros
+func sqliteTime(t time.Time) interface{} {
+	return t.Format(sqliteTimeFormat)
+}
+
+// sqliteDSN adds the pragmas every pooled connection needs unless the DSN
+// sets them: WAL so readers do not block the writer, and a busy timeout so
+// concurrent writers wait for the lock instead of failing
+func sqliteDSN(dsn string) string {
+	pragmas := []string{"busy_timeout(5000)", "journal_mode(WAL)"}
+	for _, pragma := range pragmas {
+		name, _, _ := strings.Cut(pragma, "(")
+		if strings.Contains(dsn, "_pragma="+name) {
+			continue
+		}
+		if strings.Contains(dsn, "?") {
+			dsn += "&"
+		} else {
+			dsn += "?"
+		}
+		dsn += "_pragma=" + pragma
+	}
+	return dsn
+}
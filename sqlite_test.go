@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestSQLite opens a SQLite store in a temporary directory
+func openTestSQLite(t *testing.T) Store {
+	t.Helper()
+	cfg := DefaultConfig().Storage
+	cfg.Driver = DriverSQLite
+	cfg.DSN = filepath.Join(t.TempDir(), "greeter.db")
+
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// TestSQLiteMigrations tests that migrations are recorded and only applied once
+func TestSQLiteMigrations(t *testing.T) {
+	cfg := DefaultConfig().Storage
+	cfg.Driver = DriverSQLite
+	cfg.DSN = filepath.Join(t.TempDir(), "greeter.db")
+
+	first, err := openSQLStore(cfg, sqliteDialect)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := first.CreateUser(context.Background(), UserInfo{Name: "John"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	first.Close()
+
+	second, err := openSQLStore(cfg, sqliteDialect)
+	if err != nil {
+		t.Fatalf("Expected reopening to skip applied migrations, got %v", err)
+	}
+	defer second.Close()
+
+	migrations, _ := second.migrations()
+	var version, count int
+	if err := second.db.QueryRow("SELECT MAX(version), COUNT(*) FROM schema_migrations").Scan(&version, &count); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count != len(migrations) || version != migrations[len(migrations)-1].version {
+		t.Errorf("Expected %d migrations up to %d, got %d up to %d", len(migrations), migrations[len(migrations)-1].version, count, version)
+	}
+
+	var users int
+	if err := second.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil || users != 1 {
+		t.Errorf("Expected data to survive reopening, got %d users, %v", users, err)
+	}
+}
+
+// TestSQLiteEncryptsEmailAtRest tests that the email column holds ciphertext
+func TestSQLiteEncryptsEmailAtRest(t *testing.T) {
+	useEmailCipher(t)
+	store := openTestSQLite(t).(*sqlStore)
+
+	rec, err := store.CreateUser(context.Background(), UserInfo{Name: "John", Email: "john@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var stored string
+	if err := store.db.QueryRow("SELECT email FROM users WHERE id = ?", rec.ID).Scan(&stored); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		t.Errorf("Expected an encrypted email column, got %q", stored)
+	}
+}
+
+// TestSQLiteBulkCreateIsAtomic tests that a failing row rolls back the whole batch
+func TestSQLiteBulkCreateIsAtomic(t *testing.T) {
+	store := openTestSQLite(t).(*sqlStore)
+	if _, err := store.db.Exec(`CREATE TRIGGER reject_bad BEFORE INSERT ON users
+		WHEN NEW.name = 'Bad' BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatalf("Failed to create trigger: %v", err)
+	}
+
+	if _, err := store.CreateUsers(context.Background(), []UserInfo{{Name: "Good"}, {Name: "Bad"}}); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	var users int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil || users != 0 {
+		t.Errorf("Expected no users after a failed batch, got %d, %v", users, err)
+	}
+}
+
+// TestSQLiteDSN tests the default pragmas added to SQLite DSNs
+func TestSQLiteDSN(t *testing.T) {
+	testCases := map[string]string{
+		"greeter.db":                              "greeter.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+		"file:greeter.db?mode=rwc":                "file:greeter.db?mode=rwc&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+		"greeter.db?_pragma=journal_mode(DELETE)": "greeter.db?_pragma=journal_mode(DELETE)&_pragma=busy_timeout(5000)",
+	}
+	for dsn, expected := range testCases {
+		if got := sqliteDSN(dsn); got != expected {
+			t.Errorf("sqliteDSN(%q): expected %q, got %q", dsn, expected, got)
+		}
+	}
+}
@@ -0,0 +1,702 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations of every SQL driver, one
+// directory per dialect
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// sqlDialect describes the differences between SQL databases
+type sqlDialect struct {
+	// name is the storage.driver value and the migrations directory
+	name string
+	// driver is the database/sql driver name
+	driver string
+	// placeholder returns the nth bind parameter, counting from 1
+	placeholder func(n int) string
+	// dsn adjusts the configured DSN before connecting; nil leaves it as is
+	dsn func(string) string
+	// timeValue converts times to bind parameters; nil passes them as is
+	timeValue func(time.Time) interface{}
+	// hourExpr extracts the UTC hour of day from created_at as an integer
+	hourExpr string
+	// migrationLock is run at the start of each migration transaction to
+	// serialise instances migrating the same database at startup
+	migrationLock string
+}
+
+// sqlStore implements Store on a database/sql connection pool
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// openSQLStore connects to the database, configures the pool and applies
+// pending migrations
+func openSQLStore(cfg StorageConfig, dialect sqlDialect) (*sqlStore, error) {
+	dsn := cfg.DSN
+	if dialect.dsn != nil {
+		dsn = dialect.dsn(dsn)
+	}
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s database: %w", dialect.name, err)
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	s := &sqlStore{db: db, dialect: dialect}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to %s database: %w", dialect.name, err)
+	}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// timeArg returns t as a bind parameter in UTC
+func (s *sqlStore) timeArg(t time.Time) interface{} {
+	if s.dialect.timeValue != nil {
+		return s.dialect.timeValue(t.UTC())
+	}
+	return t.UTC()
+}
+
+// rebind replaces ? placeholders with the dialect's bind parameters
+func (s *sqlStore) rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString(s.dialect.placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// migration is one numbered schema change
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations returns the dialect's migrations in version order
+func (s *sqlStore) migrations() ([]migration, error) {
+	dir := path.Join("migrations", s.dialect.name)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		prefix, _, ok := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || !strings.HasSuffix(entry.Name(), ".sql") {
+			return nil, fmt.Errorf("migration %s must be named <version>_<description>.sql", entry.Name())
+		}
+		data, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: entry.Name(), sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// migrate applies the migrations newer than the recorded schema version,
+// each in its own transaction
+func (s *sqlStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	migrations, err := s.migrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.inTx(ctx, func(tx *sql.Tx) error {
+			if s.dialect.migrationLock != "" {
+				if _, err := tx.ExecContext(ctx, s.dialect.migrationLock); err != nil {
+					return err
+				}
+			}
+			var applied int
+			if err := tx.QueryRowContext(ctx, s.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), m.version).Scan(&applied); err != nil || applied > 0 {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, s.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), m.version, s.timeArg(time.Now()))
+			return err
+		}); err != nil {
+			return fmt.Errorf("applying migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committing when it returns nil
+func (s *sqlStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, user UserInfo) (UserRecord, error) {
+	recs, err := s.CreateUsers(ctx, []UserInfo{user})
+	if err != nil {
+		return UserRecord{}, err
+	}
+	return recs[0], nil
+}
+
+func (s *sqlStore) CreateUsers(ctx context.Context, users []UserInfo) ([]UserRecord, error) {
+	recs := make([]UserRecord, 0, len(users))
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, s.rebind(`INSERT INTO users (id, name, age, location, email, email_domain, created_at, updated_at, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		outbox, err := tx.PrepareContext(ctx, s.rebind("INSERT INTO outbox (id, type, subject, data, created_at) VALUES (?, ?, ?, ?, ?)"))
+		if err != nil {
+			return err
+		}
+		defer outbox.Close()
+
+		for _, user := range users {
+			rec, sealed, err := newUserRecord(user)
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.ExecContext(ctx, rec.ID, sealed.Name, sealed.Age, sealed.Location, sealed.Email, emailDomain(user.Email),
+				s.timeArg(rec.CreatedAt), s.timeArg(rec.UpdatedAt), rec.Version); err != nil {
+				return err
+			}
+			event, err := userCreatedEvent(rec)
+			if err != nil {
+				return err
+			}
+			if _, err := outbox.ExecContext(ctx, event.ID, event.Type, event.Subject, string(event.Data), s.timeArg(event.Time)); err != nil {
+				return err
+			}
+			recs = append(recs, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inserting users: %w", err)
+	}
+	return recs, nil
+}
+
+func (s *sqlStore) GetUser(ctx context.Context, id string) (UserRecord, error) {
+	var rec UserRecord
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT id, name, age, location, email, created_at, updated_at, version
+		FROM users WHERE id = ?`), id).
+		Scan(&rec.ID, &rec.User.Name, &rec.User.Age, &rec.User.Location, &rec.User.Email, &rec.CreatedAt, &rec.UpdatedAt, &rec.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return UserRecord{}, fmt.Errorf("reading user: %w", err)
+	}
+	if rec.User, err = openUser(rec.User); err != nil {
+		return UserRecord{}, err
+	}
+	rec.CreatedAt, rec.UpdatedAt = rec.CreatedAt.UTC(), rec.UpdatedAt.UTC()
+	return rec, nil
+}
+
+func (s *sqlStore) UpdateUser(ctx context.Context, id string, user UserInfo, expectedVersion int64) (UserRecord, error) {
+	sealed, err := sealUser(user)
+	if err != nil {
+		return UserRecord{}, err
+	}
+
+	rec := UserRecord{ID: id, User: user, UpdatedAt: time.Now().UTC()}
+	err = s.db.QueryRowContext(ctx, s.rebind(`UPDATE users SET name = ?, age = ?, location = ?, email = ?, email_domain = ?, updated_at = ?, version = version + 1
+		WHERE id = ? AND (? = 0 OR version = ?) RETURNING created_at, version`),
+		sealed.Name, sealed.Age, sealed.Location, sealed.Email, emailDomain(user.Email), s.timeArg(rec.UpdatedAt), id, expectedVersion, expectedVersion).
+		Scan(&rec.CreatedAt, &rec.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := s.GetUser(ctx, id); err != nil {
+			return UserRecord{}, err
+		}
+		return UserRecord{}, ErrVersionConflict
+	}
+	if err != nil {
+		return UserRecord{}, fmt.Errorf("updating user: %w", err)
+	}
+
+	rec.CreatedAt = rec.CreatedAt.UTC()
+	return rec, nil
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM users WHERE id = ?"), id)
+	if err != nil {
+		return fmt.Errorf("deleting user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// sortColumns maps listing sort orders to columns
+var sortColumns = map[string]string{
+	SortName:      "name",
+	SortAge:       "age",
+	SortCreatedAt: "created_at",
+}
+
+func (s *sqlStore) ListUsers(ctx context.Context, q UserQuery) (UserPage, error) {
+	var where []string
+	var args []interface{}
+	if q.Name != "" {
+		where, args = append(where, "LOWER(name) = LOWER(?)"), append(args, q.Name)
+	}
+	if q.Location != "" {
+		where, args = append(where, "location = ?"), append(args, q.Location)
+	}
+	if q.MinAge > 0 {
+		where, args = append(where, "age >= ?"), append(args, q.MinAge)
+	}
+	if q.MaxAge > 0 {
+		where, args = append(where, "age <= ?"), append(args, q.MaxAge)
+	}
+	if q.EmailDomain != "" {
+		where, args = append(where, "email_domain = ?"), append(args, strings.ToLower(q.EmailDomain))
+	}
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var page UserPage
+	if err := s.db.QueryRowContext(ctx, s.rebind("SELECT COUNT(*) FROM users"+filter), args...).Scan(&page.Total); err != nil {
+		return UserPage{}, fmt.Errorf("counting users: %w", err)
+	}
+
+	column, ok := sortColumns[q.Sort]
+	if !ok {
+		column = sortColumns[SortName]
+	}
+	op, dir := ">", "ASC"
+	if q.Descending {
+		op, dir = "<", "DESC"
+	}
+	if q.After != nil {
+		var key interface{}
+		switch q.Sort {
+		case SortAge:
+			key = q.After.Age
+		case SortCreatedAt:
+			key = s.timeArg(q.After.CreatedAt)
+		default:
+			key = q.After.Name
+		}
+		where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", column, op))
+		args = append(args, key, key, q.After.ID)
+	}
+	query := "SELECT id, name, age, location, email, created_at, updated_at, version FROM users"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ?", column, dir, dir)
+	args = append(args, q.Limit+1)
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return UserPage{}, fmt.Errorf("listing users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec UserRecord
+		if err := rows.Scan(&rec.ID, &rec.User.Name, &rec.User.Age, &rec.User.Location, &rec.User.Email,
+			&rec.CreatedAt, &rec.UpdatedAt, &rec.Version); err != nil {
+			return UserPage{}, fmt.Errorf("listing users: %w", err)
+		}
+		if rec.User, err = openUser(rec.User); err != nil {
+			return UserPage{}, err
+		}
+		rec.CreatedAt, rec.UpdatedAt = rec.CreatedAt.UTC(), rec.UpdatedAt.UTC()
+		page.Records = append(page.Records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return UserPage{}, fmt.Errorf("listing users: %w", err)
+	}
+
+	if len(page.Records) > q.Limit {
+		page.Records = page.Records[:q.Limit]
+		page.Next = q.cursorAfter(page.Records[len(page.Records)-1])
+	}
+	return page, nil
+}
+
+func (s *sqlStore) RecordGreeting(ctx context.Context, event GreetingEvent) error {
+	_, err := s.db.ExecContext(ctx, s.rebind("INSERT INTO greetings (type, user_id, name_hash, locale, client, created_at) VALUES (?, ?, ?, ?, ?, ?)"),
+		event.Type, event.UserID, event.NameHash, event.Locale, event.Client, s.timeArg(event.Time))
+	if err != nil {
+		return fmt.Errorf("inserting greeting: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) GreetingsFor(ctx context.Context, userID string) ([]GreetingEvent, error) {
+	if userID == "" {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind("SELECT type, user_id, name_hash, locale, client, created_at FROM greetings WHERE user_id = ? ORDER BY id"), userID)
+	if err != nil {
+		return nil, fmt.Errorf("reading greetings: %w", err)
+	}
+	defer rows.Close()
+
+	var events []GreetingEvent
+	for rows.Next() {
+		var e GreetingEvent
+		if err := rows.Scan(&e.Type, &e.UserID, &e.NameHash, &e.Locale, &e.Client, &e.Time); err != nil {
+			return nil, fmt.Errorf("reading greetings: %w", err)
+		}
+		e.Time = e.Time.UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqlStore) DeleteGreetings(ctx context.Context, userID string) (int, error) {
+	if userID == "" {
+		return 0, nil
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM greetings WHERE user_id = ?"), userID)
+	if err != nil {
+		return 0, fmt.Errorf("deleting greetings: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqlStore) GreetingStats(ctx context.Context, q StatsQuery) (GreetingStats, error) {
+	stats := newGreetingStats(q)
+	window := []interface{}{s.timeArg(q.Since), s.timeArg(q.Until)}
+	groups := map[string]map[string]int{
+		"type":             stats.ByType,
+		"locale":           stats.ByLocale,
+		"client":           stats.ByClient,
+		s.dialect.hourExpr: {},
+	}
+	for expr, counts := range groups {
+		if err := s.countGreetings(ctx, expr, window, counts); err != nil {
+			return stats, err
+		}
+	}
+	for hour, count := range groups[s.dialect.hourExpr] {
+		h, err := strconv.Atoi(hour)
+		if err != nil || h < 0 || h > 23 {
+			return stats, fmt.Errorf("reading greeting stats: unexpected hour %q", hour)
+		}
+		stats.ByHour[h] = count
+	}
+	for _, count := range stats.ByType {
+		stats.Total += count
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT name_hash, COUNT(*) FROM greetings
+		WHERE created_at >= ? AND created_at < ? AND name_hash <> ''
+		GROUP BY name_hash ORDER BY COUNT(*) DESC, name_hash LIMIT ?`), append(window, q.Top)...)
+	if err != nil {
+		return stats, fmt.Errorf("reading greeting stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n NameCount
+		if err := rows.Scan(&n.NameHash, &n.Count); err != nil {
+			return stats, fmt.Errorf("reading greeting stats: %w", err)
+		}
+		stats.TopNames = append(stats.TopNames, n)
+	}
+	return stats, rows.Err()
+}
+
+// countGreetings counts the greetings in the window grouped by expr
+func (s *sqlStore) countGreetings(ctx context.Context, expr string, window []interface{}, counts map[string]int) error {
+	rows, err := s.db.QueryContext(ctx, s.rebind(fmt.Sprintf(
+		"SELECT %[1]s, COUNT(*) FROM greetings WHERE created_at >= ? AND created_at < ? GROUP BY %[1]s", expr)), window...)
+	if err != nil {
+		return fmt.Errorf("reading greeting stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return fmt.Errorf("reading greeting stats: %w", err)
+		}
+		counts[key] = count
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) PendingEvents(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind("SELECT id, type, subject, data, created_at FROM outbox ORDER BY seq LIMIT ?"), limit)
+	if err != nil {
+		return nil, fmt.Errorf("reading the outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var e OutboxEvent
+		var data string
+		if err := rows.Scan(&e.ID, &e.Type, &e.Subject, &data, &e.Time); err != nil {
+			return nil, fmt.Errorf("reading the outbox: %w", err)
+		}
+		e.Data, e.Time = json.RawMessage(data), e.Time.UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqlStore) DeleteEvents(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := "DELETE FROM outbox WHERE id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	if _, err := s.db.ExecContext(ctx, s.rebind(query), args...); err != nil {
+		return fmt.Errorf("deleting outbox events: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteSubjectEvents(ctx context.Context, subject string) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM outbox WHERE subject = ?"), subject)
+	if err != nil {
+		return 0, fmt.Errorf("deleting outbox events: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// scheduleColumns are the columns of schedules in scanSchedule order
+const scheduleColumns = `id, user_id, message, locale, cron, run_at, timezone, delivery, missed_runs,
+	next_run, last_run, last_error, created_by, created_at, updated_at, version`
+
+func (s *sqlStore) SaveSchedule(ctx context.Context, sch Schedule, expectedVersion int64) error {
+	if expectedVersion == 0 {
+		_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO schedules (`+scheduleColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			sch.ID, sch.UserID, sch.Message, sch.Locale, sch.Cron, s.nullTimeArg(sch.At), sch.Timezone, sch.Delivery, sch.MissedRuns,
+			s.nullTimeArg(sch.NextRun), s.nullTimeArg(sch.LastRun), sch.LastError, sch.CreatedBy, s.timeArg(sch.CreatedAt), s.timeArg(sch.UpdatedAt), sch.Version)
+		if err != nil {
+			return fmt.Errorf("saving schedule: %w", err)
+		}
+		return nil
+	}
+
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE schedules SET user_id = ?, message = ?, locale = ?, cron = ?, run_at = ?,
+		timezone = ?, delivery = ?, missed_runs = ?, next_run = ?, last_run = ?, last_error = ?, updated_at = ?, version = ?
+		WHERE id = ? AND version = ?`),
+		sch.UserID, sch.Message, sch.Locale, sch.Cron, s.nullTimeArg(sch.At), sch.Timezone, sch.Delivery, sch.MissedRuns,
+		s.nullTimeArg(sch.NextRun), s.nullTimeArg(sch.LastRun), sch.LastError, s.timeArg(sch.UpdatedAt), sch.Version, sch.ID, expectedVersion)
+	if err != nil {
+		return fmt.Errorf("saving schedule: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		if _, err := s.GetSchedule(ctx, sch.ID); err != nil {
+			return err
+		}
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func (s *sqlStore) GetSchedule(ctx context.Context, id string) (Schedule, error) {
+	sch, err := scanSchedule(s.db.QueryRowContext(ctx, s.rebind("SELECT "+scheduleColumns+" FROM schedules WHERE id = ?"), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Schedule{}, ErrNotFound
+	}
+	if err != nil {
+		return Schedule{}, fmt.Errorf("reading schedule: %w", err)
+	}
+	return sch, nil
+}
+
+func (s *sqlStore) ListSchedules(ctx context.Context) ([]Schedule, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+scheduleColumns+" FROM schedules ORDER BY created_at, id")
+	if err != nil {
+		return nil, fmt.Errorf("listing schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		sch, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("listing schedules: %w", err)
+		}
+		schedules = append(schedules, sch)
+	}
+	return schedules, rows.Err()
+}
+
+func (s *sqlStore) DeleteSchedule(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM schedules WHERE id = ?"), id)
+	if err != nil {
+		return fmt.Errorf("deleting schedule: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteUserSchedules(ctx context.Context, userID string) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM schedules WHERE user_id = ?"), userID)
+	if err != nil {
+		return 0, fmt.Errorf("deleting schedules: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// nullTimeArg returns t as a bind parameter, or NULL when t is nil
+func (s *sqlStore) nullTimeArg(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return s.timeArg(*t)
+}
+
+// scanSchedule reads a row of scheduleColumns
+func scanSchedule(row interface{ Scan(...interface{}) error }) (Schedule, error) {
+	var sch Schedule
+	var at, next, last sql.NullTime
+	if err := row.Scan(&sch.ID, &sch.UserID, &sch.Message, &sch.Locale, &sch.Cron, &at, &sch.Timezone, &sch.Delivery, &sch.MissedRuns,
+		&next, &last, &sch.LastError, &sch.CreatedBy, &sch.CreatedAt, &sch.UpdatedAt, &sch.Version); err != nil {
+		return Schedule{}, err
+	}
+	sch.At, sch.NextRun, sch.LastRun = nullTime(at), nullTime(next), nullTime(last)
+	sch.CreatedAt, sch.UpdatedAt = sch.CreatedAt.UTC(), sch.UpdatedAt.UTC()
+	return sch, nil
+}
+
+// nullTime converts a nullable column to a UTC time or nil
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+func (s *sqlStore) SuppressEmail(ctx context.Context, sup EmailSuppression) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO email_suppressions (address_hash, reason, created_at)
+		VALUES (?, ?, ?) ON CONFLICT (address_hash) DO NOTHING`),
+		sup.AddressHash, sup.Reason, s.timeArg(sup.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("suppressing email: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) GetSuppression(ctx context.Context, addressHash string) (EmailSuppression, error) {
+	var sup EmailSuppression
+	err := s.db.QueryRowContext(ctx, s.rebind("SELECT address_hash, reason, created_at FROM email_suppressions WHERE address_hash = ?"), addressHash).
+		Scan(&sup.AddressHash, &sup.Reason, &sup.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return EmailSuppression{}, ErrNotFound
+	}
+	if err != nil {
+		return EmailSuppression{}, fmt.Errorf("reading email suppression: %w", err)
+	}
+	sup.CreatedAt = sup.CreatedAt.UTC()
+	return sup, nil
+}
+
+func (s *sqlStore) DeleteSuppression(ctx context.Context, addressHash string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM email_suppressions WHERE address_hash = ?"), addressHash)
+	if err != nil {
+		return fmt.Errorf("deleting email suppression: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
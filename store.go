@@ -0,0 +1,413 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage drivers
+const (
+	DriverMemory   = "memory"
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// ErrNotFound is returned by stores when a record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrVersionConflict is returned when a record changed since it was read
+var ErrVersionConflict = errors.New("record was modified concurrently")
+
+// StorageConfig selects and tunes the storage backend
+type StorageConfig struct {
+	Driver string `json:"driver"`
+	// HistoryLimit caps the greeting events kept by the memory store; the
+	// oldest are dropped first
+	HistoryLimit int `json:"historyLimit"`
+
+	// DSN is the data source name of SQL drivers
+	DSN string `json:"dsn,omitempty"`
+	// Connection pool settings of SQL drivers; 0 means unlimited
+	MaxOpenConns    int      `json:"maxOpenConns"`
+	MaxIdleConns    int      `json:"maxIdleConns"`
+	ConnMaxLifetime Duration `json:"connMaxLifetime"`
+}
+
+// Validate checks the storage settings
+func (s StorageConfig) Validate() error {
+	switch s.Driver {
+	case DriverMemory:
+		if s.HistoryLimit <= 0 {
+			return errors.New("storage.historyLimit must be positive")
+		}
+	case DriverSQLite, DriverPostgres:
+		if s.DSN == "" {
+			return fmt.Errorf("storage.dsn is required for the %s driver", s.Driver)
+		}
+	default:
+		return fmt.Errorf("storage.driver %q is not supported", s.Driver)
+	}
+	if s.MaxOpenConns < 0 || s.MaxIdleConns < 0 || s.ConnMaxLifetime < 0 {
+		return errors.New("storage connection pool settings must not be negative")
+	}
+	return nil
+}
+
+// UserRecord is a stored user
+type UserRecord struct {
+	ID        string    `json:"id"`
+	User      UserInfo  `json:"user"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Version starts at 1 and increases with every update
+	Version int64 `json:"version"`
+}
+
+// GreetingEvent records one greeting. Names are kept only as a hash, so
+// the history does not store the name itself.
+type GreetingEvent struct {
+	Type string `json:"type"`
+	// UserID is the stored user greeted, and ties the greeting to them for
+	// export and erasure. Greetings asked for by name alone have none.
+	UserID string `json:"userId,omitempty"`
+	// NameHash is empty for greetings to the default name
+	NameHash string `json:"nameHash"`
+	Locale   string `json:"locale"`
+	// Client is the principal that asked for the greeting
+	Client string    `json:"client"`
+	Time   time.Time `json:"time"`
+}
+
+// StatsQuery selects the greetings summarised by GreetingStats
+type StatsQuery struct {
+	// Since and Until bound the greeting times, Until exclusive
+	Since time.Time
+	Until time.Time
+	// Top is the number of names to rank
+	Top int
+}
+
+// NameCount is the number of greetings to one hashed name
+type NameCount struct {
+	NameHash string `json:"nameHash"`
+	Count    int    `json:"count"`
+}
+
+// GreetingStats summarises the greetings in a time window
+type GreetingStats struct {
+	Since    time.Time      `json:"since"`
+	Until    time.Time      `json:"until"`
+	Total    int            `json:"total"`
+	ByType   map[string]int `json:"byType"`
+	ByLocale map[string]int `json:"byLocale"`
+	ByClient map[string]int `json:"byClient"`
+	// ByHour counts greetings by UTC hour of day
+	ByHour   [24]int     `json:"byHour"`
+	TopNames []NameCount `json:"topNames"`
+}
+
+// newGreetingStats returns empty stats for q
+func newGreetingStats(q StatsQuery) GreetingStats {
+	return GreetingStats{
+		Since:    q.Since,
+		Until:    q.Until,
+		ByType:   map[string]int{},
+		ByLocale: map[string]int{},
+		ByClient: map[string]int{},
+		TopNames: []NameCount{},
+	}
+}
+
+// rankNames returns the n most greeted names, ties ordered by hash
+func rankNames(counts map[string]int, n int) []NameCount {
+	ranked := make([]NameCount, 0, len(counts))
+	for hash, count := range counts {
+		ranked = append(ranked, NameCount{NameHash: hash, Count: count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].NameHash < ranked[j].NameHash
+	})
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// UserStore persists user records
+type UserStore interface {
+	CreateUser(ctx context.Context, user UserInfo) (UserRecord, error)
+	// CreateUsers stores all users or, on error, none of them
+	CreateUsers(ctx context.Context, users []UserInfo) ([]UserRecord, error)
+	GetUser(ctx context.Context, id string) (UserRecord, error)
+	// UpdateUser replaces the user when its version is still
+	// expectedVersion, returning ErrVersionConflict otherwise. An
+	// expectedVersion of 0 skips the check.
+	UpdateUser(ctx context.Context, id string, user UserInfo, expectedVersion int64) (UserRecord, error)
+	DeleteUser(ctx context.Context, id string) error
+	// ListUsers returns one page of the users matching q
+	ListUsers(ctx context.Context, q UserQuery) (UserPage, error)
+}
+
+// Sort orders for listing users
+const (
+	SortName      = "name"
+	SortAge       = "age"
+	SortCreatedAt = "createdAt"
+)
+
+// UserQuery selects a page of users. Zero values leave a filter unset.
+type UserQuery struct {
+	// Name matches case-insensitively
+	Name     string
+	Location string
+	MinAge   int
+	MaxAge   int
+	// EmailDomain matches the part of the email after @, case-insensitively
+	EmailDomain string
+
+	Sort       string
+	Descending bool
+	// After continues the listing after the position it marks
+	After *UserCursor
+	Limit int
+}
+
+// UserPage is one page of a listing
+type UserPage struct {
+	Records []UserRecord
+	// Total counts every matching user, not only this page
+	Total int
+	// Next marks the position after this page; nil on the last page
+	Next *UserCursor
+}
+
+// UserCursor marks a position in a listing by the sort key and ID of the
+// last record returned, so pages stay stable while users are added
+type UserCursor struct {
+	Sort       string    `json:"s"`
+	Descending bool      `json:"d,omitempty"`
+	Name       string    `json:"n,omitempty"`
+	Age        int       `json:"a,omitempty"`
+	CreatedAt  time.Time `json:"c,omitempty"`
+	ID         string    `json:"i"`
+}
+
+// cursorAfter returns the cursor positioned at rec
+func (q UserQuery) cursorAfter(rec UserRecord) *UserCursor {
+	return &UserCursor{
+		Sort:       q.Sort,
+		Descending: q.Descending,
+		Name:       rec.User.Name,
+		Age:        rec.User.Age,
+		CreatedAt:  rec.CreatedAt,
+		ID:         rec.ID,
+	}
+}
+
+// matches reports whether user passes the query's filters
+func (q UserQuery) matches(user UserInfo) bool {
+	switch {
+	case q.Name != "" && !strings.EqualFold(user.Name, q.Name):
+		return false
+	case q.Location != "" && user.Location != q.Location:
+		return false
+	case q.MinAge > 0 && user.Age < q.MinAge:
+		return false
+	case q.MaxAge > 0 && user.Age > q.MaxAge:
+		return false
+	case q.EmailDomain != "" && emailDomain(user.Email) != strings.ToLower(q.EmailDomain):
+		return false
+	}
+	return true
+}
+
+// less orders records by the query's sort key, then by ID
+func (q UserQuery) less(a, b UserRecord) bool {
+	var cmp int
+	switch q.Sort {
+	case SortAge:
+		cmp = a.User.Age - b.User.Age
+	case SortCreatedAt:
+		if a.CreatedAt.Before(b.CreatedAt) {
+			cmp = -1
+		} else if a.CreatedAt.After(b.CreatedAt) {
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(a.User.Name, b.User.Name)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.ID, b.ID)
+	}
+	if q.Descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// record returns a record holding the cursor's sort keys, for comparing
+// against stored records
+func (c *UserCursor) record() UserRecord {
+	return UserRecord{ID: c.ID, User: UserInfo{Name: c.Name, Age: c.Age}, CreatedAt: c.CreatedAt}
+}
+
+// emailDomain returns the lower-cased domain of an email address
+func emailDomain(email string) string {
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(domain)
+}
+
+// GreetingStore persists the greeting history
+type GreetingStore interface {
+	RecordGreeting(ctx context.Context, event GreetingEvent) error
+	// GreetingsFor and DeleteGreetings select the greetings of a user ID
+	GreetingsFor(ctx context.Context, userID string) ([]GreetingEvent, error)
+	DeleteGreetings(ctx context.Context, userID string) (int, error)
+	GreetingStats(ctx context.Context, q StatsQuery) (GreetingStats, error)
+}
+
+// OutboxStore holds events committed with the changes they describe until
+// the relay publishes them. Creating users adds a user.created event for
+// each in the same transaction.
+type OutboxStore interface {
+	// PendingEvents returns up to limit unpublished events, oldest first
+	PendingEvents(ctx context.Context, limit int) ([]OutboxEvent, error)
+	// DeleteEvents removes published events
+	DeleteEvents(ctx context.Context, ids []string) error
+	// DeleteSubjectEvents removes the unpublished events about a record and
+	// returns how many there were
+	DeleteSubjectEvents(ctx context.Context, subject string) (int, error)
+}
+
+// ScheduleStore persists greeting schedules
+type ScheduleStore interface {
+	// SaveSchedule creates the schedule when expectedVersion is 0 and
+	// otherwise replaces the one with its ID if that is still at
+	// expectedVersion, returning ErrVersionConflict when it is not
+	SaveSchedule(ctx context.Context, s Schedule, expectedVersion int64) error
+	GetSchedule(ctx context.Context, id string) (Schedule, error)
+	// ListSchedules returns every schedule, oldest first
+	ListSchedules(ctx context.Context) ([]Schedule, error)
+	DeleteSchedule(ctx context.Context, id string) error
+	// DeleteUserSchedules removes the schedules of a user and returns how
+	// many there were
+	DeleteUserSchedules(ctx context.Context, userID string) (int, error)
+}
+
+// SuppressionStore keeps the addresses email must no longer go to
+type SuppressionStore interface {
+	// SuppressEmail records a suppression; an existing one for the same
+	// address is kept
+	SuppressEmail(ctx context.Context, s EmailSuppression) error
+	// GetSuppression returns the suppression of an address hash
+	GetSuppression(ctx context.Context, addressHash string) (EmailSuppression, error)
+	DeleteSuppression(ctx context.Context, addressHash string) error
+}
+
+// Store is implemented by every storage driver
+type Store interface {
+	UserStore
+	GreetingStore
+	OutboxStore
+	ScheduleStore
+	SuppressionStore
+	Close() error
+}
+
+// dataStore is the store used by the handlers
+var dataStore Store = newMemoryStore(DefaultConfig().Storage)
+
+// openStore opens the store selected by cfg
+func openStore(cfg StorageConfig) (Store, error) {
+	switch cfg.Driver {
+	case DriverMemory:
+		return newMemoryStore(cfg), nil
+	case DriverSQLite:
+		return openSQLStore(cfg, sqliteDialect)
+	case DriverPostgres:
+		return openSQLStore(cfg, postgresDialect)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+	}
+}
+
+// newUserRecord prepares a record for a new user, returning it with the
+// user in clear text and the user as sealed for storage
+func newUserRecord(user UserInfo) (UserRecord, UserInfo, error) {
+	id, err := newID()
+	if err != nil {
+		return UserRecord{}, UserInfo{}, err
+	}
+	sealed, err := sealUser(user)
+	if err != nil {
+		return UserRecord{}, UserInfo{}, err
+	}
+	now := time.Now().UTC()
+	return UserRecord{ID: id, User: user, CreatedAt: now, UpdatedAt: now, Version: 1}, sealed, nil
+}
+
+// newID returns a random record ID
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// nameHash returns the hash under which greetings for name are recorded
+func nameHash(name string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(name)))
+	return hex.EncodeToString(sum[:])
+}
+
+// sealUser encrypts the personal data stored at rest
+func sealUser(user UserInfo) (UserInfo, error) {
+	email, err := emailCipher.Encrypt(user.Email)
+	if err != nil {
+		return user, fmt.Errorf("encrypting email: %w", err)
+	}
+	user.Email = email
+	return user, nil
+}
+
+// openUser decrypts a user read back from storage
+func openUser(user UserInfo) (UserInfo, error) {
+	email, err := emailCipher.Decrypt(user.Email)
+	if err != nil {
+		return user, fmt.Errorf("decrypting email: %w", err)
+	}
+	user.Email = email
+	return user, nil
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useStore swaps in a fresh memory store for the duration of a test
+func useStore(t *testing.T) *memoryStore {
+	t.Helper()
+	store := newMemoryStore(DefaultConfig().Storage)
+	previous := dataStore
+	dataStore = store
+	t.Cleanup(func() { dataStore = previous })
+	return store
+}
+
+// useEmailCipher enables email encryption for the duration of a test
+func useEmailCipher(t *testing.T) {
+	t.Helper()
+	c, err := newFieldCipher(PIIConfig{EncryptionKey: testEncryptionKey})
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	previous := emailCipher
+	emailCipher = c
+	t.Cleanup(func() { emailCipher = previous })
+}
+
+// storeOpener returns a new empty store of one driver
+type storeOpener func(t *testing.T) Store
+
+// storeDrivers lists every driver the repository tests run against
+func storeDrivers() map[string]storeOpener {
+	return map[string]storeOpener{
+		DriverMemory:   func(t *testing.T) Store { return newMemoryStore(DefaultConfig().Storage) },
+		DriverSQLite:   openTestSQLite,
+		DriverPostgres: openTestPostgres,
+	}
+}
+
+// TestStoreDrivers runs the repository tests against every driver
+func TestStoreDrivers(t *testing.T) {
+	for driver, open := range storeDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			t.Run("Users", func(t *testing.T) { testStoreUsers(t, open(t)) })
+			t.Run("Encryption", func(t *testing.T) { testStoreEncryption(t, open(t)) })
+			t.Run("BulkCreate", func(t *testing.T) { testStoreBulkCreate(t, open(t)) })
+			t.Run("Update", func(t *testing.T) { testStoreUpdate(t, open(t)) })
+			t.Run("List", func(t *testing.T) { testStoreList(t, open(t)) })
+			t.Run("Greetings", func(t *testing.T) { testStoreGreetings(t, open(t)) })
+			t.Run("GreetingStats", func(t *testing.T) { testStoreGreetingStats(t, open(t)) })
+			t.Run("Outbox", func(t *testing.T) { testStoreOutbox(t, open(t)) })
+			t.Run("Schedules", func(t *testing.T) { testStoreSchedules(t, open(t)) })
+			t.Run("Suppressions", func(t *testing.T) { testStoreSuppressions(t, open(t)) })
+		})
+	}
+}
+
+// testStoreUsers tests creating, reading and deleting users
+func testStoreUsers(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	rec, err := store.CreateUser(ctx, UserInfo{Name: "John", Age: 30, Location: "NYC", Email: "john@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rec.ID == "" || rec.CreatedAt.IsZero() {
+		t.Errorf("Expected an ID and creation time, got %+v", rec)
+	}
+
+	got, err := store.GetUser(ctx, rec.ID)
+	if err != nil || got.User != rec.User {
+		t.Errorf("Expected stored user %v, got %v, %v", rec.User, got.User, err)
+	}
+	if !got.CreatedAt.Equal(rec.CreatedAt) {
+		t.Errorf("Expected creation time %v, got %v", rec.CreatedAt, got.CreatedAt)
+	}
+
+	if err := store.DeleteUser(ctx, rec.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetUser(ctx, rec.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	if err := store.DeleteUser(ctx, rec.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a second delete, got %v", err)
+	}
+}
+
+// testStoreBulkCreate tests creating several users at once
+func testStoreBulkCreate(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	recs, err := store.CreateUsers(ctx, []UserInfo{{Name: "John"}, {Name: "Jane", Age: 28}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(recs) != 2 || recs[0].ID == recs[1].ID {
+		t.Fatalf("Expected 2 distinct records, got %+v", recs)
+	}
+	for _, rec := range recs {
+		got, err := store.GetUser(ctx, rec.ID)
+		if err != nil || got.User != rec.User || got.Version != 1 {
+			t.Errorf("Expected %+v to be stored at version 1, got %+v, %v", rec, got, err)
+		}
+	}
+}
+
+// testStoreOutbox tests that creating users queues their events in order
+func testStoreOutbox(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	first, err := store.CreateUser(ctx, UserInfo{Name: "John", Email: "john@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	recs, err := store.CreateUsers(ctx, []UserInfo{{Name: "Jane"}, {Name: "Jim"}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	events, err := store.PendingEvents(ctx, 2)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d, %v", len(events), err)
+	}
+	if events[0].Type != EventUserCreated || events[0].Subject != first.ID || events[1].Subject != recs[0].ID {
+		t.Errorf("Expected user.created events in creation order, got %+v", events)
+	}
+	var data UserRecord
+	if err := json.Unmarshal(events[0].Data, &data); err != nil || data.User.Email != "j***@example.com" {
+		t.Errorf("Expected the masked record, got %s", events[0].Data)
+	}
+
+	if err := store.DeleteEvents(ctx, []string{events[0].ID, events[1].ID}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	events, err = store.PendingEvents(ctx, 10)
+	if err != nil || len(events) != 1 || events[0].Subject != recs[1].ID {
+		t.Errorf("Expected only the last event to remain, got %+v, %v", events, err)
+	}
+
+	if n, err := store.DeleteSubjectEvents(ctx, recs[1].ID); err != nil || n != 1 {
+		t.Errorf("Expected 1 event deleted, got %d, %v", n, err)
+	}
+	if events, err = store.PendingEvents(ctx, 10); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events, got %+v, %v", events, err)
+	}
+}
+
+// testStoreSchedules tests saving, replacing with a version check, listing
+// and deleting schedules, including optional times
+func testStoreSchedules(t *testing.T, store Store) {
+	ctx := context.Background()
+	created := time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)
+	next := created.Add(time.Hour)
+	cron := Schedule{ID: "a", UserID: "u1", Message: ScheduleMessageTime, Cron: "0 8 * * *", Timezone: "Europe/Paris",
+		Delivery: ScheduleDeliveryWebhook, MissedRuns: MissedRunsSkip, NextRun: &next, CreatedBy: "planner", CreatedAt: created, UpdatedAt: created, Version: 1}
+	oneOff := Schedule{ID: "b", UserID: "u2", Message: ScheduleMessageGreet, Locale: "fr", At: &next, Timezone: "UTC",
+		Delivery: ScheduleDeliveryLog, MissedRuns: MissedRunsOnce, NextRun: &next, CreatedAt: created.Add(time.Second), UpdatedAt: created, Version: 1}
+	for _, sch := range []Schedule{oneOff, cron} {
+		if err := store.SaveSchedule(ctx, sch, 0); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	got, err := store.GetSchedule(ctx, "a")
+	if err != nil || !reflect.DeepEqual(got, cron) {
+		t.Errorf("Expected %+v, got %+v, %v", cron, got, err)
+	}
+
+	oneOff.NextRun, oneOff.LastRun, oneOff.LastError, oneOff.Version = nil, &next, "user not found", 2
+	if err := store.SaveSchedule(ctx, oneOff, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.SaveSchedule(ctx, oneOff, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale version, got %v", err)
+	}
+	if err := store.SaveSchedule(ctx, Schedule{ID: "c", Version: 2}, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing schedule, got %v", err)
+	}
+	list, err := store.ListSchedules(ctx)
+	if err != nil || len(list) != 2 || list[0].ID != "a" || !reflect.DeepEqual(list[1], oneOff) {
+		t.Errorf("Expected both schedules oldest first with the update, got %+v, %v", list, err)
+	}
+
+	if err := store.DeleteSchedule(ctx, "a"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetSchedule(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := store.DeleteSchedule(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if n, err := store.DeleteUserSchedules(ctx, "u2"); err != nil || n != 1 {
+		t.Errorf("Expected 1 schedule deleted, got %d, %v", n, err)
+	}
+	if list, err := store.ListSchedules(ctx); err != nil || len(list) != 0 {
+		t.Errorf("Expected no schedules, got %+v, %v", list, err)
+	}
+}
+
+// testStoreSuppressions tests that the first suppression of an address is
+// kept until it is deleted
+func testStoreSuppressions(t *testing.T, store Store) {
+	ctx := context.Background()
+	hash := emailAddressHash("john@example.com")
+	if _, err := store.GetSuppression(ctx, hash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	first := EmailSuppression{AddressHash: hash, Reason: SuppressionBounced, CreatedAt: time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)}
+	second := EmailSuppression{AddressHash: hash, Reason: SuppressionUnsubscribed, CreatedAt: first.CreatedAt.Add(time.Hour)}
+	for _, s := range []EmailSuppression{first, second} {
+		if err := store.SuppressEmail(ctx, s); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if got, err := store.GetSuppression(ctx, hash); err != nil || got != first {
+		t.Errorf("Expected %+v, got %+v, %v", first, got, err)
+	}
+
+	if err := store.DeleteSuppression(ctx, hash); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err := store.DeleteSuppression(ctx, hash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+// testStoreUpdate tests optimistic concurrency on updates
+func testStoreUpdate(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	rec, err := store.CreateUser(ctx, UserInfo{Name: "John", Location: "NYC"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	updated, err := store.UpdateUser(ctx, rec.ID, UserInfo{Name: "John", Location: "LA"}, rec.Version)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated.Version != rec.Version+1 || updated.User.Location != "LA" || !updated.CreatedAt.Equal(rec.CreatedAt) {
+		t.Errorf("Unexpected updated record %+v", updated)
+	}
+
+	if _, err := store.UpdateUser(ctx, rec.ID, UserInfo{Name: "John", Location: "SF"}, rec.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale version, got %v", err)
+	}
+	if _, err := store.UpdateUser(ctx, "missing", UserInfo{Name: "John"}, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	forced, err := store.UpdateUser(ctx, rec.ID, UserInfo{Name: "John", Location: "SF"}, 0)
+	if err != nil || forced.Version != updated.Version+1 {
+		t.Errorf("Expected an unconditional update to version %d, got %+v, %v", updated.Version+1, forced, err)
+	}
+	got, _ := store.GetUser(ctx, rec.ID)
+	if got.User.Location != "SF" || got.Version != forced.Version {
+		t.Errorf("Expected the stored record to match the last update, got %+v", got)
+	}
+}
+
+// testStoreList tests filters, sort orders and keyset pagination
+func testStoreList(t *testing.T, store Store) {
+	useEmailCipher(t)
+	ctx := context.Background()
+	users := []UserInfo{
+		{Name: "Carol", Age: 41, Location: "LA", Email: "carol@corp.example"},
+		{Name: "Alice", Age: 25, Location: "NYC", Email: "alice@example.com"},
+		{Name: "Bob", Age: 33, Location: "NYC", Email: "bob@Corp.Example"},
+		{Name: "Dave", Age: 34},
+		{Name: "Erin", Age: 19, Email: "erin@example.com"},
+	}
+	for _, user := range users {
+		if _, err := store.CreateUser(ctx, user); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		query    UserQuery
+		expected string
+	}{
+		{"By name", UserQuery{Sort: SortName}, "Alice,Bob,Carol,Dave,Erin"},
+		{"By name descending", UserQuery{Sort: SortName, Descending: true}, "Erin,Dave,Carol,Bob,Alice"},
+		{"By creation", UserQuery{Sort: SortCreatedAt}, "Carol,Alice,Bob,Dave,Erin"},
+		{"By age", UserQuery{Sort: SortAge, Descending: true, MaxAge: 40}, "Dave,Bob,Alice,Erin"},
+		{"Age range", UserQuery{Sort: SortName, MinAge: 20, MaxAge: 35}, "Alice,Bob,Dave"},
+		{"Location", UserQuery{Sort: SortName, Location: "NYC"}, "Alice,Bob"},
+		{"Email domain", UserQuery{Sort: SortName, EmailDomain: "CORP.example"}, "Bob,Carol"},
+		{"Name", UserQuery{Sort: SortName, Name: "dave"}, "Dave"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var names []string
+			q := tc.query
+			q.Limit = 2
+			total := -1
+			for pages := 0; pages < 10; pages++ {
+				page, err := store.ListUsers(ctx, q)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if total >= 0 && page.Total != total {
+					t.Errorf("Expected a stable total %d, got %d", total, page.Total)
+				}
+				total = page.Total
+				for _, rec := range page.Records {
+					names = append(names, rec.User.Name)
+				}
+				if page.Next == nil {
+					break
+				}
+				q.After = page.Next
+			}
+
+			if got := strings.Join(names, ","); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+			if total != len(names) {
+				t.Errorf("Expected total %d, got %d", len(names), total)
+			}
+		})
+	}
+}
+
+// testStoreEncryption tests that encrypted emails read back in clear text
+func testStoreEncryption(t *testing.T, store Store) {
+	useEmailCipher(t)
+	ctx := context.Background()
+
+	rec, err := store.CreateUser(ctx, UserInfo{Name: "John", Email: "john@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	got, err := store.GetUser(ctx, rec.ID)
+	if err != nil || got.User.Email != "john@example.com" {
+		t.Errorf("Expected decrypted email, got %q, %v", got.User.Email, err)
+	}
+}
+
+// testStoreGreetings tests greeting history lookup and deletion by user ID
+func testStoreGreetings(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	for _, userID := range []string{"u1", "u2", "u1", ""} {
+		event := GreetingEvent{Type: GreetingGreet, UserID: userID, NameHash: nameHash("John"), Locale: "en", Time: time.Now().UTC()}
+		if err := store.RecordGreeting(ctx, event); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	events, err := store.GreetingsFor(ctx, "u1")
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Expected 2 events for u1, got %d, %v", len(events), err)
+	}
+	if events[0].Type != GreetingGreet || events[0].UserID != "u1" || events[0].Locale != "en" || events[0].Time.IsZero() {
+		t.Errorf("Unexpected event %+v", events[0])
+	}
+	if events, _ := store.GreetingsFor(ctx, ""); len(events) != 0 {
+		t.Errorf("Expected greetings without a user to match no ID, got %d", len(events))
+	}
+
+	deleted, err := store.DeleteGreetings(ctx, "u1")
+	if err != nil || deleted != 2 {
+		t.Errorf("Expected 2 deleted, got %d, %v", deleted, err)
+	}
+	if events, _ := store.GreetingsFor(ctx, "u2"); len(events) != 1 {
+		t.Errorf("Expected other users' greetings to be kept, got %d", len(events))
+	}
+	if deleted, _ := store.DeleteGreetings(ctx, ""); deleted != 0 {
+		t.Errorf("Expected greetings without a user to be kept, got %d deleted", deleted)
+	}
+}
+
+// testStoreGreetingStats tests greeting counts over a time window
+func testStoreGreetingStats(t *testing.T, store Store) {
+	ctx := context.Background()
+	base := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	events := []GreetingEvent{
+		{Type: GreetingGreet, NameHash: nameHash("John"), Locale: "en", Client: "web", Time: base.Add(9 * time.Hour)},
+		{Type: GreetingGreet, NameHash: nameHash("John"), Locale: "es", Client: "web", Time: base.Add(9*time.Hour + time.Minute)},
+		{Type: GreetingFarewell, NameHash: nameHash("Jane"), Locale: "en", Client: "mobile", Time: base.Add(17 * time.Hour)},
+		{Type: GreetingBulkGreet, Locale: "en", Client: "mobile", Time: base.Add(23 * time.Hour)},
+		// Outside the window
+		{Type: GreetingGreet, NameHash: nameHash("Jane"), Locale: "en", Client: "web", Time: base.Add(-time.Nanosecond)},
+		{Type: GreetingGreet, NameHash: nameHash("Jane"), Locale: "en", Client: "web", Time: base.Add(24 * time.Hour)},
+	}
+	for _, e := range events {
+		if err := store.RecordGreeting(ctx, e); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	stats, err := store.GreetingStats(ctx, StatsQuery{Since: base, Until: base.Add(24 * time.Hour), Top: 1})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if stats.Total != 4 {
+		t.Errorf("Expected 4 greetings, got %d", stats.Total)
+	}
+	expectedCounts := map[string][2]map[string]int{
+		"type":   {stats.ByType, {GreetingGreet: 2, GreetingFarewell: 1, GreetingBulkGreet: 1}},
+		"locale": {stats.ByLocale, {"en": 3, "es": 1}},
+		"client": {stats.ByClient, {"web": 2, "mobile": 2}},
+	}
+	for name, counts := range expectedCounts {
+		if !reflect.DeepEqual(counts[0], counts[1]) {
+			t.Errorf("Expected counts by %s %v, got %v", name, counts[1], counts[0])
+		}
+	}
+	var byHour [24]int
+	byHour[9], byHour[17], byHour[23] = 2, 1, 1
+	if stats.ByHour != byHour {
+		t.Errorf("Expected counts by hour %v, got %v", byHour, stats.ByHour)
+	}
+	if len(stats.TopNames) != 1 || stats.TopNames[0] != (NameCount{NameHash: nameHash("John"), Count: 2}) {
+		t.Errorf("Expected John as the top name, got %+v", stats.TopNames)
+	}
+}
+
+// TestMemoryStoreEncryptsEmail tests that emails are encrypted at rest when a key is configured
+func TestMemoryStoreEncryptsEmail(t *testing.T) {
+	useEmailCipher(t)
+	ctx := context.Background()
+	store := newMemoryStore(DefaultConfig().Storage)
+
+	rec, err := store.CreateUser(ctx, UserInfo{Name: "John", Email: "john@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if stored := store.users[rec.ID].User.Email; !strings.HasPrefix(stored, encryptedPrefix) {
+		t.Errorf("Expected email to be encrypted at rest, got %q", stored)
+	}
+
+	got, err := store.GetUser(ctx, rec.ID)
+	if err != nil || got.User.Email != "john@example.com" {
+		t.Errorf("Expected decrypted email, got %q, %v", got.User.Email, err)
+	}
+}
+
+// TestMemoryStoreHistoryLimit tests that the oldest greetings are dropped past the limit
+func TestMemoryStoreHistoryLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore(StorageConfig{Driver: DriverMemory, HistoryLimit: 3})
+
+	for _, userID := range []string{"u1", "u2", "u2", "u2"} {
+		if err := store.RecordGreeting(ctx, GreetingEvent{Type: GreetingGreet, UserID: userID}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if events, _ := store.GreetingsFor(ctx, "u1"); len(events) != 0 {
+		t.Errorf("Expected the oldest event to be dropped, got %d", len(events))
+	}
+	if events, _ := store.GreetingsFor(ctx, "u2"); len(events) != 3 {
+		t.Errorf("Expected 3 events to be kept, got %d", len(events))
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate together with its PEM encodings
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate signed by parent, or self-signed when parent is nil
+func newTestCert(t *testing.T, commonName string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Greeter Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestCert writes the certificate and key to dir and returns their paths
+func writeTestCert(t *testing.T, dir, name string, c *testCert) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, c.certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// TestBuildTLSConfig tests that version, cipher and client auth settings are applied
+func TestBuildTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", true, nil)
+	server := newTestCert(t, "localhost", false, ca)
+	certFile, keyFile := writeTestCert(t, dir, "server", server)
+	caFile, _ := writeTestCert(t, dir, "ca", ca)
+
+	cfg := TLSConfig{
+		Enabled:      true,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		ClientAuth:   "require-and-verify",
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}
+
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 minimum, got %x", tlsConfig.MinVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites %v", tlsConfig.CipherSuites)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Expected RequireAndVerifyClientCert, got %v", tlsConfig.ClientAuth)
+	}
+	if tlsConfig.ClientCAs == nil {
+		t.Error("Expected client CA pool to be set")
+	}
+}
+
+// TestTLSReloaderPicksUpNewCertificate tests that a replaced certificate is served after reload
+func TestTLSReloaderPicksUpNewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "first", false, nil)
+	certFile, keyFile := writeTestCert(t, dir, "server", first)
+
+	reloader, err := newTLSReloader(TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	reloaded, err := reloader.reloadIfChanged()
+	if err != nil || reloaded {
+		t.Errorf("Expected no reload for unchanged files, got reloaded=%v err=%v", reloaded, err)
+	}
+
+	second := newTestCert(t, "second", false, nil)
+	writeTestCert(t, dir, "server", second)
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+
+	reloaded, err = reloader.reloadIfChanged()
+	if err != nil || !reloaded {
+		t.Fatalf("Expected reload after file change, got reloaded=%v err=%v", reloaded, err)
+	}
+
+	cert, err := reloader.serverConfig().GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("Expected certificate, got %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("Expected reloaded certificate 'second', got %q", leaf.Subject.CommonName)
+	}
+}
+
+// TestTLSReloaderKeepsCertificateOnBadReload tests that a broken file does not replace a working certificate
+func TestTLSReloaderKeepsCertificateOnBadReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server", newTestCert(t, "good", false, nil))
+
+	reloader, err := newTLSReloader(TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Failed to corrupt certificate: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+
+	if _, err := reloader.reloadIfChanged(); err == nil {
+		t.Error("Expected reload error for corrupt certificate")
+	}
+	if len(reloader.current.Load().Certificates) != 1 {
+		t.Error("Expected previous certificate to remain active")
+	}
+}
+
+// TestMutualTLSClientSubject tests that a verified client certificate subject reaches handlers
+func TestMutualTLSClientSubject(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", true, nil)
+	serverCert := newTestCert(t, "localhost", false, ca)
+	clientCert := newTestCert(t, "greeter-client", false, ca)
+	certFile, keyFile := writeTestCert(t, dir, "server", serverCert)
+	caFile, _ := writeTestCert(t, dir, "ca", ca)
+
+	reloader, err := newTLSReloader(TLSConfig{
+		Enabled:      true,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		ClientAuth:   "require-and-verify",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, clientSubject(r))
+	}))
+	srv.TLS = reloader.serverConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientPair, _ := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientPair},
+		MinVersion:   tls.VersionTLS12,
+	}}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Expected mTLS request to succeed, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !strings.Contains(string(body), "CN=greeter-client") {
+		t.Errorf("Expected client subject in response, got %q", string(body))
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}}}
+	if resp, err := anonymous.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("Expected request without client certificate to be rejected")
+	}
+}
+
+// TestSelfSignedClientCertificateGetsNoScopes tests that a self-signed
+// certificate carrying a mapped subject is ignored when client auth does
+// not verify certificates
+func TestSelfSignedClientCertificateGetsNoScopes(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", true, nil)
+	serverCert := newTestCert(t, "localhost", false, ca)
+	forged := newTestCert(t, "billing", false, nil)
+	certFile, keyFile := writeTestCert(t, dir, "server", serverCert)
+
+	reloader, err := newTLSReloader(TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, ClientAuth: "request"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	auth := AuthConfig{ClientScopes: map[string][]string{"CN=billing,O=Greeter Test": {ScopePIIRead}}}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := auth.resolvePrincipal(r)
+		_, _ = io.WriteString(w, principal.ID+" "+strings.Join(principal.Scopes, ","))
+	}))
+	srv.TLS = reloader.serverConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	forgedPair, _ := tls.X509KeyPair(forged.certPEM, forged.keyPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{forgedPair},
+		MinVersion:   tls.VersionTLS12,
+	}}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Expected the request to succeed, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if got := strings.TrimSpace(string(body)); got != AnonymousPrincipal {
+		t.Errorf("Expected an anonymous principal without scopes, got %q", got)
+	}
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bulk transfer media types
+const (
+	CSVType    = "text/csv"
+	NDJSONType = "application/x-ndjson"
+)
+
+// Import modes
+const (
+	// ImportAtomic stores every row or, if any row is invalid, none
+	ImportAtomic = "atomic"
+	// ImportBestEffort stores the valid rows and reports the others
+	ImportBestEffort = "best-effort"
+)
+
+// MaxImportRows caps the number of users in one import
+const MaxImportRows = 10000
+
+// Import row statuses
+const (
+	RowValid   = "valid"
+	RowInvalid = "invalid"
+	RowCreated = "created"
+	RowFailed  = "failed"
+)
+
+// transferColumns are the user fields in CSV column order
+var transferColumns = []string{"name", "age", "location", "email"}
+
+// serverColumns are the columns an export adds around the user fields.
+// Import ignores them, since the store assigns them afresh.
+var serverColumns = []string{"id", "createdAt", "updatedAt", "version"}
+
+// ImportRow reports the outcome for one row of an import
+type ImportRow struct {
+	// Line is the line of the row in the uploaded file
+	Line   int    `json:"line"`
+	Status string `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportReport is the response to an import
+type ImportReport struct {
+	Mode    string      `json:"mode"`
+	DryRun  bool        `json:"dryRun"`
+	Total   int         `json:"total"`
+	Created int         `json:"created"`
+	Invalid int         `json:"invalid"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+// importRow is a parsed row before it is stored
+type importRow struct {
+	line int
+	user UserInfo
+	err  error
+}
+
+// parseColumnMapping reads map.<field>=<CSV header> query parameters
+func parseColumnMapping(values map[string][]string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for key, vals := range values {
+		if !strings.HasPrefix(key, "map.") {
+			continue
+		}
+		field := strings.TrimPrefix(key, "map.")
+		if !containsFold(transferColumns, field) {
+			return nil, fmt.Errorf("cannot map a column to unknown field %q", field)
+		}
+		mapping[strings.ToLower(field)] = strings.TrimSpace(vals[0])
+	}
+	return mapping, nil
+}
+
+// csvColumns resolves the column index of each field from the header row.
+// A field is read from the column named in mapping, or from the column with
+// the field's own name; the server-assigned columns of an export are
+// ignored and other columns matching no field are rejected.
+func csvColumns(header []string, mapping map[string]string) (map[string]int, error) {
+	columns := map[string]int{}
+	for _, field := range transferColumns {
+		name, ok := mapping[field]
+		if !ok {
+			name = field
+		}
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				columns[field] = i
+				break
+			}
+		}
+		if _, found := columns[field]; !found && ok {
+			return nil, fmt.Errorf("column %q mapped to %s is not in the header", name, field)
+		}
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("header must include a name column")
+	}
+	for i, h := range header {
+		used := false
+		for _, index := range columns {
+			used = used || index == i
+		}
+		if !used && !containsFold(serverColumns, strings.TrimSpace(h)) {
+			return nil, fmt.Errorf("unknown column %q", h)
+		}
+	}
+	return columns, nil
+}
+
+// formulaTriggers start a formula in common spreadsheets, even after
+// leading spaces
+const formulaTriggers = "=+-@\t\r"
+
+// unescapeCell strips the quote exportUsers adds before values a
+// spreadsheet would run as a formula
+func unescapeCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && escapeCell(s[1:]) == s {
+		return s[1:]
+	}
+	return s
+}
+
+// escapeCell quotes values a spreadsheet would otherwise run as a formula
+func escapeCell(s string) string {
+	if t := strings.TrimLeft(s, " "); t != "" && strings.ContainsRune(formulaTriggers, rune(t[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// parseCSVUsers reads users from CSV with a header row. Malformed CSV fails
+// the whole import; a bad row only fails that row.
+func parseCSVUsers(data []byte, mapping map[string]string) ([]importRow, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("CSV must start with a header row")
+	}
+	columns, err := csvColumns(header, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, fmt.Errorf("malformed CSV: %v", err)
+		}
+		if len(rows) == MaxImportRows {
+			return nil, fmt.Errorf("import must not exceed %d rows", MaxImportRows)
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			rows = append(rows, importRow{line: line, err: fmt.Errorf("row has %d columns, header has %d", len(record), len(header))})
+			continue
+		}
+
+		row := importRow{line: line}
+		cell := func(field string) string {
+			if i, ok := columns[field]; ok {
+				return unescapeCell(strings.TrimSpace(record[i]))
+			}
+			return ""
+		}
+		row.user = UserInfo{Name: cell("name"), Location: cell("location"), Email: cell("email")}
+		if age := cell("age"); age != "" {
+			if row.user.Age, err = strconv.Atoi(age); err != nil {
+				row.err = errors.New("age must be an integer")
+			}
+		}
+		if row.err == nil {
+			row.err = validateUser(&row.user)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// exportedUser is a line of an NDJSON export. Its user is imported and
+// the server-assigned fields are ignored.
+type exportedUser struct {
+	ID        string    `json:"id"`
+	User      *UserInfo `json:"user"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Version   int64     `json:"version"`
+}
+
+// isExportedUser reports whether an NDJSON line has the shape of an
+// exported record rather than of a user
+func isExportedUser(line []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return false
+	}
+	_, ok := fields["user"]
+	return ok
+}
+
+// parseNDJSONUsers reads one JSON user per line, skipping blank lines.
+// Lines may also be records as exported by exportUsers.
+func parseNDJSONUsers(data []byte) ([]importRow, error) {
+	var rows []importRow
+	maxDepth := activeConfig.Get().Limits.MaxJSONDepth
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if len(rows) == MaxImportRows {
+			return nil, fmt.Errorf("import must not exceed %d rows", MaxImportRows)
+		}
+		row := importRow{line: i + 1}
+		var err error
+		if isExportedUser(line) {
+			exported := exportedUser{User: &row.user}
+			err = decodeJSON(line, &exported, maxDepth)
+		} else {
+			err = decodeJSON(line, &row.user, maxDepth)
+		}
+		if err != nil {
+			// Decoding errors describe the request body; here it is one row
+			row.err = errors.New(strings.Replace(err.Error(), "request body", "row", 1))
+		} else {
+			row.err = validateUser(&row.user)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// importUsers creates users from an uploaded CSV or NDJSON file and reports
+// the outcome of every row. In the default atomic mode any invalid row means
+// nothing is stored; best-effort mode stores every valid row. With
+// dryRun=true rows are only validated.
+func importUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method %s not allowed\n", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = ImportAtomic
+	}
+	if mode != ImportAtomic && mode != ImportBestEffort {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("mode must be %s or %s", ImportAtomic, ImportBestEffort))
+		return
+	}
+	dryRun := false
+	if s := query.Get("dryRun"); s != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "dryRun must be true or false")
+			return
+		}
+	}
+	mapping, err := parseColumnMapping(query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := requireContentType(r, CSVType, NDJSONType); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	data, err := readBody(r)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	var rows []importRow
+	if mediaType == CSVType {
+		rows, err = parseCSVUsers(data, mapping)
+	} else {
+		rows, err = parseNDJSONUsers(data)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "import contains no rows")
+		return
+	}
+
+	report := ImportReport{Mode: mode, DryRun: dryRun, Total: len(rows), Rows: make([]ImportRow, len(rows))}
+	var valid []int
+	for i, row := range rows {
+		report.Rows[i] = ImportRow{Line: row.line, Status: RowValid}
+		if row.err != nil {
+			report.Rows[i].Status, report.Rows[i].Error = RowInvalid, row.err.Error()
+			report.Invalid++
+			continue
+		}
+		valid = append(valid, i)
+	}
+
+	status := http.StatusOK
+	switch {
+	case dryRun:
+	case mode == ImportAtomic && report.Invalid > 0:
+		status = http.StatusUnprocessableEntity
+	case mode == ImportAtomic:
+		users := make([]UserInfo, len(valid))
+		for j, i := range valid {
+			users[j] = rows[i].user
+		}
+		recs, err := dataStore.CreateUsers(r.Context(), users)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		for j, i := range valid {
+			report.Rows[i].Status, report.Rows[i].ID = RowCreated, recs[j].ID
+			audit(r, AuditUserCreate, recs[j].ID, OutcomeCompleted, diffUsers(UserInfo{}, users[j]))
+			publishUserCreated(r, recs[j])
+		}
+		report.Created = len(recs)
+		status = http.StatusCreated
+	default:
+		for _, i := range valid {
+			rec, err := dataStore.CreateUser(r.Context(), rows[i].user)
+			if err != nil {
+				log.Printf("Import of line %d failed: %v", rows[i].line, err)
+				report.Rows[i].Status, report.Rows[i].Error = RowFailed, "storage error"
+				report.Failed++
+				continue
+			}
+			report.Rows[i].Status, report.Rows[i].ID = RowCreated, rec.ID
+			audit(r, AuditUserCreate, rec.ID, OutcomeCompleted, diffUsers(UserInfo{}, rows[i].user))
+			publishUserCreated(r, rec)
+			report.Created++
+		}
+	}
+	metrics.Add("users_imported", int64(report.Created))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// exportFormat picks CSV or NDJSON from the format parameter or the Accept
+// header, defaulting to NDJSON
+func exportFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "csv":
+		return CSVType, nil
+	case "ndjson":
+		return NDJSONType, nil
+	case "":
+	default:
+		return "", errors.New("format must be csv or ndjson")
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == CSVType {
+			return CSVType, nil
+		}
+	}
+	return NDJSONType, nil
+}
+
+// exportUsers streams every user matching the listing filters as CSV or
+// NDJSON, one page of the store at a time. Users are masked for callers
+// without pii:read.
+func exportUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method %s not allowed\n", r.Method)
+		return
+	}
+
+	format, err := exportFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q, err := parseUserQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.Limit, q.After = MaxPageSize, nil
+
+	principal := principalFrom(r.Context())
+	if q.Location != "" && !principal.HasScope(ScopePIIRead) {
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("filtering on location requires the %s scope", ScopePIIRead))
+		return
+	}
+
+	// Fetch the first page before committing to a 200 so storage errors can
+	// still be reported
+	page, err := dataStore.ListUsers(r.Context(), q)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	extension := "ndjson"
+	if format == CSVType {
+		extension = "csv"
+	}
+	w.Header().Set("Content-Type", format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, extension))
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	if format == CSVType {
+		_ = csvWriter.Write(append(serverColumns[:1:1], append(transferColumns, serverColumns[1:]...)...))
+	}
+	for {
+		for _, rec := range page.Records {
+			rec.User = viewForPrincipal(rec.User, principal)
+			if format == CSVType {
+				err = csvWriter.Write([]string{
+					rec.ID, escapeCell(rec.User.Name), strconv.Itoa(rec.User.Age), escapeCell(rec.User.Location), escapeCell(rec.User.Email),
+					rec.CreatedAt.Format(time.RFC3339Nano), rec.UpdatedAt.Format(time.RFC3339Nano), strconv.FormatInt(rec.Version, 10),
+				})
+			} else {
+				err = encoder.Encode(rec)
+			}
+			if err != nil {
+				// The client went away
+				return
+			}
+		}
+		csvWriter.Flush()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		if page.Next == nil {
+			return
+		}
+		q.After = page.Next
+		if page, err = dataStore.ListUsers(r.Context(), q); err != nil {
+			// The status is already sent; abort so the client sees a
+			// truncated response rather than a complete-looking one
+			log.Printf("Export failed: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// decodeImportReport decodes an import response
+func decodeImportReport(t *testing.T, body []byte) ImportReport {
+	t.Helper()
+	var report ImportReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatalf("Expected an import report, got %s", body)
+	}
+	return report
+}
+
+// countUsers returns the number of stored users
+func countUsers(t *testing.T) int {
+	t.Helper()
+	page, err := dataStore.ListUsers(context.Background(), UserQuery{Sort: SortCreatedAt, Limit: MaxPageSize})
+	if err != nil {
+		t.Fatalf("Expected to list users, got %v", err)
+	}
+	return page.Total
+}
+
+// TestImportUsers tests CSV and NDJSON imports in each mode
+func TestImportUsers(t *testing.T) {
+	validCSV := "name,age,location,email\nJohn,30,NYC,john@example.com\nJane,,,\n"
+	mixedCSV := "name,age\nJohn,30\n,25\nJane,old\nBob,40,extra\nAlice,22\n"
+	mixedNDJSON := `{"name": "John", "age": 30}` + "\n\n" + `{"name": "Jane", "nickname": "J"}` + "\n" + `{"name": "Bob", "age": -1}` + "\n"
+
+	testCases := []struct {
+		name            string
+		query           string
+		contentType     string
+		body            string
+		expectedStatus  int
+		expectedCreated int
+		expectedStored  int
+		expectedRows    []ImportRow
+	}{
+		{"Atomic CSV", "", CSVType, validCSV, http.StatusCreated, 2, 2,
+			[]ImportRow{{Line: 2, Status: RowCreated}, {Line: 3, Status: RowCreated}}},
+		{"Atomic CSV with invalid rows", "", CSVType, mixedCSV, http.StatusUnprocessableEntity, 0, 0,
+			[]ImportRow{
+				{Line: 2, Status: RowValid},
+				{Line: 3, Status: RowInvalid, Error: "name field is required"},
+				{Line: 4, Status: RowInvalid, Error: "age must be an integer"},
+				{Line: 5, Status: RowInvalid, Error: "row has 3 columns, header has 2"},
+				{Line: 6, Status: RowValid},
+			}},
+		{"Best-effort CSV", "?mode=best-effort", CSVType, mixedCSV, http.StatusOK, 2, 2,
+			[]ImportRow{
+				{Line: 2, Status: RowCreated},
+				{Line: 3, Status: RowInvalid, Error: "name field is required"},
+				{Line: 4, Status: RowInvalid, Error: "age must be an integer"},
+				{Line: 5, Status: RowInvalid, Error: "row has 3 columns, header has 2"},
+				{Line: 6, Status: RowCreated},
+			}},
+		{"Dry run", "?dryRun=true", CSVType, validCSV, http.StatusOK, 0, 0,
+			[]ImportRow{{Line: 2, Status: RowValid}, {Line: 3, Status: RowValid}}},
+		{"Header mapping", "?map.name=Full%20Name&map.age=Years", CSVType, "Full Name,Years\nJohn,30\n", http.StatusCreated, 1, 1,
+			[]ImportRow{{Line: 2, Status: RowCreated}}},
+		{"Best-effort NDJSON", "?mode=best-effort", NDJSONType, mixedNDJSON, http.StatusOK, 1, 1,
+			[]ImportRow{
+				{Line: 1, Status: RowCreated},
+				{Line: 3, Status: RowInvalid, Error: `row contains unknown field "nickname"`},
+				{Line: 4, Status: RowInvalid, Error: "age must not be negative"},
+			}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useStore(t)
+			w := serveUsers("POST", "/greeter/user-info/import"+tc.query, "", []byte(tc.body), "Content-Type", tc.contentType)
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+
+			report := decodeImportReport(t, w.Body.Bytes())
+			if report.Created != tc.expectedCreated || report.Total != len(tc.expectedRows) {
+				t.Errorf("Expected %d of %d rows created, got %d of %d", tc.expectedCreated, len(tc.expectedRows), report.Created, report.Total)
+			}
+			if len(report.Rows) != len(tc.expectedRows) {
+				t.Fatalf("Expected %d rows in the report, got %d", len(tc.expectedRows), len(report.Rows))
+			}
+			for i, row := range report.Rows {
+				expected := tc.expectedRows[i]
+				if row.Line != expected.Line || row.Status != expected.Status || row.Error != expected.Error {
+					t.Errorf("Row %d: expected %+v, got %+v", i, expected, row)
+				}
+				if (row.Status == RowCreated) != (row.ID != "") {
+					t.Errorf("Row %d: expected an ID only for created rows, got %+v", i, row)
+				}
+			}
+			if stored := countUsers(t); stored != tc.expectedStored {
+				t.Errorf("Expected %d stored users, got %d", tc.expectedStored, stored)
+			}
+		})
+	}
+}
+
+// TestImportUsersRejectsFile tests errors that reject the whole import
+func TestImportUsersRejectsFile(t *testing.T) {
+	testCases := []struct {
+		name           string
+		query          string
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{"Unsupported media type", "", "application/json", `[]`, http.StatusUnsupportedMediaType},
+		{"Unknown mode", "?mode=some", CSVType, "name\nJohn\n", http.StatusBadRequest},
+		{"Unknown column", "", CSVType, "name,nickname\nJohn,J\n", http.StatusBadRequest},
+		{"Missing name column", "", CSVType, "age\n30\n", http.StatusBadRequest},
+		{"Mapping to an unknown field", "?map.nickname=Nick", CSVType, "name\nJohn\n", http.StatusBadRequest},
+		{"Mapped column missing", "?map.name=Full%20Name", CSVType, "name\nJohn\n", http.StatusBadRequest},
+		{"Malformed CSV", "", CSVType, "name\n\"John\n", http.StatusBadRequest},
+		{"No rows", "", NDJSONType, "\n\n", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useStore(t)
+			w := serveUsers("POST", "/greeter/user-info/import"+tc.query, "", []byte(tc.body), "Content-Type", tc.contentType)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+			if stored := countUsers(t); stored != 0 {
+				t.Errorf("Expected no stored users, got %d", stored)
+			}
+		})
+	}
+}
+
+// TestEscapeCell tests that cells a spreadsheet would run as a formula are
+// quoted on export and restored on import
+func TestEscapeCell(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"Plain", "NYC", "NYC"},
+		{"Empty", "", ""},
+		{"Equals", "=SUM(A1)", "'=SUM(A1)"},
+		{"Plus", "+1", "'+1"},
+		{"Minus", "-1", "'-1"},
+		{"At", "@cmd", "'@cmd"},
+		{"Tab", "\t=1", "'\t=1"},
+		{"Carriage return", "\r=1", "'\r=1"},
+		{"After spaces", "  =1", "'  =1"},
+		{"Only spaces", "   ", "   "},
+		{"Quote without formula", "'quoted", "'quoted"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := escapeCell(tc.value); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+			if got := unescapeCell(escapeCell(tc.value)); got != tc.value {
+				t.Errorf("Expected %q after a round trip, got %q", tc.value, got)
+			}
+		})
+	}
+}
+
+// TestExportUsers tests streaming exports and their round trip through import
+func TestExportUsers(t *testing.T) {
+	useScopedKeys(t)
+	useStore(t)
+	users := make([]UserInfo, MaxPageSize+5)
+	for i := range users {
+		users[i] = UserInfo{Name: "User", Age: i, Location: "NYC", Email: "user@example.com"}
+	}
+	users[0].Name = "=SUM(A1)"
+	if _, err := dataStore.CreateUsers(context.Background(), users); err != nil {
+		t.Fatalf("Expected users to be created, got %v", err)
+	}
+
+	t.Run("NDJSON", func(t *testing.T) {
+		w := serveUsers("GET", "/greeter/user-info/export", "support-key", nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != NDJSONType {
+			t.Fatalf("Expected NDJSON, got %d and %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		lines := 0
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var rec UserRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatalf("Expected a user per line, got %s", scanner.Text())
+			}
+			if rec.User.Location != "N***" {
+				t.Errorf("Expected a masked location, got %q", rec.User.Location)
+			}
+			lines++
+		}
+		if lines != len(users) {
+			t.Errorf("Expected %d users across pages, got %d", len(users), lines)
+		}
+	})
+
+	t.Run("CSV round trip", func(t *testing.T) {
+		w := serveUsers("GET", "/greeter/user-info/export?format=csv&sort=age", "dpo-key", nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != CSVType {
+			t.Fatalf("Expected CSV, got %d and %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		records, err := csv.NewReader(bytes.NewReader(w.Body.Bytes())).ReadAll()
+		if err != nil || len(records) != len(users)+1 {
+			t.Fatalf("Expected a header and %d rows, got %d rows and %v", len(users), len(records), err)
+		}
+		if records[1][1] != "'=SUM(A1)" {
+			t.Errorf("Expected formula-like cells to be escaped, got %q", records[1][1])
+		}
+
+		// Re-import the export as it is
+		useStore(t)
+		w = serveUsers("POST", "/greeter/user-info/import", "", w.Body.Bytes(), "Content-Type", CSVType)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		report := decodeImportReport(t, w.Body.Bytes())
+		rec, err := dataStore.GetUser(context.Background(), report.Rows[0].ID)
+		if err != nil || rec.User != users[0] {
+			t.Errorf("Expected %+v after the round trip, got %+v (%v)", users[0], rec.User, err)
+		}
+	})
+
+	t.Run("NDJSON round trip", func(t *testing.T) {
+		w := serveUsers("GET", "/greeter/user-info/export?sort=age", "dpo-key", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		useStore(t)
+		w = serveUsers("POST", "/greeter/user-info/import", "", w.Body.Bytes(), "Content-Type", NDJSONType)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		report := decodeImportReport(t, w.Body.Bytes())
+		if report.Created != len(users) {
+			t.Errorf("Expected %d users, got %d", len(users), report.Created)
+		}
+		rec, err := dataStore.GetUser(context.Background(), report.Rows[0].ID)
+		if err != nil || rec.User != users[0] {
+			t.Errorf("Expected %+v after the round trip, got %+v (%v)", users[0], rec.User, err)
+		}
+	})
+
+	t.Run("Location filter requires pii:read", func(t *testing.T) {
+		if w := serveUsers("GET", "/greeter/user-info/export?location=NYC", "support-key", nil); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		if w := serveUsers("GET", "/greeter/user-info/export?format=xml", "support-key", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
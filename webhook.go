@@ -0,0 +1,868 @@
+/*
+ * Copyright (c) 2023, WSO2 LLC. (https://www.wso2.com/) All Rights Reserved.
+ *
+ * WSO2 LLC. licenses this file to you under the Apache License,
+ * Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook event types
+const (
+	EventUserCreated       = "user.created"
+	EventGreetingIssued    = "greeting.issued"
+	EventGreetingScheduled = "greeting.scheduled"
+)
+
+// webhookEventTypes lists the event types subscribers can filter on
+var webhookEventTypes = []string{EventUserCreated, EventGreetingIssued, EventGreetingScheduled}
+
+var (
+	// errSubscriptionDeleted reports a replay for a removed subscription
+	errSubscriptionDeleted = errors.New("the subscription was deleted")
+	// errSubjectErased reports a replay of an event about an erased user
+	errSubjectErased = errors.New("the user the event is about was erased")
+	// errDeliveryLogFull reports that MaxDeliveryLogs deliveries are pending
+	errDeliveryLogFull = errors.New("too many deliveries are pending")
+)
+
+// Webhook request headers
+const (
+	WebhookSignatureHeader = "X-Greeter-Signature"
+	WebhookEventHeader     = "X-Greeter-Event"
+	WebhookDeliveryHeader  = "X-Greeter-Delivery"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	// DeliveryDead marks a delivery in the dead-letter queue
+	DeliveryDead = "dead"
+)
+
+// WebhookConfig controls webhook delivery
+type WebhookConfig struct {
+	// Workers and QueueSize size the delivery pool; they apply at startup
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+	// Timeout bounds each delivery attempt
+	Timeout Duration `json:"timeout"`
+	// MaxAttempts is the number of attempts before a delivery is dead-lettered
+	MaxAttempts int `json:"maxAttempts"`
+	// InitialBackoff doubles after each failed attempt up to MaxBackoff
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	// MaxDeliveryLogs caps the deliveries kept for inspection and replay
+	MaxDeliveryLogs int `json:"maxDeliveryLogs"`
+	// AllowPrivateNetworks permits loopback and private targets, which are
+	// otherwise refused so webhooks cannot probe the internal network
+	AllowPrivateNetworks bool `json:"allowPrivateNetworks"`
+}
+
+// Validate checks the webhook settings
+func (c WebhookConfig) Validate() error {
+	positive := map[string]int64{
+		"workers":         int64(c.Workers),
+		"queueSize":       int64(c.QueueSize),
+		"timeout":         int64(c.Timeout),
+		"maxAttempts":     int64(c.MaxAttempts),
+		"initialBackoff":  int64(c.InitialBackoff),
+		"maxDeliveryLogs": int64(c.MaxDeliveryLogs),
+	}
+	for name, v := range positive {
+		if v <= 0 {
+			return fmt.Errorf("webhooks.%s must be positive", name)
+		}
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		return errors.New("webhooks.maxBackoff must not be less than webhooks.initialBackoff")
+	}
+	return nil
+}
+
+// WebhookSubscription is a registered receiver
+type WebhookSubscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events are event types, prefixes such as user.* or * for everything
+	Events []string `json:"events"`
+	// IncludePII sends personal data unmasked; only callers with pii:read
+	// may set it
+	IncludePII bool `json:"includePII"`
+	// Secret signs deliveries; it is only returned when the subscription is
+	// created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// matches reports whether the subscription wants events of type eventType
+func (s *WebhookSubscription) matches(eventType string) bool {
+	for _, filter := range s.Events {
+		if filter == "*" || filter == eventType ||
+			strings.HasSuffix(filter, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(filter, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// validEventFilter reports whether filter matches at least one event type
+func validEventFilter(filter string) bool {
+	probe := WebhookSubscription{Events: []string{filter}}
+	for _, eventType := range webhookEventTypes {
+		if probe.matches(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the JSON body of a delivery
+type WebhookEvent struct {
+	ID   string      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// webhookSubject identifies whom an event is about, so replays can check
+// the user still exists and erasures can purge the deliveries
+type webhookSubject struct {
+	UserID string
+}
+
+// DeliveryAttempt records one try at delivering an event
+type DeliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   Duration  `json:"duration"`
+}
+
+// WebhookDelivery tracks an event on its way to one subscriber
+type WebhookDelivery struct {
+	ID             string            `json:"id"`
+	SubscriptionID string            `json:"subscriptionId"`
+	EventID        string            `json:"eventId"`
+	EventType      string            `json:"eventType"`
+	Status         string            `json:"status"`
+	Attempts       []DeliveryAttempt `json:"attempts"`
+	NextAttempt    *time.Time        `json:"nextAttempt,omitempty"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	// ReplayOf is the delivery this one replays
+	ReplayOf string `json:"replayOf,omitempty"`
+
+	// payload is the masked event. full is the unmasked one sent to
+	// IncludePII subscriptions; it is dropped once the delivery finishes and
+	// rebuilt from the stored user for a replay.
+	payload []byte
+	full    []byte
+	subject webhookSubject
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhookSignature checks a signature header of the form
+// t=<unix seconds>,v1=<hex>, rejecting timestamps older than tolerance. It
+// is what a receiver written in Go would run.
+func verifyWebhookSignature(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp int64
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return errors.New("malformed signature header")
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp outside tolerance")
+	}
+	expected := signWebhook(secret, timestamp, body)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// newWebhookSecret returns a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// publicAddressOnly refuses connections to loopback, private, link-local
+// and other non-public addresses unless the config allows them. It runs at
+// dial time, after DNS resolution, so a hostname cannot be pointed at an
+// internal address after it was registered.
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	if activeConfig.Get().Webhooks.AllowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("webhook target %s is not a public address", host)
+	}
+	return nil
+}
+
+// webhookDispatcher keeps the subscriptions and delivers events to them
+// from a pool of workers. Failed deliveries are retried with exponential
+// backoff and dead-lettered after the last attempt.
+type webhookDispatcher struct {
+	mu            sync.Mutex
+	subscriptions map[string]*WebhookSubscription
+	deliveries    map[string]*WebhookDelivery
+	// order holds delivery IDs, oldest first, for trimming the log
+	order  []string
+	timers map[string]*time.Timer
+	closed bool
+
+	workers int
+	queue   chan string
+	client  *http.Client
+	start   sync.Once
+	wg      sync.WaitGroup
+}
+
+// newWebhookDispatcher returns a dispatcher; workers start with the first
+// delivery
+func newWebhookDispatcher(cfg WebhookConfig) *webhookDispatcher {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicAddressOnly}
+	return &webhookDispatcher{
+		subscriptions: map[string]*WebhookSubscription{},
+		deliveries:    map[string]*WebhookDelivery{},
+		timers:        map[string]*time.Timer{},
+		workers:       cfg.Workers,
+		queue:         make(chan string, cfg.QueueSize),
+		client: &http.Client{
+			// No proxy, so the address check applies to the receiver itself
+			Transport: &http.Transport{DialContext: dialer.DialContext, MaxIdleConnsPerHost: 2},
+			// A redirect could lead to an address the check would refuse
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// webhooks is the dispatcher used by the handlers
+var webhooks = newWebhookDispatcher(DefaultConfig().Webhooks)
+
+// Subscribe registers a subscription, assigning its ID and secret
+func (d *webhookDispatcher) Subscribe(sub WebhookSubscription) (WebhookSubscription, error) {
+	var err error
+	if sub.ID, err = newID(); err != nil {
+		return sub, err
+	}
+	if sub.Secret, err = newWebhookSecret(); err != nil {
+		return sub, err
+	}
+	sub.CreatedAt = time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscriptions[sub.ID] = &sub
+	return sub, nil
+}
+
+// Subscriptions returns the subscriptions without their secrets
+func (d *webhookDispatcher) Subscriptions() []WebhookSubscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subs := make([]WebhookSubscription, 0, len(d.subscriptions))
+	for _, sub := range d.subscriptions {
+		s := *sub
+		s.Secret = ""
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs
+}
+
+// Subscription returns one subscription without its secret
+func (d *webhookDispatcher) Subscription(id string) (WebhookSubscription, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sub, ok := d.subscriptions[id]
+	if !ok {
+		return WebhookSubscription{}, false
+	}
+	s := *sub
+	s.Secret = ""
+	return s, true
+}
+
+// Unsubscribe removes a subscription; its pending deliveries are
+// dead-lettered when they next come up
+func (d *webhookDispatcher) Unsubscribe(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.subscriptions[id]
+	delete(d.subscriptions, id)
+	return ok
+}
+
+// Publish delivers an event about subject to every matching subscription.
+// masked is sent in place of data to subscriptions without IncludePII.
+func (d *webhookDispatcher) Publish(eventType string, subject webhookSubject, data, masked interface{}) {
+	eventID, err := newID()
+	if err != nil {
+		log.Printf("Failed to publish %s webhook event: %v", eventType, err)
+		return
+	}
+	event := WebhookEvent{ID: eventID, Type: eventType, Time: time.Now().UTC(), Data: masked}
+	maskedPayload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s webhook event: %v", eventType, err)
+		return
+	}
+	event.Data = data
+	fullPayload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s webhook event: %v", eventType, err)
+		return
+	}
+
+	d.mu.Lock()
+	var queued []string
+	for _, sub := range d.subscriptions {
+		if !sub.matches(eventType) {
+			continue
+		}
+		delivery := &WebhookDelivery{SubscriptionID: sub.ID, EventID: event.ID, EventType: eventType, payload: maskedPayload, subject: subject}
+		if sub.IncludePII && !bytes.Equal(fullPayload, maskedPayload) {
+			delivery.full = fullPayload
+		}
+		if err := d.addDelivery(delivery); err != nil {
+			metrics.Add("webhook_deliveries_dropped", 1)
+			log.Printf("Failed to queue %s webhook event for %s: %v", eventType, sub.ID, err)
+			continue
+		}
+		queued = append(queued, delivery.ID)
+	}
+	d.mu.Unlock()
+
+	for _, id := range queued {
+		d.enqueue(id)
+	}
+}
+
+// addDelivery records delivery as a new pending one, making room by
+// dropping finished deliveries. When MaxDeliveryLogs deliveries are still
+// pending it is refused. d.mu must be held.
+func (d *webhookDispatcher) addDelivery(delivery *WebhookDelivery) error {
+	max := activeConfig.Get().Webhooks.MaxDeliveryLogs
+	d.trim(max - 1)
+	if len(d.order) >= max {
+		return errDeliveryLogFull
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	delivery.ID = id
+	delivery.Status = DeliveryPending
+	delivery.Attempts = []DeliveryAttempt{}
+	delivery.CreatedAt = time.Now().UTC()
+	d.deliveries[delivery.ID] = delivery
+	d.order = append(d.order, delivery.ID)
+	return nil
+}
+
+// trim drops the oldest finished deliveries beyond max, succeeded ones
+// before dead letters; d.mu must be held
+func (d *webhookDispatcher) trim(max int) {
+	for _, status := range []string{DeliverySucceeded, DeliveryDead} {
+		for i := 0; len(d.order) > max && i < len(d.order); {
+			if delivery := d.deliveries[d.order[i]]; delivery.Status == status {
+				delete(d.deliveries, delivery.ID)
+				d.order = append(d.order[:i], d.order[i+1:]...)
+				continue
+			}
+			i++
+		}
+	}
+}
+
+// Forget removes the deliveries of events about a user, pending or not,
+// and cancels their retries; an attempt already under way still completes
+func (d *webhookDispatcher) Forget(subject webhookSubject) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kept := d.order[:0]
+	for _, id := range d.order {
+		about := d.deliveries[id].subject
+		if subject.UserID != "" && about.UserID == subject.UserID {
+			if timer, ok := d.timers[id]; ok {
+				timer.Stop()
+				delete(d.timers, id)
+			}
+			delete(d.deliveries, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	n := len(d.order) - len(kept)
+	d.order = kept
+	return n
+}
+
+// enqueue hands a delivery to the workers, dead-lettering it when the
+// queue is full
+func (d *webhookDispatcher) enqueue(id string) {
+	d.start.Do(func() {
+		for i := 0; i < d.workers; i++ {
+			d.wg.Add(1)
+			go d.work()
+		}
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.timers, id)
+	if d.closed {
+		return
+	}
+	delivery, ok := d.deliveries[id]
+	if !ok {
+		return
+	}
+	delivery.NextAttempt = nil
+	select {
+	case d.queue <- id:
+	default:
+		d.deadLetter(delivery, "delivery queue is full")
+	}
+}
+
+// deadLetter moves a delivery to the dead-letter queue; d.mu must be held
+func (d *webhookDispatcher) deadLetter(delivery *WebhookDelivery, reason string) {
+	delivery.Status = DeliveryDead
+	delivery.NextAttempt = nil
+	delivery.full = nil
+	metrics.Add("webhook_dead_letters", 1)
+	log.Printf("Webhook delivery %s to %s dead-lettered: %s", delivery.ID, delivery.SubscriptionID, reason)
+}
+
+// work delivers queued events until the queue is closed
+func (d *webhookDispatcher) work() {
+	defer d.wg.Done()
+	for id := range d.queue {
+		d.attempt(id)
+	}
+}
+
+// attempt makes one delivery attempt and schedules a retry or dead-letters
+// the delivery when it fails
+func (d *webhookDispatcher) attempt(id string) {
+	cfg := activeConfig.Get().Webhooks
+
+	d.mu.Lock()
+	delivery, ok := d.deliveries[id]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+	sub, ok := d.subscriptions[delivery.SubscriptionID]
+	if !ok {
+		d.deadLetter(delivery, "subscription was deleted")
+		d.mu.Unlock()
+		return
+	}
+	target, secret, payload, eventType := sub.URL, sub.Secret, delivery.payload, delivery.EventType
+	if delivery.full != nil {
+		payload = delivery.full
+	}
+	d.mu.Unlock()
+
+	attempt := send(d.client, target, secret, id, eventType, payload, time.Duration(cfg.Timeout))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	switch {
+	case attempt.Error == "":
+		delivery.Status = DeliverySucceeded
+		delivery.full = nil
+		metrics.Add("webhook_deliveries", 1)
+	case len(delivery.Attempts) >= cfg.MaxAttempts:
+		d.deadLetter(delivery, attempt.Error)
+	case !d.closed:
+		delay := backoff(len(delivery.Attempts), time.Duration(cfg.InitialBackoff), time.Duration(cfg.MaxBackoff))
+		next := time.Now().UTC().Add(delay)
+		delivery.NextAttempt = &next
+		d.timers[id] = time.AfterFunc(delay, func() { d.enqueue(id) })
+	}
+}
+
+// send POSTs a signed payload and reports the attempt. Anything but a 2xx
+// response is a failure.
+func send(client *http.Client, target, secret, deliveryID, eventType string, payload []byte, timeout time.Duration) DeliveryAttempt {
+	started := time.Now()
+	attempt := DeliveryAttempt{Time: started.UTC()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "greeter-webhooks/"+AppVersion)
+	req.Header.Set(WebhookEventHeader, eventType)
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	timestamp := started.Unix()
+	req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, signWebhook(secret, timestamp, payload)))
+
+	resp, err := client.Do(req)
+	attempt.Duration = Duration(time.Since(started))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("receiver answered %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// backoff returns the delay before the retry following attempt n: initial
+// doubled for each earlier attempt, capped at max, with up to half of it
+// randomised so receivers coming back up are not hit all at once
+func backoff(n int, initial, max time.Duration) time.Duration {
+	delay := initial
+	for i := 1; i < n && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+}
+
+// Deliveries returns the logged deliveries, newest first, optionally only
+// those for one subscription or with one status
+func (d *webhookDispatcher) Deliveries(subscriptionID, status string) []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries := []WebhookDelivery{}
+	for i := len(d.order) - 1; i >= 0; i-- {
+		delivery := d.deliveries[d.order[i]]
+		if (subscriptionID == "" || delivery.SubscriptionID == subscriptionID) && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, d.copyDelivery(delivery))
+		}
+	}
+	return deliveries
+}
+
+// Delivery returns one logged delivery
+func (d *webhookDispatcher) Delivery(id string) (WebhookDelivery, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery, ok := d.deliveries[id]
+	if !ok {
+		return WebhookDelivery{}, false
+	}
+	return d.copyDelivery(delivery), true
+}
+
+// copyDelivery copies a delivery so callers can read it without the lock;
+// d.mu must be held
+func (d *webhookDispatcher) copyDelivery(delivery *WebhookDelivery) WebhookDelivery {
+	c := *delivery
+	c.Attempts = append([]DeliveryAttempt{}, delivery.Attempts...)
+	return c
+}
+
+// Replay queues a new delivery of the same event to the same subscription.
+// Events about a user are only replayed while the user exists, and
+// IncludePII subscriptions get the user as it is stored now.
+func (d *webhookDispatcher) Replay(ctx context.Context, id string) (WebhookDelivery, error) {
+	d.mu.Lock()
+	original, ok := d.deliveries[id]
+	if !ok {
+		d.mu.Unlock()
+		return WebhookDelivery{}, ErrNotFound
+	}
+	sub, ok := d.subscriptions[original.SubscriptionID]
+	if !ok {
+		d.mu.Unlock()
+		return WebhookDelivery{}, errSubscriptionDeleted
+	}
+	replay := &WebhookDelivery{
+		SubscriptionID: original.SubscriptionID,
+		EventID:        original.EventID,
+		EventType:      original.EventType,
+		ReplayOf:       original.ID,
+		payload:        original.payload,
+		subject:        original.subject,
+	}
+	includePII := sub.IncludePII
+	d.mu.Unlock()
+
+	if replay.subject.UserID != "" {
+		rec, err := dataStore.GetUser(ctx, replay.subject.UserID)
+		if errors.Is(err, ErrNotFound) {
+			return WebhookDelivery{}, errSubjectErased
+		} else if err != nil {
+			return WebhookDelivery{}, err
+		}
+		if includePII && replay.EventType == EventUserCreated {
+			if replay.full, err = withEventData(replay.payload, rec); err != nil {
+				return WebhookDelivery{}, err
+			}
+		}
+	}
+
+	d.mu.Lock()
+	if err := d.addDelivery(replay); err != nil {
+		d.mu.Unlock()
+		return WebhookDelivery{}, err
+	}
+	copied := d.copyDelivery(replay)
+	d.mu.Unlock()
+
+	d.enqueue(replay.ID)
+	return copied, nil
+}
+
+// withEventData returns the event in payload with its data replaced
+func withEventData(payload []byte, data interface{}) ([]byte, error) {
+	var event WebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	event.Data = data
+	return json.Marshal(event)
+}
+
+// Close stops delivering. Attempts in progress finish unless ctx expires
+// first; scheduled retries are dropped.
+func (d *webhookDispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for id, timer := range d.timers {
+		timer.Stop()
+		delete(d.timers, id)
+	}
+	close(d.queue)
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// validWebhookURL checks that raw is an absolute http or https URL
+func validWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	return nil
+}
+
+// webhookRequest is the body of POST /greeter/webhooks
+type webhookRequest struct {
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`
+	IncludePII bool     `json:"includePII"`
+}
+
+// webhooksHandler lists subscriptions and registers new ones
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"webhooks": webhooks.Subscriptions()})
+	case http.MethodPost:
+		createWebhook(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method %s not allowed\n", r.Method)
+	}
+}
+
+// createWebhook registers a subscription and returns it with its secret,
+// which is not shown again
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if err := validWebhookURL(req.URL); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if len(req.Events) == 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "events must list at least one event type")
+		return
+	}
+	for _, filter := range req.Events {
+		if !validEventFilter(filter) {
+			writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("unknown event type %q; expected one of %s, a prefix such as user.* or *", filter, strings.Join(webhookEventTypes, ", ")))
+			return
+		}
+	}
+	principal := principalFrom(r.Context())
+	if req.IncludePII && !principal.HasScope(ScopePIIRead) {
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("includePII requires the %s scope", ScopePIIRead))
+		return
+	}
+
+	sub, err := webhooks.Subscribe(WebhookSubscription{URL: req.URL, Events: req.Events, IncludePII: req.IncludePII, CreatedBy: principal.ID})
+	if err != nil {
+		log.Printf("Failed to register webhook: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to register webhook")
+		return
+	}
+	log.Printf("Webhook %s registered by %s for %s", sub.ID, sub.CreatedBy, strings.Join(sub.Events, ","))
+	w.Header().Set("Location", "/greeter/webhooks/"+sub.ID)
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+// webhookHandler serves /greeter/webhooks/{id}, its delivery log, the
+// dead-letter queue and delivery replays
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/greeter/webhooks/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "dead-letters" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": webhooks.Deliveries("", DeliveryDead)})
+	case len(parts) == 2 && parts[0] == "deliveries" && r.Method == http.MethodGet:
+		delivery, ok := webhooks.Delivery(parts[1])
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "delivery not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, delivery)
+	case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "replay" && r.Method == http.MethodPost:
+		delivery, err := webhooks.Replay(r.Context(), parts[1])
+		switch {
+		case errors.Is(err, ErrNotFound):
+			writeJSONError(w, http.StatusNotFound, "delivery not found")
+			return
+		case errors.Is(err, errSubscriptionDeleted):
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		case errors.Is(err, errSubjectErased):
+			writeJSONError(w, http.StatusGone, err.Error())
+			return
+		case errors.Is(err, errDeliveryLogFull):
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to replay delivery %s: %v", parts[1], err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to replay delivery")
+			return
+		}
+		writeJSON(w, http.StatusAccepted, delivery)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		sub, ok := webhooks.Subscription(parts[0])
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "webhook not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, sub)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !webhooks.Unsubscribe(parts[0]) {
+			writeJSONError(w, http.StatusNotFound, "webhook not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+		if _, ok := webhooks.Subscription(parts[0]); !ok {
+			writeJSONError(w, http.StatusNotFound, "webhook not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": webhooks.Deliveries(parts[0], r.URL.Query().Get("status"))})
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// publishUserCreated notifies subscribers of a new user, wakes the relay
+// of the event the store committed with it and sends the welcome email
+func publishUserCreated(r *http.Request, rec UserRecord) {
+	masked := rec
+	masked.User = maskPII(rec.User)
+	webhooks.Publish(EventUserCreated, webhookSubject{UserID: rec.ID}, rec, masked)
+	eventRelay.Notify()
+	sendWelcomeEmail(r, rec)
+}